@@ -19,6 +19,7 @@ package main
 import (
 	"flag"
 	"os"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
@@ -33,9 +34,11 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
 	azurefirewallrulesv1 "github.com/Azure/azure-firewall-egress-controller/pkg/api/v1"
+	azurefirewallrulesv2 "github.com/Azure/azure-firewall-egress-controller/pkg/api/v2"
 	azure "github.com/Azure/azure-firewall-egress-controller/pkg/azure"
 	"github.com/Azure/azure-firewall-egress-controller/pkg/controllers"
 	environment "github.com/Azure/azure-firewall-egress-controller/pkg/environment"
+	"github.com/Azure/azure-firewall-egress-controller/pkg/version"
 	"github.com/Azure/go-autorest/autorest/azure/auth"
 	"k8s.io/klog/v2"
 	//+kubebuilder:scaffold:imports
@@ -50,18 +53,44 @@ func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
 
 	utilruntime.Must(azurefirewallrulesv1.AddToScheme(scheme))
+	utilruntime.Must(azurefirewallrulesv2.AddToScheme(scheme))
 	//+kubebuilder:scaffold:scheme
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "plan" {
+		os.Exit(runPlan(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "uninstall" {
+		os.Exit(runUninstall(os.Args[2:]))
+	}
+
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var dryRun bool
+	var resyncPeriod time.Duration
+	var unmanagedRules string
+	var driftPolicy string
+	var driftCheckPeriod time.Duration
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.BoolVar(&dryRun, "dry-run", false,
+		"Render the rule collection group and print the diff against the live one "+
+			"without modifying the firewall policy or the IP Groups.")
+	flag.DurationVar(&resyncPeriod, "resync-period", 10*time.Minute,
+		"The interval at which the rule collection groups are rebuilt even if no object changed. 0 disables the resync.")
+	flag.StringVar(&unmanagedRules, "unmanaged-rules", azure.UnmanagedRulesOverwrite,
+		"How to handle the rule collections and rules found in the rule collection group that are not generated by the controller: "+
+			azure.UnmanagedRulesOverwrite+", "+azure.UnmanagedRulesAdopt+" or "+azure.UnmanagedRulesRefuse+".")
+	flag.StringVar(&driftPolicy, "drift-policy", azure.DriftPolicyCorrect,
+		"How to handle the changes made to the rule collection group and the IP Groups outside of the controller: "+
+			azure.DriftPolicyCorrect+" or "+azure.DriftPolicyAlert+".")
+	flag.DurationVar(&driftCheckPeriod, "drift-check-period", 10*time.Minute,
+		"The interval at which the live rule collection group is compared with the generated one. 0 disables the check.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -70,6 +99,19 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
+	switch unmanagedRules {
+	case azure.UnmanagedRulesOverwrite, azure.UnmanagedRulesAdopt, azure.UnmanagedRulesRefuse:
+	default:
+		setupLog.Error(nil, "invalid value of --unmanaged-rules", "value", unmanagedRules)
+		os.Exit(1)
+	}
+	switch driftPolicy {
+	case azure.DriftPolicyCorrect, azure.DriftPolicyAlert:
+	default:
+		setupLog.Error(nil, "invalid value of --drift-policy", "value", driftPolicy)
+		os.Exit(1)
+	}
+
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:                 scheme,
 		MetricsBindAddress:     metricsAddr,
@@ -96,20 +138,31 @@ func main() {
 
 	env := environment.GetEnv()
 
-	azClient := azure.NewAzClient(env.SubscriptionID, env.ResourceGroupName, env.FwPolicyName, env.FwPolicyRuleCollectionGroupName, env.FwPolicyRuleCollectionGroupPriority, env.ClientID, mgr.GetClient())
+	azClient := azure.NewAzClientSet(env.SubscriptionID, env.ResourceGroupName, env.FwPolicyName, env.FwPolicyRuleCollectionGroupName, env.FwPolicyRuleCollectionGroupPriority, env.ClientID, mgr.GetClient())
 
 	var authorizer autorest.Authorizer
 	authorizer, err = auth.NewAuthorizerFromEnvironment()
 	azClient.SetAuthorizer(authorizer)
+	azClient.SetDryRun(dryRun)
+	azClient.SetClusterName(env.ClusterName)
+	azClient.SetEventRecorder(mgr.GetEventRecorderFor("azure-firewall-egress-controller"))
+	azClient.SetUnmanagedRulesPolicy(unmanagedRules)
+	azClient.SetDriftPolicy(driftPolicy, driftCheckPeriod)
 
 	firewallPolicyLoc := azClient.FetchFirewallPolicyLocation()
 
 	klog.Infof("Azure Firewall Policy Details: Subscription=\"%s\" Resource Group=\"%s\" Location=\"%s\" Name=\"%s\" Rule Collection Group=\"%s\" Rule Collection Group Priority=\"%d\"", env.SubscriptionID, env.ResourceGroupName, firewallPolicyLoc, env.FwPolicyName, env.FwPolicyRuleCollectionGroupName, env.FwPolicyRuleCollectionGroupPriority)
 
+	if err = mgr.Add(azClient); err != nil {
+		setupLog.Error(err, "unable to add the Azure client to the manager")
+		os.Exit(1)
+	}
+
 	if err = (&controllers.AzureFirewallRulesReconciler{
-		Client:   mgr.GetClient(),
-		Scheme:   mgr.GetScheme(),
-		AzClient: azClient,
+		Client:       mgr.GetClient(),
+		Scheme:       mgr.GetScheme(),
+		AzClient:     azClient,
+		ResyncPeriod: resyncPeriod,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "AzureFirewallRules")
 		os.Exit(1)
@@ -118,6 +171,21 @@ func main() {
 		setupLog.Error(err, "unable to create webhook", "webhook", "AzureFirewallRules")
 		os.Exit(1)
 	}
+	if err = (&azurefirewallrulesv2.AzureFirewallRules{}).SetupWebhookWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create webhook", "webhook", "AzureFirewallRules", "version", "v2")
+		os.Exit(1)
+	}
+	// The stored objects are left untouched in dry-run mode.
+	if !dryRun {
+		if err = mgr.Add(&controllers.StorageVersionMigrator{Client: mgr.GetClient(), Reader: mgr.GetAPIReader()}); err != nil {
+			setupLog.Error(err, "unable to add the storage version migrator to the manager")
+			os.Exit(1)
+		}
+	}
+	if err = (&azurefirewallrulesv1.EgressPolicy{}).SetupWebhookWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create webhook", "webhook", "EgressPolicy")
+		os.Exit(1)
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
@@ -129,7 +197,7 @@ func main() {
 		os.Exit(1)
 	}
 
-	setupLog.Info("starting manager")
+	setupLog.Info("starting manager", "version", version.Version)
 	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
 		setupLog.Error(err, "problem running manager")
 		os.Exit(1)
@@ -0,0 +1,114 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// egressPolicyAuthorizationPath is the path of the webhook checking that the user creating or updating an
+// EgressPolicy may read the pods of the namespaces it selects.
+const egressPolicyAuthorizationPath = "/authorize-egress-azure-firewall-egress-controller-io-v1-egresspolicy"
+
+// egressPolicyNamespaceAuthorizer denies the EgressPolicies whose namespaceSelector matches a namespace in which the
+// requesting user can't list pods, so that a tenant can't grant egress to the workloads of another one. The
+// validator of the type doesn't get the user of the request, hence the separate handler.
+type egressPolicyNamespaceAuthorizer struct {
+	decoder *admission.Decoder
+	// review creates a SubjectAccessReview and fills its status.
+	review func(ctx context.Context, sar *authorizationv1.SubjectAccessReview) error
+}
+
+var _ admission.Handler = &egressPolicyNamespaceAuthorizer{}
+
+// Handle implements admission.Handler.
+func (h *egressPolicyNamespaceAuthorizer) Handle(ctx context.Context, req admission.Request) admission.Response {
+	if req.Operation != admissionv1.Create && req.Operation != admissionv1.Update {
+		return admission.Allowed("")
+	}
+	policy := &EgressPolicy{}
+	if err := h.decoder.Decode(req, policy); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	// The finalizer of a deleted object is removed whatever it selects.
+	if policy.Spec.NamespaceSelector == nil || !policy.DeletionTimestamp.IsZero() {
+		return admission.Allowed("")
+	}
+	namespaceSelector, err := metav1.LabelSelectorAsSelector(policy.Spec.NamespaceSelector)
+	if err != nil {
+		// Reported by the validating webhook of the type.
+		return admission.Allowed("")
+	}
+	if webhookClient == nil {
+		return admission.Errored(http.StatusInternalServerError, fmt.Errorf("the webhook client is not set up"))
+	}
+	namespaceList := &corev1.NamespaceList{}
+	if err := webhookClient.List(ctx, namespaceList, client.MatchingLabelsSelector{Selector: namespaceSelector}); err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+
+	var denied []string
+	for _, ns := range namespaceList.Items {
+		if ns.Name == policy.Namespace {
+			continue
+		}
+		sar := newPodListAccessReview(req, ns.Name)
+		if err := h.review(ctx, sar); err != nil {
+			return admission.Errored(http.StatusInternalServerError, err)
+		}
+		if !sar.Status.Allowed {
+			denied = append(denied, ns.Name)
+		}
+	}
+	if len(denied) != 0 {
+		return admission.Denied(fmt.Sprintf("spec.namespaceSelector selects namespaces in which %s can't list pods: %s",
+			req.UserInfo.Username, strings.Join(denied, ", ")))
+	}
+	return admission.Allowed("")
+}
+
+// newPodListAccessReview returns the SubjectAccessReview asking whether the user of the request can list the pods
+// of the namespace.
+func newPodListAccessReview(req admission.Request, namespace string) *authorizationv1.SubjectAccessReview {
+	extra := make(map[string]authorizationv1.ExtraValue, len(req.UserInfo.Extra))
+	for key, value := range req.UserInfo.Extra {
+		extra[key] = authorizationv1.ExtraValue(value)
+	}
+	return &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace: namespace,
+				Verb:      "list",
+				Resource:  "pods",
+			},
+			User:   req.UserInfo.Username,
+			Groups: req.UserInfo.Groups,
+			UID:    req.UserInfo.UID,
+			Extra:  extra,
+		},
+	}
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// EgressPolicySpec defines the desired state of EgressPolicy
+type EgressPolicySpec struct {
+	// PodSelector selects the pods whose IPs are used as the source of the rules.
+	// +kubebuilder:validation:Required
+	PodSelector metav1.LabelSelector `json:"podSelector"`
+	// NamespaceSelector selects the namespaces in which pods are matched.
+	// When omitted only pods in the namespace of the EgressPolicy are matched. The user creating or updating the
+	// EgressPolicy must be allowed to list the pods of every other selected namespace.
+	// +optional
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	// Rules are the rules applied to the selected pods. Nat rules are not supported.
+	// +kubebuilder:validation:Required
+	Rules []AzureFirewallEgressrulesRulesSpec `json:"rules"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Ready",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].status"
+//+kubebuilder:printcolumn:name="Synced",type="string",JSONPath=".status.conditions[?(@.type==\"Synced\")].status"
+//+kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+
+// EgressPolicy is the Schema for the egressPolicies API
+type EgressPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   EgressPolicySpec         `json:"spec,omitempty"`
+	Status AzureFirewallRulesStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// EgressPolicyList contains a list of EgressPolicy
+type EgressPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []EgressPolicy `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&EgressPolicy{}, &EgressPolicyList{})
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"context"
+
+	"github.com/Azure/azure-firewall-egress-controller/pkg/environment"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// log is for logging in this package.
+var egresspolicylog = logf.Log.WithName("egresspolicy-resource")
+
+func (r *EgressPolicy) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	webhookClient = mgr.GetClient()
+	defaultFirewallPolicy = defaultFirewallPolicyOf(environment.GetEnv())
+	decoder, err := admission.NewDecoder(mgr.GetScheme())
+	if err != nil {
+		return err
+	}
+	mgr.GetWebhookServer().Register(egressPolicyAuthorizationPath, &webhook.Admission{
+		Handler: &egressPolicyNamespaceAuthorizer{
+			decoder: decoder,
+			review: func(ctx context.Context, sar *authorizationv1.SubjectAccessReview) error {
+				return mgr.GetClient().Create(ctx, sar)
+			},
+		},
+	})
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		Complete()
+}
+
+//+kubebuilder:webhook:path=/mutate-egress-azure-firewall-egress-controller-io-v1-egresspolicy,mutating=true,failurePolicy=fail,sideEffects=None,groups=egress.azure-firewall-egress-controller.io,resources=egresspolicies,verbs=create;update,versions=v1,name=megresspolicy.kb.io,admissionReviewVersions=v1
+
+var _ webhook.Defaulter = &EgressPolicy{}
+
+// Default implements webhook.Defaulter so a webhook will be registered for the type
+func (r *EgressPolicy) Default() {
+	egresspolicylog.Info("default", "name", r.Name, "namespace", r.Namespace)
+
+	for i := range r.Spec.Rules {
+		defaultRule(&r.Spec.Rules[i])
+	}
+}
+
+//+kubebuilder:webhook:path=/authorize-egress-azure-firewall-egress-controller-io-v1-egresspolicy,mutating=false,failurePolicy=fail,sideEffects=None,groups=egress.azure-firewall-egress-controller.io,resources=egresspolicies,verbs=create;update,versions=v1,name=aegresspolicy.kb.io,admissionReviewVersions=v1
+//+kubebuilder:webhook:path=/validate-egress-azure-firewall-egress-controller-io-v1-egresspolicy,mutating=false,failurePolicy=fail,sideEffects=None,groups=egress.azure-firewall-egress-controller.io,resources=egresspolicies,verbs=create;update,versions=v1,name=vegresspolicy.kb.io,admissionReviewVersions=v1
+
+var _ webhook.Validator = &EgressPolicy{}
+
+// ValidateCreate implements webhook.Validator so a webhook will be registered for the type
+func (r *EgressPolicy) ValidateCreate() error {
+	egresspolicylog.Info("validate create", "name", r.Name, "namespace", r.Namespace)
+
+	return r.validate()
+}
+
+// ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
+func (r *EgressPolicy) ValidateUpdate(old runtime.Object) error {
+	egresspolicylog.Info("validate update", "name", r.Name, "namespace", r.Namespace)
+
+	// The finalizer of a deleted object is removed whether the object is still valid or not.
+	if !r.DeletionTimestamp.IsZero() {
+		return nil
+	}
+	return r.validate()
+}
+
+// ValidateDelete implements webhook.Validator so a webhook will be registered for the type
+func (r *EgressPolicy) ValidateDelete() error {
+	egresspolicylog.Info("validate delete", "name", r.Name, "namespace", r.Namespace)
+
+	return nil
+}
+
+// validate reports all the errors of the object, and of its rules against the rules of the other objects.
+func (r *EgressPolicy) validate() error {
+	allErrs := r.validateFields()
+	allErrs = append(allErrs, validateAgainstExistingObjects("EgressPolicy "+r.Namespace+"/"+r.Name, nil, r.pathRules())...)
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(GroupVersion.WithKind("EgressPolicy").GroupKind(), r.Name, allErrs)
+}
+
+func (r *EgressPolicy) validateFields() field.ErrorList {
+	var allErrs field.ErrorList
+	if _, err := metav1.LabelSelectorAsSelector(&r.Spec.PodSelector); err != nil {
+		allErrs = append(allErrs, field.Invalid(field.NewPath("spec", "podSelector"), r.Spec.PodSelector, err.Error()))
+	}
+	if r.Spec.NamespaceSelector != nil {
+		if _, err := metav1.LabelSelectorAsSelector(r.Spec.NamespaceSelector); err != nil {
+			allErrs = append(allErrs, field.Invalid(field.NewPath("spec", "namespaceSelector"), r.Spec.NamespaceSelector, err.Error()))
+		}
+	}
+	return append(allErrs, validateRules(r.pathRules(), false)...)
+}
+
+func (r *EgressPolicy) pathRules() []pathRule {
+	var rules []pathRule
+	for i, rule := range r.Spec.Rules {
+		rules = append(rules, pathRule{path: field.NewPath("spec", "rules").Index(i), rule: rule})
+	}
+	return rules
+}
@@ -0,0 +1,197 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	n "github.com/Azure/azure-sdk-for-go/services/network/mgmt/2021-03-01/network"
+	admissionv1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func TestValidateEgressPolicy(t *testing.T) {
+	type testCase struct {
+		Name     string
+		rules    []AzureFirewallEgressrulesRulesSpec
+		Expected []string
+	}
+
+	natRule := AzureFirewallEgressrulesRulesSpec{
+		RuleCollectionName:   "dnat-web",
+		Priority:             100,
+		RuleName:             "web",
+		DestinationAddresses: []string{"20.0.0.1"},
+		DestinationPorts:     []string{"443"},
+		TranslatedAddress:    "10.0.0.4",
+		TranslatedPort:       "8443",
+		Protocol:             []string{"TCP"},
+		Action:               n.FirewallPolicyFilterRuleCollectionActionType(n.FirewallPolicyNatRuleCollectionActionTypeDNAT),
+		RuleType:             RuleTypeNat,
+	}
+
+	testCases := []testCase{
+		{
+			Name:  "valid",
+			rules: []AzureFirewallEgressrulesRulesSpec{newTestRule("allow-web", 200, "github"), newTestNetworkRule("ntp")},
+		},
+		{
+			Name:     "nat-rule",
+			rules:    []AzureFirewallEgressrulesRulesSpec{newTestRule("allow-web", 200, "github"), natRule},
+			Expected: []string{"spec.rules[1].ruleType"},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			policy := &EgressPolicy{
+				ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "team-a"},
+				Spec: EgressPolicySpec{
+					PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+					Rules:       tc.rules,
+				},
+			}
+			err := policy.ValidateCreate()
+			if fields := invalidFields(err); !reflect.DeepEqual(fields, tc.Expected) {
+				t.Errorf("Expected invalid fields %v, but got: %v (%v)", tc.Expected, fields, err)
+			}
+		})
+	}
+
+	// The same rule is accepted from a cluster admin.
+	if err := newTestAzureFirewallRules("dnat", natRule).ValidateCreate(); err != nil {
+		t.Errorf("Expected no error, but got: %v", err)
+	}
+}
+
+func TestDefaultEgressPolicy(t *testing.T) {
+	policy := &EgressPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "team-a"},
+		Spec: EgressPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+			Rules: []AzureFirewallEgressrulesRulesSpec{
+				{RuleCollectionName: "allow-web", Priority: 200, RuleName: "github", TargetFqdns: []string{"GitHub.com"}},
+			},
+		},
+	}
+	policy.Default()
+
+	expected := AzureFirewallEgressrulesRulesSpec{
+		RuleCollectionName: "allow-web",
+		Priority:           200,
+		RuleName:           "github",
+		TargetFqdns:        []string{"github.com"},
+		Protocol:           []string{DefaultApplicationProtocol},
+		Action:             n.FirewallPolicyFilterRuleCollectionActionTypeAllow,
+		RuleType:           RuleTypeApplication,
+	}
+	if !reflect.DeepEqual(policy.Spec.Rules[0], expected) {
+		t.Errorf("Expected %+v, but got: %+v", expected, policy.Spec.Rules[0])
+	}
+	if err := policy.ValidateCreate(); err != nil {
+		t.Errorf("Expected no error, but got: %v", err)
+	}
+}
+
+func TestAuthorizeEgressPolicyNamespaces(t *testing.T) {
+	type testCase struct {
+		Name              string
+		namespaceSelector *metav1.LabelSelector
+		Expected          bool
+	}
+
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if err := AddToScheme(scheme); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	webhookClient = fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a", Labels: map[string]string{"team": "a"}}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a-staging", Labels: map[string]string{"team": "a"}}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-b", Labels: map[string]string{"team": "b"}}},
+	).Build()
+	t.Cleanup(func() { webhookClient = nil })
+
+	decoder, err := admission.NewDecoder(scheme)
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	// alice can list the pods of the namespaces of team a only.
+	authorizer := &egressPolicyNamespaceAuthorizer{
+		decoder: decoder,
+		review: func(ctx context.Context, sar *authorizationv1.SubjectAccessReview) error {
+			sar.Status.Allowed = sar.Spec.User == "alice" && sar.Spec.ResourceAttributes.Namespace != "team-b"
+			return nil
+		},
+	}
+
+	testCases := []testCase{
+		{
+			Name:     "no-namespace-selector",
+			Expected: true,
+		},
+		{
+			Name:              "readable-namespaces",
+			namespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "a"}},
+			Expected:          true,
+		},
+		{
+			Name:              "unreadable-namespace",
+			namespaceSelector: &metav1.LabelSelector{},
+			Expected:          false,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			policy := &EgressPolicy{
+				ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "team-a"},
+				Spec: EgressPolicySpec{
+					PodSelector:       metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+					NamespaceSelector: tc.namespaceSelector,
+					Rules:             []AzureFirewallEgressrulesRulesSpec{newTestRule("allow-web", 200, "github")},
+				},
+			}
+			raw, err := json.Marshal(policy)
+			if err != nil {
+				t.Fatalf("Expected no error, but got: %v", err)
+			}
+			resp := authorizer.Handle(context.Background(), admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+				Operation: admissionv1.Create,
+				UserInfo:  authenticationv1.UserInfo{Username: "alice"},
+				Object:    runtime.RawExtension{Raw: raw},
+			}})
+			if resp.Allowed != tc.Expected {
+				t.Errorf("Expected allowed %v, but got: %v (%v)", tc.Expected, resp.Allowed, resp.Result)
+			}
+		})
+	}
+}
@@ -26,47 +26,169 @@ import (
 
 // AzureFirewallRulesSpec defines the desired state of azureFirewallRules
 type AzureFirewallRulesSpec struct {
-	EgressRules []AzureFirewallEgressRulesSpec `json:"egressRules,omitempty"`
+	// FirewallPolicy is the rule collection group the rules are applied to.
+	// When omitted the rule collection group configured in the controller is used.
+	// +optional
+	FirewallPolicy *FirewallPolicyReference       `json:"firewallPolicy,omitempty"`
+	EgressRules    []AzureFirewallEgressRulesSpec `json:"egressRules,omitempty"`
+}
+
+// FirewallPolicyReference identifies a rule collection group of an Azure Firewall Policy
+type FirewallPolicyReference struct {
+	// ResourceID is the resource ID of the firewall policy.
+	// +kubebuilder:validation:Required
+	ResourceID string `json:"resourceId"`
+	// RuleCollectionGroup is the name of the rule collection group managed by the controller.
+	// +kubebuilder:validation:Required
+	RuleCollectionGroup string `json:"ruleCollectionGroup"`
+	// RuleCollectionGroupPriority is the priority of the rule collection group.
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:Minimum=100
+	// +kubebuilder:validation:Maximum=65000
+	RuleCollectionGroupPriority int32 `json:"ruleCollectionGroupPriority"`
 }
 
 type AzureFirewallEgressRulesSpec struct {
 	// +kubebuilder:validation:Required
 	Name string `json:"name"`
-	// +kubebuilder:validation:Required
-	NodeSelector []map[string]string `json:"nodeSelector"`
+	// NodeSelector is the legacy node selector. Every key/value pair selects the nodes having that label into
+	// its own IP Group, and the IP Groups of all the pairs are sources of the rules.
+	// Use NodeLabelSelector to combine labels or to match label expressions.
+	// +optional
+	NodeSelector []map[string]string `json:"nodeSelector,omitempty"`
+	// NodeLabelSelector selects the nodes whose IPs are used as the source of the rules. The nodes must match all
+	// the labels and expressions of the selector. Every distinct selector has its own IP Group.
+	// Exactly one of NodeSelector and NodeLabelSelector must be set.
+	// +optional
+	NodeLabelSelector *metav1.LabelSelector `json:"nodeLabelSelector,omitempty"`
 	// +kubebuilder:validation:Required
 	Rules []AzureFirewallEgressrulesRulesSpec `json:"rules"`
 }
 
+// RuleType is the type of an egress rule.
+// +kubebuilder:validation:Enum=Application;Network;Nat
+type RuleType string
+
+const (
+	// RuleTypeApplication filters the HTTP and HTTPS traffic by FQDN or URL.
+	RuleTypeApplication RuleType = "Application"
+	// RuleTypeNetwork filters the traffic by destination address, FQDN, port and IP protocol.
+	RuleTypeNetwork RuleType = "Network"
+	// RuleTypeNat forwards the inbound traffic of the firewall to a translated address.
+	RuleTypeNat RuleType = "Nat"
+)
+
 type AzureFirewallEgressrulesRulesSpec struct {
 	// +kubebuilder:validation:Required
 	RuleCollectionName string `json:"ruleCollectionName"`
 	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:Minimum=100
+	// +kubebuilder:validation:Maximum=65000
 	Priority int32 `json:"priority"`
 	// +kubebuilder:validation:Required
-	RuleName             string   `json:"ruleName"`
+	RuleName string `json:"ruleName"`
+	// DestinationAddresses are IP addresses, CIDRs or ranges of IP addresses, e.g. "10.0.0.1-10.0.0.9", or "*".
+	// +kubebuilder:validation:MaxItems=1000
 	DestinationAddresses []string `json:"destinationAddresses,omitempty"`
-	DestinationPorts     []string `json:"destinationPorts,omitempty"`
-	DestinationFqdns     []string `json:"destinationFqdns,omitempty"`
-	TargetFqdns          []string `json:"targetFqdns,omitempty"`
-	TargetUrls           []string `json:"targetUrls,omitempty"`
-	// +kubebuilder:validation:Required
-	Protocol []string `json:"protocol"`
-	// +kubebuilder:validation:Required
-	Action n.FirewallPolicyFilterRuleCollectionActionType `json:"action"`
-	// +kubebuilder:validation:Required
-	RuleType string `json:"ruleType"`
+	// DestinationPorts are ports or ranges of ports, e.g. "1000-2000", or "*".
+	// +kubebuilder:validation:MaxItems=100
+	DestinationPorts []string `json:"destinationPorts,omitempty"`
+	// DestinationFqdns are the FQDNs of a Network rule, without wildcard, or "*".
+	// +kubebuilder:validation:MaxItems=1000
+	DestinationFqdns []string `json:"destinationFqdns,omitempty"`
+	// DestinationIPGroups are the IP Groups of a Network rule, by name in the resource group of the firewall policy
+	// or by resource ID.
+	// +kubebuilder:validation:MaxItems=200
+	DestinationIPGroups []string `json:"destinationIpGroups,omitempty"`
+	// DestinationServiceTags are the service tags of a Network rule, e.g. "AzureKeyVault" or "AzureKeyVault.WestEurope".
+	// +kubebuilder:validation:MaxItems=1000
+	DestinationServiceTags []string `json:"destinationServiceTags,omitempty"`
+	// TargetFqdns are the FQDNs of an Application rule, optionally starting with a wildcard, e.g. "*.contoso.com".
+	// +kubebuilder:validation:MaxItems=1000
+	TargetFqdns []string `json:"targetFqdns,omitempty"`
+	// TargetUrls are the URLs of an Application rule, without scheme, e.g. "www.contoso.com/path/*".
+	// +kubebuilder:validation:MaxItems=1000
+	TargetUrls []string `json:"targetUrls,omitempty"`
+	// SourceAddresses are the clients allowed by a Nat rule. Defaults to any source.
+	// +kubebuilder:validation:MaxItems=1000
+	SourceAddresses []string `json:"sourceAddresses,omitempty"`
+	// TranslatedAddress is the address the traffic matching a Nat rule is forwarded to.
+	TranslatedAddress string `json:"translatedAddress,omitempty"`
+	// TranslatedFqdn is the FQDN the traffic matching a Nat rule is forwarded to.
+	TranslatedFqdn string `json:"translatedFqdn,omitempty"`
+	// TranslatedPort is the port the traffic matching a Nat rule is forwarded to.
+	TranslatedPort string `json:"translatedPort,omitempty"`
+	// Protocol are "HTTP" or "HTTPS", optionally followed by a port, e.g. "HTTPS:443", for Application rules,
+	// TCP, UDP, ICMP or Any for Network rules, and TCP or UDP for Nat rules.
+	// Defaults to "Https:443" for Application rules.
+	// +optional
+	// +kubebuilder:validation:MinItems=1
+	Protocol []string `json:"protocol,omitempty"`
+	// Action defaults to DNAT for Nat rules and to Allow for the other rules.
+	// +optional
+	// +kubebuilder:validation:Enum=Allow;Deny;DNAT
+	Action n.FirewallPolicyFilterRuleCollectionActionType `json:"action,omitempty"`
+	// RuleType defaults to Nat when translated or source addresses are set, to Application when target FQDNs or URLs
+	// are set and to Network when destinations are set.
+	// +optional
+	RuleType RuleType `json:"ruleType,omitempty"`
 }
 
+const (
+	// ProtectedAnnotation set to "true" makes the webhook reject the deletion of the object, e.g. for the baseline
+	// egress rules of the cluster system components.
+	ProtectedAnnotation = "egress.azure-firewall-egress-controller.io/protected"
+	// CleanupFinalizer keeps a deleted AzureFirewallRules until the controller removed its rules from the firewall
+	// policy and deleted the IP Groups no other object uses.
+	CleanupFinalizer = "egress.azure-firewall-egress-controller.io/cleanup"
+)
+
+const (
+	// ConditionTypeReady indicates that all the egress rules of the object are enforced by the firewall policy.
+	ConditionTypeReady = "Ready"
+	// ConditionTypeSynced indicates whether the last rule collection group deployment succeeded.
+	ConditionTypeSynced = "Synced"
+	// ConditionTypeDegraded indicates that one or more egress rules could not be processed.
+	ConditionTypeDegraded = "Degraded"
+	// ConditionTypeDrifted indicates that the live rule collection group was changed outside of the controller.
+	ConditionTypeDrifted = "Drifted"
+)
+
 // AzureFirewallRulesStatus defines the observed state of azureFirewallRules
 type AzureFirewallRulesStatus struct {
-	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
-	// Important: Run "make" to regenerate code after modifying this file
+	// ObservedGeneration is the most recent generation processed by the controller.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// RuleCollectionGroupETag is the ETag of the last applied rule collection group.
+	// +optional
+	RuleCollectionGroupETag string `json:"ruleCollectionGroupEtag,omitempty"`
+	// EgressRules holds the sync state of each egress rule.
+	// +optional
+	EgressRules []AzureFirewallEgressRuleStatus `json:"egressRules,omitempty"`
+	// Conditions represent the latest available observations of the object's state.
+	// +optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+}
+
+// AzureFirewallEgressRuleStatus defines the observed state of a single egress rule
+type AzureFirewallEgressRuleStatus struct {
+	Name string `json:"name"`
+	// IPGroupIDs are the resource IDs of the IP Groups resolved from the node selector.
+	// +optional
+	IPGroupIDs []string `json:"ipGroupIds,omitempty"`
+	// Error is the last error encountered while processing the egress rule.
+	// +optional
+	Error string `json:"error,omitempty"`
 }
 
 //+kubebuilder:object:root=true
 //+kubebuilder:resource:scope=Cluster
 //+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Ready",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].status"
+//+kubebuilder:printcolumn:name="Synced",type="string",JSONPath=".status.conditions[?(@.type==\"Synced\")].status"
+//+kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
 
 // AzureFirewallRules is the Schema for the azureFirewallRules API
 type AzureFirewallRules struct {
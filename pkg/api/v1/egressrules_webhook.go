@@ -17,11 +17,16 @@ limitations under the License.
 package v1
 
 import (
-	"errors"
-	"strconv"
+	"fmt"
+	"strings"
 
+	"github.com/Azure/azure-firewall-egress-controller/pkg/environment"
 	n "github.com/Azure/azure-sdk-for-go/services/network/mgmt/2021-03-01/network"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 	ctrl "sigs.k8s.io/controller-runtime"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
@@ -30,22 +35,52 @@ import (
 type Pair struct {
 	Action             n.FirewallPolicyFilterRuleCollectionActionType
 	Priority           int32
-	RuleCollectionType string
+	RuleCollectionType RuleType
 }
 
+// Limits of the rule collections and rules accepted by the webhooks.
+const (
+	// MinRuleCollectionPriority and MaxRuleCollectionPriority bound the priorities accepted by Azure.
+	MinRuleCollectionPriority = 100
+	MaxRuleCollectionPriority = 65000
+	// MaxFqdnsPerRule is the maximum number of target FQDNs, target URLs or destination FQDNs of a rule.
+	MaxFqdnsPerRule = 1000
+	// MaxAddressesPerRule is the maximum number of source or destination addresses of a rule.
+	MaxAddressesPerRule = 1000
+	// MaxPortsPerRule is the maximum number of destination ports of a rule.
+	MaxPortsPerRule = 100
+	// MaxIpGroupsPerRule is the maximum number of destination IP Groups of a rule, as a firewall references at most
+	// 200 IP Groups.
+	MaxIpGroupsPerRule = 200
+)
+
 // log is for logging in this package.
 var azurefirewallruleslog = logf.Log.WithName("azurefirewallrules-resource")
 
 func (r *AzureFirewallRules) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	webhookClient = mgr.GetClient()
+	defaultFirewallPolicy = defaultFirewallPolicyOf(environment.GetEnv())
 	return ctrl.NewWebhookManagedBy(mgr).
 		For(r).
 		Complete()
 }
 
-// TODO(user): EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
+//+kubebuilder:webhook:path=/mutate-egress-azure-firewall-egress-controller-io-v1-azurefirewallrules,mutating=true,failurePolicy=fail,sideEffects=None,groups=egress.azure-firewall-egress-controller.io,resources=azurefirewallrules,verbs=create;update,versions=v1,name=mazurefirewallrules.kb.io,admissionReviewVersions=v1
+
+var _ webhook.Defaulter = &AzureFirewallRules{}
+
+// Default implements webhook.Defaulter so a webhook will be registered for the type
+func (r *AzureFirewallRules) Default() {
+	azurefirewallruleslog.Info("default", "name", r.Name)
+
+	for i := range r.Spec.EgressRules {
+		for j := range r.Spec.EgressRules[i].Rules {
+			defaultRule(&r.Spec.EgressRules[i].Rules[j])
+		}
+	}
+}
 
-// TODO(user): change verbs to "verbs=create;update;delete" if you want to enable deletion validation.
-//+kubebuilder:webhook:path=/validate-egress-azure-firewall-egress-controller-io-v1-azurefirewallrules,mutating=false,failurePolicy=fail,sideEffects=None,groups=egress.azure-firewall-egress-controller.io,resources=azurefirewallrules,verbs=create;update,versions=v1,name=vazurefirewallrules.kb.io,admissionReviewVersions=v1
+//+kubebuilder:webhook:path=/validate-egress-azure-firewall-egress-controller-io-v1-azurefirewallrules,mutating=false,failurePolicy=fail,sideEffects=None,groups=egress.azure-firewall-egress-controller.io,resources=azurefirewallrules,verbs=create;update;delete,versions=v1,name=vazurefirewallrules.kb.io,admissionReviewVersions=v1
 
 var _ webhook.Validator = &AzureFirewallRules{}
 
@@ -53,68 +88,262 @@ var _ webhook.Validator = &AzureFirewallRules{}
 func (r *AzureFirewallRules) ValidateCreate() error {
 	azurefirewallruleslog.Info("validate create", "name", r.Name)
 
-	return r.validateFields()
+	return r.validate()
 }
 
 // ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
 func (r *AzureFirewallRules) ValidateUpdate(old runtime.Object) error {
 	azurefirewallruleslog.Info("validate update", "name", r.Name)
 
-	return r.validateFields()
+	// The finalizer of a deleted object is removed whether the object is still valid or not.
+	if !r.DeletionTimestamp.IsZero() {
+		return nil
+	}
+	return r.validate()
 }
 
 // ValidateDelete implements webhook.Validator so a webhook will be registered for the type
 func (r *AzureFirewallRules) ValidateDelete() error {
 	azurefirewallruleslog.Info("validate delete", "name", r.Name)
 
-	// TODO(user): fill in your validation logic upon object deletion.
-	return nil
+	return ValidateDeletion(GroupVersion.WithResource("azurefirewallrules").GroupResource(), r)
 }
 
-func (r *AzureFirewallRules) validateFields() error {
+// ValidateDeletion rejects the deletion of an object protected by the ProtectedAnnotation.
+func ValidateDeletion(resource schema.GroupResource, obj metav1.Object) error {
+	if obj.GetAnnotations()[ProtectedAnnotation] != "true" {
+		return nil
+	}
+	return apierrors.NewForbidden(resource, obj.GetName(), fmt.Errorf("the object is protected by the annotation %s=true, remove the annotation to delete it", ProtectedAnnotation))
+}
+
+// validate reports all the errors of the object at once.
+func (r *AzureFirewallRules) validate() error {
+	allErrs := r.ValidationErrors()
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(GroupVersion.WithKind("AzureFirewallRules").GroupKind(), r.Name, allErrs)
+}
+
+// ValidationErrors returns all the errors of the object, and of its rules against the rules of the other objects.
+func (r *AzureFirewallRules) ValidationErrors() field.ErrorList {
+	allErrs := r.validateFields()
+	return append(allErrs, validateAgainstExistingObjects("AzureFirewallRules "+r.Name, r.Spec.FirewallPolicy, r.pathRules())...)
+}
+
+func (r *AzureFirewallRules) validateFields() field.ErrorList {
+	var allErrs field.ErrorList
+	for i, egressrule := range r.Spec.EgressRules {
+		allErrs = append(allErrs, validateNodeSelector(egressrule, field.NewPath("spec", "egressRules").Index(i))...)
+	}
+	allErrs = append(allErrs, validateFirewallPolicyReference(r.Spec.FirewallPolicy, field.NewPath("spec", "firewallPolicy"))...)
+	return append(allErrs, validateRules(r.pathRules(), true)...)
+}
+
+// setField tells whether a field of a rule is set.
+type setField struct {
+	name string
+	set  bool
+}
+
+// pathRule is a rule together with the path of its field, to report the errors on that field.
+type pathRule struct {
+	path *field.Path
+	rule AzureFirewallEgressrulesRulesSpec
+}
+
+func (r *AzureFirewallRules) pathRules() []pathRule {
+	var rules []pathRule
+	for i, egressrule := range r.Spec.EgressRules {
+		for j, rule := range egressrule.Rules {
+			rules = append(rules, pathRule{path: field.NewPath("spec", "egressRules").Index(i).Child("rules").Index(j), rule: rule})
+		}
+	}
+	return rules
+}
+
+func validateNodeSelector(egressrule AzureFirewallEgressRulesSpec, path *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	if (len(egressrule.NodeSelector) == 0) == (egressrule.NodeLabelSelector == nil) {
+		allErrs = append(allErrs, field.Invalid(path, egressrule.Name, "exactly one of nodeSelector and nodeLabelSelector must be set"))
+	}
+	if egressrule.NodeLabelSelector != nil {
+		if _, err := metav1.LabelSelectorAsSelector(egressrule.NodeLabelSelector); err != nil {
+			allErrs = append(allErrs, field.Invalid(path.Child("nodeLabelSelector"), egressrule.NodeLabelSelector, err.Error()))
+		}
+	}
+	return allErrs
+}
+
+func validateFirewallPolicyReference(ref *FirewallPolicyReference, path *field.Path) field.ErrorList {
+	if ref == nil {
+		return nil
+	}
+	var allErrs field.ErrorList
+	split := strings.Split(ref.ResourceID, "/")
+	if len(split) != 9 || split[1] != "subscriptions" || !strings.EqualFold(split[3], "resourceGroups") || !strings.EqualFold(split[6], "Microsoft.Network") || !strings.EqualFold(split[7], "firewallPolicies") || split[8] == "" {
+		allErrs = append(allErrs, field.Invalid(path.Child("resourceId"), ref.ResourceID, "must be a firewall policy resource ID"))
+	}
+	if ref.RuleCollectionGroup == "" {
+		allErrs = append(allErrs, field.Required(path.Child("ruleCollectionGroup"), "the rule collection group name is mandatory"))
+	}
+	if ref.RuleCollectionGroupPriority < MinRuleCollectionPriority || ref.RuleCollectionGroupPriority > MaxRuleCollectionPriority {
+		allErrs = append(allErrs, field.Invalid(path.Child("ruleCollectionGroupPriority"), ref.RuleCollectionGroupPriority, fmt.Sprintf("must be between %d and %d", MinRuleCollectionPriority, MaxRuleCollectionPriority)))
+	}
+	return allErrs
+}
+
+// validateRules reports the errors of the rules of an object. Nat rules are only accepted when allowNat is set: a DNAT
+// rule exposes internal addresses through the shared firewall, so it is kept to the cluster-scoped resources.
+func validateRules(rules []pathRule, allowNat bool) field.ErrorList {
+	var allErrs field.ErrorList
 	var priorityMap = make(map[int32]string)
 	var ruleCollectionNameMap = make(map[string]Pair)
-	for _, egressrule := range r.Spec.EgressRules {
-		for _, rule := range egressrule.Rules {
-			//Rule collection priority must of unique
-			if _, ok := priorityMap[rule.Priority]; ok {
-				if priorityMap[rule.Priority] != rule.RuleCollectionName {
-					return errors.New("Invalid Rule Collection Group . Priority " + strconv.FormatInt(int64(rule.Priority), 10) + " used for more than one rule collection.")
+	var ruleNames = make(map[string]bool)
+	for _, pr := range rules {
+		rule, path := pr.rule, pr.path
+
+		if rule.Priority < MinRuleCollectionPriority || rule.Priority > MaxRuleCollectionPriority {
+			allErrs = append(allErrs, field.Invalid(path.Child("priority"), rule.Priority, fmt.Sprintf("must be between %d and %d", MinRuleCollectionPriority, MaxRuleCollectionPriority)))
+		}
+
+		//Rule collection priority must of unique
+		if name, ok := priorityMap[rule.Priority]; ok && name != rule.RuleCollectionName {
+			allErrs = append(allErrs, field.Invalid(path.Child("priority"), rule.Priority, "is already used by rule collection "+name))
+		} else {
+			priorityMap[rule.Priority] = rule.RuleCollectionName
+		}
+
+		//Rule Collection names must be unique
+		pair := Pair{
+			Action:             rule.Action,
+			Priority:           rule.Priority,
+			RuleCollectionType: rule.RuleType,
+		}
+		if existing, ok := ruleCollectionNameMap[rule.RuleCollectionName]; ok && existing != pair {
+			allErrs = append(allErrs, field.Invalid(path.Child("ruleCollectionName"), rule.RuleCollectionName, "is used for more than one rule collection with a different action, priority or rule type"))
+		} else if !ok {
+			ruleCollectionNameMap[rule.RuleCollectionName] = pair
+		}
+
+		//Rule names must be unique in a rule collection
+		if ruleNames[rule.RuleCollectionName+"/"+rule.RuleName] {
+			allErrs = append(allErrs, field.Duplicate(path.Child("ruleName"), rule.RuleName))
+		}
+		ruleNames[rule.RuleCollectionName+"/"+rule.RuleName] = true
+
+		allErrs = append(allErrs, validateRuleLimits(rule, path)...)
+		allErrs = append(allErrs, validateRuleSyntax(rule, path)...)
+
+		switch rule.RuleType {
+		case RuleTypeApplication, RuleTypeNetwork:
+			if rule.Action != n.FirewallPolicyFilterRuleCollectionActionTypeAllow && rule.Action != n.FirewallPolicyFilterRuleCollectionActionTypeDeny {
+				allErrs = append(allErrs, field.NotSupported(path.Child("action"), rule.Action, []string{string(n.FirewallPolicyFilterRuleCollectionActionTypeAllow), string(n.FirewallPolicyFilterRuleCollectionActionTypeDeny)}))
+			}
+		case RuleTypeNat:
+			if !allowNat {
+				allErrs = append(allErrs, field.Forbidden(path.Child("ruleType"), "Nat rules are only supported by AzureFirewallRules"))
+				continue
+			}
+		default:
+			allErrs = append(allErrs, field.NotSupported(path.Child("ruleType"), rule.RuleType, []string{string(RuleTypeApplication), string(RuleTypeNetwork), string(RuleTypeNat)}))
+			continue
+		}
+
+		if rule.RuleType != RuleTypeNat {
+			for _, f := range []setField{{"sourceAddresses", rule.SourceAddresses != nil}, {"translatedAddress", rule.TranslatedAddress != ""}, {"translatedFqdn", rule.TranslatedFqdn != ""}, {"translatedPort", rule.TranslatedPort != ""}} {
+				if f.set {
+					allErrs = append(allErrs, field.Forbidden(path.Child(f.name), "is only supported by Nat rules"))
 				}
 			}
-			priorityMap[rule.Priority] = rule.RuleCollectionName
+		}
 
-			//Rule Collection names must be unique
-			if _, ok := ruleCollectionNameMap[rule.RuleCollectionName]; ok {
-				pair := ruleCollectionNameMap[rule.RuleCollectionName]
-				if pair.Action != rule.Action || pair.Priority != rule.Priority || pair.RuleCollectionType != rule.RuleType {
-					return errors.New("Invalid Rule Collection Group . Name " + rule.RuleCollectionName + " used for more than one rule collection.")
+		if rule.RuleType == RuleTypeNat {
+			if rule.Action != n.FirewallPolicyFilterRuleCollectionActionType(n.FirewallPolicyNatRuleCollectionActionTypeDNAT) {
+				allErrs = append(allErrs, field.Invalid(path.Child("action"), rule.Action, "must be DNAT for Nat rules"))
+			}
+			for _, f := range []setField{{"targetFqdns", rule.TargetFqdns != nil}, {"targetUrls", rule.TargetUrls != nil}, {"destinationFqdns", rule.DestinationFqdns != nil}, {"destinationIpGroups", rule.DestinationIPGroups != nil}, {"destinationServiceTags", rule.DestinationServiceTags != nil}} {
+				if f.set {
+					allErrs = append(allErrs, field.Forbidden(path.Child(f.name), "is not supported by Nat rules"))
 				}
 			}
-			ruleCollectionNameMap[rule.RuleCollectionName] = Pair{
-				Action:             rule.Action,
-				Priority:           rule.Priority,
-				RuleCollectionType: rule.RuleType,
+			if len(rule.DestinationAddresses) != 1 {
+				allErrs = append(allErrs, field.Invalid(path.Child("destinationAddresses"), rule.DestinationAddresses, "Nat rules require exactly one destination address"))
 			}
-
-			if rule.RuleType == "Application" {
-				if rule.TargetFqdns == nil {
-					return errors.New("Invalid Rule " + rule.RuleName + " Target Fqdns field is mandatory field for Application rule")
-				} else if rule.DestinationAddresses != nil || rule.DestinationFqdns != nil || rule.DestinationPorts != nil {
-					return errors.New("Invalid Rule " + rule.RuleName + " Fields DestinationAddresses/DestinationFqdns/DestinationPorts are not supported by Application Rule")
+			if len(rule.DestinationPorts) != 1 {
+				allErrs = append(allErrs, field.Invalid(path.Child("destinationPorts"), rule.DestinationPorts, "Nat rules require exactly one destination port"))
+			}
+			if (rule.TranslatedAddress == "") == (rule.TranslatedFqdn == "") {
+				allErrs = append(allErrs, field.Invalid(path.Child("translatedAddress"), rule.TranslatedAddress, "exactly one of translatedAddress and translatedFqdn must be set"))
+			}
+			if rule.TranslatedPort == "" {
+				allErrs = append(allErrs, field.Required(path.Child("translatedPort"), "Nat rules require a translated port"))
+			}
+		} else if rule.RuleType == RuleTypeApplication {
+			if rule.TargetFqdns == nil {
+				allErrs = append(allErrs, field.Required(path.Child("targetFqdns"), "Application rules require target FQDNs"))
+			}
+			for _, f := range []setField{{"destinationAddresses", rule.DestinationAddresses != nil}, {"destinationFqdns", rule.DestinationFqdns != nil}, {"destinationIpGroups", rule.DestinationIPGroups != nil}, {"destinationServiceTags", rule.DestinationServiceTags != nil}, {"destinationPorts", rule.DestinationPorts != nil}} {
+				if f.set {
+					allErrs = append(allErrs, field.Forbidden(path.Child(f.name), "is not supported by Application rules"))
+				}
+			}
+		} else {
+			for _, f := range []setField{{"targetFqdns", rule.TargetFqdns != nil}, {"targetUrls", rule.TargetUrls != nil}} {
+				if f.set {
+					allErrs = append(allErrs, field.Forbidden(path.Child(f.name), "is not supported by Network rules"))
+				}
+			}
+			// A Network rule has a single type of destination.
+			destinations := 0
+			for _, f := range []struct {
+				name   string
+				values []string
+			}{
+				{"destinationAddresses", rule.DestinationAddresses},
+				{"destinationIpGroups", rule.DestinationIPGroups},
+				{"destinationServiceTags", rule.DestinationServiceTags},
+				{"destinationFqdns", rule.DestinationFqdns},
+			} {
+				if f.values == nil {
+					continue
 				}
-			} else {
-				if rule.TargetFqdns != nil || rule.TargetUrls != nil {
-					return errors.New("Invalid Rule " + rule.RuleName + " Fields TargetFqdns/TargetUrls are not supported by Network Rule")
-				} else if rule.DestinationAddresses != nil && rule.DestinationFqdns != nil {
-					return errors.New("Invalid Rule " + rule.RuleName + " Multiple destination types cannot provided")
-				} else if rule.DestinationAddresses == nil && rule.DestinationFqdns == nil {
-					return errors.New("Invalid Rule " + rule.RuleName + " One destination type should be provided")
-				} else if rule.DestinationPorts == nil {
-					return errors.New("Invalid Rule " + rule.RuleName + " Destination port missing")
+				if destinations++; destinations > 1 {
+					allErrs = append(allErrs, field.Invalid(path.Child(f.name), f.values, "only one of destinationAddresses, destinationIpGroups, destinationServiceTags and destinationFqdns may be set"))
 				}
 			}
+			if destinations == 0 {
+				allErrs = append(allErrs, field.Required(path.Child("destinationAddresses"), "one of destinationAddresses, destinationIpGroups, destinationServiceTags and destinationFqdns must be set"))
+			}
+			if rule.DestinationPorts == nil {
+				allErrs = append(allErrs, field.Required(path.Child("destinationPorts"), "Network rules require destination ports"))
+			}
+		}
+	}
+	return allErrs
+}
+
+// validateRuleLimits checks the number of values of the list fields of a rule.
+func validateRuleLimits(rule AzureFirewallEgressrulesRulesSpec, path *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	for _, list := range []struct {
+		name   string
+		values []string
+		max    int
+	}{
+		{"targetFqdns", rule.TargetFqdns, MaxFqdnsPerRule},
+		{"targetUrls", rule.TargetUrls, MaxFqdnsPerRule},
+		{"destinationFqdns", rule.DestinationFqdns, MaxFqdnsPerRule},
+		{"destinationAddresses", rule.DestinationAddresses, MaxAddressesPerRule},
+		{"destinationIpGroups", rule.DestinationIPGroups, MaxIpGroupsPerRule},
+		{"destinationServiceTags", rule.DestinationServiceTags, MaxAddressesPerRule},
+		{"sourceAddresses", rule.SourceAddresses, MaxAddressesPerRule},
+		{"destinationPorts", rule.DestinationPorts, MaxPortsPerRule},
+	} {
+		if len(list.values) > list.max {
+			allErrs = append(allErrs, field.TooMany(path.Child(list.name), len(list.values), list.max))
 		}
 	}
-	return nil
+	return allErrs
 }
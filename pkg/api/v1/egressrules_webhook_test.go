@@ -0,0 +1,304 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/Azure/azure-firewall-egress-controller/pkg/environment"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newTestRule(ruleCollectionName string, priority int32, ruleName string) AzureFirewallEgressrulesRulesSpec {
+	return AzureFirewallEgressrulesRulesSpec{
+		RuleCollectionName: ruleCollectionName,
+		Priority:           priority,
+		RuleName:           ruleName,
+		TargetFqdns:        []string{"github.com"},
+		Protocol:           []string{"HTTPS:443"},
+		Action:             "Allow",
+		RuleType:           "Application",
+	}
+}
+
+func newTestAzureFirewallRules(name string, rules ...AzureFirewallEgressrulesRulesSpec) *AzureFirewallRules {
+	return &AzureFirewallRules{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: AzureFirewallRulesSpec{
+			EgressRules: []AzureFirewallEgressRulesSpec{
+				{
+					Name:         "egress",
+					NodeSelector: []map[string]string{{"app": "service"}},
+					Rules:        rules,
+				},
+			},
+		},
+	}
+}
+
+// setTestWebhookClient makes the webhooks validate against the given existing objects.
+func setTestWebhookClient(t *testing.T, objs ...client.Object) {
+	scheme := runtime.NewScheme()
+	if err := AddToScheme(scheme); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	webhookClient = fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build()
+	t.Cleanup(func() { webhookClient = nil })
+}
+
+// invalidFields returns the fields reported by an Invalid error.
+func invalidFields(err error) []string {
+	var statusErr *apierrors.StatusError
+	if !errors.As(err, &statusErr) || statusErr.ErrStatus.Details == nil {
+		return nil
+	}
+	var fields []string
+	for _, cause := range statusErr.ErrStatus.Details.Causes {
+		fields = append(fields, cause.Field)
+	}
+	return fields
+}
+
+func TestValidateAzureFirewallRules(t *testing.T) {
+	type testCase struct {
+		Name     string
+		rules    *AzureFirewallRules
+		Expected []string
+	}
+
+	tooManyFqdns := newTestRule("allow-web", 200, "many")
+	for i := 0; i <= MaxFqdnsPerRule; i++ {
+		tooManyFqdns.TargetFqdns = append(tooManyFqdns.TargetFqdns, fmt.Sprintf("host%d.example.com", i))
+	}
+	natFieldsInApplicationRule := newTestRule("allow-web", 50, "github")
+	natFieldsInApplicationRule.TranslatedPort = "8080"
+	unknownRuleType := newTestRule("allow-web", 200, "github")
+	unknownRuleType.RuleType = "Dns"
+	dnatApplicationRule := newTestRule("allow-web", 200, "github")
+	dnatApplicationRule.Action = "DNAT"
+	serviceTagRule := newTestNetworkRule("key-vault")
+	serviceTagRule.DestinationAddresses = nil
+	serviceTagRule.DestinationServiceTags = []string{"AzureKeyVault.WestEurope"}
+	ipGroupRule := newTestNetworkRule("shared-services")
+	ipGroupRule.DestinationAddresses = nil
+	ipGroupRule.DestinationIPGroups = []string{"shared-services"}
+	mixedDestinations := newTestNetworkRule("mixed")
+	mixedDestinations.DestinationIPGroups = []string{"shared-services"}
+	mixedDestinations.DestinationServiceTags = []string{"AzureKeyVault"}
+	noDestination := newTestNetworkRule("none")
+	noDestination.DestinationAddresses = nil
+	serviceTagsInApplicationRule := newTestRule("allow-web", 200, "github")
+	serviceTagsInApplicationRule.DestinationServiceTags = []string{"AzureKeyVault"}
+
+	testCases := []testCase{
+		{
+			Name:  "valid",
+			rules: newTestAzureFirewallRules("web", newTestRule("allow-web", 200, "github"), newTestRule("allow-web", 200, "gitlab")),
+		},
+		{
+			Name:     "all-errors",
+			rules:    newTestAzureFirewallRules("web", natFieldsInApplicationRule, newTestRule("allow-web", 50, "github")),
+			Expected: []string{"spec.egressRules[0].rules[0].priority", "spec.egressRules[0].rules[0].translatedPort", "spec.egressRules[0].rules[1].priority", "spec.egressRules[0].rules[1].ruleName"},
+		},
+		{
+			Name:     "priority-collision",
+			rules:    newTestAzureFirewallRules("web", newTestRule("allow-web", 200, "github"), newTestRule("allow-api", 200, "github")),
+			Expected: []string{"spec.egressRules[0].rules[1].priority"},
+		},
+		{
+			Name:     "too-many-fqdns",
+			rules:    newTestAzureFirewallRules("web", tooManyFqdns),
+			Expected: []string{"spec.egressRules[0].rules[0].targetFqdns"},
+		},
+		{
+			Name:     "unknown-rule-type",
+			rules:    newTestAzureFirewallRules("web", unknownRuleType),
+			Expected: []string{"spec.egressRules[0].rules[0].ruleType"},
+		},
+		{
+			Name:     "dnat-application-rule",
+			rules:    newTestAzureFirewallRules("web", dnatApplicationRule),
+			Expected: []string{"spec.egressRules[0].rules[0].action"},
+		},
+		{
+			Name:  "service-tags-and-ip-groups",
+			rules: newTestAzureFirewallRules("network", serviceTagRule, ipGroupRule),
+		},
+		{
+			Name:     "mixed-destinations",
+			rules:    newTestAzureFirewallRules("network", mixedDestinations),
+			Expected: []string{"spec.egressRules[0].rules[0].destinationIpGroups", "spec.egressRules[0].rules[0].destinationServiceTags"},
+		},
+		{
+			Name:     "no-destination",
+			rules:    newTestAzureFirewallRules("network", noDestination),
+			Expected: []string{"spec.egressRules[0].rules[0].destinationAddresses"},
+		},
+		{
+			Name:     "service-tags-in-application-rule",
+			rules:    newTestAzureFirewallRules("web", serviceTagsInApplicationRule),
+			Expected: []string{"spec.egressRules[0].rules[0].destinationServiceTags"},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			err := tc.rules.ValidateCreate()
+			if fields := invalidFields(err); !reflect.DeepEqual(fields, tc.Expected) {
+				t.Errorf("Expected invalid fields %v, but got: %v (%v)", tc.Expected, fields, err)
+			}
+		})
+	}
+}
+
+func TestValidateAgainstExistingObjects(t *testing.T) {
+	otherPolicy := &FirewallPolicyReference{
+		ResourceID:                  "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Network/firewallPolicies/hub",
+		RuleCollectionGroup:         "aks-egress",
+		RuleCollectionGroupPriority: 400,
+	}
+	existingPolicy := &EgressPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "team-a"},
+		Spec:       EgressPolicySpec{Rules: []AzureFirewallEgressrulesRulesSpec{newTestRule("team-a", 300, "github")}},
+	}
+	setTestWebhookClient(t, newTestAzureFirewallRules("web", newTestRule("allow-web", 200, "github")), existingPolicy)
+	defaultFirewallPolicy = defaultFirewallPolicyOf(environment.EnvVariables{
+		SubscriptionID:                      "sub",
+		ResourceGroupName:                   "rg",
+		FwPolicyName:                        "spoke",
+		FwPolicyRuleCollectionGroupName:     "aks-egress",
+		FwPolicyRuleCollectionGroupPriority: 400,
+	})
+	t.Cleanup(func() { defaultFirewallPolicy = nil })
+
+	type testCase struct {
+		Name     string
+		object   interface{ ValidateCreate() error }
+		Expected []string
+	}
+
+	otherTarget := newTestAzureFirewallRules("hub", newTestRule("allow-web", 200, "github"))
+	otherTarget.Spec.FirewallPolicy = otherPolicy
+	// The rule collection group configured in the controller, referenced explicitly.
+	defaultTarget := newTestAzureFirewallRules("api", newTestRule("allow-api", 200, "github"))
+	defaultTarget.Spec.FirewallPolicy = &FirewallPolicyReference{
+		ResourceID:                  "/subscriptions/sub/resourceGroups/RG/providers/Microsoft.Network/firewallPolicies/spoke",
+		RuleCollectionGroup:         "aks-egress",
+		RuleCollectionGroupPriority: 400,
+	}
+	denyWeb := newTestRule("allow-web", 200, "gitlab")
+	denyWeb.Action = "Deny"
+
+	testCases := []testCase{
+		{
+			Name:   "same-rule-collection",
+			object: newTestAzureFirewallRules("api", newTestRule("allow-web", 200, "gitlab")),
+		},
+		{
+			Name:   "itself",
+			object: newTestAzureFirewallRules("web", newTestRule("allow-web", 200, "github")),
+		},
+		{
+			Name:   "other-rule-collection-group",
+			object: otherTarget,
+		},
+		{
+			Name:     "default-rule-collection-group",
+			object:   defaultTarget,
+			Expected: []string{"spec.egressRules[0].rules[0].priority"},
+		},
+		{
+			Name:     "priority-collision",
+			object:   newTestAzureFirewallRules("api", newTestRule("allow-api", 200, "github")),
+			Expected: []string{"spec.egressRules[0].rules[0].priority"},
+		},
+		{
+			Name:     "different-action",
+			object:   newTestAzureFirewallRules("api", denyWeb),
+			Expected: []string{"spec.egressRules[0].rules[0].ruleCollectionName"},
+		},
+		{
+			Name:     "duplicate-rule-name",
+			object:   newTestAzureFirewallRules("api", newTestRule("allow-web", 200, "github")),
+			Expected: []string{"spec.egressRules[0].rules[0].ruleName"},
+		},
+		{
+			Name: "egress-policy",
+			object: &EgressPolicy{
+				ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "team-b"},
+				Spec:       EgressPolicySpec{Rules: []AzureFirewallEgressrulesRulesSpec{newTestRule("team-b", 300, "github")}},
+			},
+			Expected: []string{"spec.rules[0].priority"},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			err := tc.object.ValidateCreate()
+			if fields := invalidFields(err); !reflect.DeepEqual(fields, tc.Expected) {
+				t.Errorf("Expected invalid fields %v, but got: %v (%v)", tc.Expected, fields, err)
+			}
+		})
+	}
+}
+
+func TestValidateDelete(t *testing.T) {
+	type testCase struct {
+		Name        string
+		annotations map[string]string
+		Expected    bool
+	}
+
+	testCases := []testCase{
+		{Name: "not-annotated", Expected: false},
+		{Name: "protected", annotations: map[string]string{ProtectedAnnotation: "true"}, Expected: true},
+		{Name: "not-protected", annotations: map[string]string{ProtectedAnnotation: "false"}, Expected: false},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			rules := newTestAzureFirewallRules("web", newTestRule("allow-web", 200, "github"))
+			rules.Annotations = tc.annotations
+			err := rules.ValidateDelete()
+			if forbidden := apierrors.IsForbidden(err); forbidden != tc.Expected {
+				t.Errorf("Expected forbidden %t, but got: %v", tc.Expected, err)
+			}
+		})
+	}
+}
+
+func TestValidateUpdateOfDeletedObject(t *testing.T) {
+	rules := newTestAzureFirewallRules("web", newTestRule("allow-web", 50, "github"))
+	if err := rules.ValidateUpdate(rules.DeepCopy()); err == nil {
+		t.Errorf("Expected an error, but got: nil")
+	}
+	now := metav1.Now()
+	rules.DeletionTimestamp = &now
+	if err := rules.ValidateUpdate(rules.DeepCopy()); err != nil {
+		t.Errorf("Expected no error, but got: %v", err)
+	}
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Azure/azure-firewall-egress-controller/pkg/environment"
+	utils "github.com/Azure/azure-firewall-egress-controller/pkg/utils"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// defaultFirewallPolicy is the rule collection group the controller applies the objects without firewallPolicy
+// reference to, as configured in the environment. It is nil until the webhooks are set up with a manager, in which
+// case only the objects without reference are known to target it.
+var defaultFirewallPolicy *FirewallPolicyReference
+
+// defaultFirewallPolicyOf returns the rule collection group configured in the environment, or nil if none is.
+func defaultFirewallPolicyOf(env environment.EnvVariables) *FirewallPolicyReference {
+	if env.FwPolicyName == "" {
+		return nil
+	}
+	return &FirewallPolicyReference{
+		ResourceID:                  utils.ResourceID(utils.SubscriptionID(env.SubscriptionID), utils.ResourceGroup(env.ResourceGroupName), "Microsoft.Network", "firewallPolicies", env.FwPolicyName),
+		RuleCollectionGroup:         env.FwPolicyRuleCollectionGroupName,
+		RuleCollectionGroupPriority: env.FwPolicyRuleCollectionGroupPriority,
+	}
+}
+
+// webhookClient lists the existing objects the webhooks validate an object against. It is nil until the webhooks
+// are set up with a manager, in which case only the object itself is validated.
+var webhookClient client.Reader
+
+// existingRules are the rules of an existing AzureFirewallRules or EgressPolicy object.
+type existingRules struct {
+	owner          string
+	firewallPolicy *FirewallPolicyReference
+	rules          []AzureFirewallEgressrulesRulesSpec
+}
+
+// listExistingRules returns the rules of the existing objects, except the one named self.
+func listExistingRules(ctx context.Context, self string) ([]existingRules, error) {
+	var existing []existingRules
+
+	erulesList := &AzureFirewallRulesList{}
+	if err := webhookClient.List(ctx, erulesList); err != nil {
+		return nil, err
+	}
+	for _, item := range erulesList.Items {
+		if owner := "AzureFirewallRules " + item.Name; owner != self {
+			var rules []AzureFirewallEgressrulesRulesSpec
+			for _, egressrule := range item.Spec.EgressRules {
+				rules = append(rules, egressrule.Rules...)
+			}
+			existing = append(existing, existingRules{owner: owner, firewallPolicy: item.Spec.FirewallPolicy, rules: rules})
+		}
+	}
+
+	policyList := &EgressPolicyList{}
+	if err := webhookClient.List(ctx, policyList); err != nil {
+		return nil, err
+	}
+	for _, policy := range policyList.Items {
+		if owner := "EgressPolicy " + policy.Namespace + "/" + policy.Name; owner != self {
+			existing = append(existing, existingRules{owner: owner, rules: policy.Spec.Rules})
+		}
+	}
+	return existing, nil
+}
+
+// sameRuleCollectionGroup returns true if both references target the same rule collection group. Objects without
+// reference target the rule collection group configured in the controller, which an explicit reference may target
+// as well.
+func sameRuleCollectionGroup(ref *FirewallPolicyReference, other *FirewallPolicyReference) bool {
+	if ref == nil {
+		ref = defaultFirewallPolicy
+	}
+	if other == nil {
+		other = defaultFirewallPolicy
+	}
+	if ref == nil || other == nil {
+		return ref == nil && other == nil
+	}
+	return strings.EqualFold(ref.ResourceID, other.ResourceID) && strings.EqualFold(ref.RuleCollectionGroup, other.RuleCollectionGroup)
+}
+
+// validateAgainstExistingObjects checks that the rules don't collide with the rules of the other objects targeting
+// the same rule collection group, which the controller merges into the same rule collections.
+func validateAgainstExistingObjects(self string, ref *FirewallPolicyReference, rules []pathRule) field.ErrorList {
+	if webhookClient == nil {
+		return nil
+	}
+	existing, err := listExistingRules(context.Background(), self)
+	if err != nil {
+		return field.ErrorList{field.InternalError(field.NewPath("spec"), err)}
+	}
+
+	type ownedRuleCollection struct {
+		owner string
+		name  string
+		pair  Pair
+	}
+	priorities := make(map[int32]ownedRuleCollection)
+	ruleCollections := make(map[string]ownedRuleCollection)
+	ruleNames := make(map[string]string)
+	for _, other := range existing {
+		if !sameRuleCollectionGroup(ref, other.firewallPolicy) {
+			continue
+		}
+		for _, rule := range other.rules {
+			ruleCollection := ownedRuleCollection{
+				owner: other.owner,
+				name:  rule.RuleCollectionName,
+				pair:  Pair{Action: rule.Action, Priority: rule.Priority, RuleCollectionType: rule.RuleType},
+			}
+			if _, ok := priorities[rule.Priority]; !ok {
+				priorities[rule.Priority] = ruleCollection
+			}
+			if _, ok := ruleCollections[rule.RuleCollectionName]; !ok {
+				ruleCollections[rule.RuleCollectionName] = ruleCollection
+			}
+			if _, ok := ruleNames[rule.RuleCollectionName+"/"+rule.RuleName]; !ok {
+				ruleNames[rule.RuleCollectionName+"/"+rule.RuleName] = other.owner
+			}
+		}
+	}
+
+	var allErrs field.ErrorList
+	for _, pr := range rules {
+		rule, path := pr.rule, pr.path
+		if other, ok := priorities[rule.Priority]; ok && other.name != rule.RuleCollectionName {
+			allErrs = append(allErrs, field.Invalid(path.Child("priority"), rule.Priority, fmt.Sprintf("is already used by rule collection %s of %s", other.name, other.owner)))
+		}
+		pair := Pair{Action: rule.Action, Priority: rule.Priority, RuleCollectionType: rule.RuleType}
+		if other, ok := ruleCollections[rule.RuleCollectionName]; ok && other.pair != pair {
+			allErrs = append(allErrs, field.Invalid(path.Child("ruleCollectionName"), rule.RuleCollectionName, fmt.Sprintf("is already used by %s with a different action, priority or rule type", other.owner)))
+		}
+		if owner, ok := ruleNames[rule.RuleCollectionName+"/"+rule.RuleName]; ok {
+			allErrs = append(allErrs, field.Invalid(path.Child("ruleName"), rule.RuleName, fmt.Sprintf("is already used in rule collection %s by %s", rule.RuleCollectionName, owner)))
+		}
+	}
+	return allErrs
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"fmt"
+	"strings"
+
+	n "github.com/Azure/azure-sdk-for-go/services/network/mgmt/2021-03-01/network"
+)
+
+// DefaultApplicationProtocol is the protocol of the Application rules that don't set one.
+const DefaultApplicationProtocol = "Https:443"
+
+// defaultRule fills in the fields of a rule that can be inferred from the other ones, and normalizes its values so
+// that equivalent specs generate the same rule. Values that can't be parsed are left as they are for the validation
+// to reject them.
+func defaultRule(rule *AzureFirewallEgressrulesRulesSpec) {
+	if rule.RuleType == "" {
+		rule.RuleType = inferRuleType(*rule)
+	}
+	if rule.Action == "" {
+		if rule.RuleType == RuleTypeNat {
+			rule.Action = n.FirewallPolicyFilterRuleCollectionActionType(n.FirewallPolicyNatRuleCollectionActionTypeDNAT)
+		} else {
+			rule.Action = n.FirewallPolicyFilterRuleCollectionActionTypeAllow
+		}
+	}
+	if len(rule.Protocol) == 0 && rule.RuleType == RuleTypeApplication {
+		rule.Protocol = []string{DefaultApplicationProtocol}
+	}
+
+	rule.Protocol = normalizeList(rule.Protocol, func(protocol string) string { return normalizeProtocol(rule.RuleType, protocol) })
+	rule.TargetFqdns = normalizeList(rule.TargetFqdns, strings.ToLower)
+	rule.DestinationFqdns = normalizeList(rule.DestinationFqdns, strings.ToLower)
+	rule.TranslatedFqdn = strings.ToLower(rule.TranslatedFqdn)
+	rule.DestinationAddresses = normalizeList(rule.DestinationAddresses, strings.TrimSpace)
+	rule.DestinationIPGroups = normalizeList(rule.DestinationIPGroups, strings.TrimSpace)
+	rule.DestinationServiceTags = normalizeList(rule.DestinationServiceTags, strings.TrimSpace)
+	rule.SourceAddresses = normalizeList(rule.SourceAddresses, strings.TrimSpace)
+}
+
+// inferRuleType returns the type of rule the set fields belong to: the translation fields and the source addresses
+// are only supported by Nat rules, the target FQDNs and URLs by Application rules and the destinations by Network
+// rules. It returns an empty type when no field tells.
+func inferRuleType(rule AzureFirewallEgressrulesRulesSpec) RuleType {
+	switch {
+	case rule.TranslatedAddress != "" || rule.TranslatedFqdn != "" || rule.TranslatedPort != "" || rule.SourceAddresses != nil:
+		return RuleTypeNat
+	case rule.TargetFqdns != nil || rule.TargetUrls != nil:
+		return RuleTypeApplication
+	case rule.DestinationAddresses != nil || rule.DestinationIPGroups != nil || rule.DestinationServiceTags != nil || rule.DestinationFqdns != nil || rule.DestinationPorts != nil:
+		return RuleTypeNetwork
+	}
+	return ""
+}
+
+// normalizeProtocol returns the protocol with the casing of the Azure API and, for Application rules, an explicit
+// port, e.g. "https" becomes "Https:443".
+func normalizeProtocol(ruleType RuleType, protocol string) string {
+	switch ruleType {
+	case RuleTypeApplication:
+		if protocolType, port, err := ParseApplicationProtocol(protocol); err == nil {
+			return fmt.Sprintf("%s:%d", protocolType, port)
+		}
+	case RuleTypeNetwork, RuleTypeNat:
+		if networkProtocol, err := ParseNetworkProtocol(protocol); err == nil {
+			return string(networkProtocol)
+		}
+	}
+	return protocol
+}
+
+// normalizeList normalizes the values of a list and removes the duplicates, keeping the first occurrence. A nil list
+// stays nil, as the validation tells unset fields from empty ones.
+func normalizeList(values []string, normalize func(string) string) []string {
+	if values == nil {
+		return nil
+	}
+	normalized := []string{}
+	seen := make(map[string]bool)
+	for _, value := range values {
+		value = normalize(value)
+		if !seen[value] {
+			seen[value] = true
+			normalized = append(normalized, value)
+		}
+	}
+	return normalized
+}
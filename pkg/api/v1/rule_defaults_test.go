@@ -0,0 +1,124 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDefaultRule(t *testing.T) {
+	type testCase struct {
+		Name     string
+		rule     AzureFirewallEgressrulesRulesSpec
+		Expected AzureFirewallEgressrulesRulesSpec
+	}
+
+	testCases := []testCase{
+		{
+			Name: "application",
+			rule: AzureFirewallEgressrulesRulesSpec{
+				TargetFqdns: []string{"GitHub.com", "github.com", "*.Contoso.com"},
+			},
+			Expected: AzureFirewallEgressrulesRulesSpec{
+				TargetFqdns: []string{"github.com", "*.contoso.com"},
+				Protocol:    []string{"Https:443"},
+				Action:      "Allow",
+				RuleType:    "Application",
+			},
+		},
+		{
+			Name: "application-protocols",
+			rule: AzureFirewallEgressrulesRulesSpec{
+				TargetUrls: []string{"www.contoso.com/Path"},
+				Protocol:   []string{"http", "HTTPS:443", "https", "FTP"},
+				Action:     "Deny",
+			},
+			Expected: AzureFirewallEgressrulesRulesSpec{
+				TargetUrls: []string{"www.contoso.com/Path"},
+				Protocol:   []string{"Http:80", "Https:443", "FTP"},
+				Action:     "Deny",
+				RuleType:   "Application",
+			},
+		},
+		{
+			Name: "network",
+			rule: AzureFirewallEgressrulesRulesSpec{
+				DestinationAddresses: []string{"10.0.0.0/24", " 10.0.0.0/24", "10.0.1.1"},
+				DestinationPorts:     []string{"443"},
+				Protocol:             []string{"tcp", "any"},
+			},
+			Expected: AzureFirewallEgressrulesRulesSpec{
+				DestinationAddresses: []string{"10.0.0.0/24", "10.0.1.1"},
+				DestinationPorts:     []string{"443"},
+				Protocol:             []string{"TCP", "Any"},
+				Action:               "Allow",
+				RuleType:             "Network",
+			},
+		},
+		{
+			Name: "nat",
+			rule: AzureFirewallEgressrulesRulesSpec{
+				DestinationAddresses: []string{"20.0.0.1"},
+				DestinationPorts:     []string{"53"},
+				TranslatedFqdn:       "DNS.Contoso.com",
+				TranslatedPort:       "53",
+				Protocol:             []string{"udp"},
+			},
+			Expected: AzureFirewallEgressrulesRulesSpec{
+				DestinationAddresses: []string{"20.0.0.1"},
+				DestinationPorts:     []string{"53"},
+				TranslatedFqdn:       "dns.contoso.com",
+				TranslatedPort:       "53",
+				Protocol:             []string{"UDP"},
+				Action:               "DNAT",
+				RuleType:             "Nat",
+			},
+		},
+		{
+			Name: "unknown",
+			rule: AzureFirewallEgressrulesRulesSpec{
+				Protocol: []string{"tcp"},
+			},
+			Expected: AzureFirewallEgressrulesRulesSpec{
+				Protocol: []string{"tcp"},
+				Action:   "Allow",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			defaultRule(&tc.rule)
+			if !reflect.DeepEqual(tc.rule, tc.Expected) {
+				t.Errorf("Expected rule %+v, but got: %+v", tc.Expected, tc.rule)
+			}
+		})
+	}
+}
+
+func TestDefaultedRulesAreValid(t *testing.T) {
+	rules := newTestAzureFirewallRules("web",
+		AzureFirewallEgressrulesRulesSpec{RuleCollectionName: "allow-web", Priority: 200, RuleName: "github", TargetFqdns: []string{"GitHub.com"}},
+		AzureFirewallEgressrulesRulesSpec{RuleCollectionName: "allow-dns", Priority: 300, RuleName: "dns", DestinationAddresses: []string{"168.63.129.16"}, DestinationPorts: []string{"53"}, Protocol: []string{"udp"}},
+	)
+	rules.Default()
+	if err := rules.ValidateCreate(); err != nil {
+		t.Errorf("Expected no error, but got: %v", err)
+	}
+}
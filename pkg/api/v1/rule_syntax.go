@@ -0,0 +1,258 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	n "github.com/Azure/azure-sdk-for-go/services/network/mgmt/2021-03-01/network"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// fqdnRegexp matches a fully qualified domain name without wildcard.
+var fqdnRegexp = regexp.MustCompile(`^([A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?\.)*[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?$`)
+
+const maxFqdnLength = 253
+
+// ipGroupNameRegexp matches the name of an Azure IP Group.
+var ipGroupNameRegexp = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9_.-]{0,78}[A-Za-z0-9_])?$`)
+
+// ipGroupIdRegexp matches the resource ID of an Azure IP Group, case insensitive like Azure resource IDs.
+var ipGroupIdRegexp = regexp.MustCompile(`(?i)^/subscriptions/[^/]+/resourceGroups/[^/]+/providers/Microsoft\.Network/ipGroups/([^/]+)$`)
+
+// serviceTagRegexp matches a service tag, optionally scoped to a region, e.g. "AzureKeyVault.WestEurope".
+var serviceTagRegexp = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]*(\.[A-Za-z0-9]+)?$`)
+
+// ParseApplicationProtocol parses a protocol of an Application rule, "HTTP" or "HTTPS" optionally followed by a
+// port, e.g. "HTTPS:8443". The protocol is case insensitive and the port defaults to the port of the protocol.
+func ParseApplicationProtocol(protocol string) (n.FirewallPolicyRuleApplicationProtocolType, int32, error) {
+	name, port, hasPort := strings.Cut(protocol, ":")
+	var protocolType n.FirewallPolicyRuleApplicationProtocolType
+	var defaultPort int32
+	switch strings.ToUpper(name) {
+	case "HTTP":
+		protocolType, defaultPort = n.FirewallPolicyRuleApplicationProtocolTypeHTTP, 80
+	case "HTTPS":
+		protocolType, defaultPort = n.FirewallPolicyRuleApplicationProtocolTypeHTTPS, 443
+	default:
+		return "", 0, fmt.Errorf("protocol must be HTTP or HTTPS, optionally followed by a port, e.g. HTTPS:443")
+	}
+	if !hasPort {
+		return protocolType, defaultPort, nil
+	}
+	value, err := parsePort(port)
+	if err != nil {
+		return "", 0, err
+	}
+	return protocolType, value, nil
+}
+
+// ParseNetworkProtocol parses a protocol of a Network rule: TCP, UDP, ICMP or Any, case insensitive.
+func ParseNetworkProtocol(protocol string) (n.FirewallPolicyRuleNetworkProtocol, error) {
+	for _, networkProtocol := range n.PossibleFirewallPolicyRuleNetworkProtocolValues() {
+		if strings.EqualFold(protocol, string(networkProtocol)) {
+			return networkProtocol, nil
+		}
+	}
+	return "", fmt.Errorf("protocol must be TCP, UDP, ICMP or Any")
+}
+
+// ParseNatProtocol parses a protocol of a Nat rule: TCP or UDP, case insensitive.
+func ParseNatProtocol(protocol string) (n.FirewallPolicyRuleNetworkProtocol, error) {
+	networkProtocol, err := ParseNetworkProtocol(protocol)
+	if err != nil || (networkProtocol != n.FirewallPolicyRuleNetworkProtocolTCP && networkProtocol != n.FirewallPolicyRuleNetworkProtocolUDP) {
+		return "", fmt.Errorf("protocol of a Nat rule must be TCP or UDP")
+	}
+	return networkProtocol, nil
+}
+
+func parsePort(port string) (int32, error) {
+	value, err := strconv.ParseInt(port, 10, 32)
+	if err != nil || value < 1 || value > 65535 {
+		return 0, fmt.Errorf("port must be a number between 1 and 65535")
+	}
+	return int32(value), nil
+}
+
+// validatePortRange accepts "*", a port or a range of ports, e.g. "1000-2000".
+func validatePortRange(ports string) error {
+	if ports == "*" {
+		return nil
+	}
+	first, last, isRange := strings.Cut(ports, "-")
+	start, err := parsePort(first)
+	if err != nil || !isRange {
+		return err
+	}
+	end, err := parsePort(last)
+	if err != nil {
+		return err
+	}
+	if start > end {
+		return fmt.Errorf("the first port of the range must not be greater than the last one")
+	}
+	return nil
+}
+
+// validateAddress accepts "*", an IP address, a CIDR or a range of IP addresses, e.g. "10.0.0.1-10.0.0.9".
+func validateAddress(address string) error {
+	if address == "*" || net.ParseIP(address) != nil {
+		return nil
+	}
+	if _, _, err := net.ParseCIDR(address); err == nil {
+		return nil
+	}
+	first, last, isRange := strings.Cut(address, "-")
+	if isRange {
+		start, end := net.ParseIP(first), net.ParseIP(last)
+		if start == nil || end == nil || (start.To4() == nil) != (end.To4() == nil) {
+			return fmt.Errorf("the range must be made of two IP addresses of the same family")
+		}
+		if start.To4() != nil {
+			start, end = start.To4(), end.To4()
+		}
+		if bytes.Compare(start, end) > 0 {
+			return fmt.Errorf("the first address of the range must not be greater than the last one")
+		}
+		return nil
+	}
+	return fmt.Errorf("address must be *, an IP address, a CIDR or a range of IP addresses")
+}
+
+// validateFqdn accepts a fully qualified domain name. With wildcards, "*" and a leading wildcard, e.g.
+// "*.contoso.com" or "*contoso.com", are accepted too.
+func validateFqdn(fqdn string, wildcards bool) error {
+	name := fqdn
+	if wildcards && name == "*" {
+		return nil
+	}
+	if wildcards && strings.HasPrefix(name, "*") {
+		name = strings.TrimPrefix(strings.TrimPrefix(name, "*"), ".")
+	}
+	if len(name) > maxFqdnLength || !fqdnRegexp.MatchString(name) {
+		if wildcards {
+			return fmt.Errorf("must be a fully qualified domain name, optionally starting with a wildcard, e.g. *.contoso.com")
+		}
+		return fmt.Errorf("must be a fully qualified domain name without wildcard")
+	}
+	return nil
+}
+
+// validateIpGroup accepts the name of an IP Group or its resource ID, e.g.
+// "/subscriptions/<id>/resourceGroups/<name>/providers/Microsoft.Network/ipGroups/<name>".
+func validateIpGroup(ipGroup string) error {
+	name := ipGroup
+	if strings.HasPrefix(ipGroup, "/") {
+		match := ipGroupIdRegexp.FindStringSubmatch(ipGroup)
+		if match == nil {
+			return fmt.Errorf("must be the resource ID of an IP Group, e.g. /subscriptions/<id>/resourceGroups/<name>/providers/Microsoft.Network/ipGroups/<name>")
+		}
+		name = match[1]
+	}
+	if !ipGroupNameRegexp.MatchString(name) {
+		return fmt.Errorf("the name of an IP Group must be 1 to 80 letters, digits, underscores, periods or hyphens, starting with a letter or digit and ending with a letter, digit or underscore")
+	}
+	return nil
+}
+
+// validateServiceTag accepts a service tag, optionally followed by a region, e.g. "AzureKeyVault.WestEurope".
+func validateServiceTag(serviceTag string) error {
+	if !serviceTagRegexp.MatchString(serviceTag) {
+		return fmt.Errorf("must be a service tag, optionally followed by a region, e.g. AzureKeyVault.WestEurope")
+	}
+	return nil
+}
+
+// validateTargetUrl accepts a URL without scheme, e.g. "www.contoso.com/path/*".
+func validateTargetUrl(targetUrl string) error {
+	if strings.Contains(targetUrl, "://") {
+		return fmt.Errorf("must not contain a scheme, e.g. www.contoso.com/path")
+	}
+	host, path, _ := strings.Cut(targetUrl, "/")
+	if err := validateFqdn(host, true); err != nil {
+		return err
+	}
+	if _, err := url.ParseRequestURI("/" + path); err != nil || strings.ContainsAny(path, " \t") {
+		return fmt.Errorf("must be a host followed by an optional path, e.g. www.contoso.com/path")
+	}
+	return nil
+}
+
+// validateRuleSyntax checks the syntax of the addresses, IP Groups, service tags, ports, FQDNs, URLs and protocols of
+// a rule.
+func validateRuleSyntax(rule AzureFirewallEgressrulesRulesSpec, path *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	for _, list := range []struct {
+		name     string
+		values   []string
+		validate func(string) error
+	}{
+		{"destinationAddresses", rule.DestinationAddresses, validateAddress},
+		{"destinationIpGroups", rule.DestinationIPGroups, validateIpGroup},
+		{"destinationServiceTags", rule.DestinationServiceTags, validateServiceTag},
+		{"sourceAddresses", rule.SourceAddresses, validateAddress},
+		{"destinationPorts", rule.DestinationPorts, validatePortRange},
+		{"targetFqdns", rule.TargetFqdns, func(fqdn string) error { return validateFqdn(fqdn, true) }},
+		{"destinationFqdns", rule.DestinationFqdns, func(fqdn string) error { return validateFqdn(fqdn, fqdn == "*") }},
+		{"targetUrls", rule.TargetUrls, validateTargetUrl},
+	} {
+		for i, value := range list.values {
+			if err := list.validate(value); err != nil {
+				allErrs = append(allErrs, field.Invalid(path.Child(list.name).Index(i), value, err.Error()))
+			}
+		}
+	}
+
+	if rule.TranslatedAddress != "" && net.ParseIP(rule.TranslatedAddress) == nil {
+		allErrs = append(allErrs, field.Invalid(path.Child("translatedAddress"), rule.TranslatedAddress, "must be an IP address"))
+	}
+	if rule.TranslatedFqdn != "" {
+		if err := validateFqdn(rule.TranslatedFqdn, false); err != nil {
+			allErrs = append(allErrs, field.Invalid(path.Child("translatedFqdn"), rule.TranslatedFqdn, err.Error()))
+		}
+	}
+	if rule.TranslatedPort != "" {
+		if _, err := parsePort(rule.TranslatedPort); err != nil {
+			allErrs = append(allErrs, field.Invalid(path.Child("translatedPort"), rule.TranslatedPort, err.Error()))
+		}
+	}
+
+	if len(rule.Protocol) == 0 {
+		allErrs = append(allErrs, field.Required(path.Child("protocol"), "at least one protocol must be set"))
+	}
+	for i, protocol := range rule.Protocol {
+		var err error
+		switch rule.RuleType {
+		case RuleTypeApplication:
+			_, _, err = ParseApplicationProtocol(protocol)
+		case RuleTypeNetwork:
+			_, err = ParseNetworkProtocol(protocol)
+		case RuleTypeNat:
+			_, err = ParseNatProtocol(protocol)
+		}
+		if err != nil {
+			allErrs = append(allErrs, field.Invalid(path.Child("protocol").Index(i), protocol, err.Error()))
+		}
+	}
+	return allErrs
+}
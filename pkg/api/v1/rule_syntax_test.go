@@ -0,0 +1,210 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"reflect"
+	"testing"
+
+	n "github.com/Azure/azure-sdk-for-go/services/network/mgmt/2021-03-01/network"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+func newTestNetworkRule(ruleName string) AzureFirewallEgressrulesRulesSpec {
+	return AzureFirewallEgressrulesRulesSpec{
+		RuleCollectionName:   "allow-network",
+		Priority:             300,
+		RuleName:             ruleName,
+		DestinationAddresses: []string{"10.0.0.0/24"},
+		DestinationPorts:     []string{"443"},
+		Protocol:             []string{"TCP"},
+		Action:               "Allow",
+		RuleType:             "Network",
+	}
+}
+
+func TestValidateRuleSyntax(t *testing.T) {
+	type testCase struct {
+		Name     string
+		rule     AzureFirewallEgressrulesRulesSpec
+		Expected []string
+	}
+
+	withRule := func(rule AzureFirewallEgressrulesRulesSpec, update func(*AzureFirewallEgressrulesRulesSpec)) AzureFirewallEgressrulesRulesSpec {
+		update(&rule)
+		return rule
+	}
+	network := newTestNetworkRule("network")
+	application := newTestRule("allow-web", 200, "application")
+
+	testCases := []testCase{
+		{
+			Name: "valid-network",
+			rule: withRule(network, func(r *AzureFirewallEgressrulesRulesSpec) {
+				r.DestinationAddresses = []string{"*", "10.0.0.1", "10.0.0.0/8", "10.0.0.1-10.0.0.9", "fd00::/8", "fd00::1-fd00::9"}
+				r.DestinationPorts = []string{"*", "443", "1000-2000"}
+				r.Protocol = []string{"TCP", "udp", "Any", "ICMP"}
+			}),
+		},
+		{
+			Name: "valid-application",
+			rule: withRule(application, func(r *AzureFirewallEgressrulesRulesSpec) {
+				r.TargetFqdns = []string{"*", "*.contoso.com", "*contoso.com", "www.contoso.com"}
+				r.TargetUrls = []string{"www.contoso.com/path/*", "*.contoso.com", "contoso.com/a?b=c"}
+				r.Protocol = []string{"HTTP", "https:8443"}
+			}),
+		},
+		{
+			Name: "invalid-addresses",
+			rule: withRule(network, func(r *AzureFirewallEgressrulesRulesSpec) {
+				r.DestinationAddresses = []string{"10.0.0.256", "10.0.0.0/33", "10.0.0.9-10.0.0.1", "10.0.0.1-fd00::1", "10.0.0.*"}
+			}),
+			Expected: []string{"network[0].destinationAddresses[0]", "network[0].destinationAddresses[1]", "network[0].destinationAddresses[2]", "network[0].destinationAddresses[3]", "network[0].destinationAddresses[4]"},
+		},
+		{
+			Name: "invalid-ports",
+			rule: withRule(network, func(r *AzureFirewallEgressrulesRulesSpec) {
+				r.DestinationPorts = []string{"0", "65536", "2000-1000", "http", "1000-", "1-2-3"}
+			}),
+			Expected: []string{"network[0].destinationPorts[0]", "network[0].destinationPorts[1]", "network[0].destinationPorts[2]", "network[0].destinationPorts[3]", "network[0].destinationPorts[4]", "network[0].destinationPorts[5]"},
+		},
+		{
+			Name: "invalid-destination-fqdns",
+			rule: withRule(network, func(r *AzureFirewallEgressrulesRulesSpec) {
+				r.DestinationAddresses = nil
+				r.DestinationFqdns = []string{"*", "www.contoso.com", "*.contoso.com", "contoso..com", "-contoso.com"}
+			}),
+			Expected: []string{"network[0].destinationFqdns[2]", "network[0].destinationFqdns[3]", "network[0].destinationFqdns[4]"},
+		},
+		{
+			Name: "valid-ip-groups",
+			rule: withRule(network, func(r *AzureFirewallEgressrulesRulesSpec) {
+				r.DestinationAddresses = nil
+				r.DestinationIPGroups = []string{"shared-services", "ipg_1.v2_", "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Network/ipGroups/shared-services", "/subscriptions/sub/resourcegroups/rg/providers/microsoft.network/ipgroups/shared"}
+			}),
+		},
+		{
+			Name: "invalid-ip-groups",
+			rule: withRule(network, func(r *AzureFirewallEgressrulesRulesSpec) {
+				r.DestinationAddresses = nil
+				r.DestinationIPGroups = []string{"-shared", "shared.", "shared services", "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Network/firewallPolicies/policy", "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Network/ipGroups/-shared"}
+			}),
+			Expected: []string{"network[0].destinationIpGroups[0]", "network[0].destinationIpGroups[1]", "network[0].destinationIpGroups[2]", "network[0].destinationIpGroups[3]", "network[0].destinationIpGroups[4]"},
+		},
+		{
+			Name: "service-tags",
+			rule: withRule(network, func(r *AzureFirewallEgressrulesRulesSpec) {
+				r.DestinationAddresses = nil
+				r.DestinationServiceTags = []string{"AzureKeyVault", "AzureKeyVault.WestEurope", "Storage.", "10.0.0.1", "AzureKeyVault.West Europe"}
+			}),
+			Expected: []string{"network[0].destinationServiceTags[2]", "network[0].destinationServiceTags[3]", "network[0].destinationServiceTags[4]"},
+		},
+		{
+			Name: "invalid-network-protocols",
+			rule: withRule(network, func(r *AzureFirewallEgressrulesRulesSpec) {
+				r.Protocol = []string{"TPC", "HTTPS:443"}
+			}),
+			Expected: []string{"network[0].protocol[0]", "network[0].protocol[1]"},
+		},
+		{
+			Name: "invalid-application",
+			rule: withRule(application, func(r *AzureFirewallEgressrulesRulesSpec) {
+				r.TargetFqdns = []string{"www.*.com", "contoso.com."}
+				r.TargetUrls = []string{"https://www.contoso.com/path", "www.contoso.com/a b", "/path"}
+				r.Protocol = []string{"HTTP", "HTTPS:", "HTTPS:99999", "FTP:21", "MSSQL:1433"}
+			}),
+			Expected: []string{"network[0].targetFqdns[0]", "network[0].targetFqdns[1]", "network[0].targetUrls[0]", "network[0].targetUrls[1]", "network[0].targetUrls[2]", "network[0].protocol[1]", "network[0].protocol[2]", "network[0].protocol[3]", "network[0].protocol[4]"},
+		},
+		{
+			Name: "no-protocol",
+			rule: withRule(application, func(r *AzureFirewallEgressrulesRulesSpec) {
+				r.Protocol = nil
+			}),
+			Expected: []string{"network[0].protocol"},
+		},
+		{
+			Name: "invalid-nat",
+			rule: AzureFirewallEgressrulesRulesSpec{
+				DestinationAddresses: []string{"20.0.0.1"},
+				DestinationPorts:     []string{"443"},
+				SourceAddresses:      []string{"1.2.3.4/40"},
+				TranslatedAddress:    "10.0.0.0/24",
+				TranslatedFqdn:       "*.contoso.com",
+				TranslatedPort:       "8080-8081",
+				Protocol:             []string{"TCP"},
+				Action:               n.FirewallPolicyFilterRuleCollectionActionType(n.FirewallPolicyNatRuleCollectionActionTypeDNAT),
+				RuleType:             RuleTypeNat,
+			},
+			Expected: []string{"network[0].sourceAddresses[0]", "network[0].translatedAddress", "network[0].translatedFqdn", "network[0].translatedPort"},
+		},
+		{
+			Name: "nat-protocols",
+			rule: AzureFirewallEgressrulesRulesSpec{
+				DestinationAddresses: []string{"20.0.0.1"},
+				DestinationPorts:     []string{"53"},
+				TranslatedAddress:    "10.0.0.4",
+				TranslatedPort:       "53",
+				Protocol:             []string{"TCP", "udp", "Any", "ICMP"},
+				Action:               n.FirewallPolicyFilterRuleCollectionActionType(n.FirewallPolicyNatRuleCollectionActionTypeDNAT),
+				RuleType:             RuleTypeNat,
+			},
+			Expected: []string{"network[0].protocol[2]", "network[0].protocol[3]"},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			var fields []string
+			for _, err := range validateRuleSyntax(tc.rule, field.NewPath("network").Index(0)) {
+				fields = append(fields, err.Field)
+			}
+			if !reflect.DeepEqual(fields, tc.Expected) {
+				t.Errorf("Expected invalid fields %v, but got: %v", tc.Expected, fields)
+			}
+		})
+	}
+}
+
+func TestParseApplicationProtocol(t *testing.T) {
+	type testCase struct {
+		protocol     string
+		ExpectedType n.FirewallPolicyRuleApplicationProtocolType
+		ExpectedPort int32
+		ExpectedErr  bool
+	}
+
+	testCases := []testCase{
+		{protocol: "HTTP", ExpectedType: n.FirewallPolicyRuleApplicationProtocolTypeHTTP, ExpectedPort: 80},
+		{protocol: "https", ExpectedType: n.FirewallPolicyRuleApplicationProtocolTypeHTTPS, ExpectedPort: 443},
+		{protocol: "HTTPs:8443", ExpectedType: n.FirewallPolicyRuleApplicationProtocolTypeHTTPS, ExpectedPort: 8443},
+		{protocol: "HTTP:", ExpectedErr: true},
+		{protocol: "HTTP:0", ExpectedErr: true},
+		{protocol: "HTTP:80:80", ExpectedErr: true},
+		{protocol: "TCP", ExpectedErr: true},
+	}
+
+	for _, tc := range testCases {
+		protocolType, port, err := ParseApplicationProtocol(tc.protocol)
+		if (err != nil) != tc.ExpectedErr {
+			t.Errorf("Expected error %v for %q, but got: %v", tc.ExpectedErr, tc.protocol, err)
+		}
+		if protocolType != tc.ExpectedType || port != tc.ExpectedPort {
+			t.Errorf("Expected %s:%d for %q, but got: %s:%d", tc.ExpectedType, tc.ExpectedPort, tc.protocol, protocolType, port)
+		}
+	}
+}
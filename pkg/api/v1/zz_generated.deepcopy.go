@@ -22,9 +22,30 @@ limitations under the License.
 package v1
 
 import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AzureFirewallEgressRuleStatus) DeepCopyInto(out *AzureFirewallEgressRuleStatus) {
+	*out = *in
+	if in.IPGroupIDs != nil {
+		in, out := &in.IPGroupIDs, &out.IPGroupIDs
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AzureFirewallEgressRuleStatus.
+func (in *AzureFirewallEgressRuleStatus) DeepCopy() *AzureFirewallEgressRuleStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(AzureFirewallEgressRuleStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *AzureFirewallEgressRulesSpec) DeepCopyInto(out *AzureFirewallEgressRulesSpec) {
 	*out = *in
@@ -41,6 +62,11 @@ func (in *AzureFirewallEgressRulesSpec) DeepCopyInto(out *AzureFirewallEgressRul
 			}
 		}
 	}
+	if in.NodeLabelSelector != nil {
+		in, out := &in.NodeLabelSelector, &out.NodeLabelSelector
+		*out = new(metav1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
 	if in.Rules != nil {
 		in, out := &in.Rules, &out.Rules
 		*out = make([]AzureFirewallEgressrulesRulesSpec, len(*in))
@@ -78,6 +104,16 @@ func (in *AzureFirewallEgressrulesRulesSpec) DeepCopyInto(out *AzureFirewallEgre
 		*out = make([]string, len(*in))
 		copy(*out, *in)
 	}
+	if in.DestinationIPGroups != nil {
+		in, out := &in.DestinationIPGroups, &out.DestinationIPGroups
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.DestinationServiceTags != nil {
+		in, out := &in.DestinationServiceTags, &out.DestinationServiceTags
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
 	if in.TargetFqdns != nil {
 		in, out := &in.TargetFqdns, &out.TargetFqdns
 		*out = make([]string, len(*in))
@@ -88,6 +124,11 @@ func (in *AzureFirewallEgressrulesRulesSpec) DeepCopyInto(out *AzureFirewallEgre
 		*out = make([]string, len(*in))
 		copy(*out, *in)
 	}
+	if in.SourceAddresses != nil {
+		in, out := &in.SourceAddresses, &out.SourceAddresses
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
 	if in.Protocol != nil {
 		in, out := &in.Protocol, &out.Protocol
 		*out = make([]string, len(*in))
@@ -111,7 +152,7 @@ func (in *AzureFirewallRules) DeepCopyInto(out *AzureFirewallRules) {
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	in.Spec.DeepCopyInto(&out.Spec)
-	out.Status = in.Status
+	in.Status.DeepCopyInto(&out.Status)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AzureFirewallRules.
@@ -167,6 +208,11 @@ func (in *AzureFirewallRulesList) DeepCopyObject() runtime.Object {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *AzureFirewallRulesSpec) DeepCopyInto(out *AzureFirewallRulesSpec) {
 	*out = *in
+	if in.FirewallPolicy != nil {
+		in, out := &in.FirewallPolicy, &out.FirewallPolicy
+		*out = new(FirewallPolicyReference)
+		**out = **in
+	}
 	if in.EgressRules != nil {
 		in, out := &in.EgressRules, &out.EgressRules
 		*out = make([]AzureFirewallEgressRulesSpec, len(*in))
@@ -189,6 +235,20 @@ func (in *AzureFirewallRulesSpec) DeepCopy() *AzureFirewallRulesSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *AzureFirewallRulesStatus) DeepCopyInto(out *AzureFirewallRulesStatus) {
 	*out = *in
+	if in.EgressRules != nil {
+		in, out := &in.EgressRules, &out.EgressRules
+		*out = make([]AzureFirewallEgressRuleStatus, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]metav1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AzureFirewallRulesStatus.
@@ -201,6 +261,108 @@ func (in *AzureFirewallRulesStatus) DeepCopy() *AzureFirewallRulesStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *EgressPolicy) DeepCopyInto(out *EgressPolicy) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new EgressPolicy.
+func (in *EgressPolicy) DeepCopy() *EgressPolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(EgressPolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *EgressPolicy) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *EgressPolicyList) DeepCopyInto(out *EgressPolicyList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]EgressPolicy, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new EgressPolicyList.
+func (in *EgressPolicyList) DeepCopy() *EgressPolicyList {
+	if in == nil {
+		return nil
+	}
+	out := new(EgressPolicyList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *EgressPolicyList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *EgressPolicySpec) DeepCopyInto(out *EgressPolicySpec) {
+	*out = *in
+	in.PodSelector.DeepCopyInto(&out.PodSelector)
+	if in.NamespaceSelector != nil {
+		in, out := &in.NamespaceSelector, &out.NamespaceSelector
+		*out = new(metav1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Rules != nil {
+		in, out := &in.Rules, &out.Rules
+		*out = make([]AzureFirewallEgressrulesRulesSpec, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new EgressPolicySpec.
+func (in *EgressPolicySpec) DeepCopy() *EgressPolicySpec {
+	if in == nil {
+		return nil
+	}
+	out := new(EgressPolicySpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *FirewallPolicyReference) DeepCopyInto(out *FirewallPolicyReference) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FirewallPolicyReference.
+func (in *FirewallPolicyReference) DeepCopy() *FirewallPolicyReference {
+	if in == nil {
+		return nil
+	}
+	out := new(FirewallPolicyReference)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Pair) DeepCopyInto(out *Pair) {
 	*out = *in
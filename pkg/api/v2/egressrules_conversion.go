@@ -0,0 +1,267 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v2
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	v1 "github.com/Azure/azure-firewall-egress-controller/pkg/api/v1"
+	n "github.com/Azure/azure-sdk-for-go/services/network/mgmt/2021-03-01/network"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/conversion"
+)
+
+// LegacyNodeSelectorsAnnotation keeps the v1 nodeSelector of the egress rules, by egress rule name, as v2 only
+// supports label selectors. It is only used while the egress rule has no node selector, or the one converted from
+// the v1 nodeSelector.
+const LegacyNodeSelectorsAnnotation = "egress.azure-firewall-egress-controller.io/v1-node-selectors"
+
+// LegacyProtocolsAnnotation keeps the v1 protocols of the rules having protocols that can't be parsed, by egress rule
+// name then by "<rule collection name>/<rule name>", as v2 only holds parsed protocols. It is only used while the
+// protocols of the rule are the ones converted from the v1 protocols.
+const LegacyProtocolsAnnotation = "egress.azure-firewall-egress-controller.io/v1-protocols"
+
+var _ conversion.Convertible = &AzureFirewallRules{}
+
+// ConvertTo converts the object to v1: every rule of a rule collection becomes a v1 rule carrying the name,
+// priority, action and rule type of the rule collection.
+func (src *AzureFirewallRules) ConvertTo(dstRaw conversion.Hub) error {
+	dst := dstRaw.(*v1.AzureFirewallRules)
+	src = src.DeepCopy()
+
+	legacy := make(map[string][]map[string]string)
+	if raw, ok := src.Annotations[LegacyNodeSelectorsAnnotation]; ok {
+		if err := json.Unmarshal([]byte(raw), &legacy); err != nil {
+			return fmt.Errorf("invalid annotation %s: %w", LegacyNodeSelectorsAnnotation, err)
+		}
+	}
+	legacyProtocols := make(map[string]map[string][]string)
+	if raw, ok := src.Annotations[LegacyProtocolsAnnotation]; ok {
+		if err := json.Unmarshal([]byte(raw), &legacyProtocols); err != nil {
+			return fmt.Errorf("invalid annotation %s: %w", LegacyProtocolsAnnotation, err)
+		}
+	}
+
+	dst.ObjectMeta = src.ObjectMeta
+	delete(dst.Annotations, LegacyNodeSelectorsAnnotation)
+	delete(dst.Annotations, LegacyProtocolsAnnotation)
+	if len(dst.Annotations) == 0 {
+		dst.Annotations = nil
+	}
+
+	dst.Spec = v1.AzureFirewallRulesSpec{FirewallPolicy: (*v1.FirewallPolicyReference)(src.Spec.FirewallPolicy)}
+	for _, egressRule := range src.Spec.EgressRules {
+		v1EgressRule := v1.AzureFirewallEgressRulesSpec{Name: egressRule.Name}
+		if nodeSelector, ok := legacy[egressRule.Name]; ok && (egressRule.NodeSelector == nil || reflect.DeepEqual(egressRule.NodeSelector, labelSelectorOf(nodeSelector))) {
+			v1EgressRule.NodeSelector = nodeSelector
+		} else {
+			v1EgressRule.NodeLabelSelector = egressRule.NodeSelector
+		}
+		for _, ruleCollection := range egressRule.RuleCollections {
+			for _, rule := range ruleCollection.Rules {
+				protocols := protocolStrings(rule.Protocols)
+				if v1Protocols, ok := legacyProtocols[egressRule.Name][ruleKey(ruleCollection.Name, rule.Name)]; ok && reflect.DeepEqual(rule.Protocols, protocolsOf(v1.RuleType(ruleCollection.RuleType), v1Protocols)) {
+					protocols = v1Protocols
+				}
+				v1EgressRule.Rules = append(v1EgressRule.Rules, v1.AzureFirewallEgressrulesRulesSpec{
+					RuleCollectionName:     ruleCollection.Name,
+					Priority:               ruleCollection.Priority,
+					RuleName:               rule.Name,
+					DestinationAddresses:   rule.DestinationAddresses,
+					DestinationPorts:       rule.DestinationPorts,
+					DestinationFqdns:       rule.DestinationFqdns,
+					DestinationIPGroups:    rule.DestinationIPGroups,
+					DestinationServiceTags: rule.DestinationServiceTags,
+					TargetFqdns:            rule.TargetFqdns,
+					TargetUrls:             rule.TargetUrls,
+					SourceAddresses:        rule.SourceAddresses,
+					TranslatedAddress:      rule.TranslatedAddress,
+					TranslatedFqdn:         rule.TranslatedFqdn,
+					TranslatedPort:         rule.TranslatedPort,
+					Protocol:               protocols,
+					Action:                 n.FirewallPolicyFilterRuleCollectionActionType(ruleCollection.Action),
+					RuleType:               v1.RuleType(ruleCollection.RuleType),
+				})
+			}
+		}
+		dst.Spec.EgressRules = append(dst.Spec.EgressRules, v1EgressRule)
+	}
+
+	dst.Status = v1.AzureFirewallRulesStatus{
+		ObservedGeneration:      src.Status.ObservedGeneration,
+		RuleCollectionGroupETag: src.Status.RuleCollectionGroupETag,
+		Conditions:              src.Status.Conditions,
+	}
+	for _, status := range src.Status.EgressRules {
+		dst.Status.EgressRules = append(dst.Status.EgressRules, v1.AzureFirewallEgressRuleStatus(status))
+	}
+	return nil
+}
+
+// ConvertFrom converts the object from v1: the v1 rules are grouped by rule collection name, in the order the rule
+// collections first appear. Protocols that can't be parsed are dropped, as the controller skips them, and the v1
+// protocols of their rule are kept in an annotation so that the object converts back unchanged.
+func (dst *AzureFirewallRules) ConvertFrom(srcRaw conversion.Hub) error {
+	src := srcRaw.(*v1.AzureFirewallRules).DeepCopy()
+
+	legacy := make(map[string][]map[string]string)
+	legacyProtocols := make(map[string]map[string][]string)
+	dst.ObjectMeta = src.ObjectMeta
+	dst.Spec = AzureFirewallRulesSpec{FirewallPolicy: (*FirewallPolicyReference)(src.Spec.FirewallPolicy)}
+	for _, v1EgressRule := range src.Spec.EgressRules {
+		egressRule := EgressRule{Name: v1EgressRule.Name, NodeSelector: v1EgressRule.NodeLabelSelector}
+		if len(v1EgressRule.NodeSelector) != 0 {
+			legacy[v1EgressRule.Name] = v1EgressRule.NodeSelector
+			egressRule.NodeSelector = labelSelectorOf(v1EgressRule.NodeSelector)
+		}
+		ruleCollections := make(map[string]int)
+		for _, rule := range v1EgressRule.Rules {
+			i, ok := ruleCollections[rule.RuleCollectionName]
+			if !ok {
+				i = len(egressRule.RuleCollections)
+				ruleCollections[rule.RuleCollectionName] = i
+				egressRule.RuleCollections = append(egressRule.RuleCollections, RuleCollection{
+					Name:     rule.RuleCollectionName,
+					Priority: rule.Priority,
+					Action:   Action(rule.Action),
+					RuleType: RuleType(rule.RuleType),
+				})
+			}
+			protocols := protocolsOf(rule.RuleType, rule.Protocol)
+			if len(protocols) != len(rule.Protocol) {
+				if legacyProtocols[v1EgressRule.Name] == nil {
+					legacyProtocols[v1EgressRule.Name] = make(map[string][]string)
+				}
+				legacyProtocols[v1EgressRule.Name][ruleKey(rule.RuleCollectionName, rule.RuleName)] = rule.Protocol
+			}
+			egressRule.RuleCollections[i].Rules = append(egressRule.RuleCollections[i].Rules, Rule{
+				Name:                   rule.RuleName,
+				DestinationAddresses:   rule.DestinationAddresses,
+				DestinationPorts:       rule.DestinationPorts,
+				DestinationFqdns:       rule.DestinationFqdns,
+				DestinationIPGroups:    rule.DestinationIPGroups,
+				DestinationServiceTags: rule.DestinationServiceTags,
+				TargetFqdns:            rule.TargetFqdns,
+				TargetUrls:             rule.TargetUrls,
+				SourceAddresses:        rule.SourceAddresses,
+				TranslatedAddress:      rule.TranslatedAddress,
+				TranslatedFqdn:         rule.TranslatedFqdn,
+				TranslatedPort:         rule.TranslatedPort,
+				Protocols:              protocols,
+			})
+		}
+		dst.Spec.EgressRules = append(dst.Spec.EgressRules, egressRule)
+	}
+
+	delete(dst.Annotations, LegacyNodeSelectorsAnnotation)
+	delete(dst.Annotations, LegacyProtocolsAnnotation)
+	if len(legacy) != 0 {
+		if err := dst.setAnnotation(LegacyNodeSelectorsAnnotation, legacy); err != nil {
+			return err
+		}
+	}
+	if len(legacyProtocols) != 0 {
+		if err := dst.setAnnotation(LegacyProtocolsAnnotation, legacyProtocols); err != nil {
+			return err
+		}
+	}
+
+	dst.Status = AzureFirewallRulesStatus{
+		ObservedGeneration:      src.Status.ObservedGeneration,
+		RuleCollectionGroupETag: src.Status.RuleCollectionGroupETag,
+		Conditions:              src.Status.Conditions,
+	}
+	for _, status := range src.Status.EgressRules {
+		dst.Status.EgressRules = append(dst.Status.EgressRules, EgressRuleStatus(status))
+	}
+	return nil
+}
+
+// setAnnotation sets the annotation to the value marshaled as JSON.
+func (dst *AzureFirewallRules) setAnnotation(key string, value interface{}) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	if dst.Annotations == nil {
+		dst.Annotations = make(map[string]string)
+	}
+	dst.Annotations[key] = string(raw)
+	return nil
+}
+
+// ruleKey returns the key of a rule in LegacyProtocolsAnnotation. Azure names can't contain a slash.
+func ruleKey(ruleCollectionName string, ruleName string) string {
+	return ruleCollectionName + "/" + ruleName
+}
+
+// labelSelectorOf returns the label selector equivalent to a v1 nodeSelector. A v1 nodeSelector with several labels
+// selects the nodes having any of them, which a label selector can't express, so it only has an equivalent when it
+// has a single label.
+func labelSelectorOf(nodeSelector []map[string]string) *metav1.LabelSelector {
+	var matchLabels map[string]string
+	for _, m := range nodeSelector {
+		for k, v := range m {
+			if matchLabels != nil {
+				return nil
+			}
+			matchLabels = map[string]string{k: v}
+		}
+	}
+	if matchLabels == nil {
+		return nil
+	}
+	return &metav1.LabelSelector{MatchLabels: matchLabels}
+}
+
+// protocolsOf parses the v1 protocols of a rule.
+func protocolsOf(ruleType v1.RuleType, protocols []string) []Protocol {
+	if protocols == nil {
+		return nil
+	}
+	parsed := []Protocol{}
+	for _, protocol := range protocols {
+		if ruleType != v1.RuleTypeNetwork && ruleType != v1.RuleTypeNat {
+			if protocolType, port, err := v1.ParseApplicationProtocol(protocol); err == nil {
+				parsed = append(parsed, Protocol{Type: ProtocolType(protocolType), Port: port})
+				continue
+			}
+		}
+		if networkProtocol, err := v1.ParseNetworkProtocol(protocol); err == nil {
+			parsed = append(parsed, Protocol{Type: ProtocolType(networkProtocol)})
+		}
+	}
+	return parsed
+}
+
+// protocolStrings formats the protocols of a rule as v1 protocols, e.g. "Https:443".
+func protocolStrings(protocols []Protocol) []string {
+	if protocols == nil {
+		return nil
+	}
+	formatted := []string{}
+	for _, protocol := range protocols {
+		if protocol.Port != 0 {
+			formatted = append(formatted, fmt.Sprintf("%s:%d", protocol.Type, protocol.Port))
+		} else {
+			formatted = append(formatted, string(protocol.Type))
+		}
+	}
+	return formatted
+}
@@ -0,0 +1,240 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v2
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	v1 "github.com/Azure/azure-firewall-egress-controller/pkg/api/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newTestV1Rules() *v1.AzureFirewallRules {
+	return &v1.AzureFirewallRules{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Annotations: map[string]string{"team": "web"}},
+		Spec: v1.AzureFirewallRulesSpec{
+			EgressRules: []v1.AzureFirewallEgressRulesSpec{
+				{
+					Name:         "legacy",
+					NodeSelector: []map[string]string{{"app": "web", "tier": "front"}, {"app": "api"}},
+					Rules: []v1.AzureFirewallEgressrulesRulesSpec{
+						{RuleCollectionName: "allow-web", Priority: 200, RuleName: "github", TargetFqdns: []string{"github.com"}, Protocol: []string{"Https:443", "Http:8080"}, Action: "Allow", RuleType: "Application"},
+						{RuleCollectionName: "allow-dns", Priority: 300, RuleName: "dns", DestinationAddresses: []string{"168.63.129.16"}, DestinationPorts: []string{"53"}, Protocol: []string{"UDP", "TCP"}, Action: "Allow", RuleType: "Network"},
+						{RuleCollectionName: "allow-web", Priority: 200, RuleName: "gitlab", TargetUrls: []string{"gitlab.com/org/*"}, Protocol: []string{"Https:443"}, Action: "Allow", RuleType: "Application"},
+						{RuleCollectionName: "allow-dns", Priority: 300, RuleName: "key-vault", DestinationServiceTags: []string{"AzureKeyVault.WestEurope"}, DestinationPorts: []string{"443"}, Protocol: []string{"TCP"}, Action: "Allow", RuleType: "Network"},
+						{RuleCollectionName: "allow-dns", Priority: 300, RuleName: "shared", DestinationIPGroups: []string{"shared-services"}, DestinationPorts: []string{"*"}, Protocol: []string{"Any"}, Action: "Allow", RuleType: "Network"},
+					},
+				},
+				{
+					Name:              "selector",
+					NodeLabelSelector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "pool", Operator: metav1.LabelSelectorOpIn, Values: []string{"egress"}}}},
+					Rules: []v1.AzureFirewallEgressrulesRulesSpec{
+						{RuleCollectionName: "dnat", Priority: 400, RuleName: "https", DestinationAddresses: []string{"20.0.0.1"}, DestinationPorts: []string{"443"}, TranslatedAddress: "10.240.0.100", TranslatedPort: "8443", Protocol: []string{"TCP"}, Action: "DNAT", RuleType: "Nat"},
+					},
+				},
+				{
+					Name:         "single",
+					NodeSelector: []map[string]string{{"app": "batch"}},
+					Rules: []v1.AzureFirewallEgressrulesRulesSpec{
+						{RuleCollectionName: "deny-all", Priority: 500, RuleName: "all", DestinationAddresses: []string{"*"}, DestinationPorts: []string{"*"}, Protocol: []string{"Any"}, Action: "Deny", RuleType: "Network"},
+					},
+				},
+			},
+		},
+		Status: v1.AzureFirewallRulesStatus{
+			ObservedGeneration: 3,
+			EgressRules:        []v1.AzureFirewallEgressRuleStatus{{Name: "legacy", IPGroupIDs: []string{"ipgroup-1"}}},
+			Conditions:         []metav1.Condition{{Type: v1.ConditionTypeReady, Status: metav1.ConditionTrue}},
+		},
+	}
+}
+
+func TestConvertFromV1(t *testing.T) {
+	rules := &AzureFirewallRules{}
+	if err := rules.ConvertFrom(newTestV1Rules()); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	legacy := rules.Spec.EgressRules[0]
+	if legacy.NodeSelector != nil {
+		t.Errorf("Expected no node selector for a v1 nodeSelector with several labels, but got: %v", legacy.NodeSelector)
+	}
+	expectedRuleCollections := []RuleCollection{
+		{Name: "allow-web", Priority: 200, Action: ActionAllow, RuleType: RuleTypeApplication, Rules: []Rule{
+			{Name: "github", TargetFqdns: []string{"github.com"}, Protocols: []Protocol{{Type: ProtocolTypeHttps, Port: 443}, {Type: ProtocolTypeHttp, Port: 8080}}},
+			{Name: "gitlab", TargetUrls: []string{"gitlab.com/org/*"}, Protocols: []Protocol{{Type: ProtocolTypeHttps, Port: 443}}},
+		}},
+		{Name: "allow-dns", Priority: 300, Action: ActionAllow, RuleType: RuleTypeNetwork, Rules: []Rule{
+			{Name: "dns", DestinationAddresses: []string{"168.63.129.16"}, DestinationPorts: []string{"53"}, Protocols: []Protocol{{Type: ProtocolTypeUDP}, {Type: ProtocolTypeTCP}}},
+			{Name: "key-vault", DestinationServiceTags: []string{"AzureKeyVault.WestEurope"}, DestinationPorts: []string{"443"}, Protocols: []Protocol{{Type: ProtocolTypeTCP}}},
+			{Name: "shared", DestinationIPGroups: []string{"shared-services"}, DestinationPorts: []string{"*"}, Protocols: []Protocol{{Type: ProtocolTypeAny}}},
+		}},
+	}
+	if !reflect.DeepEqual(legacy.RuleCollections, expectedRuleCollections) {
+		t.Errorf("Expected rule collections %+v, but got: %+v", expectedRuleCollections, legacy.RuleCollections)
+	}
+
+	expectedSelector := &metav1.LabelSelector{MatchLabels: map[string]string{"app": "batch"}}
+	if single := rules.Spec.EgressRules[2]; !reflect.DeepEqual(single.NodeSelector, expectedSelector) {
+		t.Errorf("Expected node selector %v, but got: %v", expectedSelector, single.NodeSelector)
+	}
+	expectedAnnotation := `{"legacy":[{"app":"web","tier":"front"},{"app":"api"}],"single":[{"app":"batch"}]}`
+	if annotation := rules.Annotations[LegacyNodeSelectorsAnnotation]; annotation != expectedAnnotation {
+		t.Errorf("Expected annotation %s, but got: %s", expectedAnnotation, annotation)
+	}
+}
+
+func TestConvertRoundTrip(t *testing.T) {
+	expected := newTestV1Rules()
+	rules := &AzureFirewallRules{}
+	if err := rules.ConvertFrom(expected.DeepCopy()); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	converted := &v1.AzureFirewallRules{}
+	if err := rules.ConvertTo(converted); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	// The rules are grouped by rule collection.
+	legacyRules := expected.Spec.EgressRules[0].Rules
+	expected.Spec.EgressRules[0].Rules = []v1.AzureFirewallEgressrulesRulesSpec{legacyRules[0], legacyRules[2], legacyRules[1], legacyRules[3], legacyRules[4]}
+	if !reflect.DeepEqual(converted, expected) {
+		t.Errorf("Expected %+v, but got: %+v", expected, converted)
+	}
+}
+
+func TestConvertToV1WithChangedNodeSelector(t *testing.T) {
+	rules := &AzureFirewallRules{}
+	if err := rules.ConvertFrom(newTestV1Rules()); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	selector := &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}}
+	rules.Spec.EgressRules[0].NodeSelector = selector
+
+	converted := &v1.AzureFirewallRules{}
+	if err := rules.ConvertTo(converted); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if egressRule := converted.Spec.EgressRules[0]; egressRule.NodeSelector != nil || !reflect.DeepEqual(egressRule.NodeLabelSelector, selector) {
+		t.Errorf("Expected node label selector %v, but got: %v / %v", selector, egressRule.NodeSelector, egressRule.NodeLabelSelector)
+	}
+	if egressRule := converted.Spec.EgressRules[2]; !reflect.DeepEqual(egressRule.NodeSelector, []map[string]string{{"app": "batch"}}) {
+		t.Errorf("Expected the v1 nodeSelector to be kept, but got: %v", egressRule.NodeSelector)
+	}
+	if _, ok := converted.Annotations[LegacyNodeSelectorsAnnotation]; ok {
+		t.Errorf("Expected no annotation %s in v1", LegacyNodeSelectorsAnnotation)
+	}
+}
+
+func TestConvertUnparsableProtocols(t *testing.T) {
+	expected := newTestV1Rules()
+	expected.Spec.EgressRules[2].Rules[0].Protocol = []string{"Any", "Gre"}
+	rules := &AzureFirewallRules{}
+	if err := rules.ConvertFrom(expected.DeepCopy()); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if protocols := rules.Spec.EgressRules[2].RuleCollections[0].Rules[0].Protocols; !reflect.DeepEqual(protocols, []Protocol{{Type: ProtocolTypeAny}}) {
+		t.Errorf("Expected the protocols that can't be parsed to be dropped, but got: %+v", protocols)
+	}
+	expectedAnnotation := `{"single":{"deny-all/all":["Any","Gre"]}}`
+	if annotation := rules.Annotations[LegacyProtocolsAnnotation]; annotation != expectedAnnotation {
+		t.Errorf("Expected annotation %s, but got: %s", expectedAnnotation, annotation)
+	}
+
+	converted := &v1.AzureFirewallRules{}
+	if err := rules.ConvertTo(converted); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if protocols := converted.Spec.EgressRules[2].Rules[0].Protocol; !reflect.DeepEqual(protocols, []string{"Any", "Gre"}) {
+		t.Errorf("Expected the v1 protocols to be kept, but got: %v", protocols)
+	}
+	if _, ok := converted.Annotations[LegacyProtocolsAnnotation]; ok {
+		t.Errorf("Expected no annotation %s in v1", LegacyProtocolsAnnotation)
+	}
+
+	rules.Spec.EgressRules[2].RuleCollections[0].Rules[0].Protocols = []Protocol{{Type: ProtocolTypeTCP}}
+	converted = &v1.AzureFirewallRules{}
+	if err := rules.ConvertTo(converted); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if protocols := converted.Spec.EgressRules[2].Rules[0].Protocol; !reflect.DeepEqual(protocols, []string{"TCP"}) {
+		t.Errorf("Expected the changed protocols, but got: %v", protocols)
+	}
+}
+
+func newTestRules(ruleCollections ...RuleCollection) *AzureFirewallRules {
+	return &AzureFirewallRules{
+		ObjectMeta: metav1.ObjectMeta{Name: "web"},
+		Spec: AzureFirewallRulesSpec{
+			EgressRules: []EgressRule{
+				{
+					Name:            "egress",
+					NodeSelector:    &metav1.LabelSelector{MatchLabels: map[string]string{"app": "service"}},
+					RuleCollections: ruleCollections,
+				},
+			},
+		},
+	}
+}
+
+func TestDefault(t *testing.T) {
+	rules := newTestRules(RuleCollection{Name: "allow-web", Priority: 200, RuleType: RuleTypeApplication, Rules: []Rule{
+		{Name: "github", TargetFqdns: []string{"GitHub.com", "github.com"}},
+	}})
+	rules.Default()
+
+	expected := newTestRules(RuleCollection{Name: "allow-web", Priority: 200, Action: ActionAllow, RuleType: RuleTypeApplication, Rules: []Rule{
+		{Name: "github", TargetFqdns: []string{"github.com"}, Protocols: []Protocol{{Type: ProtocolTypeHttps, Port: 443}}},
+	}})
+	if !reflect.DeepEqual(rules, expected) {
+		t.Errorf("Expected %+v, but got: %+v", expected, rules)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	rules := newTestRules(
+		RuleCollection{Name: "allow-web", Priority: 200, Action: ActionAllow, RuleType: RuleTypeApplication, Rules: []Rule{
+			{Name: "github", TargetFqdns: []string{"github.com"}, Protocols: []Protocol{{Type: ProtocolTypeHttps, Port: 443}}},
+			{Name: "github", TargetFqdns: []string{"https://gitlab.com"}, Protocols: []Protocol{{Type: ProtocolTypeTCP}}},
+		}},
+		RuleCollection{Name: "allow-dns", Priority: 200, Action: ActionAllow, RuleType: RuleTypeNetwork, Rules: []Rule{
+			{Name: "dns", DestinationAddresses: []string{"168.63.129.16"}, DestinationPorts: []string{"53"}, Protocols: []Protocol{{Type: ProtocolTypeUDP}}},
+		}},
+	)
+
+	err := rules.ValidateCreate()
+	var statusErr *apierrors.StatusError
+	if !errors.As(err, &statusErr) || statusErr.ErrStatus.Details == nil {
+		t.Fatalf("Expected an invalid error, but got: %v", err)
+	}
+	var fields []string
+	for _, cause := range statusErr.ErrStatus.Details.Causes {
+		fields = append(fields, cause.Field)
+	}
+	expected := []string{
+		"spec.egressRules[0].ruleCollections[0].rules[1].name",
+		"spec.egressRules[0].ruleCollections[0].rules[1].targetFqdns[0]",
+		"spec.egressRules[0].ruleCollections[0].rules[1].protocols[0]",
+		"spec.egressRules[0].ruleCollections[1].priority",
+	}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Errorf("Expected invalid fields %v, but got: %v (%v)", expected, fields, err)
+	}
+}
@@ -0,0 +1,225 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v2
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// AzureFirewallRulesSpec defines the desired state of azureFirewallRules
+type AzureFirewallRulesSpec struct {
+	// FirewallPolicy is the rule collection group the rules are applied to.
+	// When omitted the rule collection group configured in the controller is used.
+	// +optional
+	FirewallPolicy *FirewallPolicyReference `json:"firewallPolicy,omitempty"`
+	// EgressRules are the rule collections applied to the egress traffic of groups of nodes.
+	// +optional
+	EgressRules []EgressRule `json:"egressRules,omitempty"`
+}
+
+// FirewallPolicyReference identifies a rule collection group of an Azure Firewall Policy
+type FirewallPolicyReference struct {
+	// ResourceID is the resource ID of the firewall policy.
+	// +kubebuilder:validation:Required
+	ResourceID string `json:"resourceId"`
+	// RuleCollectionGroup is the name of the rule collection group managed by the controller.
+	// +kubebuilder:validation:Required
+	RuleCollectionGroup string `json:"ruleCollectionGroup"`
+	// RuleCollectionGroupPriority is the priority of the rule collection group.
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:Minimum=100
+	// +kubebuilder:validation:Maximum=65000
+	RuleCollectionGroupPriority int32 `json:"ruleCollectionGroupPriority"`
+}
+
+// EgressRule applies rule collections to the egress traffic of the nodes matching a label selector.
+type EgressRule struct {
+	// +kubebuilder:validation:Required
+	Name string `json:"name"`
+	// NodeSelector selects the nodes whose IPs are the source of the rules. Every distinct selector has its own
+	// IP Group.
+	// +optional
+	NodeSelector *metav1.LabelSelector `json:"nodeSelector,omitempty"`
+	// +kubebuilder:validation:Required
+	RuleCollections []RuleCollection `json:"ruleCollections"`
+}
+
+// RuleType is the type of the rules of a rule collection.
+// +kubebuilder:validation:Enum=Application;Network;Nat
+type RuleType string
+
+const (
+	// RuleTypeApplication filters the HTTP and HTTPS traffic by FQDN or URL.
+	RuleTypeApplication RuleType = "Application"
+	// RuleTypeNetwork filters the traffic by destination address, FQDN, port and IP protocol.
+	RuleTypeNetwork RuleType = "Network"
+	// RuleTypeNat forwards the inbound traffic of the firewall to a translated address.
+	RuleTypeNat RuleType = "Nat"
+)
+
+// Action is the action of a rule collection.
+// +kubebuilder:validation:Enum=Allow;Deny;DNAT
+type Action string
+
+const (
+	ActionAllow Action = "Allow"
+	ActionDeny  Action = "Deny"
+	ActionDNAT  Action = "DNAT"
+)
+
+// RuleCollection is a rule collection of the firewall policy. The rule collections with the same name are merged
+// into a single one, so they must have the same priority, action and rule type.
+type RuleCollection struct {
+	// +kubebuilder:validation:Required
+	Name string `json:"name"`
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:Minimum=100
+	// +kubebuilder:validation:Maximum=65000
+	Priority int32 `json:"priority"`
+	// Action defaults to DNAT for Nat rules and to Allow for the other rules.
+	// +optional
+	Action Action `json:"action,omitempty"`
+	// +kubebuilder:validation:Required
+	RuleType RuleType `json:"ruleType"`
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MinItems=1
+	Rules []Rule `json:"rules"`
+}
+
+// Rule is a rule of a rule collection. The fields a rule supports depend on the rule type of its collection.
+type Rule struct {
+	// +kubebuilder:validation:Required
+	Name string `json:"name"`
+	// DestinationAddresses are IP addresses, CIDRs or ranges of IP addresses, e.g. "10.0.0.1-10.0.0.9", or "*".
+	// +kubebuilder:validation:MaxItems=1000
+	DestinationAddresses []string `json:"destinationAddresses,omitempty"`
+	// DestinationPorts are ports or ranges of ports, e.g. "1000-2000", or "*".
+	// +kubebuilder:validation:MaxItems=100
+	DestinationPorts []string `json:"destinationPorts,omitempty"`
+	// DestinationFqdns are the FQDNs of a Network rule, without wildcard, or "*".
+	// +kubebuilder:validation:MaxItems=1000
+	DestinationFqdns []string `json:"destinationFqdns,omitempty"`
+	// DestinationIPGroups are the IP Groups of a Network rule, by name in the resource group of the firewall policy
+	// or by resource ID.
+	// +kubebuilder:validation:MaxItems=200
+	DestinationIPGroups []string `json:"destinationIpGroups,omitempty"`
+	// DestinationServiceTags are the service tags of a Network rule, e.g. "AzureKeyVault" or "AzureKeyVault.WestEurope".
+	// +kubebuilder:validation:MaxItems=1000
+	DestinationServiceTags []string `json:"destinationServiceTags,omitempty"`
+	// TargetFqdns are the FQDNs of an Application rule, optionally starting with a wildcard, e.g. "*.contoso.com".
+	// +kubebuilder:validation:MaxItems=1000
+	TargetFqdns []string `json:"targetFqdns,omitempty"`
+	// TargetUrls are the URLs of an Application rule, without scheme, e.g. "www.contoso.com/path/*".
+	// +kubebuilder:validation:MaxItems=1000
+	TargetUrls []string `json:"targetUrls,omitempty"`
+	// SourceAddresses are the clients allowed by a Nat rule. Defaults to any source.
+	// +kubebuilder:validation:MaxItems=1000
+	SourceAddresses []string `json:"sourceAddresses,omitempty"`
+	// TranslatedAddress is the address the traffic matching a Nat rule is forwarded to.
+	TranslatedAddress string `json:"translatedAddress,omitempty"`
+	// TranslatedFqdn is the FQDN the traffic matching a Nat rule is forwarded to.
+	TranslatedFqdn string `json:"translatedFqdn,omitempty"`
+	// TranslatedPort is the port the traffic matching a Nat rule is forwarded to.
+	TranslatedPort string `json:"translatedPort,omitempty"`
+	// Protocols default to HTTPS on port 443 for Application rules.
+	// +optional
+	Protocols []Protocol `json:"protocols,omitempty"`
+}
+
+// ProtocolType is a protocol matched by a rule: Http or Https for Application rules, TCP, UDP, ICMP or Any for
+// Network rules and TCP or UDP for Nat rules.
+// +kubebuilder:validation:Enum=Http;Https;TCP;UDP;ICMP;Any
+type ProtocolType string
+
+const (
+	ProtocolTypeHttp  ProtocolType = "Http"
+	ProtocolTypeHttps ProtocolType = "Https"
+	ProtocolTypeTCP   ProtocolType = "TCP"
+	ProtocolTypeUDP   ProtocolType = "UDP"
+	ProtocolTypeICMP  ProtocolType = "ICMP"
+	ProtocolTypeAny   ProtocolType = "Any"
+)
+
+// Protocol is a protocol matched by a rule.
+type Protocol struct {
+	// +kubebuilder:validation:Required
+	Type ProtocolType `json:"type"`
+	// Port is the port of an Http or Https protocol. Defaults to the port of the protocol.
+	// +optional
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	Port int32 `json:"port,omitempty"`
+}
+
+// AzureFirewallRulesStatus defines the observed state of azureFirewallRules
+type AzureFirewallRulesStatus struct {
+	// ObservedGeneration is the most recent generation processed by the controller.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// RuleCollectionGroupETag is the ETag of the last applied rule collection group.
+	// +optional
+	RuleCollectionGroupETag string `json:"ruleCollectionGroupEtag,omitempty"`
+	// EgressRules holds the sync state of each egress rule.
+	// +optional
+	EgressRules []EgressRuleStatus `json:"egressRules,omitempty"`
+	// Conditions represent the latest available observations of the object's state.
+	// +optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+}
+
+// EgressRuleStatus defines the observed state of a single egress rule
+type EgressRuleStatus struct {
+	Name string `json:"name"`
+	// IPGroupIDs are the resource IDs of the IP Groups resolved from the node selector.
+	// +optional
+	IPGroupIDs []string `json:"ipGroupIds,omitempty"`
+	// Error is the last error encountered while processing the egress rule.
+	// +optional
+	Error string `json:"error,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:resource:scope=Cluster
+//+kubebuilder:storageversion
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Ready",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].status"
+//+kubebuilder:printcolumn:name="Synced",type="string",JSONPath=".status.conditions[?(@.type==\"Synced\")].status"
+//+kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+
+// AzureFirewallRules is the Schema for the azureFirewallRules API
+type AzureFirewallRules struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   AzureFirewallRulesSpec   `json:"spec,omitempty"`
+	Status AzureFirewallRulesStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// AzureFirewallRulesList contains a list of azureFirewallRules
+type AzureFirewallRulesList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []AzureFirewallRules `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&AzureFirewallRules{}, &AzureFirewallRulesList{})
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v2
+
+import (
+	"strings"
+
+	v1 "github.com/Azure/azure-firewall-egress-controller/pkg/api/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+)
+
+// log is for logging in this package.
+var azurefirewallruleslog = logf.Log.WithName("azurefirewallrules-resource")
+
+func (r *AzureFirewallRules) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		Complete()
+}
+
+//+kubebuilder:webhook:path=/mutate-egress-azure-firewall-egress-controller-io-v2-azurefirewallrules,mutating=true,failurePolicy=fail,sideEffects=None,groups=egress.azure-firewall-egress-controller.io,resources=azurefirewallrules,verbs=create;update,versions=v2,name=mazurefirewallrules-v2.kb.io,admissionReviewVersions=v1
+
+var _ webhook.Defaulter = &AzureFirewallRules{}
+
+// Default implements webhook.Defaulter so a webhook will be registered for the type. The object gets the same
+// defaults as in v1.
+func (r *AzureFirewallRules) Default() {
+	azurefirewallruleslog.Info("default", "name", r.Name)
+
+	hub := &v1.AzureFirewallRules{}
+	if err := r.ConvertTo(hub); err != nil {
+		azurefirewallruleslog.Error(err, "unable to default", "name", r.Name)
+		return
+	}
+	hub.Default()
+	if err := r.ConvertFrom(hub); err != nil {
+		azurefirewallruleslog.Error(err, "unable to default", "name", r.Name)
+	}
+}
+
+//+kubebuilder:webhook:path=/validate-egress-azure-firewall-egress-controller-io-v2-azurefirewallrules,mutating=false,failurePolicy=fail,sideEffects=None,groups=egress.azure-firewall-egress-controller.io,resources=azurefirewallrules,verbs=create;update;delete,versions=v2,name=vazurefirewallrules-v2.kb.io,admissionReviewVersions=v1
+
+var _ webhook.Validator = &AzureFirewallRules{}
+
+// ValidateCreate implements webhook.Validator so a webhook will be registered for the type
+func (r *AzureFirewallRules) ValidateCreate() error {
+	azurefirewallruleslog.Info("validate create", "name", r.Name)
+
+	return r.validate()
+}
+
+// ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
+func (r *AzureFirewallRules) ValidateUpdate(old runtime.Object) error {
+	azurefirewallruleslog.Info("validate update", "name", r.Name)
+
+	// The finalizer of a deleted object is removed whether the object is still valid or not.
+	if !r.DeletionTimestamp.IsZero() {
+		return nil
+	}
+	return r.validate()
+}
+
+// ValidateDelete implements webhook.Validator so a webhook will be registered for the type
+func (r *AzureFirewallRules) ValidateDelete() error {
+	azurefirewallruleslog.Info("validate delete", "name", r.Name)
+
+	return v1.ValidateDeletion(GroupVersion.WithResource("azurefirewallrules").GroupResource(), r)
+}
+
+// validate runs the v1 validation on the converted object and reports the errors on the v2 fields.
+func (r *AzureFirewallRules) validate() error {
+	hub := &v1.AzureFirewallRules{}
+	if err := r.ConvertTo(hub); err != nil {
+		return apierrors.NewBadRequest(err.Error())
+	}
+	allErrs := hub.ValidationErrors()
+	if len(allErrs) == 0 {
+		return nil
+	}
+	for _, err := range allErrs {
+		err.Field = r.fieldOf(err.Field)
+	}
+	return apierrors.NewInvalid(GroupVersion.WithKind("AzureFirewallRules").GroupKind(), r.Name, allErrs)
+}
+
+// fieldOf returns the v2 field of a field of the converted v1 object.
+func (r *AzureFirewallRules) fieldOf(v1Field string) string {
+	for i, egressRule := range r.Spec.EgressRules {
+		egressRulePath := field.NewPath("spec", "egressRules").Index(i)
+		if v1Field == egressRulePath.Child("nodeLabelSelector").String() {
+			return egressRulePath.Child("nodeSelector").String()
+		}
+		j := 0
+		for k, ruleCollection := range egressRule.RuleCollections {
+			ruleCollectionPath := egressRulePath.Child("ruleCollections").Index(k)
+			for l := range ruleCollection.Rules {
+				rulePath := ruleCollectionPath.Child("rules").Index(l)
+				prefix := egressRulePath.Child("rules").Index(j).String() + "."
+				j++
+				if !strings.HasPrefix(v1Field, prefix) {
+					continue
+				}
+				rest := strings.TrimPrefix(v1Field, prefix)
+				name := rest
+				if end := strings.IndexAny(rest, ".["); end != -1 {
+					name = rest[:end]
+				}
+				switch name {
+				case "ruleCollectionName":
+					return ruleCollectionPath.Child("name").String()
+				case "priority", "action", "ruleType":
+					return ruleCollectionPath.Child(name).String()
+				case "ruleName":
+					return rulePath.Child("name").String()
+				case "protocol":
+					return rulePath.Child("protocols").String() + strings.TrimPrefix(rest, name)
+				}
+				return rulePath.String() + "." + rest
+			}
+		}
+	}
+	return v1Field
+}
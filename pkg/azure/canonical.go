@@ -0,0 +1,275 @@
+// -------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package azure
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	n "github.com/Azure/azure-sdk-for-go/services/network/mgmt/2021-03-01/network"
+)
+
+// canonicalRuleCollectionGroup is the normalized model of a rule collection group used to detect changes.
+// The order of the rule collections, rules, addresses, ports and protocols doesn't affect the firewall, so they
+// are sorted, and read-only fields, nulls and empty lists are dropped. Two rule collection groups are equal if
+// their canonical models are deeply equal.
+type canonicalRuleCollectionGroup struct {
+	Priority        int32                     `json:"priority,omitempty"`
+	RuleCollections []canonicalRuleCollection `json:"ruleCollections,omitempty"`
+}
+
+type canonicalRuleCollection struct {
+	Name               string          `json:"name"`
+	RuleCollectionType string          `json:"ruleCollectionType,omitempty"`
+	Priority           int32           `json:"priority,omitempty"`
+	Action             string          `json:"action,omitempty"`
+	Rules              []canonicalRule `json:"rules,omitempty"`
+}
+
+// canonicalRule holds the fields of the network, application and NAT rules.
+type canonicalRule struct {
+	Name                 string   `json:"name"`
+	RuleType             string   `json:"ruleType,omitempty"`
+	Description          string   `json:"description,omitempty"`
+	SourceAddresses      []string `json:"sourceAddresses,omitempty"`
+	SourceIPGroups       []string `json:"sourceIpGroups,omitempty"`
+	DestinationAddresses []string `json:"destinationAddresses,omitempty"`
+	DestinationIPGroups  []string `json:"destinationIpGroups,omitempty"`
+	DestinationFqdns     []string `json:"destinationFqdns,omitempty"`
+	DestinationPorts     []string `json:"destinationPorts,omitempty"`
+	IPProtocols          []string `json:"ipProtocols,omitempty"`
+	Protocols            []string `json:"protocols,omitempty"`
+	TargetFqdns          []string `json:"targetFqdns,omitempty"`
+	TargetUrls           []string `json:"targetUrls,omitempty"`
+	FqdnTags             []string `json:"fqdnTags,omitempty"`
+	WebCategories        []string `json:"webCategories,omitempty"`
+	TerminateTLS         bool     `json:"terminateTLS,omitempty"`
+	TranslatedAddress    string   `json:"translatedAddress,omitempty"`
+	TranslatedPort       string   `json:"translatedPort,omitempty"`
+	TranslatedFqdn       string   `json:"translatedFqdn,omitempty"`
+}
+
+// canonicalRuleCollectionGroupOf returns the canonical model of the rule collection group.
+func canonicalRuleCollectionGroupOf(fwRuleCollectionGrp *n.FirewallPolicyRuleCollectionGroup) canonicalRuleCollectionGroup {
+	group := canonicalRuleCollectionGroup{}
+	if fwRuleCollectionGrp.FirewallPolicyRuleCollectionGroupProperties != nil && fwRuleCollectionGrp.Priority != nil {
+		group.Priority = *fwRuleCollectionGrp.Priority
+	}
+	for _, ruleCollection := range ruleCollectionsOf(fwRuleCollectionGrp) {
+		group.RuleCollections = append(group.RuleCollections, canonicalRuleCollectionOf(ruleCollection))
+	}
+	sort.SliceStable(group.RuleCollections, func(i, j int) bool {
+		return group.RuleCollections[i].Name < group.RuleCollections[j].Name
+	})
+	return group
+}
+
+func canonicalRuleCollectionOf(ruleCollection n.BasicFirewallPolicyRuleCollection) canonicalRuleCollection {
+	canonical := canonicalRuleCollection{}
+	if natRuleCollection, ok := ruleCollection.AsFirewallPolicyNatRuleCollection(); ok {
+		canonical.Name = stringValue(natRuleCollection.Name)
+		canonical.RuleCollectionType = string(natRuleCollection.RuleCollectionType)
+		canonical.Priority = int32Value(natRuleCollection.Priority)
+		if natRuleCollection.Action != nil {
+			canonical.Action = string(natRuleCollection.Action.Type)
+		}
+	} else if filterRuleCollection, ok := ruleCollection.AsFirewallPolicyFilterRuleCollection(); ok {
+		canonical.Name = stringValue(filterRuleCollection.Name)
+		canonical.RuleCollectionType = string(filterRuleCollection.RuleCollectionType)
+		canonical.Priority = int32Value(filterRuleCollection.Priority)
+		if filterRuleCollection.Action != nil {
+			canonical.Action = string(filterRuleCollection.Action.Type)
+		}
+	}
+	for _, rule := range ruleCollectionRules(ruleCollection) {
+		canonical.Rules = append(canonical.Rules, canonicalRuleOf(rule))
+	}
+	sort.SliceStable(canonical.Rules, func(i, j int) bool {
+		return canonical.Rules[i].Name < canonical.Rules[j].Name
+	})
+	return canonical
+}
+
+func canonicalRuleOf(rule n.BasicFirewallPolicyRule) canonicalRule {
+	canonical := canonicalRule{}
+	if applicationRule, ok := rule.AsApplicationRule(); ok {
+		canonical = canonicalRule{
+			Name:                 stringValue(applicationRule.Name),
+			RuleType:             string(applicationRule.RuleType),
+			Description:          stringValue(applicationRule.Description),
+			SourceAddresses:      sortedStrings(applicationRule.SourceAddresses),
+			SourceIPGroups:       sortedStrings(applicationRule.SourceIPGroups),
+			DestinationAddresses: sortedStrings(applicationRule.DestinationAddresses),
+			TargetFqdns:          sortedStrings(applicationRule.TargetFqdns),
+			TargetUrls:           sortedStrings(applicationRule.TargetUrls),
+			FqdnTags:             sortedStrings(applicationRule.FqdnTags),
+			WebCategories:        sortedStrings(applicationRule.WebCategories),
+		}
+		if applicationRule.TerminateTLS != nil {
+			canonical.TerminateTLS = *applicationRule.TerminateTLS
+		}
+		if applicationRule.Protocols != nil {
+			var protocols []string
+			for _, protocol := range *applicationRule.Protocols {
+				protocols = append(protocols, string(protocol.ProtocolType)+":"+strconv.Itoa(int(int32Value(protocol.Port))))
+			}
+			canonical.Protocols = sortedStrings(&protocols)
+		}
+	} else if natRule, ok := rule.AsNatRule(); ok {
+		canonical = canonicalRule{
+			Name:                 stringValue(natRule.Name),
+			RuleType:             string(natRule.RuleType),
+			Description:          stringValue(natRule.Description),
+			SourceAddresses:      sortedStrings(natRule.SourceAddresses),
+			SourceIPGroups:       sortedStrings(natRule.SourceIPGroups),
+			DestinationAddresses: sortedStrings(natRule.DestinationAddresses),
+			DestinationPorts:     sortedStrings(natRule.DestinationPorts),
+			IPProtocols:          sortedIPProtocols(natRule.IPProtocols),
+			TranslatedAddress:    stringValue(natRule.TranslatedAddress),
+			TranslatedPort:       stringValue(natRule.TranslatedPort),
+			TranslatedFqdn:       stringValue(natRule.TranslatedFqdn),
+		}
+	} else if networkRule, ok := rule.AsRule(); ok {
+		canonical = canonicalRule{
+			Name:                 stringValue(networkRule.Name),
+			RuleType:             string(networkRule.RuleType),
+			Description:          stringValue(networkRule.Description),
+			SourceAddresses:      sortedStrings(networkRule.SourceAddresses),
+			SourceIPGroups:       sortedStrings(networkRule.SourceIPGroups),
+			DestinationAddresses: sortedStrings(networkRule.DestinationAddresses),
+			DestinationIPGroups:  sortedStrings(networkRule.DestinationIPGroups),
+			DestinationFqdns:     sortedStrings(networkRule.DestinationFqdns),
+			DestinationPorts:     sortedStrings(networkRule.DestinationPorts),
+			IPProtocols:          sortedIPProtocols(networkRule.IPProtocols),
+		}
+	}
+	return canonical
+}
+
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func int32Value(i *int32) int32 {
+	if i == nil {
+		return 0
+	}
+	return *i
+}
+
+// sortedStrings returns a sorted copy of the list, or nil if it is empty.
+func sortedStrings(list *[]string) []string {
+	if list == nil || len(*list) == 0 {
+		return nil
+	}
+	sorted := append([]string(nil), *list...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+func sortedIPProtocols(protocols *[]n.FirewallPolicyRuleNetworkProtocol) []string {
+	if protocols == nil {
+		return nil
+	}
+	var list []string
+	for _, protocol := range *protocols {
+		list = append(list, string(protocol))
+	}
+	return sortedStrings(&list)
+}
+
+// equal returns true if the rule collection groups configure the firewall the same way.
+func (group canonicalRuleCollectionGroup) equal(other canonicalRuleCollectionGroup) bool {
+	return reflect.DeepEqual(group, other)
+}
+
+// JSON returns the canonical model as indented JSON.
+func (group canonicalRuleCollectionGroup) JSON() string {
+	canonicalJSON, _ := json.MarshalIndent(group, "", "    ")
+	return string(canonicalJSON)
+}
+
+// diffRuleCollectionGroups returns the changes from the old to the new rule collection group, one per line:
+// "+" for added rule collections and rules, "-" for removed ones and "~" for changed fields, e.g.
+// "~ rule allow-service/github: targetFqdns [github.com] -> [*.github.com github.com]".
+func diffRuleCollectionGroups(old canonicalRuleCollectionGroup, new canonicalRuleCollectionGroup) []string {
+	var changes []string
+	if old.Priority != new.Priority {
+		changes = append(changes, fmt.Sprintf("~ rule collection group: priority %d -> %d", old.Priority, new.Priority))
+	}
+
+	oldRuleCollections := make(map[string]canonicalRuleCollection)
+	for _, ruleCollection := range old.RuleCollections {
+		oldRuleCollections[ruleCollection.Name] = ruleCollection
+	}
+	newRuleCollections := make(map[string]bool)
+	for _, ruleCollection := range new.RuleCollections {
+		newRuleCollections[ruleCollection.Name] = true
+		oldRuleCollection, ok := oldRuleCollections[ruleCollection.Name]
+		if !ok {
+			changes = append(changes, "+ rule collection "+ruleCollection.Name)
+			oldRuleCollection = canonicalRuleCollection{Name: ruleCollection.Name}
+		} else {
+			changes = append(changes, diffFields("rule collection "+ruleCollection.Name, oldRuleCollection, ruleCollection)...)
+		}
+		changes = append(changes, diffRules(ruleCollection.Name, oldRuleCollection.Rules, ruleCollection.Rules)...)
+	}
+	for _, ruleCollection := range old.RuleCollections {
+		if !newRuleCollections[ruleCollection.Name] {
+			changes = append(changes, "- rule collection "+ruleCollection.Name)
+		}
+	}
+	return changes
+}
+
+func diffRules(ruleCollectionName string, old []canonicalRule, new []canonicalRule) []string {
+	var changes []string
+	oldRules := make(map[string]canonicalRule)
+	for _, rule := range old {
+		oldRules[rule.Name] = rule
+	}
+	newRules := make(map[string]bool)
+	for _, rule := range new {
+		newRules[rule.Name] = true
+		name := ruleCollectionName + "/" + rule.Name
+		if oldRule, ok := oldRules[rule.Name]; ok {
+			changes = append(changes, diffFields("rule "+name, oldRule, rule)...)
+		} else {
+			changes = append(changes, "+ rule "+name)
+		}
+	}
+	for _, rule := range old {
+		if !newRules[rule.Name] {
+			changes = append(changes, "- rule "+ruleCollectionName+"/"+rule.Name)
+		}
+	}
+	return changes
+}
+
+// diffFields returns the changed fields of two structs of the same type, except the rules of a rule collection.
+func diffFields(prefix string, old interface{}, new interface{}) []string {
+	var changed []string
+	oldValue, newValue := reflect.ValueOf(old), reflect.ValueOf(new)
+	for i := 0; i < oldValue.NumField(); i++ {
+		field := oldValue.Type().Field(i)
+		if field.Name == "Rules" || reflect.DeepEqual(oldValue.Field(i).Interface(), newValue.Field(i).Interface()) {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		changed = append(changed, fmt.Sprintf("%s %v -> %v", name, oldValue.Field(i).Interface(), newValue.Field(i).Interface()))
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	return []string{"~ " + prefix + ": " + strings.Join(changed, ", ")}
+}
@@ -0,0 +1,188 @@
+package azure
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	azurefirewallrulesv1 "github.com/Azure/azure-firewall-egress-controller/pkg/api/v1"
+	azfake "github.com/Azure/azure-firewall-egress-controller/pkg/azure/fake"
+	n "github.com/Azure/azure-sdk-for-go/services/network/mgmt/2021-03-01/network"
+	"github.com/Azure/go-autorest/autorest/to"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+func TestCanonicalRuleCollectionGroupIgnoresReadOnlyFieldsAndEmptyLists(t *testing.T) {
+	generated := &n.FirewallPolicyRuleCollectionGroup{
+		FirewallPolicyRuleCollectionGroupProperties: &(n.FirewallPolicyRuleCollectionGroupProperties{
+			Priority: to.Int32Ptr(300),
+			RuleCollections: &[]n.BasicFirewallPolicyRuleCollection{
+				&n.FirewallPolicyFilterRuleCollection{
+					Name:               to.StringPtr("aks-fw-ng-network"),
+					Priority:           to.Int32Ptr(110),
+					RuleCollectionType: n.RuleCollectionTypeFirewallPolicyFilterRuleCollection,
+					Rules: &[]n.BasicFirewallPolicyRule{
+						&n.Rule{
+							Name:                 to.StringPtr("rule1"),
+							RuleType:             n.RuleTypeNetworkRule,
+							DestinationAddresses: &[]string{"*"},
+							DestinationFqdns:     &[]string{},
+						},
+					},
+				},
+			},
+		}),
+	}
+	live := &n.FirewallPolicyRuleCollectionGroup{
+		Name: to.StringPtr("live"),
+		Etag: to.StringPtr("etag"),
+		FirewallPolicyRuleCollectionGroupProperties: &(n.FirewallPolicyRuleCollectionGroupProperties{
+			Priority: to.Int32Ptr(300),
+			RuleCollections: &[]n.BasicFirewallPolicyRuleCollection{
+				&n.FirewallPolicyFilterRuleCollection{
+					Name:               to.StringPtr("aks-fw-ng-network"),
+					Priority:           to.Int32Ptr(110),
+					RuleCollectionType: n.RuleCollectionTypeFirewallPolicyFilterRuleCollection,
+					Rules: &[]n.BasicFirewallPolicyRule{
+						&n.Rule{
+							Name:                 to.StringPtr("rule1"),
+							RuleType:             n.RuleTypeNetworkRule,
+							DestinationAddresses: &[]string{"*"},
+							SourceAddresses:      &[]string{},
+						},
+					},
+				},
+			},
+		}),
+	}
+	live.FirewallPolicyRuleCollectionGroupProperties.ProvisioningState = n.ProvisioningStateSucceeded
+
+	generatedConfig := canonicalRuleCollectionGroupOf(generated)
+	liveConfig := canonicalRuleCollectionGroupOf(live)
+	if !generatedConfig.equal(liveConfig) {
+		t.Errorf("Expected the configs to be equal:\n%s\nvs live:\n%s", generatedConfig.JSON(), liveConfig.JSON())
+	}
+}
+
+func TestCanonicalRuleCollectionGroupIgnoresOrder(t *testing.T) {
+	networkRule := func(name string, addresses []string, ports []string) n.BasicFirewallPolicyRule {
+		return &n.Rule{
+			Name:                 to.StringPtr(name),
+			RuleType:             n.RuleTypeNetworkRule,
+			SourceAddresses:      &addresses,
+			DestinationAddresses: &[]string{"*"},
+			DestinationPorts:     &ports,
+			IPProtocols:          &[]n.FirewallPolicyRuleNetworkProtocol{n.FirewallPolicyRuleNetworkProtocolTCP, n.FirewallPolicyRuleNetworkProtocolUDP},
+		}
+	}
+	ruleCollection := func(name string, rules ...n.BasicFirewallPolicyRule) n.BasicFirewallPolicyRuleCollection {
+		return &n.FirewallPolicyFilterRuleCollection{
+			Name:               to.StringPtr(name),
+			Priority:           to.Int32Ptr(110),
+			RuleCollectionType: n.RuleCollectionTypeFirewallPolicyFilterRuleCollection,
+			Action:             &n.FirewallPolicyFilterRuleCollectionAction{Type: n.FirewallPolicyFilterRuleCollectionActionTypeAllow},
+			Rules:              &rules,
+		}
+	}
+	group := func(ruleCollections ...n.BasicFirewallPolicyRuleCollection) *n.FirewallPolicyRuleCollectionGroup {
+		return &n.FirewallPolicyRuleCollectionGroup{
+			FirewallPolicyRuleCollectionGroupProperties: &n.FirewallPolicyRuleCollectionGroupProperties{
+				Priority:        to.Int32Ptr(300),
+				RuleCollections: &ruleCollections,
+			},
+		}
+	}
+
+	config := canonicalRuleCollectionGroupOf(group(
+		ruleCollection("a", networkRule("rule1", []string{"10.0.0.1", "10.0.0.2"}, []string{"80", "443"}), networkRule("rule2", []string{"10.0.0.3"}, []string{"53"})),
+		ruleCollection("b", networkRule("rule3", []string{"10.0.0.4"}, []string{"22"})),
+	))
+	reordered := canonicalRuleCollectionGroupOf(group(
+		ruleCollection("b", networkRule("rule3", []string{"10.0.0.4"}, []string{"22"})),
+		ruleCollection("a", networkRule("rule2", []string{"10.0.0.3"}, []string{"53"}), networkRule("rule1", []string{"10.0.0.2", "10.0.0.1"}, []string{"443", "80"})),
+	))
+	if !config.equal(reordered) {
+		t.Errorf("Expected the configs to be equal:\n%s\nvs reordered:\n%s", config.JSON(), reordered.JSON())
+	}
+	if changes := diffRuleCollectionGroups(config, reordered); len(changes) != 0 {
+		t.Errorf("Expected no changes, but got: %v", changes)
+	}
+}
+
+func TestDiffRuleCollectionGroups(t *testing.T) {
+	old := canonicalRuleCollectionGroup{
+		Priority: 300,
+		RuleCollections: []canonicalRuleCollection{
+			{Name: "allow-service", Priority: 200, Action: "Allow", Rules: []canonicalRule{
+				{Name: "github", TargetFqdns: []string{"github.com"}, Protocols: []string{"Https:443"}},
+				{Name: "ubuntu", TargetFqdns: []string{"ubuntu.com"}},
+			}},
+			{Name: "deny-all", Priority: 900, Action: "Deny"},
+		},
+	}
+	new := canonicalRuleCollectionGroup{
+		Priority: 300,
+		RuleCollections: []canonicalRuleCollection{
+			{Name: "allow-db", Priority: 210, Action: "Allow", Rules: []canonicalRule{
+				{Name: "sql", DestinationPorts: []string{"1433"}},
+			}},
+			{Name: "allow-service", Priority: 250, Action: "Allow", Rules: []canonicalRule{
+				{Name: "github", TargetFqdns: []string{"*.github.com", "github.com"}, Protocols: []string{"Https:443"}},
+			}},
+		},
+	}
+
+	expected := []string{
+		"+ rule collection allow-db",
+		"+ rule allow-db/sql",
+		"~ rule collection allow-service: priority 200 -> 250",
+		"~ rule allow-service/github: targetFqdns [github.com] -> [*.github.com github.com]",
+		"- rule allow-service/ubuntu",
+		"- rule collection deny-all",
+	}
+	if changes := diffRuleCollectionGroups(old, new); !reflect.DeepEqual(changes, expected) {
+		t.Errorf("Expected changes %v, but got: %v", expected, changes)
+	}
+}
+
+func TestReorderedEgressRulesAreNotRedeployed(t *testing.T) {
+	rules := newTestFirewallRules()
+	for i, egressRule := range rules.Spec.EgressRules {
+		rules.Spec.EgressRules[i].Rules = []azurefirewallrulesv1.AzureFirewallEgressrulesRulesSpec{
+			{
+				RuleCollectionName: "allow-" + egressRule.Name,
+				Priority:           int32(200 + i),
+				RuleName:           "github",
+				TargetFqdns:        []string{"github.com", "api.github.com"},
+				Protocol:           []string{"HTTPS:443"},
+				Action:             "Allow",
+				RuleType:           "Application",
+			},
+		}
+	}
+	arm := azfake.NewARM()
+	az, k8sClient := newTestAzClientWithFakeARM(t, arm, rules.DeepCopy(),
+		newTestNode("node-1", map[string]string{"app": "service"}, "10.240.0.4"),
+		newTestNode("node-2", map[string]string{"app": "db"}, "10.240.0.5"))
+	if err := az.processRequest(context.Background(), ctrl.Request{}, nil); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	updated := &azurefirewallrulesv1.AzureFirewallRules{}
+	if err := k8sClient.Get(context.Background(), types.NamespacedName{Name: rules.Name}, updated); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	egressRules := updated.Spec.EgressRules
+	egressRules[0], egressRules[1] = egressRules[1], egressRules[0]
+	egressRules[0].Rules[0].TargetFqdns = []string{"api.github.com", "github.com"}
+	if err := k8sClient.Update(context.Background(), updated); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if err := az.processRequest(context.Background(), ctrl.Request{}, nil); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if puts := countRuleCollectionGroupPuts(arm); puts != 1 {
+		t.Errorf("Expected %d rule collection group updates, but got: %d", 1, puts)
+	}
+}
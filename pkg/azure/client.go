@@ -7,9 +7,20 @@ package azure
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
 	"time"
 
 	azurefirewallrulesv1 "github.com/Azure/azure-firewall-egress-controller/pkg/api/v1"
+	utils "github.com/Azure/azure-firewall-egress-controller/pkg/utils"
+	"github.com/Azure/azure-firewall-egress-controller/pkg/version"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
 	a "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/network/armnetwork/v2"
@@ -18,20 +29,52 @@ import (
 	"github.com/Azure/go-autorest/autorest/azure/auth"
 	"github.com/Azure/go-autorest/autorest/to"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 const (
-	IpGroupNamePrefix string = "IPGroup-node-"
+	IpGroupNamePrefix    string = "IPGroup-node-"
+	PodIpGroupNamePrefix string = "IPGroup-pod-"
+
+	// ManagedByTagKey and ManagedByTagValue tag the IP Groups created by the controller.
+	ManagedByTagKey   string = "managed-by"
+	ManagedByTagValue string = "azure-firewall-egress-controller"
+	// ClusterTagKey, SelectorTagKey and ControllerVersionTagKey identify the cluster, the selector of the nodes or
+	// pods, and the version of the controller that last updated an IP Group.
+	ClusterTagKey           string = "cluster"
+	SelectorTagKey          string = "selector"
+	ControllerVersionTagKey string = "controller-version"
+
+	// The firewall policy can't be updated while it is in the Updating provisioning state. Its state is polled
+	// with an exponential backoff before giving up and retrying the whole event loop run later.
+	policyUpdatingRetries       = 20
+	policyUpdatingRetryPause    = 1 * time.Second
+	policyUpdatingMaxRetryPause = 30 * time.Second
 )
 
-var pollers = make(map[string]*runtime.Poller[a.IPGroupsClientCreateOrUpdateResponse])
+var errPolicyUpdating = errors.New("firewall policy is in the Updating state")
+
+// Transport sends ARM requests. It is satisfied by both the azcore and the autorest HTTP pipelines.
+type Transport interface {
+	Do(req *http.Request) (*http.Response, error)
+}
 
 // AzClient is an interface for client to Azure
 type AzClient interface {
 	SetAuthorizer(authorizer autorest.Authorizer)
+	SetDryRun(dryRun bool)
+	SetEventRecorder(recorder record.EventRecorder)
+	SetUnmanagedRulesPolicy(policy string)
+	SetClusterName(name string)
+	SetDriftPolicy(policy string, checkPeriod time.Duration)
+	Start(ctx context.Context) error
+	Plan(ctx context.Context) error
+	Uninstall(ctx context.Context, timeout time.Duration) error
 	FetchFirewallPolicyLocation() string
 	UpdateFirewallPolicy(ctx context.Context, req ctrl.Request) error
 	processRequest(ctx context.Context, req ctrl.Request, nodesWithFwTaint []*corev1.Node) error
@@ -55,7 +98,56 @@ type azClient struct {
 	queue                               *Queue
 	client                              client.Client
 
-	configCache *[]byte
+	// pollers holds the pending IP Group updates. The clients of a set share it with the other clients managing
+	// IP Groups in the same resource group, and only use it while holding the lock of the resource group.
+	pollers map[string]*ipGroupUpdate
+
+	configCache             *canonicalRuleCollectionGroup
+	ruleCollectionGroupETag string
+
+	// The generated config is split into several rule collection groups when it exceeds the size limit. shardCache
+	// holds the last applied config of the rule collection groups beyond the first one.
+	limits        firewallPolicyLimits
+	shardCache    map[string]*canonicalRuleCollectionGroup
+	shardsChecked bool
+	// shardPrioritiesChecked is the number of rule collection groups whose priorities were last checked against the
+	// live rule collection groups.
+	shardPrioritiesChecked int
+
+	// Every live rule collection group is compared with the generated one before its first deployment.
+	liveRuleCollectionGroupChecked bool
+	liveShardsChecked              map[string]bool
+	unmanagedRulesPolicy           string
+	adoptedRuleCollections         []n.BasicFirewallPolicyRuleCollection
+	adoptedRules                   map[string][]n.BasicFirewallPolicyRule
+	driftCondition                 *metav1.Condition
+
+	// The live rule collection group is compared with the generated one every driftCheckPeriod, and the live
+	// IP Groups with the addresses last applied in every event loop run.
+	driftPolicy      string
+	driftCheckPeriod time.Duration
+	lastDriftCheck   time.Time
+	appliedIpGroups  map[string][]string
+	driftedIpGroups  []string
+
+	clusterName string
+	dryRun      bool
+	planOutput  io.Writer
+	recorder    record.EventRecorder
+	retryPause  time.Duration
+
+	// defaultTargetKey is the rule collection group of the objects without a firewallPolicy reference.
+	// It is empty when the client is not part of a client set, in which case the client owns them.
+	defaultTargetKey string
+	ipGroupRegistry  *desiredIpGroupsRegistry
+	// onReleased is called after an event loop run that left the rule collection group without any object.
+	onReleased func(ctx context.Context, az *azClient)
+	// The clients of a set update the firewall policies and IP Groups one at a time, and only remove the taint of
+	// a node once all of them are done with it.
+	policyLocks  *keyedMutex
+	ipGroupLocks *keyedMutex
+	taintBarrier *taintRemovalBarrier
+	priorities   *ruleCollectionGroupPriorities
 
 	ctx context.Context
 }
@@ -79,9 +171,37 @@ func NewAzClient(subscriptionID string, resourceGroupName string, fwPolicyName s
 	if err != nil {
 		klog.Error("failed to create Firewall Policy client: %v", err)
 	}
+	rcgClient := n.NewFirewallPolicyRuleCollectionGroupsClientWithBaseURI(settings.Environment.ResourceManagerEndpoint, string(subscriptionID))
+	return newAzClient(fwPolicyClient, rcgClient, ipGroupClient, subscriptionID, resourceGroupName, fwPolicyName, fwPolicyRuleCollectionGroupName, fwPolicyRuleCollectionGroupPriority, clientID, client)
+}
+
+// NewAzClientWithTransport returns an Azure Client that sends every ARM request through the given transport
+// instead of the network. It is used to run the controller against the in-memory backend in pkg/azure/fake.
+func NewAzClientWithTransport(subscriptionID string, resourceGroupName string, fwPolicyName string, fwPolicyRuleCollectionGroupName string, fwPolicyRuleCollectionGroupPriority int32, client client.Client, transport Transport, cred azcore.TokenCredential) AzClient {
+	options := &arm.ClientOptions{ClientOptions: policy.ClientOptions{Transport: transport}}
+	ipGroupClient, err := a.NewIPGroupsClient(subscriptionID, cred, options)
+	if err != nil {
+		klog.Error("failed to create IP group client: %v", err)
+		return nil
+	}
+	fwPolicyClient, err := a.NewFirewallPoliciesClient(subscriptionID, cred, options)
+	if err != nil {
+		klog.Error("failed to create Firewall Policy client: %v", err)
+		return nil
+	}
+	rcgClient := n.NewFirewallPolicyRuleCollectionGroupsClient(subscriptionID)
+	rcgClient.Sender = transport
+	rcgClient.Authorizer = autorest.NullAuthorizer{}
+	rcgClient.PollingDelay = 100 * time.Millisecond
+	az := newAzClient(fwPolicyClient, rcgClient, ipGroupClient, subscriptionID, resourceGroupName, fwPolicyName, fwPolicyRuleCollectionGroupName, fwPolicyRuleCollectionGroupPriority, "", client)
+	az.retryPause = 100 * time.Millisecond
+	return az
+}
+
+func newAzClient(fwPolicyClient *a.FirewallPoliciesClient, rcgClient n.FirewallPolicyRuleCollectionGroupsClient, ipGroupClient *a.IPGroupsClient, subscriptionID string, resourceGroupName string, fwPolicyName string, fwPolicyRuleCollectionGroupName string, fwPolicyRuleCollectionGroupPriority int32, clientID string, client client.Client) *azClient {
 	az := &azClient{
 		fwPolicyClient:                    fwPolicyClient,
-		fwPolicyRuleCollectionGroupClient: n.NewFirewallPolicyRuleCollectionGroupsClientWithBaseURI(settings.Environment.ResourceManagerEndpoint, string(subscriptionID)),
+		fwPolicyRuleCollectionGroupClient: rcgClient,
 		ipGroupClient:                     ipGroupClient,
 		clientID:                          clientID,
 
@@ -91,17 +211,26 @@ func NewAzClient(subscriptionID string, resourceGroupName string, fwPolicyName s
 		fwPolicyRuleCollectionGroupName:     fwPolicyRuleCollectionGroupName,
 		fwPolicyRuleCollectionGroupPriority: fwPolicyRuleCollectionGroupPriority,
 		firewallPolicyLoc:                   "",
-		queue:                               NewQueue("policyBuilder"),
+		queue:                               NewQueue("policyBuilder-" + fwPolicyName + "-" + fwPolicyRuleCollectionGroupName),
 		client:                              client,
 
-		configCache: to.ByteSlicePtr([]byte{}),
+		pollers: make(map[string]*ipGroupUpdate),
+
+		limits:            defaultFirewallPolicyLimits,
+		shardCache:        make(map[string]*canonicalRuleCollectionGroup),
+		liveShardsChecked: make(map[string]bool),
+
+		unmanagedRulesPolicy: UnmanagedRulesOverwrite,
+		adoptedRules:         make(map[string][]n.BasicFirewallPolicyRule),
+		driftPolicy:          DriftPolicyCorrect,
+		appliedIpGroups:      make(map[string][]string),
+
+		planOutput: os.Stdout,
+		retryPause: policyUpdatingRetryPause,
 
 		ctx: context.Background(),
 	}
 
-	worker := NewWorker(az.queue, az.client)
-	go worker.DoWork()
-
 	return az
 }
 
@@ -109,18 +238,24 @@ func (az *azClient) SetAuthorizer(authorizer autorest.Authorizer) {
 	az.fwPolicyRuleCollectionGroupClient.Authorizer = authorizer
 }
 
-func (az *azClient) UpdateFirewallPolicy(ctx context.Context, req ctrl.Request) (err error) {
-	az.checkIfJobToBeAddedToChannel(ctx, req)
+// SetDryRun makes the client render the firewall configuration without modifying any Azure resource.
+func (az *azClient) SetDryRun(dryRun bool) {
+	az.dryRun = dryRun
+}
 
-	return
+// SetClusterName sets the name of the cluster the IP Groups are tagged with.
+func (az *azClient) SetClusterName(name string) {
+	az.clusterName = name
 }
 
-func (az *azClient) checkIfJobToBeAddedToChannel(ctx context.Context, req ctrl.Request) (err error) {
-	az.queue.AddJob(Job{
-		Request:  req,
-		ctx:      ctx,
-		AzClient: az,
-	})
+// Start processes the queued requests until the context is cancelled. It implements manager.Runnable.
+func (az *azClient) Start(ctx context.Context) error {
+	NewWorker(az.queue, az.client, az).DoWork(ctx)
+	return nil
+}
+
+func (az *azClient) UpdateFirewallPolicy(ctx context.Context, req ctrl.Request) (err error) {
+	az.queue.AddJob(req)
 	return
 }
 
@@ -128,25 +263,57 @@ func (az *azClient) processRequest(ctx context.Context, req ctrl.Request, nodesW
 	processEventStart := time.Now()
 
 	var erulesSourceAddresses = make(map[string][]string)
+	var erulesErrors = make(map[string]string)
 	var ipGroupIds = make(map[string]string)
+	var desiredIpGroups = make(map[string]bool)
+	var ipGroupNodes = make(map[string][]*corev1.Node)
+	var ipGroupErr error
+	az.driftedIpGroups = nil
 	erulesList := &azurefirewallrulesv1.AzureFirewallRulesList{}
 	listOpts := []client.ListOption{}
 	if err := az.client.List(ctx, erulesList, listOpts...); err != nil {
 		return err
 	}
 
+	policyList := &azurefirewallrulesv1.EgressPolicyList{}
+	if err := az.client.List(ctx, policyList, listOpts...); err != nil {
+		return err
+	}
+
 	nodeList := &corev1.NodeList{}
 	if err := az.client.List(ctx, nodeList, []client.ListOption{}...); err != nil {
 		return err
 	}
 
-	//fetch all the Ip groups in a resource group
+	//only process the objects targeting the rule collection group of this client
+	erulesList.Items = az.ownedFirewallRules(erulesList.Items)
+	policyList.Items = az.ownedEgressPolicies(policyList.Items)
+
+	//The rules of the objects being deleted are removed from the rule collection group before releasing them
+	var deletedRules []azurefirewallrulesv1.AzureFirewallRules
+	var deletedPolicies []azurefirewallrulesv1.EgressPolicy
+	erulesList.Items, deletedRules = splitDeletedFirewallRules(erulesList.Items)
+	policyList.Items, deletedPolicies = splitDeletedEgressPolicies(policyList.Items)
+	if !az.dryRun {
+		az.addFinalizers(ctx, finalizedObjects(erulesList.Items, policyList.Items))
+	}
+
+	if az.defaultTargetKey == "" || az.defaultTargetKey == az.targetKey() {
+		taintedNodes.Set(float64(countTaintedNodes(*nodeList)))
+	}
+
+	//fetch all the Ip groups in a resource group. Another client of the set may update the same IP Groups, so they
+	//are listed and updated while holding the lock of the resource group.
+	unlockIpGroups := az.lockIpGroups()
 	var ipGroupsInRG = make(map[string]*a.IPGroup)
 	res1 := az.ipGroupClient.NewListByResourceGroupPager(az.resourceGroupName, nil)
 	for res1.More() {
 		page, err := res1.NextPage(ctx)
+		observeARMRequest(opIPGroupList, err)
 		if err != nil {
+			unlockIpGroups()
 			klog.Error("failed to advance page: %v", err)
+			return err
 		}
 		for _, ipGroup := range page.Value {
 			ipGroupsInRG[*ipGroup.Name] = ipGroup
@@ -156,85 +323,324 @@ func (az *azClient) processRequest(ctx context.Context, req ctrl.Request, nodesW
 	for _, item := range erulesList.Items {
 		for _, egressrule := range item.Spec.EgressRules {
 			var sourceIpGroups []string
-			if egressrule.NodeSelector != nil {
-				for _, m := range egressrule.NodeSelector {
-					for k, v := range m {
-						IPGroupName := IpGroupNamePrefix + k + v
-						if ipGroupIds[IPGroupName] == "" {
-							sourceAddress := getSourceAddressesByNodeLabels(k, v, *nodeList)
-							var id = ""
-
-							//check if IP Group already exists
-							if _, ok := ipGroupsInRG[IPGroupName]; ok {
-								addressesInIpGroup := ipGroupsInRG[IPGroupName].Properties.IPAddresses
-								IPGroupProvisioningState := *ipGroupsInRG[IPGroupName].Properties.ProvisioningState
-								if len(sourceAddress) == len(addressesInIpGroup) && !checkIfElementsPresentInArray(sourceAddress, addressesInIpGroup) {
-									//IP group not changed
-									id = *ipGroupsInRG[IPGroupName].ID
-								} else if IPGroupProvisioningState == a.ProvisioningStateUpdating && pollers[IPGroupName] != nil {
-									//if the IP group is in updating state, wait for it to complete.
-									klog.Info("Waiting for the Ip group update to complete, ", IPGroupName)
-									_, err = pollers[IPGroupName].PollUntilDone(ctx, nil)
-								}
-							}
-
-							// update IP Group and get the associated ID.
-							if id == "" {
-								poller := az.updateIpGroup(sourceAddress, IPGroupName)
-								pollers[IPGroupName] = poller
-								res, err1 := az.ipGroupClient.Get(az.ctx, az.resourceGroupName, IPGroupName, &a.IPGroupsClientGetOptions{Expand: nil})
-								if err1 != nil {
-									klog.Error("Failed to get the IP Group", err1)
-								}
-								id = *res.IPGroup.ID
-							}
-							ipGroupIds[IPGroupName] = id
+			nodeIpGroups, err1 := nodeIpGroupsOf(az.clusterName, egressrule)
+			if err1 != nil {
+				erulesErrors[egressrule.Name] = err1.Error()
+			}
+			for _, nodeIpGroup := range nodeIpGroups {
+				IPGroupName := nodeIpGroup.name
+				desiredIpGroups[IPGroupName] = true
+				if ipGroupIds[IPGroupName] == "" {
+					nodes := nodesBySelector(nodeIpGroup.selector, *nodeList)
+					id, updated, err1 := az.resolveIpGroup(ctx, IPGroupName, nodeIpGroup.description(), getSourceAddressesByNodes(nodes), ipGroupsInRG)
+					if err1 != nil {
+						erulesErrors[egressrule.Name] = err1.Error()
+						if ipGroupErr == nil {
+							ipGroupErr = err1
 						}
-						sourceIpGroups = append(sourceIpGroups, ipGroupIds[IPGroupName])
+						continue
+					}
+					if updated {
+						ipGroupNodes[IPGroupName] = nodes
 					}
+					ipGroupIds[IPGroupName] = id
 				}
+				sourceIpGroups = append(sourceIpGroups, ipGroupIds[IPGroupName])
 			}
 			erulesSourceAddresses[egressrule.Name] = sourceIpGroups
 		}
 	}
 
-	go az.WaitForNodeIpGroupUpdate(ctx, nodesWithFwTaint, pollers)
+	//Resolve the pods selected by every EgressPolicy into a dedicated IP Group
+	fwRulesList := *erulesList.DeepCopy()
+	for _, policy := range policyList.Items {
+		key := egressPolicyKey(policy)
+		IPGroupName := PodIpGroupName(az.clusterName, policy.Namespace, policy.Name)
+		desiredIpGroups[IPGroupName] = true
+		// The webhook rejects them, but an EgressPolicy stored before it did must not expose internal addresses.
+		if hasNatRules(policy) {
+			erulesErrors[key] = "Nat rules are only supported by AzureFirewallRules"
+			continue
+		}
+		sourceAddress, err1 := az.getSourceAddressesByPodSelector(ctx, policy)
+		if err1 != nil {
+			erulesErrors[key] = err1.Error()
+			continue
+		}
+		id, _, err1 := az.resolveIpGroup(ctx, IPGroupName, "EgressPolicy "+policy.Namespace+"/"+policy.Name, sourceAddress, ipGroupsInRG)
+		if err1 != nil {
+			erulesErrors[key] = err1.Error()
+			if ipGroupErr == nil {
+				ipGroupErr = err1
+			}
+			continue
+		}
+		erulesSourceAddresses[key] = []string{id}
+		fwRulesList.Items = append(fwRulesList.Items, egressPolicyToFirewallRules(policy))
+	}
+
+	excludeRulesWithoutProtocols(&fwRulesList, erulesErrors)
+	resolveDestinationIpGroups(&fwRulesList, ipGroupsInRG, erulesErrors)
+	az.recordDesiredIpGroups(desiredIpGroups)
+
+	go az.WaitForNodeIpGroupUpdate(ctx, nodesWithFwTaint, az.pendingIpGroupUpdates(), ipGroupNodes)
+	unlockIpGroups()
+
+	objects := deployedObjects(erulesList.Items, policyList.Items)
+	if len(az.driftedIpGroups) != 0 {
+		az.recordDeploymentEvent(objects, corev1.EventTypeWarning, EventReasonDriftDetected, "IP Groups changed outside of the controller were not corrected: %s", strings.Join(az.driftedIpGroups, ", "))
+	}
 
 	//Generate fw config
-	az.BuildPolicy(*erulesList, erulesSourceAddresses)
+	err = az.buildPolicy(fwRulesList, erulesSourceAddresses, objects)
+	if !az.dryRun {
+		az.updateStatus(ctx, *erulesList, erulesSourceAddresses, erulesErrors, err)
+		az.updateEgressPolicyStatus(ctx, *policyList, erulesSourceAddresses, erulesErrors, err)
+	}
+
+	//The rule collection group no longer references the IP Groups that are not desired anymore
+	if err == nil {
+		adoptedIpGroups := unnamedClusterIpGroups(erulesList.Items, policyList.Items)
+		for name := range unnamedClusterIpGroups(deletedRules, deletedPolicies) {
+			adoptedIpGroups[name] = true
+		}
+		az.deleteOrphanedIpGroups(ctx, ipGroupsInRG, az.desiredIpGroupsInResourceGroup(desiredIpGroups), adoptedIpGroups)
+		if !az.dryRun {
+			az.removeFinalizers(ctx, finalizedObjects(deletedRules, deletedPolicies))
+		}
+	}
 
 	duration := time.Now().Sub(processEventStart)
+	processRequestDuration.WithLabelValues(az.fwPolicyRuleCollectionGroupName).Observe(duration.Seconds())
 	klog.Infof("Completed last event loop run in: %+v", duration)
+
+	//The egress rules whose IP Group could not be updated are missing from the rule collection group until a retry succeeds
+	if err == nil {
+		err = ipGroupErr
+	}
+	if err == nil && az.onReleased != nil && len(erulesList.Items) == 0 && len(policyList.Items) == 0 {
+		az.onReleased(ctx, az)
+	}
 	return
 }
 
-func (az *azClient) updateIpGroup(sourceAddress []*string, ipGroupsName string) *runtime.Poller[a.IPGroupsClientCreateOrUpdateResponse] {
+// excludeRulesWithoutProtocols removes the rules none of whose protocols can be converted, e.g. from objects stored
+// before the webhook validated the protocols, and reports them as errors of their egress rule. The rules are copied,
+// as those of the EgressPolicies are shared with the listed objects.
+func excludeRulesWithoutProtocols(fwRulesList *azurefirewallrulesv1.AzureFirewallRulesList, erulesErrors map[string]string) {
+	for i := range fwRulesList.Items {
+		for j := range fwRulesList.Items[i].Spec.EgressRules {
+			egressRule := &fwRulesList.Items[i].Spec.EgressRules[j]
+			var rules []azurefirewallrulesv1.AzureFirewallEgressrulesRulesSpec
+			for _, rule := range egressRule.Rules {
+				if err := ruleProtocolsError(rule); err != nil {
+					klog.Error("Excluding a rule of egress rule ", egressRule.Name, ": ", err)
+					addEgressRuleError(erulesErrors, egressRule.Name, err.Error())
+					continue
+				}
+				rules = append(rules, rule)
+			}
+			egressRule.Rules = rules
+		}
+	}
+}
+
+// addEgressRuleError records an error of an egress rule, after the ones already recorded.
+func addEgressRuleError(erulesErrors map[string]string, name string, msg string) {
+	if previous, ok := erulesErrors[name]; ok {
+		msg = previous + "; " + msg
+	}
+	erulesErrors[name] = msg
+}
+
+// resolveDestinationIpGroups replaces the names of the destination IP Groups by the resource ID of the IP Group of
+// that name in the resource group of the firewall policy. Azure rejects the whole rule collection group when a rule
+// references a missing IP Group, so such rules are excluded and reported as errors of their egress rule. The rules
+// are copied, as those of the EgressPolicies are shared with the listed objects.
+func resolveDestinationIpGroups(fwRulesList *azurefirewallrulesv1.AzureFirewallRulesList, ipGroupsInRG map[string]*a.IPGroup, erulesErrors map[string]string) {
+	ipGroupIDs := make(map[string]string)
+	for name, ipGroup := range ipGroupsInRG {
+		if ipGroup.ID != nil {
+			ipGroupIDs[strings.ToLower(name)] = *ipGroup.ID
+		}
+	}
+	for i := range fwRulesList.Items {
+		for j := range fwRulesList.Items[i].Spec.EgressRules {
+			egressRule := &fwRulesList.Items[i].Spec.EgressRules[j]
+			var rules []azurefirewallrulesv1.AzureFirewallEgressrulesRulesSpec
+			for _, rule := range egressRule.Rules {
+				if rule.DestinationIPGroups != nil {
+					var missing []string
+					ids := make([]string, 0, len(rule.DestinationIPGroups))
+					for _, ipGroup := range rule.DestinationIPGroups {
+						if !strings.HasPrefix(ipGroup, "/") {
+							id, ok := ipGroupIDs[strings.ToLower(ipGroup)]
+							if !ok {
+								missing = append(missing, ipGroup)
+								continue
+							}
+							ipGroup = id
+						}
+						ids = append(ids, ipGroup)
+					}
+					if len(missing) != 0 {
+						msg := fmt.Sprintf("rule %s of rule collection %s references IP Groups that don't exist: %s", rule.RuleName, rule.RuleCollectionName, strings.Join(missing, ", "))
+						klog.Error("Excluding a rule of egress rule ", egressRule.Name, ": ", msg)
+						addEgressRuleError(erulesErrors, egressRule.Name, msg)
+						continue
+					}
+					rule.DestinationIPGroups = ids
+				}
+				rules = append(rules, rule)
+			}
+			egressRule.Rules = rules
+		}
+	}
+}
+
+// resolveIpGroup makes sure the IP Group holds the given addresses and returns its resource ID, and whether an
+// update of the IP Group was started.
+func (az *azClient) resolveIpGroup(ctx context.Context, IPGroupName string, selector string, sourceAddress []*string, ipGroupsInRG map[string]*a.IPGroup) (string, bool, error) {
+	//check if IP Group already exists
+	if _, ok := ipGroupsInRG[IPGroupName]; ok {
+		if err := az.checkIpGroupCluster(ipGroupsInRG[IPGroupName]); err != nil {
+			return "", false, err
+		}
+		addressesInIpGroup := ipGroupsInRG[IPGroupName].Properties.IPAddresses
+		IPGroupProvisioningState := *ipGroupsInRG[IPGroupName].Properties.ProvisioningState
+		if len(sourceAddress) == len(addressesInIpGroup) && !checkIfElementsPresentInArray(sourceAddress, addressesInIpGroup) {
+			//IP group not changed
+			az.recordAppliedIpGroup(IPGroupName, sourceAddress)
+			return *ipGroupsInRG[IPGroupName].ID, false, nil
+		} else if az.ipGroupDrifted(IPGroupName, sourceAddress) {
+			klog.Infof("IP Group %s was changed outside of the controller", IPGroupName)
+			if az.driftPolicy == DriftPolicyAlert {
+				ipGroupDrifted.WithLabelValues(az.resourceGroupName, IPGroupName).Set(1)
+				az.driftedIpGroups = append(az.driftedIpGroups, IPGroupName)
+				return *ipGroupsInRG[IPGroupName].ID, false, nil
+			}
+		}
+		if IPGroupProvisioningState == a.ProvisioningStateUpdating && az.pollers[IPGroupName] != nil {
+			//if the IP group is in updating state, wait for it to complete.
+			klog.Info("Waiting for the Ip group update to complete, ", IPGroupName)
+			az.pollers[IPGroupName].wait(ctx)
+		}
+	}
+
+	if az.dryRun {
+		klog.Infof("dry-run: IP Group %s would be updated with %d addresses", IPGroupName, len(sourceAddress))
+		return utils.ResourceID(utils.SubscriptionID(az.subscriptionID), utils.ResourceGroup(az.resourceGroupName), "Microsoft.Network", "ipGroups", IPGroupName), false, nil
+	}
+
+	// update IP Group and get the associated ID.
+	poller, err := az.updateIpGroup(sourceAddress, IPGroupName, selector)
+	if err != nil {
+		return "", false, errors.New("Failed to update the IP Group " + IPGroupName + ": " + err.Error())
+	}
+	az.pollers[IPGroupName] = &ipGroupUpdate{poller: poller}
+	res, err := az.ipGroupClient.Get(az.ctx, az.resourceGroupName, IPGroupName, &a.IPGroupsClientGetOptions{Expand: nil})
+	observeARMRequest(opIPGroupGet, err)
+	if err != nil {
+		klog.Error("Failed to get the IP Group", err)
+		return "", false, errors.New("Failed to get the IP Group " + IPGroupName + ": " + err.Error())
+	}
+	ipGroupAddressCount.WithLabelValues(az.resourceGroupName, IPGroupName).Set(float64(len(sourceAddress)))
+	az.recordAppliedIpGroup(IPGroupName, sourceAddress)
+	return *res.IPGroup.ID, poller != nil, nil
+}
+
+func (az *azClient) updateIpGroup(sourceAddress []*string, ipGroupsName string, selector string) (*runtime.Poller[a.IPGroupsClientCreateOrUpdateResponse], error) {
+	tags := map[string]*string{
+		ManagedByTagKey:         to.StringPtr(ManagedByTagValue),
+		SelectorTagKey:          to.StringPtr(truncateTagValue(selector)),
+		ControllerVersionTagKey: to.StringPtr(version.Version),
+	}
+	if az.clusterName != "" {
+		tags[ClusterTagKey] = to.StringPtr(az.clusterName)
+	}
+	// The IP Groups are created in the location of the firewall policy, which is only fetched when first needed.
+	if az.firewallPolicyLoc == "" {
+		az.FetchFirewallPolicyLocation()
+	}
 	poller, err := az.ipGroupClient.BeginCreateOrUpdate(az.ctx, az.resourceGroupName, ipGroupsName, a.IPGroup{
 		Location: to.StringPtr(az.firewallPolicyLoc),
-		Tags:     map[string]*string{},
+		Tags:     tags,
 		Properties: &a.IPGroupPropertiesFormat{
 			IPAddresses: sourceAddress,
 		},
 	}, nil)
+	observeARMRequest(opIPGroupCreateOrUpdate, err)
 	if err != nil {
 		klog.Error("Error updating the Ip Group: ", err)
+		return nil, err
 	}
 	klog.Info("Updating Ip Group: ", ipGroupsName)
 
-	return poller
+	return poller, nil
 }
 
 func (az *azClient) BuildPolicy(erulesList azurefirewallrulesv1.AzureFirewallRulesList, erulesSourceAddresses map[string][]string) (err error) {
-	ruleCollections := BuildFirewallConfig(erulesList, erulesSourceAddresses)
+	return az.buildPolicy(erulesList, erulesSourceAddresses, nil)
+}
+
+// buildPolicy generates and applies the rule collection group, recording the deployment events on the given objects.
+func (az *azClient) buildPolicy(erulesList azurefirewallrulesv1.AzureFirewallRulesList, erulesSourceAddresses map[string][]string, objects []k8sruntime.Object) (err error) {
+	ruleCollections := az.withAdoptedRules(az.withManagedDescription(BuildFirewallConfig(erulesList, erulesSourceAddresses)))
+
+	// The rule collection groups beyond the first one hold the rule collections that overflow the size limit.
+	checkLive := az.unmanagedRulesPolicy == UnmanagedRulesRefuse || az.driftCheckDue()
+	shards, err := shardRuleCollections(*ruleCollections, az.fwPolicyRuleCollectionGroupName, az.fwPolicyRuleCollectionGroupPriority, az.limits)
+	if err == nil {
+		err = az.checkShardPriorities(shards, checkLive)
+	}
+	if err != nil {
+		klog.Error("Error building the rule collection group: ", err)
+		az.recordDeploymentEvent(objects, corev1.EventTypeWarning, EventReasonLimitsExceeded, "Not deploying rule collection group %s: %v", az.fwPolicyRuleCollectionGroupName, err)
+		return err
+	}
+	ruleCollectionGroupShards.WithLabelValues(az.fwPolicyRuleCollectionGroupName).Set(float64(len(shards)))
+	az.recordPriorities(shards)
+
+	if az.dryRun {
+		for _, shard := range shards {
+			if err := az.printPlan(shard.name, shard.ruleCollectionGroup()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// All the rule collection groups are compared with the live ones in the same run.
+	if err := az.deployRuleCollectionGroup(shards[0].ruleCollectionGroup(), checkLive, objects); err != nil {
+		return err
+	}
+	return az.deployShards(shards[1:], checkLive, objects)
+}
 
-	fwRuleCollectionGrpObj := &n.FirewallPolicyRuleCollectionGroup{
-		FirewallPolicyRuleCollectionGroupProperties: &(n.FirewallPolicyRuleCollectionGroupProperties{
-			Priority:        to.Int32Ptr(az.fwPolicyRuleCollectionGroupPriority),
-			RuleCollections: ruleCollections,
-		}),
+// deployRuleCollectionGroup applies the configured rule collection group, unless it matches the last applied one.
+func (az *azClient) deployRuleCollectionGroup(fwRuleCollectionGrpObj *n.FirewallPolicyRuleCollectionGroup, checkLive bool, objects []k8sruntime.Object) (err error) {
+	if checkLive || !az.liveRuleCollectionGroupChecked {
+		upToDate, err := az.checkLiveRuleCollectionGroup(az.fwPolicyRuleCollectionGroupName, fwRuleCollectionGrpObj, objects)
+		if err != nil {
+			klog.Error("Error checking the live rule collection group: ", err)
+			return err
+		}
+		if upToDate {
+			az.updateCache(fwRuleCollectionGrpObj)
+			return nil
+		}
+		if az.configIsSame(fwRuleCollectionGrpObj) {
+			// The generated config didn't change since the last deployment, so the live one was changed outside of the controller.
+			if az.driftPolicy == DriftPolicyAlert {
+				klog.Info("Rule collection group was changed outside of the controller, not correcting it as the drift policy is ", az.driftPolicy)
+				return nil
+			}
+			az.configCache = nil
+		}
 	}
 
 	if az.configIsSame(fwRuleCollectionGrpObj) {
+		configCacheHits.WithLabelValues(az.fwPolicyRuleCollectionGroupName).Inc()
 		klog.Info("cache: Config has NOT changed! No need to connect to ARM.")
 		return
 	}
@@ -242,44 +648,69 @@ func (az *azClient) BuildPolicy(erulesList azurefirewallrulesv1.AzureFirewallRul
 	configJSON, _ := dumpSanitizedJSON(fwRuleCollectionGrpObj)
 	klog.Infof("Generated config:\n%s", string(configJSON))
 
-	//Poll for policy provisioning state and update the policy if the provisioning state is not "Updating"
-	isPolicyInUpdatingState := false
-	for {
-		fwPolicyObj, err := az.fwPolicyClient.Get(az.ctx, string(az.resourceGroupName), az.fwPolicyName, &a.FirewallPoliciesClientGetOptions{Expand: nil})
-		if err != nil || *fwPolicyObj.Properties.ProvisioningState != a.ProvisioningStateUpdating {
-			break
-		} else {
-			if !isPolicyInUpdatingState {
-				klog.Info("FW Policy is in the Updating state, waiting for the update to complete.....")
-				isPolicyInUpdatingState = true
-			}
-		}
+	defer az.lockFirewallPolicy()()
+	if err = az.waitForPolicyUpdate(); err != nil {
+		az.configCache = nil
+		klog.Error("Error getting the Firewall Policy: ", err)
+		az.recordDeploymentEvent(objects, corev1.EventTypeWarning, EventReasonDeploymentFailed, "Failed to deploy rule collection group %s to firewall policy %s: %v", az.fwPolicyRuleCollectionGroupName, az.fwPolicyName, err)
+		return
 	}
 
 	// Initiate deployment
 	klog.Info("BEGIN firewall policy deployment")
-	fwRuleCollectionGrp, err1 := az.fwPolicyRuleCollectionGroupClient.CreateOrUpdate(az.ctx, string(az.resourceGroupName), az.fwPolicyName, az.fwPolicyRuleCollectionGroupName, *fwRuleCollectionGrpObj)
-
-	err1 = fwRuleCollectionGrp.WaitForCompletionRef(az.ctx, az.fwPolicyRuleCollectionGroupClient.BaseClient.Client)
+	az.recordDeploymentEvent(objects, corev1.EventTypeNormal, EventReasonDeploymentStarted, "Deploying rule collection group %s to firewall policy %s", az.fwPolicyRuleCollectionGroupName, az.fwPolicyName)
+	fwRuleCollectionGrp, err := az.fwPolicyRuleCollectionGroupClient.CreateOrUpdate(az.ctx, string(az.resourceGroupName), az.fwPolicyName, az.fwPolicyRuleCollectionGroupName, *fwRuleCollectionGrpObj)
+	if err == nil {
+		err = fwRuleCollectionGrp.WaitForCompletionRef(az.ctx, az.fwPolicyRuleCollectionGroupClient.BaseClient.Client)
+	}
+	observeARMRequest(opRuleCollectionGroupCreateOrUpdate, err)
 
 	// Cache Phase //
 	// ----------- //
-	if err1 != nil {
+	if err != nil {
 		az.configCache = nil
-		klog.Error("Error updating the Firewall Policy: ", err1)
+		klog.Error("Error updating the Firewall Policy: ", err)
+		az.recordDeploymentEvent(objects, corev1.EventTypeWarning, EventReasonDeploymentFailed, "Failed to deploy rule collection group %s to firewall policy %s: %v", az.fwPolicyRuleCollectionGroupName, az.fwPolicyName, err)
 		return
 	}
 
+	if result, err1 := fwRuleCollectionGrp.Result(az.fwPolicyRuleCollectionGroupClient); err1 == nil && result.Etag != nil {
+		az.ruleCollectionGroupETag = *result.Etag
+	}
+
 	klog.Info("cache: Updated with latest applied config.")
 	az.updateCache(fwRuleCollectionGrpObj)
+	az.correctDrift()
 
 	klog.Info("Applied generated firewall policy configuration.....")
+	az.recordDeploymentEvent(objects, corev1.EventTypeNormal, EventReasonDeploymentSucceeded, "Deployed rule collection group %s to firewall policy %s", az.fwPolicyRuleCollectionGroupName, az.fwPolicyName)
 	return
 }
 
+// waitForPolicyUpdate polls the provisioning state of the firewall policy until it is not "Updating" anymore, as
+// the firewall policy accepts a single update at a time.
+func (az *azClient) waitForPolicyUpdate() error {
+	isPolicyInUpdatingState := false
+	return utils.RetryWithBackoff(policyUpdatingRetries, az.retryPause, policyUpdatingMaxRetryPause, func() (utils.Retriable, error) {
+		fwPolicyObj, err := az.fwPolicyClient.Get(az.ctx, string(az.resourceGroupName), az.fwPolicyName, &a.FirewallPoliciesClientGetOptions{Expand: nil})
+		observeARMRequest(opFirewallPolicyGet, err)
+		if err != nil {
+			return utils.Retriable(false), err
+		}
+		if fwPolicyObj.Properties != nil && fwPolicyObj.Properties.ProvisioningState != nil && *fwPolicyObj.Properties.ProvisioningState == a.ProvisioningStateUpdating {
+			if !isPolicyInUpdatingState {
+				klog.Info("FW Policy is in the Updating state, waiting for the update to complete.....")
+				isPolicyInUpdatingState = true
+			}
+			return utils.Retriable(true), errPolicyUpdating
+		}
+		return utils.Retriable(false), nil
+	})
+}
+
 func (az *azClient) FetchFirewallPolicyLocation() string {
 	fwPolicyObj, err := az.fwPolicyClient.Get(az.ctx, string(az.resourceGroupName), az.fwPolicyName, &a.FirewallPoliciesClientGetOptions{Expand: nil})
-
+	observeARMRequest(opFirewallPolicyGet, err)
 	if err != nil {
 		klog.Error("Firewall Policy not found", err)
 	} else {
@@ -0,0 +1,355 @@
+package azure
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	azurefirewallrulesv1 "github.com/Azure/azure-firewall-egress-controller/pkg/api/v1"
+	azfake "github.com/Azure/azure-firewall-egress-controller/pkg/azure/fake"
+	a "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/network/armnetwork/v2"
+	n "github.com/Azure/azure-sdk-for-go/services/network/mgmt/2021-03-01/network"
+	"github.com/Azure/go-autorest/autorest/to"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	fake "sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+const (
+	testSubscriptionID = "00000000-0000-0000-0000-000000000000"
+	testResourceGroup  = "rg"
+	testFwPolicy       = "fw-policy"
+	testRuleCollGroup  = "aks-egress"
+)
+
+func newTestNode(name string, labels map[string]string, ip string) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: labels,
+		},
+		Status: corev1.NodeStatus{
+			Addresses: []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: ip}},
+		},
+	}
+}
+
+func newTestAzClientWithFakeARM(t *testing.T, arm *azfake.ARM, obj ...client.Object) (*azClient, client.Client) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if err := azurefirewallrulesv1.AddToScheme(scheme); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(obj...).Build()
+
+	arm.AddFirewallPolicy(testSubscriptionID, testResourceGroup, testFwPolicy, "westeurope")
+	az := NewAzClientWithTransport(testSubscriptionID, testResourceGroup, testFwPolicy, testRuleCollGroup, 400, k8sClient, arm, arm.Credential()).(*azClient)
+	if loc := az.FetchFirewallPolicyLocation(); loc != "westeurope" {
+		t.Fatalf("Expected firewall policy location %s, but got: %s", "westeurope", loc)
+	}
+	return az, k8sClient
+}
+
+func nodeIpGroupNameOf(k string, v string) string {
+	return NodeIpGroupName("", labels.SelectorFromSet(labels.Set{k: v}))
+}
+
+func ipGroupAddresses(t *testing.T, arm *azfake.ARM, name string) []string {
+	ipGroup, ok := arm.IPGroup(azfake.IPGroupID(testSubscriptionID, testResourceGroup, name))
+	if !ok {
+		t.Fatalf("Expected IP Group %s to exist", name)
+	}
+	var addresses []string
+	for _, address := range ipGroup.Properties.IPAddresses {
+		addresses = append(addresses, *address)
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+func TestProcessRequestWithFakeARM(t *testing.T) {
+	rules := newTestFirewallRules()
+	rules.Spec.EgressRules[0].Rules = []azurefirewallrulesv1.AzureFirewallEgressrulesRulesSpec{
+		{
+			RuleCollectionName: "allow-service",
+			Priority:           200,
+			RuleName:           "github",
+			TargetFqdns:        []string{"github.com"},
+			Protocol:           []string{"HTTPS:443"},
+			Action:             "Allow",
+			RuleType:           "Application",
+		},
+	}
+	rules.Spec.EgressRules[1].Rules = []azurefirewallrulesv1.AzureFirewallEgressrulesRulesSpec{
+		{
+			RuleCollectionName:   "allow-db",
+			Priority:             300,
+			RuleName:             "sql",
+			DestinationAddresses: []string{"10.0.0.4"},
+			DestinationPorts:     []string{"1433"},
+			Protocol:             []string{"TCP"},
+			Action:               "Allow",
+			RuleType:             "Network",
+		},
+	}
+
+	arm := azfake.NewARM()
+	arm.PendingPolls = 1
+	az, k8sClient := newTestAzClientWithFakeARM(t, arm,
+		&rules,
+		newTestNode("node-1", map[string]string{"app": "service"}, "10.240.0.4"),
+		newTestNode("node-2", map[string]string{"app": "service"}, "10.240.0.5"),
+		newTestNode("node-3", map[string]string{"app": "db"}, "10.240.0.6"),
+	)
+	ctx := context.Background()
+
+	if err := az.processRequest(ctx, ctrl.Request{}, nil); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	if addresses := ipGroupAddresses(t, arm, nodeIpGroupNameOf("app", "service")); !reflect.DeepEqual(addresses, []string{"10.240.0.4", "10.240.0.5"}) {
+		t.Errorf("Expected addresses %v, but got: %v", []string{"10.240.0.4", "10.240.0.5"}, addresses)
+	}
+	if addresses := ipGroupAddresses(t, arm, nodeIpGroupNameOf("app", "db")); !reflect.DeepEqual(addresses, []string{"10.240.0.6"}) {
+		t.Errorf("Expected addresses %v, but got: %v", []string{"10.240.0.6"}, addresses)
+	}
+
+	rcg, ok := arm.RuleCollectionGroup(azfake.RuleCollectionGroupID(testSubscriptionID, testResourceGroup, testFwPolicy, testRuleCollGroup))
+	if !ok {
+		t.Fatalf("Expected rule collection group %s to exist", testRuleCollGroup)
+	}
+	if rcg.ProvisioningState != n.ProvisioningStateSucceeded {
+		t.Errorf("Expected provisioning state %s, but got: %s", n.ProvisioningStateSucceeded, rcg.ProvisioningState)
+	}
+	if *rcg.Priority != 400 {
+		t.Errorf("Expected priority %d, but got: %d", 400, *rcg.Priority)
+	}
+	ruleCollections := *rcg.RuleCollections
+	if len(ruleCollections) != 2 {
+		t.Fatalf("Expected %d rule collections, but got: %d", 2, len(ruleCollections))
+	}
+	for _, rc := range ruleCollections {
+		ruleCollection := rc.(n.FirewallPolicyFilterRuleCollection)
+		var sourceIPGroups []string
+		switch rule := (*ruleCollection.Rules)[0].(type) {
+		case n.ApplicationRule:
+			sourceIPGroups = *rule.SourceIPGroups
+		case n.Rule:
+			sourceIPGroups = *rule.SourceIPGroups
+		}
+		expected := map[string]string{"allow-service": nodeIpGroupNameOf("app", "service"), "allow-db": nodeIpGroupNameOf("app", "db")}[*ruleCollection.Name]
+		if !reflect.DeepEqual(sourceIPGroups, []string{azfake.IPGroupID(testSubscriptionID, testResourceGroup, expected)}) {
+			t.Errorf("Expected source IP Groups of %s to be %s, but got: %v", *ruleCollection.Name, expected, sourceIPGroups)
+		}
+	}
+
+	fwPolicy, _ := arm.FirewallPolicy(azfake.FirewallPolicyID(testSubscriptionID, testResourceGroup, testFwPolicy))
+	if *fwPolicy.Properties.ProvisioningState != azfake.ProvisioningStateSucceeded {
+		t.Errorf("Expected firewall policy provisioning state %s, but got: %s", azfake.ProvisioningStateSucceeded, *fwPolicy.Properties.ProvisioningState)
+	}
+
+	updated := &azurefirewallrulesv1.AzureFirewallRules{}
+	if err := k8sClient.Get(ctx, types.NamespacedName{Name: rules.Name}, updated); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if !meta.IsStatusConditionTrue(updated.Status.Conditions, azurefirewallrulesv1.ConditionTypeReady) {
+		t.Errorf("Expected condition %s to be True, but got: %v", azurefirewallrulesv1.ConditionTypeReady, updated.Status.Conditions)
+	}
+	if updated.Status.RuleCollectionGroupETag != *rcg.Etag {
+		t.Errorf("Expected etag %s, but got: %s", *rcg.Etag, updated.Status.RuleCollectionGroupETag)
+	}
+
+	// A node joining the pool is added to the IP Group and the unchanged config is not pushed again.
+	if err := k8sClient.Create(ctx, newTestNode("node-4", map[string]string{"app": "db"}, "10.240.0.7")); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if err := az.processRequest(ctx, ctrl.Request{}, nil); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if addresses := ipGroupAddresses(t, arm, nodeIpGroupNameOf("app", "db")); !reflect.DeepEqual(addresses, []string{"10.240.0.6", "10.240.0.7"}) {
+		t.Errorf("Expected addresses %v, but got: %v", []string{"10.240.0.6", "10.240.0.7"}, addresses)
+	}
+	rcgPuts := 0
+	for _, req := range arm.Requests() {
+		if req == http.MethodPut+" "+azfake.RuleCollectionGroupID(testSubscriptionID, testResourceGroup, testFwPolicy, testRuleCollGroup) {
+			rcgPuts++
+		}
+	}
+	if rcgPuts != 1 {
+		t.Errorf("Expected %d rule collection group updates, but got: %d", 1, rcgPuts)
+	}
+}
+
+func TestProcessRequestWithFakeARMFailure(t *testing.T) {
+	rules := newTestFirewallRules()
+	arm := azfake.NewARM()
+	az, k8sClient := newTestAzClientWithFakeARM(t, arm, &rules, newTestNode("node-1", map[string]string{"app": "service"}, "10.240.0.4"))
+	ctx := context.Background()
+
+	arm.FailNext(http.MethodPut, azfake.RuleCollectionGroupID(testSubscriptionID, testResourceGroup, testFwPolicy, testRuleCollGroup), http.StatusBadRequest)
+	if err := az.processRequest(ctx, ctrl.Request{}, nil); err == nil {
+		t.Errorf("Expected an error, but got: nil")
+	}
+	if _, ok := arm.RuleCollectionGroup(azfake.RuleCollectionGroupID(testSubscriptionID, testResourceGroup, testFwPolicy, testRuleCollGroup)); ok {
+		t.Errorf("Expected rule collection group %s not to exist", testRuleCollGroup)
+	}
+
+	updated := &azurefirewallrulesv1.AzureFirewallRules{}
+	if err := k8sClient.Get(ctx, types.NamespacedName{Name: rules.Name}, updated); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if !meta.IsStatusConditionFalse(updated.Status.Conditions, azurefirewallrulesv1.ConditionTypeSynced) {
+		t.Errorf("Expected condition %s to be False, but got: %v", azurefirewallrulesv1.ConditionTypeSynced, updated.Status.Conditions)
+	}
+}
+
+func TestBuildPolicyWaitsForFirewallPolicyUpdate(t *testing.T) {
+	rules := newTestFirewallRules()
+	arm := azfake.NewARM()
+	az, _ := newTestAzClientWithFakeARM(t, arm, &rules, newTestNode("node-1", map[string]string{"app": "service"}, "10.240.0.4"))
+	policyID := azfake.FirewallPolicyID(testSubscriptionID, testResourceGroup, testFwPolicy)
+
+	arm.SetProvisioningState(policyID, azfake.ProvisioningStateUpdating)
+	time.AfterFunc(300*time.Millisecond, func() {
+		arm.SetProvisioningState(policyID, azfake.ProvisioningStateSucceeded)
+	})
+	if err := az.processRequest(context.Background(), ctrl.Request{}, nil); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if _, ok := arm.RuleCollectionGroup(azfake.RuleCollectionGroupID(testSubscriptionID, testResourceGroup, testFwPolicy, testRuleCollGroup)); !ok {
+		t.Errorf("Expected rule collection group %s to exist", testRuleCollGroup)
+	}
+}
+
+func TestProcessRequestReturnsIpGroupErrors(t *testing.T) {
+	rules := newTestFirewallRules()
+	arm := azfake.NewARM()
+	az, _ := newTestAzClientWithFakeARM(t, arm, &rules, newTestNode("node-1", map[string]string{"app": "service"}, "10.240.0.4"))
+
+	arm.FailNext(http.MethodPut, azfake.IPGroupID(testSubscriptionID, testResourceGroup, nodeIpGroupNameOf("app", "service")), http.StatusBadRequest)
+	if err := az.processRequest(context.Background(), ctrl.Request{}, nil); err == nil {
+		t.Errorf("Expected an error, but got: nil")
+	}
+	// The other egress rules are still applied.
+	if _, ok := arm.RuleCollectionGroup(azfake.RuleCollectionGroupID(testSubscriptionID, testResourceGroup, testFwPolicy, testRuleCollGroup)); !ok {
+		t.Errorf("Expected rule collection group %s to exist", testRuleCollGroup)
+	}
+}
+
+func TestProcessRequestResolvesDestinationIpGroups(t *testing.T) {
+	sharedID := azfake.IPGroupID("11111111-1111-1111-1111-111111111111", "shared-rg", "shared-services")
+	rules := newTestFirewallRules()
+	rules.Spec.EgressRules = rules.Spec.EgressRules[:1]
+	rules.Spec.EgressRules[0].Rules = []azurefirewallrulesv1.AzureFirewallEgressrulesRulesSpec{
+		{RuleCollectionName: "allow-shared", Priority: 300, RuleName: "shared", DestinationIPGroups: []string{"local-services", sharedID}, DestinationPorts: []string{"443"}, Protocol: []string{"TCP"}, Action: "Allow", RuleType: "Network"},
+	}
+	arm := azfake.NewARM()
+	arm.AddIPGroup(testSubscriptionID, testResourceGroup, "local-services", "westeurope", []string{"10.1.0.0/24"})
+	az, _ := newTestAzClientWithFakeARM(t, arm, &rules, newTestNode("node-1", map[string]string{"app": "service"}, "10.240.0.4"))
+
+	if err := az.processRequest(context.Background(), ctrl.Request{}, nil); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	rcg, ok := arm.RuleCollectionGroup(azfake.RuleCollectionGroupID(testSubscriptionID, testResourceGroup, testFwPolicy, testRuleCollGroup))
+	if !ok {
+		t.Fatalf("Expected rule collection group %s to exist", testRuleCollGroup)
+	}
+	rule := (*(*rcg.RuleCollections)[0].(n.FirewallPolicyFilterRuleCollection).Rules)[0].(n.Rule)
+	expected := []string{azfake.IPGroupID(testSubscriptionID, testResourceGroup, "local-services"), sharedID}
+	if !reflect.DeepEqual(*rule.DestinationIPGroups, expected) {
+		t.Errorf("Expected destination IP Groups %v, but got: %v", expected, *rule.DestinationIPGroups)
+	}
+}
+
+func TestProcessRequestExcludesRulesWithoutProtocols(t *testing.T) {
+	rules := newDriftTestRules()
+	rules.Spec.EgressRules[0].Rules = append(rules.Spec.EgressRules[0].Rules, azurefirewallrulesv1.AzureFirewallEgressrulesRulesSpec{
+		RuleCollectionName: "allow-ftp", Priority: 300, RuleName: "ftp", TargetFqdns: []string{"ftp.example.com"}, Protocol: []string{"FTP:21"}, Action: "Allow", RuleType: "Application",
+	})
+	arm := azfake.NewARM()
+	az, k8sClient := newTestAzClientWithFakeARM(t, arm, &rules, newTestNode("node-1", map[string]string{"app": "service"}, "10.240.0.4"))
+
+	if err := az.processRequest(context.Background(), ctrl.Request{}, nil); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if names := liveRuleCollectionNames(t, arm); !reflect.DeepEqual(names, []string{"allow-service"}) {
+		t.Errorf("Expected rule collections %v, but got: %v", []string{"allow-service"}, names)
+	}
+
+	updated := &azurefirewallrulesv1.AzureFirewallRules{}
+	if err := k8sClient.Get(context.Background(), types.NamespacedName{Name: rules.Name}, updated); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if condition := meta.FindStatusCondition(updated.Status.Conditions, azurefirewallrulesv1.ConditionTypeDegraded); condition == nil || condition.Status != metav1.ConditionTrue {
+		t.Errorf("Expected condition %s to be %s, but got: %v", azurefirewallrulesv1.ConditionTypeDegraded, metav1.ConditionTrue, condition)
+	}
+	if msg := updated.Status.EgressRules[0].Error; msg == "" {
+		t.Errorf("Expected an error for egress rule %s, but got none", updated.Status.EgressRules[0].Name)
+	}
+}
+
+func TestProcessRequestExcludesRulesWithMissingDestinationIpGroups(t *testing.T) {
+	rules := newDriftTestRules()
+	rules.Spec.EgressRules[0].Rules = append(rules.Spec.EgressRules[0].Rules, azurefirewallrulesv1.AzureFirewallEgressrulesRulesSpec{
+		RuleCollectionName: "allow-shared", Priority: 300, RuleName: "shared", DestinationIPGroups: []string{"local-servics"}, DestinationPorts: []string{"443"}, Protocol: []string{"TCP"}, Action: "Allow", RuleType: "Network",
+	})
+	arm := azfake.NewARM()
+	arm.AddIPGroup(testSubscriptionID, testResourceGroup, "local-services", "westeurope", []string{"10.1.0.0/24"})
+	az, k8sClient := newTestAzClientWithFakeARM(t, arm, &rules, newTestNode("node-1", map[string]string{"app": "service"}, "10.240.0.4"))
+
+	if err := az.processRequest(context.Background(), ctrl.Request{}, nil); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if names := liveRuleCollectionNames(t, arm); !reflect.DeepEqual(names, []string{"allow-service"}) {
+		t.Errorf("Expected rule collections %v, but got: %v", []string{"allow-service"}, names)
+	}
+
+	updated := &azurefirewallrulesv1.AzureFirewallRules{}
+	if err := k8sClient.Get(context.Background(), types.NamespacedName{Name: rules.Name}, updated); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if condition := meta.FindStatusCondition(updated.Status.Conditions, azurefirewallrulesv1.ConditionTypeDegraded); condition == nil || condition.Status != metav1.ConditionTrue {
+		t.Errorf("Expected condition %s to be %s, but got: %v", azurefirewallrulesv1.ConditionTypeDegraded, metav1.ConditionTrue, condition)
+	}
+	if msg := updated.Status.EgressRules[0].Error; !strings.Contains(msg, "local-servics") {
+		t.Errorf("Expected an error about IP Group %s, but got: %q", "local-servics", msg)
+	}
+}
+
+func TestResolveDestinationIpGroupsCopiesRules(t *testing.T) {
+	localServicesID := azfake.IPGroupID(testSubscriptionID, testResourceGroup, "local-services")
+	ipGroupsInRG := map[string]*a.IPGroup{
+		"local-services": {Name: to.StringPtr("local-services"), ID: to.StringPtr(localServicesID)},
+	}
+	policy := azurefirewallrulesv1.EgressPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "allow-shared", Namespace: "team-a"},
+		Spec: azurefirewallrulesv1.EgressPolicySpec{
+			Rules: []azurefirewallrulesv1.AzureFirewallEgressrulesRulesSpec{
+				{RuleCollectionName: "allow-shared", Priority: 300, RuleName: "shared", DestinationIPGroups: []string{"local-services"}, DestinationPorts: []string{"443"}, Protocol: []string{"TCP"}, Action: "Allow", RuleType: "Network"},
+			},
+		},
+	}
+	fwRulesList := azurefirewallrulesv1.AzureFirewallRulesList{Items: []azurefirewallrulesv1.AzureFirewallRules{egressPolicyToFirewallRules(policy)}}
+
+	resolveDestinationIpGroups(&fwRulesList, ipGroupsInRG, map[string]string{})
+	expected := []string{localServicesID}
+	if ipGroups := fwRulesList.Items[0].Spec.EgressRules[0].Rules[0].DestinationIPGroups; !reflect.DeepEqual(ipGroups, expected) {
+		t.Errorf("Expected destination IP Groups %v, but got: %v", expected, ipGroups)
+	}
+	if ipGroups := policy.Spec.Rules[0].DestinationIPGroups; !reflect.DeepEqual(ipGroups, []string{"local-services"}) {
+		t.Errorf("Expected the EgressPolicy to be unchanged, but got: %v", ipGroups)
+	}
+}
@@ -0,0 +1,531 @@
+// -------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package azure
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	azurefirewallrulesv1 "github.com/Azure/azure-firewall-egress-controller/pkg/api/v1"
+	utils "github.com/Azure/azure-firewall-egress-controller/pkg/utils"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/go-autorest/autorest"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// targetKey identifies a rule collection group of a firewall policy.
+func targetKey(subscriptionID string, resourceGroupName string, fwPolicyName string, fwPolicyRuleCollectionGroupName string) string {
+	fwPolicyID := utils.ResourceID(utils.SubscriptionID(subscriptionID), utils.ResourceGroup(resourceGroupName), "Microsoft.Network", "firewallPolicies", fwPolicyName)
+	return strings.ToLower(fwPolicyID + "/ruleCollectionGroups/" + fwPolicyRuleCollectionGroupName)
+}
+
+func targetKeyOf(ref *azurefirewallrulesv1.FirewallPolicyReference) string {
+	subscriptionID, resourceGroupName, fwPolicyName := utils.ParseResourceID(ref.ResourceID)
+	return targetKey(string(subscriptionID), string(resourceGroupName), string(fwPolicyName), ref.RuleCollectionGroup)
+}
+
+func (az *azClient) targetKey() string {
+	return targetKey(az.subscriptionID, az.resourceGroupName, az.fwPolicyName, az.fwPolicyRuleCollectionGroupName)
+}
+
+// owns returns true if the rules of an object with the given firewallPolicy reference are applied by this client.
+func (az *azClient) owns(ref *azurefirewallrulesv1.FirewallPolicyReference) bool {
+	if ref == nil {
+		return az.defaultTargetKey == "" || az.defaultTargetKey == az.targetKey()
+	}
+	return targetKeyOf(ref) == az.targetKey()
+}
+
+func (az *azClient) ownedFirewallRules(items []azurefirewallrulesv1.AzureFirewallRules) []azurefirewallrulesv1.AzureFirewallRules {
+	var owned []azurefirewallrulesv1.AzureFirewallRules
+	for _, item := range items {
+		if az.owns(item.Spec.FirewallPolicy) {
+			owned = append(owned, item)
+		}
+	}
+	return owned
+}
+
+// ownedEgressPolicies returns the EgressPolicies applied by this client. Namespaced EgressPolicies can't choose their
+// rule collection group, they are all applied to the one configured in the controller.
+func (az *azClient) ownedEgressPolicies(items []azurefirewallrulesv1.EgressPolicy) []azurefirewallrulesv1.EgressPolicy {
+	if !az.owns(nil) {
+		return nil
+	}
+	return items
+}
+
+// desiredIpGroupsRegistry records the IP Groups desired by every rule collection group of a client set, so that
+// the garbage collection of one client doesn't delete an IP Group another client still references.
+type desiredIpGroupsRegistry struct {
+	mu       sync.Mutex
+	byTarget map[string]map[string]bool
+}
+
+func (az *azClient) recordDesiredIpGroups(desiredIpGroups map[string]bool) {
+	if az.ipGroupRegistry == nil {
+		return
+	}
+	az.ipGroupRegistry.mu.Lock()
+	defer az.ipGroupRegistry.mu.Unlock()
+	az.ipGroupRegistry.byTarget[az.targetKey()] = desiredIpGroups
+}
+
+// desiredIpGroupsInResourceGroup returns the IP Groups desired by any client managing a firewall policy in the
+// resource group of this client.
+func (az *azClient) desiredIpGroupsInResourceGroup(desiredIpGroups map[string]bool) map[string]bool {
+	if az.ipGroupRegistry == nil {
+		return desiredIpGroups
+	}
+	az.ipGroupRegistry.mu.Lock()
+	defer az.ipGroupRegistry.mu.Unlock()
+
+	resourceGroupKey := az.resourceGroupKey() + "/"
+	desired := make(map[string]bool)
+	for key, ipGroups := range az.ipGroupRegistry.byTarget {
+		if !strings.HasPrefix(key, resourceGroupKey) {
+			continue
+		}
+		for name := range ipGroups {
+			desired[name] = true
+		}
+	}
+	for name := range desiredIpGroups {
+		desired[name] = true
+	}
+	return desired
+}
+
+// ruleCollectionGroupPriorities records the priorities of the rule collection groups of every client of a set, so
+// that the rule collection groups a config overflows into don't take the priority of the ones of another client.
+type ruleCollectionGroupPriorities struct {
+	mu       sync.Mutex
+	byTarget map[string]map[int32]string
+}
+
+func (az *azClient) recordPriorities(shards []ruleCollectionGroupShard) {
+	if az.priorities == nil {
+		return
+	}
+	priorities := make(map[int32]string, len(shards))
+	for _, shard := range shards {
+		priorities[shard.priority] = shard.name
+	}
+	az.priorities.mu.Lock()
+	defer az.priorities.mu.Unlock()
+	az.priorities.byTarget[az.targetKey()] = priorities
+}
+
+// otherTargetPriorities returns the priorities of the rule collection groups of the other clients managing the
+// firewall policy of this client.
+func (az *azClient) otherTargetPriorities() map[int32]string {
+	used := make(map[int32]string)
+	if az.priorities == nil {
+		return used
+	}
+	az.priorities.mu.Lock()
+	defer az.priorities.mu.Unlock()
+
+	firewallPolicyKey := az.firewallPolicyKey() + "/"
+	for key, priorities := range az.priorities.byTarget {
+		if key == az.targetKey() || !strings.HasPrefix(key, firewallPolicyKey) {
+			continue
+		}
+		for priority, name := range priorities {
+			used[priority] = name
+		}
+	}
+	return used
+}
+
+// keyedMutex serializes the clients of a set updating the same Azure resource, as a firewall policy accepts a single
+// update at a time and the clients managing the same IP Group would otherwise overwrite each other's update.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+func newKeyedMutex() *keyedMutex {
+	return &keyedMutex{locks: make(map[string]*sync.Mutex)}
+}
+
+// lock locks the mutex of the key and returns the function unlocking it. A nil keyedMutex doesn't lock anything.
+func (m *keyedMutex) lock(key string) func() {
+	if m == nil {
+		return func() {}
+	}
+	m.mu.Lock()
+	l, ok := m.locks[key]
+	if !ok {
+		l = &sync.Mutex{}
+		m.locks[key] = l
+	}
+	m.mu.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+func (az *azClient) firewallPolicyKey() string {
+	return strings.ToLower(utils.ResourceID(utils.SubscriptionID(az.subscriptionID), utils.ResourceGroup(az.resourceGroupName), "Microsoft.Network", "firewallPolicies", az.fwPolicyName))
+}
+
+func (az *azClient) resourceGroupKey() string {
+	return strings.ToLower(utils.ResourceGroupID(utils.SubscriptionID(az.subscriptionID), utils.ResourceGroup(az.resourceGroupName)))
+}
+
+// lockFirewallPolicy waits for the other clients of the set to finish updating the firewall policy of the client.
+func (az *azClient) lockFirewallPolicy() func() {
+	return az.policyLocks.lock(az.firewallPolicyKey())
+}
+
+// lockIpGroups waits for the other clients of the set to finish updating the IP Groups of the resource group of the
+// client.
+func (az *azClient) lockIpGroups() func() {
+	return az.ipGroupLocks.lock(az.resourceGroupKey())
+}
+
+// azClientSet manages one azClient, with its own queue and config cache, per rule collection group.
+type azClientSet struct {
+	defaultClient *azClient
+	newClient     func(subscriptionID string, resourceGroupName string, fwPolicyName string, fwPolicyRuleCollectionGroupName string, fwPolicyRuleCollectionGroupPriority int32) AzClient
+	client        client.Client
+	registry      *desiredIpGroupsRegistry
+	policyLocks   *keyedMutex
+	ipGroupLocks  *keyedMutex
+	taintBarrier  *taintRemovalBarrier
+	priorities    *ruleCollectionGroupPriorities
+
+	mu      sync.Mutex
+	clients map[string]*azClient
+	// pollers holds the pending IP Group updates of every resource group, shared by the clients managing it.
+	pollers    map[string]map[string]*ipGroupUpdate
+	stops      map[string]context.CancelFunc
+	authorizer autorest.Authorizer
+	dryRun     bool
+	recorder   record.EventRecorder
+	// unmanagedRulesPolicy is empty until it is set, in which case the clients keep their default.
+	unmanagedRulesPolicy string
+	driftPolicy          string
+	driftCheckPeriod     time.Duration
+	clusterName          string
+	// ctx is the context of the manager once the client set is started. The clients created afterwards are
+	// started with it.
+	ctx context.Context
+}
+
+// NewAzClientSet returns an Azure Client that applies the rules of the objects without a firewallPolicy reference
+// to the given rule collection group, and creates a client for every other rule collection group referenced by
+// the AzureFirewallRules and EgressPolicy objects.
+func NewAzClientSet(subscriptionID string, resourceGroupName string, fwPolicyName string, fwPolicyRuleCollectionGroupName string, fwPolicyRuleCollectionGroupPriority int32, clientID string, client client.Client) AzClient {
+	return newAzClientSet(subscriptionID, resourceGroupName, fwPolicyName, fwPolicyRuleCollectionGroupName, fwPolicyRuleCollectionGroupPriority, client,
+		func(subscriptionID string, resourceGroupName string, fwPolicyName string, fwPolicyRuleCollectionGroupName string, fwPolicyRuleCollectionGroupPriority int32) AzClient {
+			return NewAzClient(subscriptionID, resourceGroupName, fwPolicyName, fwPolicyRuleCollectionGroupName, fwPolicyRuleCollectionGroupPriority, clientID, client)
+		})
+}
+
+// NewAzClientSetWithTransport returns a client set whose clients send every ARM request through the given transport.
+func NewAzClientSetWithTransport(subscriptionID string, resourceGroupName string, fwPolicyName string, fwPolicyRuleCollectionGroupName string, fwPolicyRuleCollectionGroupPriority int32, client client.Client, transport Transport, cred azcore.TokenCredential) AzClient {
+	return newAzClientSet(subscriptionID, resourceGroupName, fwPolicyName, fwPolicyRuleCollectionGroupName, fwPolicyRuleCollectionGroupPriority, client,
+		func(subscriptionID string, resourceGroupName string, fwPolicyName string, fwPolicyRuleCollectionGroupName string, fwPolicyRuleCollectionGroupPriority int32) AzClient {
+			return NewAzClientWithTransport(subscriptionID, resourceGroupName, fwPolicyName, fwPolicyRuleCollectionGroupName, fwPolicyRuleCollectionGroupPriority, client, transport, cred)
+		})
+}
+
+func newAzClientSet(subscriptionID string, resourceGroupName string, fwPolicyName string, fwPolicyRuleCollectionGroupName string, fwPolicyRuleCollectionGroupPriority int32, client client.Client, newClient func(string, string, string, string, int32) AzClient) AzClient {
+	defaultClient, ok := newClient(subscriptionID, resourceGroupName, fwPolicyName, fwPolicyRuleCollectionGroupName, fwPolicyRuleCollectionGroupPriority).(*azClient)
+	if !ok {
+		return nil
+	}
+	s := &azClientSet{
+		defaultClient: defaultClient,
+		newClient:     newClient,
+		client:        client,
+		registry:      &desiredIpGroupsRegistry{byTarget: make(map[string]map[string]bool)},
+		policyLocks:   newKeyedMutex(),
+		ipGroupLocks:  newKeyedMutex(),
+		priorities:    &ruleCollectionGroupPriorities{byTarget: make(map[string]map[int32]string)},
+		clients:       make(map[string]*azClient),
+		pollers:       make(map[string]map[string]*ipGroupUpdate),
+		stops:         make(map[string]context.CancelFunc),
+	}
+	s.taintBarrier = newTaintRemovalBarrier(s.targetKeys)
+	s.shareState(defaultClient)
+	s.clients[defaultClient.targetKey()] = defaultClient
+	return s
+}
+
+// shareState makes the client use the state shared by the clients of the set. It must be called with the lock held.
+func (s *azClientSet) shareState(az *azClient) {
+	az.defaultTargetKey = s.defaultClient.targetKey()
+	az.ipGroupRegistry = s.registry
+	az.policyLocks = s.policyLocks
+	az.ipGroupLocks = s.ipGroupLocks
+	az.taintBarrier = s.taintBarrier
+	az.priorities = s.priorities
+	// The rule collection group of a client takes its priority before the client applies it.
+	az.priorities.mu.Lock()
+	if _, ok := az.priorities.byTarget[az.targetKey()]; !ok {
+		az.priorities.byTarget[az.targetKey()] = map[int32]string{az.fwPolicyRuleCollectionGroupPriority: az.fwPolicyRuleCollectionGroupName}
+	}
+	az.priorities.mu.Unlock()
+	resourceGroupKey := az.resourceGroupKey()
+	if _, ok := s.pollers[resourceGroupKey]; !ok {
+		s.pollers[resourceGroupKey] = az.pollers
+	}
+	az.pollers = s.pollers[resourceGroupKey]
+}
+
+// targetKeys returns the rule collection groups managed by the client set.
+func (s *azClientSet) targetKeys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for key := range s.clients {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// firewallPolicyReferences returns the firewallPolicy references of every AzureFirewallRules object, nil for the
+// objects applied to the default rule collection group.
+func (s *azClientSet) firewallPolicyReferences(ctx context.Context) []*azurefirewallrulesv1.FirewallPolicyReference {
+	var refs []*azurefirewallrulesv1.FirewallPolicyReference
+	erulesList := &azurefirewallrulesv1.AzureFirewallRulesList{}
+	if err := s.client.List(ctx, erulesList); err != nil {
+		klog.Error("Error listing AzureFirewallRules: ", err)
+	}
+	for _, item := range erulesList.Items {
+		refs = append(refs, item.Spec.FirewallPolicy)
+	}
+	return refs
+}
+
+// discoverTargets creates a client for every rule collection group referenced by an object. A client is removed by
+// releaseTarget once its rule collection group is no longer referenced and has been emptied.
+func (s *azClientSet) discoverTargets(ctx context.Context) []*azClient {
+	refs := s.firewallPolicyReferences(ctx)
+	missing := make(map[string]*azurefirewallrulesv1.FirewallPolicyReference)
+	s.mu.Lock()
+	for _, ref := range refs {
+		if ref == nil {
+			continue
+		}
+		key := targetKeyOf(ref)
+		if _, ok := s.clients[key]; !ok {
+			missing[key] = ref
+		}
+	}
+	s.mu.Unlock()
+
+	// The clients are created without holding the lock, so that the other events are not blocked meanwhile.
+	created := make(map[string]*azClient)
+	for key, ref := range missing {
+		subscriptionID, resourceGroupName, fwPolicyName := utils.ParseResourceID(ref.ResourceID)
+		az, ok := s.newClient(string(subscriptionID), string(resourceGroupName), string(fwPolicyName), ref.RuleCollectionGroup, ref.RuleCollectionGroupPriority).(*azClient)
+		if !ok {
+			klog.Error("Failed to create the Azure client for ", ref.ResourceID, "/", ref.RuleCollectionGroup)
+			continue
+		}
+		created[key] = az
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, az := range created {
+		// Another event may have created the client in the meantime.
+		if _, ok := s.clients[key]; ok {
+			continue
+		}
+		s.shareState(az)
+		az.onReleased = s.releaseTarget
+		az.dryRun = s.dryRun
+		az.recorder = s.recorder
+		az.clusterName = s.clusterName
+		if s.unmanagedRulesPolicy != "" {
+			az.unmanagedRulesPolicy = s.unmanagedRulesPolicy
+		}
+		if s.driftPolicy != "" {
+			az.SetDriftPolicy(s.driftPolicy, s.driftCheckPeriod)
+		}
+		if s.authorizer != nil {
+			az.SetAuthorizer(s.authorizer)
+		}
+		klog.Infof("Managing rule collection group %s of firewall policy %s", missing[key].RuleCollectionGroup, missing[key].ResourceID)
+		s.clients[key] = az
+		s.startClient(key, az)
+	}
+	return s.sortedClients()
+}
+
+// releaseTarget removes the client of a rule collection group that holds no rules anymore, unless it is the default
+// one or an object references it again. It is called by the client after a successful event loop run.
+func (s *azClientSet) releaseTarget(ctx context.Context, az *azClient) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := az.targetKey()
+	if az == s.defaultClient || s.clients[key] != az {
+		return
+	}
+	// The objects are listed while holding the lock, so that discoverTargets either sees the client or creates a
+	// new one for an object created meanwhile.
+	for _, ref := range s.firewallPolicyReferences(ctx) {
+		if ref != nil && targetKeyOf(ref) == key {
+			return
+		}
+	}
+	klog.Infof("Stopped managing rule collection group %s of firewall policy %s", az.fwPolicyRuleCollectionGroupName, az.fwPolicyName)
+	delete(s.clients, key)
+	if stop, ok := s.stops[key]; ok {
+		stop()
+		delete(s.stops, key)
+	}
+	s.registry.mu.Lock()
+	delete(s.registry.byTarget, key)
+	s.registry.mu.Unlock()
+	s.priorities.mu.Lock()
+	delete(s.priorities.byTarget, key)
+	s.priorities.mu.Unlock()
+}
+
+// startClient runs the worker of a client once the client set is started. It must be called with the lock held.
+func (s *azClientSet) startClient(key string, az *azClient) {
+	if s.ctx == nil {
+		return
+	}
+	ctx, stop := context.WithCancel(s.ctx)
+	s.stops[key] = stop
+	go az.Start(ctx)
+}
+
+func (s *azClientSet) sortedClients() []*azClient {
+	var keys []string
+	for key := range s.clients {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var clients []*azClient
+	for _, key := range keys {
+		clients = append(clients, s.clients[key])
+	}
+	return clients
+}
+
+func (s *azClientSet) SetAuthorizer(authorizer autorest.Authorizer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.authorizer = authorizer
+	for _, az := range s.clients {
+		az.SetAuthorizer(authorizer)
+	}
+}
+
+func (s *azClientSet) SetDryRun(dryRun bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dryRun = dryRun
+	for _, az := range s.clients {
+		az.SetDryRun(dryRun)
+	}
+}
+
+func (s *azClientSet) SetEventRecorder(recorder record.EventRecorder) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.recorder = recorder
+	for _, az := range s.clients {
+		az.SetEventRecorder(recorder)
+	}
+}
+
+func (s *azClientSet) SetUnmanagedRulesPolicy(policy string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unmanagedRulesPolicy = policy
+	for _, az := range s.clients {
+		az.SetUnmanagedRulesPolicy(policy)
+	}
+}
+
+func (s *azClientSet) SetClusterName(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clusterName = name
+	for _, az := range s.clients {
+		az.SetClusterName(name)
+	}
+}
+
+func (s *azClientSet) SetDriftPolicy(policy string, checkPeriod time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.driftPolicy = policy
+	s.driftCheckPeriod = checkPeriod
+	for _, az := range s.clients {
+		az.SetDriftPolicy(policy, checkPeriod)
+	}
+}
+
+// Start runs the worker of every client, each processing its rule collection group concurrently with the others,
+// until the context is cancelled.
+func (s *azClientSet) Start(ctx context.Context) error {
+	s.mu.Lock()
+	s.ctx = ctx
+	for key, az := range s.clients {
+		s.startClient(key, az)
+	}
+	s.mu.Unlock()
+	<-ctx.Done()
+	return nil
+}
+
+func (s *azClientSet) Plan(ctx context.Context) (err error) {
+	for _, az := range s.discoverTargets(ctx) {
+		if err1 := az.Plan(ctx); err1 != nil && err == nil {
+			err = err1
+		}
+	}
+	return
+}
+
+func (s *azClientSet) FetchFirewallPolicyLocation() string {
+	return s.defaultClient.FetchFirewallPolicyLocation()
+}
+
+// UpdateFirewallPolicy queues the event for every rule collection group, as node and pod events can affect all of them.
+func (s *azClientSet) UpdateFirewallPolicy(ctx context.Context, req ctrl.Request) error {
+	for _, az := range s.discoverTargets(ctx) {
+		az.UpdateFirewallPolicy(ctx, req)
+	}
+	return nil
+}
+
+func (s *azClientSet) processRequest(ctx context.Context, req ctrl.Request, nodesWithFwTaint []*corev1.Node) (err error) {
+	for _, az := range s.discoverTargets(ctx) {
+		if err1 := az.processRequest(ctx, req, nodesWithFwTaint); err1 != nil && err == nil {
+			err = err1
+		}
+	}
+	return
+}
+
+func (s *azClientSet) BuildPolicy(items azurefirewallrulesv1.AzureFirewallRulesList, erulesSourceAddresses map[string][]string) error {
+	return s.defaultClient.BuildPolicy(items, erulesSourceAddresses)
+}
+
+func (s *azClientSet) AddTaints(ctx context.Context, req ctrl.Request) {
+	s.defaultClient.AddTaints(ctx, req)
+}
+
+func (s *azClientSet) RemoveTaints(ctx context.Context, node *corev1.Node) {
+	s.defaultClient.RemoveTaints(ctx, node)
+}
@@ -0,0 +1,301 @@
+package azure
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	azurefirewallrulesv1 "github.com/Azure/azure-firewall-egress-controller/pkg/api/v1"
+	azfake "github.com/Azure/azure-firewall-egress-controller/pkg/azure/fake"
+	n "github.com/Azure/azure-sdk-for-go/services/network/mgmt/2021-03-01/network"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	fake "sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestOwns(t *testing.T) {
+	az := &azClient{
+		subscriptionID:                  "sub",
+		resourceGroupName:               "rg",
+		fwPolicyName:                    "fw-policy",
+		fwPolicyRuleCollectionGroupName: "aks-egress",
+	}
+	defaultRef := &azurefirewallrulesv1.FirewallPolicyReference{
+		ResourceID:          "/subscriptions/sub/resourceGroups/RG/providers/Microsoft.Network/firewallPolicies/fw-policy",
+		RuleCollectionGroup: "aks-egress",
+	}
+	otherRef := &azurefirewallrulesv1.FirewallPolicyReference{
+		ResourceID:          "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Network/firewallPolicies/fw-policy",
+		RuleCollectionGroup: "aks-egress-2",
+	}
+
+	type testCase struct {
+		Name             string
+		defaultTargetKey string
+		ref              *azurefirewallrulesv1.FirewallPolicyReference
+		ExpectedOutput   bool
+	}
+
+	testCases := []testCase{
+		{Name: "standalone-no-ref", ref: nil, ExpectedOutput: true},
+		{Name: "default-no-ref", defaultTargetKey: az.targetKey(), ref: nil, ExpectedOutput: true},
+		{Name: "other-no-ref", defaultTargetKey: "other", ref: nil, ExpectedOutput: false},
+		{Name: "same-ref", defaultTargetKey: "other", ref: defaultRef, ExpectedOutput: true},
+		{Name: "other-ref", defaultTargetKey: az.targetKey(), ref: otherRef, ExpectedOutput: false},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			az.defaultTargetKey = tc.defaultTargetKey
+			if output := az.owns(tc.ref); output != tc.ExpectedOutput {
+				t.Errorf("Expected %t, but got: %t", tc.ExpectedOutput, output)
+			}
+		})
+	}
+}
+
+func TestOwnedEgressPolicies(t *testing.T) {
+	az := &azClient{
+		subscriptionID:                  "sub",
+		resourceGroupName:               "rg",
+		fwPolicyName:                    "fw-policy",
+		fwPolicyRuleCollectionGroupName: "aks-egress",
+	}
+	policies := []azurefirewallrulesv1.EgressPolicy{{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "team-a"}}}
+
+	az.defaultTargetKey = az.targetKey()
+	if owned := az.ownedEgressPolicies(policies); len(owned) != 1 {
+		t.Errorf("Expected the default target to apply the EgressPolicy, but got: %v", owned)
+	}
+	az.defaultTargetKey = "other"
+	if owned := az.ownedEgressPolicies(policies); len(owned) != 0 {
+		t.Errorf("Expected another target not to apply the EgressPolicy, but got: %v", owned)
+	}
+}
+
+func TestAzClientSetWithFakeARM(t *testing.T) {
+	hubRef := &azurefirewallrulesv1.FirewallPolicyReference{
+		ResourceID:                  azfake.FirewallPolicyID(testSubscriptionID, "rg-hub", "fw-policy-hub"),
+		RuleCollectionGroup:         "spoke-1",
+		RuleCollectionGroupPriority: 500,
+	}
+	newRules := func(name string, ruleCollectionName string, ref *azurefirewallrulesv1.FirewallPolicyReference) *azurefirewallrulesv1.AzureFirewallRules {
+		return &azurefirewallrulesv1.AzureFirewallRules{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: azurefirewallrulesv1.AzureFirewallRulesSpec{
+				FirewallPolicy: ref,
+				EgressRules: []azurefirewallrulesv1.AzureFirewallEgressRulesSpec{
+					{
+						Name:         name,
+						NodeSelector: []map[string]string{{"app": "service"}},
+						Rules: []azurefirewallrulesv1.AzureFirewallEgressrulesRulesSpec{
+							{
+								RuleCollectionName: ruleCollectionName,
+								Priority:           200,
+								RuleName:           "github",
+								TargetFqdns:        []string{"github.com"},
+								Protocol:           []string{"HTTPS:443"},
+								Action:             "Allow",
+								RuleType:           "Application",
+							},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if err := azurefirewallrulesv1.AddToScheme(scheme); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	hubRules := newRules("hub-rules", "allow-hub", hubRef)
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		newRules("default-rules", "allow-default", nil),
+		hubRules,
+		newTestNode("node-1", map[string]string{"app": "service"}, "10.240.0.4"),
+	).Build()
+
+	arm := azfake.NewARM()
+	arm.AddFirewallPolicy(testSubscriptionID, testResourceGroup, testFwPolicy, "westeurope")
+	arm.AddFirewallPolicy(testSubscriptionID, "rg-hub", "fw-policy-hub", "northeurope")
+	s := NewAzClientSetWithTransport(testSubscriptionID, testResourceGroup, testFwPolicy, testRuleCollGroup, 400, k8sClient, arm, arm.Credential())
+	s.FetchFirewallPolicyLocation()
+	ctx := context.Background()
+
+	ruleCollectionNames := func(id string) []string {
+		rcg, ok := arm.RuleCollectionGroup(id)
+		if !ok {
+			t.Fatalf("Expected rule collection group %s to exist", id)
+		}
+		names := []string{}
+		for _, rc := range *rcg.RuleCollections {
+			names = append(names, *rc.(n.FirewallPolicyFilterRuleCollection).Name)
+		}
+		return names
+	}
+	defaultRCG := azfake.RuleCollectionGroupID(testSubscriptionID, testResourceGroup, testFwPolicy, testRuleCollGroup)
+	hubRCG := azfake.RuleCollectionGroupID(testSubscriptionID, "rg-hub", "fw-policy-hub", "spoke-1")
+
+	if err := s.processRequest(ctx, ctrl.Request{}, nil); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if names := ruleCollectionNames(defaultRCG); !reflect.DeepEqual(names, []string{"allow-default"}) {
+		t.Errorf("Expected rule collections %v, but got: %v", []string{"allow-default"}, names)
+	}
+	if names := ruleCollectionNames(hubRCG); !reflect.DeepEqual(names, []string{"allow-hub"}) {
+		t.Errorf("Expected rule collections %v, but got: %v", []string{"allow-hub"}, names)
+	}
+	hubIpGroup, ok := arm.IPGroup(azfake.IPGroupID(testSubscriptionID, "rg-hub", nodeIpGroupNameOf("app", "service")))
+	if !ok {
+		t.Fatalf("Expected IP Group %s to exist in %s", nodeIpGroupNameOf("app", "service"), "rg-hub")
+	}
+	if *hubIpGroup.Location != "northeurope" {
+		t.Errorf("Expected location %s, but got: %s", "northeurope", *hubIpGroup.Location)
+	}
+	if rcg, _ := arm.RuleCollectionGroup(hubRCG); *rcg.Priority != 500 {
+		t.Errorf("Expected priority %d, but got: %d", 500, *rcg.Priority)
+	}
+
+	// Moving the rules back to the default rule collection group empties the hub one.
+	if err := k8sClient.Get(ctx, types.NamespacedName{Name: hubRules.Name}, hubRules); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	hubRules.Spec.FirewallPolicy = nil
+	if err := k8sClient.Update(ctx, hubRules); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if err := s.processRequest(ctx, ctrl.Request{}, nil); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if names := ruleCollectionNames(defaultRCG); !reflect.DeepEqual(names, []string{"allow-default", "allow-hub"}) && !reflect.DeepEqual(names, []string{"allow-hub", "allow-default"}) {
+		t.Errorf("Expected rule collections %v, but got: %v", []string{"allow-default", "allow-hub"}, names)
+	}
+	if rcg, _ := arm.RuleCollectionGroup(hubRCG); rcg.RuleCollections != nil && len(*rcg.RuleCollections) != 0 {
+		t.Errorf("Expected no rule collections, but got: %d", len(*rcg.RuleCollections))
+	}
+}
+
+func TestAzClientSetStartProcessesEveryTarget(t *testing.T) {
+	hubRef := &azurefirewallrulesv1.FirewallPolicyReference{
+		ResourceID:                  azfake.FirewallPolicyID(testSubscriptionID, "rg-hub", "fw-policy-hub"),
+		RuleCollectionGroup:         "spoke-1",
+		RuleCollectionGroupPriority: 500,
+	}
+	defaultRules := newTestFirewallRules()
+	hubRules := newTestFirewallRules()
+	hubRules.Name = "hub-rules"
+	hubRules.Spec.FirewallPolicy = hubRef
+
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if err := azurefirewallrulesv1.AddToScheme(scheme); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(&defaultRules, &hubRules).Build()
+
+	arm := azfake.NewARM()
+	arm.AddFirewallPolicy(testSubscriptionID, testResourceGroup, testFwPolicy, "westeurope")
+	arm.AddFirewallPolicy(testSubscriptionID, "rg-hub", "fw-policy-hub", "northeurope")
+	s := NewAzClientSetWithTransport(testSubscriptionID, testResourceGroup, testFwPolicy, testRuleCollGroup, 400, k8sClient, arm, arm.Credential())
+	s.FetchFirewallPolicyLocation()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Start(ctx)
+	if err := s.UpdateFirewallPolicy(ctx, ctrl.Request{}); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	for _, id := range []string{
+		azfake.RuleCollectionGroupID(testSubscriptionID, testResourceGroup, testFwPolicy, testRuleCollGroup),
+		azfake.RuleCollectionGroupID(testSubscriptionID, "rg-hub", "fw-policy-hub", "spoke-1"),
+	} {
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			if _, ok := arm.RuleCollectionGroup(id); ok {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected rule collection group %s to be applied", id)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+}
+
+func TestAzClientSetSharedFirewallPolicy(t *testing.T) {
+	secondRef := &azurefirewallrulesv1.FirewallPolicyReference{
+		ResourceID:                  azfake.FirewallPolicyID(testSubscriptionID, testResourceGroup, testFwPolicy),
+		RuleCollectionGroup:         "aks-egress-2",
+		RuleCollectionGroupPriority: 500,
+	}
+	defaultRules := newTestFirewallRules()
+	secondRules := newTestFirewallRules()
+	secondRules.Name = "second-rules"
+	secondRules.Spec.FirewallPolicy = secondRef
+
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if err := azurefirewallrulesv1.AddToScheme(scheme); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(&defaultRules, &secondRules).Build()
+
+	arm := azfake.NewARM()
+	arm.AddFirewallPolicy(testSubscriptionID, testResourceGroup, testFwPolicy, "westeurope")
+	s := NewAzClientSetWithTransport(testSubscriptionID, testResourceGroup, testFwPolicy, testRuleCollGroup, 400, k8sClient, arm, arm.Credential()).(*azClientSet)
+	s.FetchFirewallPolicyLocation()
+	ctx := context.Background()
+
+	if err := s.processRequest(ctx, ctrl.Request{}, nil); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	secondRCG := azfake.RuleCollectionGroupID(testSubscriptionID, testResourceGroup, testFwPolicy, "aks-egress-2")
+	for _, id := range []string{azfake.RuleCollectionGroupID(testSubscriptionID, testResourceGroup, testFwPolicy, testRuleCollGroup), secondRCG} {
+		if _, ok := arm.RuleCollectionGroup(id); !ok {
+			t.Errorf("Expected rule collection group %s to exist", id)
+		}
+	}
+	clients := s.sortedClients()
+	if len(clients) != 2 {
+		t.Fatalf("Expected %d clients, but got: %d", 2, len(clients))
+	}
+	// Both clients update the same firewall policy and IP Groups, so they share their locks and pending updates.
+	if clients[0].policyLocks != clients[1].policyLocks || clients[0].ipGroupLocks != clients[1].ipGroupLocks || clients[0].taintBarrier != clients[1].taintBarrier {
+		t.Errorf("Expected the clients to share their locks")
+	}
+	if reflect.ValueOf(clients[0].pollers).Pointer() != reflect.ValueOf(clients[1].pollers).Pointer() {
+		t.Errorf("Expected the clients to share their IP Group pollers")
+	}
+	// The rule collection groups the default one overflows into must not take the priority of the other one.
+	if priorities := s.defaultClient.otherTargetPriorities(); !reflect.DeepEqual(priorities, map[int32]string{500: "aks-egress-2"}) {
+		t.Errorf("Expected priorities %v, but got: %v", map[int32]string{500: "aks-egress-2"}, priorities)
+	}
+
+	// The client of a rule collection group no longer referenced is removed once the rule collection group is emptied.
+	if err := k8sClient.Delete(ctx, &secondRules); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if err := s.processRequest(ctx, ctrl.Request{}, nil); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if rcg, _ := arm.RuleCollectionGroup(secondRCG); rcg.RuleCollections != nil && len(*rcg.RuleCollections) != 0 {
+		t.Errorf("Expected no rule collections, but got: %d", len(*rcg.RuleCollections))
+	}
+	if clients := s.sortedClients(); len(clients) != 1 || clients[0] != s.defaultClient {
+		t.Errorf("Expected only the default client, but got: %d clients", len(clients))
+	}
+}
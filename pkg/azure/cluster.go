@@ -0,0 +1,125 @@
+// -------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package azure
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	a "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/network/armnetwork/v2"
+	n "github.com/Azure/azure-sdk-for-go/services/network/mgmt/2021-03-01/network"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+// managedRuleDescription is the description of the rules generated by the controller. Rule collection groups have no
+// tags, so the description records that the controller owns the rules, and which cluster does.
+const managedRuleDescription = "Managed by azure-firewall-egress-controller"
+
+// clusterRuleDescriptionPrefix starts the description of the rules generated by a controller with a cluster name.
+const clusterRuleDescriptionPrefix = managedRuleDescription + " for cluster "
+
+// ipGroupCluster returns the cluster the IP Group is tagged with, or an empty string.
+func ipGroupCluster(ipGroup *a.IPGroup) string {
+	if ipGroup.Tags[ClusterTagKey] == nil {
+		return ""
+	}
+	return *ipGroup.Tags[ClusterTagKey]
+}
+
+// checkIpGroupCluster refuses to modify an IP Group tagged with another cluster.
+func (az *azClient) checkIpGroupCluster(ipGroup *a.IPGroup) error {
+	if cluster := ipGroupCluster(ipGroup); cluster != "" && cluster != az.clusterName {
+		return fmt.Errorf("IP Group %s belongs to cluster %s", *ipGroup.Name, cluster)
+	}
+	return nil
+}
+
+// ruleCollectionGroupDescriptionInfix separates the rule collection group the rules were generated for from the
+// rest of the description, so that the rule collection groups of other clients of the same cluster are told apart.
+const ruleCollectionGroupDescriptionInfix = " in rule collection group "
+
+// ruleOwnership identifies the client that generated a rule.
+type ruleOwnership struct {
+	cluster             string
+	ruleCollectionGroup string
+}
+
+// withManagedDescription marks the generated rules as managed by the controller, for the cluster when it has a name,
+// and for the rule collection group of the client. The rules keep the name of the first rule collection group when
+// they overflow into the next ones.
+func (az *azClient) withManagedDescription(ruleCollections *[]n.BasicFirewallPolicyRuleCollection) *[]n.BasicFirewallPolicyRuleCollection {
+	description := managedRuleDescription
+	if az.clusterName != "" {
+		description = clusterRuleDescriptionPrefix + az.clusterName
+	}
+	description += ruleCollectionGroupDescriptionInfix + az.fwPolicyRuleCollectionGroupName
+	for _, ruleCollection := range *ruleCollections {
+		for _, rule := range ruleCollectionRules(ruleCollection) {
+			switch r := rule.(type) {
+			case *n.ApplicationRule:
+				r.Description = to.StringPtr(description)
+			case *n.NatRule:
+				r.Description = to.StringPtr(description)
+			case *n.Rule:
+				r.Description = to.StringPtr(description)
+			}
+		}
+	}
+	return ruleCollections
+}
+
+// ruleOwner returns the cluster and the rule collection group the rule was generated for, and whether the
+// controller generated it at all. The cluster is empty for the rules of a controller without cluster name.
+func ruleOwner(rule n.BasicFirewallPolicyRule) (ruleOwnership, bool) {
+	description := canonicalRuleOf(rule).Description
+	var owner ruleOwnership
+	if index := strings.LastIndex(description, ruleCollectionGroupDescriptionInfix); index >= 0 {
+		owner.ruleCollectionGroup = description[index+len(ruleCollectionGroupDescriptionInfix):]
+		description = description[:index]
+	}
+	if description == managedRuleDescription {
+		return owner, true
+	}
+	if cluster := strings.TrimPrefix(description, clusterRuleDescriptionPrefix); cluster != description {
+		owner.cluster = cluster
+		return owner, true
+	}
+	return ruleOwnership{}, false
+}
+
+// ownsRule returns true if the controller generated the rule for the cluster and the rule collection group of the
+// client. The rules generated before the cluster had a name belong to the cluster, and the rules generated before
+// they were marked with a rule collection group belong to the client.
+func (az *azClient) ownsRule(rule n.BasicFirewallPolicyRule) bool {
+	owner, ok := ruleOwner(rule)
+	return ok && (owner.cluster == "" || owner.cluster == az.clusterName) &&
+		(owner.ruleCollectionGroup == "" || owner.ruleCollectionGroup == az.fwPolicyRuleCollectionGroupName)
+}
+
+// foreignOwners describes the other clusters and rule collection groups owning rules of the rule collection group.
+func (az *azClient) foreignOwners(fwRuleCollectionGrp *n.FirewallPolicyRuleCollectionGroup) []string {
+	owners := make(map[string]bool)
+	for _, ruleCollection := range ruleCollectionsOf(fwRuleCollectionGrp) {
+		for _, rule := range ruleCollectionRules(ruleCollection) {
+			owner, ok := ruleOwner(rule)
+			if !ok || az.ownsRule(rule) {
+				continue
+			}
+			if owner.cluster != "" && owner.cluster != az.clusterName {
+				owners["cluster "+owner.cluster] = true
+			} else {
+				owners["rule collection group "+owner.ruleCollectionGroup] = true
+			}
+		}
+	}
+	var foreign []string
+	for owner := range owners {
+		foreign = append(foreign, owner)
+	}
+	sort.Strings(foreign)
+	return foreign
+}
@@ -0,0 +1,115 @@
+package azure
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	azfake "github.com/Azure/azure-firewall-egress-controller/pkg/azure/fake"
+	a "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/network/armnetwork/v2"
+	"github.com/Azure/go-autorest/autorest/to"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+func TestClusterIpGroupNames(t *testing.T) {
+	selector := labels.SelectorFromSet(labels.Set{"app": "service"})
+
+	if name := NodeIpGroupName("", selector); name != "IPGroup-node-app-service-1d80579166" {
+		t.Errorf("Expected %s, but got: %s", "IPGroup-node-app-service-1d80579166", name)
+	}
+	if name := NodeIpGroupName("aks-prod", selector); !strings.HasPrefix(name, "IPGroup-node-aks-prod-app-service-") {
+		t.Errorf("Expected IP Group name to start with %s, but got: %s", "IPGroup-node-aks-prod-app-service-", name)
+	}
+	if NodeIpGroupName("aks-prod", selector) == NodeIpGroupName("aks-test", selector) {
+		t.Errorf("Expected distinct IP Group names for clusters %s and %s", "aks-prod", "aks-test")
+	}
+	if PodIpGroupName("aks-prod", "team-a", "web") == PodIpGroupName("aks-test", "team-a", "web") {
+		t.Errorf("Expected distinct IP Group names for clusters %s and %s", "aks-prod", "aks-test")
+	}
+}
+
+func TestOrphanedIpGroupsOfCluster(t *testing.T) {
+	newIpGroup := func(name string, cluster string) *a.IPGroup {
+		tags := map[string]*string{ManagedByTagKey: to.StringPtr(ManagedByTagValue)}
+		if cluster != "" {
+			tags[ClusterTagKey] = to.StringPtr(cluster)
+		}
+		return &a.IPGroup{Name: to.StringPtr(name), Tags: tags}
+	}
+	ipGroupsInRG := map[string]*a.IPGroup{
+		"IPGroup-node-aks-prod-old": newIpGroup("IPGroup-node-aks-prod-old", "aks-prod"),
+		"IPGroup-node-aks-test-old": newIpGroup("IPGroup-node-aks-test-old", "aks-test"),
+		"IPGroup-node-legacy":       newIpGroup("IPGroup-node-legacy", ""),
+		"IPGroup-node-untagged":     {Name: to.StringPtr("IPGroup-node-untagged")},
+	}
+
+	// The IP Group tagged before the cluster had a name could belong to another cluster unless it is named after
+	// a selector of the cluster.
+	expected := []string{"IPGroup-node-aks-prod-old"}
+	if output := orphanedIpGroups(ipGroupsInRG, map[string]bool{}, "aks-prod", nil); !reflect.DeepEqual(output, expected) {
+		t.Errorf("Expected %v, but got: %v", expected, output)
+	}
+	expected = []string{"IPGroup-node-aks-prod-old", "IPGroup-node-legacy"}
+	if output := orphanedIpGroups(ipGroupsInRG, map[string]bool{}, "aks-prod", map[string]bool{"IPGroup-node-legacy": true}); !reflect.DeepEqual(output, expected) {
+		t.Errorf("Expected %v, but got: %v", expected, output)
+	}
+	expected = []string{"IPGroup-node-legacy", "IPGroup-node-untagged"}
+	if output := orphanedIpGroups(ipGroupsInRG, map[string]bool{}, "", nil); !reflect.DeepEqual(output, expected) {
+		t.Errorf("Expected %v, but got: %v", expected, output)
+	}
+}
+
+func TestIpGroupOfAnotherClusterIsNotModified(t *testing.T) {
+	az, _ := newTestAzClientWithFakeARM(t, azfake.NewARM())
+	az.SetClusterName("aks-test")
+	ipGroupsInRG := map[string]*a.IPGroup{
+		"IPGroup-node-shared": {
+			Name: to.StringPtr("IPGroup-node-shared"),
+			Tags: map[string]*string{ManagedByTagKey: to.StringPtr(ManagedByTagValue), ClusterTagKey: to.StringPtr("aks-prod")},
+			Properties: &a.IPGroupPropertiesFormat{
+				IPAddresses: []*string{to.StringPtr("10.240.0.4")},
+			},
+		},
+	}
+
+	_, _, err := az.resolveIpGroup(context.Background(), "IPGroup-node-shared", "app in (service)", []*string{to.StringPtr("10.1.0.4")}, ipGroupsInRG)
+	if err == nil || !strings.Contains(err.Error(), "aks-prod") {
+		t.Errorf("Expected an error about cluster %s, but got: %v", "aks-prod", err)
+	}
+}
+
+func TestRuleCollectionGroupOfAnotherClusterIsNotModified(t *testing.T) {
+	rules := newDriftTestRules()
+	arm := azfake.NewARM()
+	prod, _ := newTestAzClientWithFakeARM(t, arm, rules.DeepCopy(), newTestNode("node-1", map[string]string{"app": "service"}, "10.240.0.4"))
+	prod.SetClusterName("aks-prod")
+	if err := prod.processRequest(context.Background(), ctrl.Request{}, nil); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if puts := countRuleCollectionGroupPuts(arm); puts != 1 {
+		t.Fatalf("Expected %d rule collection group updates, but got: %d", 1, puts)
+	}
+
+	test, k8sClient := newTestAzClientWithFakeARM(t, arm, rules.DeepCopy(), newTestNode("node-2", map[string]string{"app": "service"}, "10.1.0.4"))
+	test.SetClusterName("aks-test")
+	for i := 0; i < 2; i++ {
+		if err := test.processRequest(context.Background(), ctrl.Request{}, nil); err == nil {
+			t.Errorf("Expected an error, but got: nil")
+		}
+	}
+	if puts := countRuleCollectionGroupPuts(arm); puts != 1 {
+		t.Errorf("Expected %d rule collection group updates, but got: %d", 1, puts)
+	}
+	if condition := driftCondition(t, k8sClient, rules.Name); condition == nil || condition.Status != metav1.ConditionTrue || condition.Reason != reasonOtherCluster {
+		t.Errorf("Expected condition with reason %s, but got: %v", reasonOtherCluster, condition)
+	}
+
+	// The rules of the cluster itself are not foreign.
+	prod.liveRuleCollectionGroupChecked = false
+	if err := prod.processRequest(context.Background(), ctrl.Request{}, nil); err != nil {
+		t.Errorf("Expected no error, but got: %v", err)
+	}
+}
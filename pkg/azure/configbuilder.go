@@ -6,12 +6,12 @@
 package azure
 
 import (
-	"strconv"
-	"strings"
+	"fmt"
 
 	azurefirewallrulesv1 "github.com/Azure/azure-firewall-egress-controller/pkg/api/v1"
 	n "github.com/Azure/azure-sdk-for-go/services/network/mgmt/2021-03-01/network"
 	"github.com/Azure/go-autorest/autorest/to"
+	"k8s.io/klog/v2"
 )
 
 func BuildFirewallConfig(erulesList azurefirewallrulesv1.AzureFirewallRulesList, erulesSourceAddresses map[string][]string) *[]n.BasicFirewallPolicyRuleCollection {
@@ -19,20 +19,19 @@ func BuildFirewallConfig(erulesList azurefirewallrulesv1.AzureFirewallRulesList,
 
 	for _, item := range erulesList.Items {
 		for _, egressrule := range item.Spec.EgressRules {
-			if len(erulesSourceAddresses[egressrule.Name]) != 0 {
-				for _, rule := range egressrule.Rules {
-					if len(ruleCollections) == 0 || NotFoundRuleCollection(rule, ruleCollections) {
-						ruleCollection := BuildRuleCollection(egressrule, rule, erulesSourceAddresses)
-						ruleCollections = append(ruleCollections, ruleCollection)
-					} else {
-						for i := 0; i < len(ruleCollections); i++ {
-							ruleCollection := ruleCollections[i].(*n.FirewallPolicyFilterRuleCollection)
-							if rule.RuleCollectionName == *ruleCollection.Name {
-								fwRules := *ruleCollection.Rules
-								fwRule := GetRule(egressrule, rule, erulesSourceAddresses)
-								fwRules = append(fwRules, fwRule)
-								ruleCollection.Rules = &fwRules
-							}
+			hasSourceAddresses := len(erulesSourceAddresses[egressrule.Name]) != 0
+			for _, rule := range egressrule.Rules {
+				// Nat rules use their own source addresses rather than the IP Groups of the selected nodes.
+				if !hasSourceAddresses && rule.RuleType != azurefirewallrulesv1.RuleTypeNat {
+					continue
+				}
+				if len(ruleCollections) == 0 || NotFoundRuleCollection(rule, ruleCollections) {
+					ruleCollection := BuildRuleCollection(egressrule, rule, erulesSourceAddresses)
+					ruleCollections = append(ruleCollections, ruleCollection)
+				} else {
+					for i := 0; i < len(ruleCollections); i++ {
+						if rule.RuleCollectionName == GetRuleCollectionName(ruleCollections[i]) {
+							AppendRule(ruleCollections[i], GetRule(egressrule, rule, erulesSourceAddresses))
 						}
 					}
 				}
@@ -44,15 +43,42 @@ func BuildFirewallConfig(erulesList azurefirewallrulesv1.AzureFirewallRulesList,
 
 func NotFoundRuleCollection(rule azurefirewallrulesv1.AzureFirewallEgressrulesRulesSpec, ruleCollections []n.BasicFirewallPolicyRuleCollection) bool {
 	for i := 0; i < len(ruleCollections); i++ {
-		ruleCollection := ruleCollections[i].(*n.FirewallPolicyFilterRuleCollection)
-		if rule.RuleCollectionName == *ruleCollection.Name {
+		if rule.RuleCollectionName == GetRuleCollectionName(ruleCollections[i]) {
 			return false
 		}
 	}
 	return true
 }
 
+func GetRuleCollectionName(ruleCollection n.BasicFirewallPolicyRuleCollection) string {
+	if natRuleCollection, ok := ruleCollection.AsFirewallPolicyNatRuleCollection(); ok {
+		return *natRuleCollection.Name
+	}
+	filterRuleCollection, _ := ruleCollection.AsFirewallPolicyFilterRuleCollection()
+	return *filterRuleCollection.Name
+}
+
+func AppendRule(ruleCollection n.BasicFirewallPolicyRuleCollection, fwRule n.BasicFirewallPolicyRule) {
+	switch rc := ruleCollection.(type) {
+	case *n.FirewallPolicyNatRuleCollection:
+		fwRules := append(*rc.Rules, fwRule)
+		rc.Rules = &fwRules
+	case *n.FirewallPolicyFilterRuleCollection:
+		fwRules := append(*rc.Rules, fwRule)
+		rc.Rules = &fwRules
+	}
+}
+
 func BuildRuleCollection(egressrule azurefirewallrulesv1.AzureFirewallEgressRulesSpec, rule azurefirewallrulesv1.AzureFirewallEgressrulesRulesSpec, erulesSourceAddresses map[string][]string) n.BasicFirewallPolicyRuleCollection {
+	if rule.RuleType == "Nat" {
+		return &n.FirewallPolicyNatRuleCollection{
+			Name:               to.StringPtr(rule.RuleCollectionName),
+			Action:             &n.FirewallPolicyNatRuleCollectionAction{Type: n.FirewallPolicyNatRuleCollectionActionTypeDNAT},
+			Priority:           to.Int32Ptr(rule.Priority),
+			RuleCollectionType: GetRuleCollectionType(rule.RuleType),
+			Rules:              BuildRules(egressrule, rule, erulesSourceAddresses),
+		}
+	}
 	ruleCollection := &n.FirewallPolicyFilterRuleCollection{
 		Name:               to.StringPtr(rule.RuleCollectionName),
 		Action:             BuildAction(rule.Action),
@@ -107,79 +133,132 @@ func GetRule(egressrule azurefirewallrulesv1.AzureFirewallEgressRulesSpec, rule
 	} else if rule.RuleType == "Network" {
 		destinationAddresses := []string{}
 		destinationFqdns := []string{}
-		if rule.DestinationAddresses != nil {
-			destinationAddresses = rule.DestinationAddresses
-		}
+		destinationIpGroups := []string{}
+		// Azure takes the service tags as destination addresses.
+		destinationAddresses = append(destinationAddresses, rule.DestinationAddresses...)
+		destinationAddresses = append(destinationAddresses, rule.DestinationServiceTags...)
 		if rule.DestinationFqdns != nil {
 			destinationFqdns = rule.DestinationFqdns
 		}
+		if rule.DestinationIPGroups != nil {
+			destinationIpGroups = rule.DestinationIPGroups
+		}
 		fwRule := &n.Rule{
 			SourceIPGroups:       &(sourceAddresses),
 			DestinationAddresses: &(destinationAddresses),
 			DestinationFqdns:     &(destinationFqdns),
+			DestinationIPGroups:  &(destinationIpGroups),
 			DestinationPorts:     &(rule.DestinationPorts),
 			RuleType:             GetRuleType(rule.RuleType),
 			IPProtocols:          GetIpProtocols(rule.Protocol),
 			Name:                 to.StringPtr(rule.RuleName),
 		}
 		return fwRule
+	} else if rule.RuleType == "Nat" {
+		sourceAddresses := []string{"*"}
+		if rule.SourceAddresses != nil {
+			sourceAddresses = rule.SourceAddresses
+		}
+		fwRule := &n.NatRule{
+			SourceAddresses:      &(sourceAddresses),
+			DestinationAddresses: &(rule.DestinationAddresses),
+			DestinationPorts:     &(rule.DestinationPorts),
+			RuleType:             GetRuleType(rule.RuleType),
+			IPProtocols:          GetNatProtocols(rule.Protocol),
+			Name:                 to.StringPtr(rule.RuleName),
+			TranslatedPort:       to.StringPtr(rule.TranslatedPort),
+		}
+		if rule.TranslatedAddress != "" {
+			fwRule.TranslatedAddress = to.StringPtr(rule.TranslatedAddress)
+		} else {
+			fwRule.TranslatedFqdn = to.StringPtr(rule.TranslatedFqdn)
+		}
+		return fwRule
 	}
 	return fwRule
 
 }
 
+// GetApplicationProtocols converts the protocols of an Application rule. The webhook rejects malformed protocols, so
+// the ones that can't be parsed are skipped rather than widening the rule.
 func GetApplicationProtocols(protocol []string) *[]n.FirewallPolicyRuleApplicationProtocol {
 	var protocols []n.FirewallPolicyRuleApplicationProtocol
 
 	for i := 0; i < len(protocol); i++ {
-		p := strings.Split(protocol[i], ":")
-		port, _ := strconv.ParseInt(p[1], 10, 64)
-		protocolport := int32(port)
-		var protocolType n.FirewallPolicyRuleApplicationProtocolType
-		if p[0] == "HTTP" {
-			protocolType = n.FirewallPolicyRuleApplicationProtocolTypeHTTP
-		} else {
-			protocolType = n.FirewallPolicyRuleApplicationProtocolTypeHTTPS
+		protocolType, port, err := azurefirewallrulesv1.ParseApplicationProtocol(protocol[i])
+		if err != nil {
+			klog.Errorf("Skipping protocol %q of an Application rule: %v", protocol[i], err)
+			continue
 		}
 		ruleApplicationProtocol := n.FirewallPolicyRuleApplicationProtocol{
 			ProtocolType: protocolType,
-			Port:         &protocolport,
+			Port:         to.Int32Ptr(port),
 		}
 		protocols = append(protocols, ruleApplicationProtocol)
 	}
 	return &protocols
 }
 
+// GetIpProtocols converts the IP protocols of a Network rule. Unknown protocols are skipped rather than turned into
+// Any.
 func GetIpProtocols(protocol []string) *[]n.FirewallPolicyRuleNetworkProtocol {
+	return getIpProtocols(protocol, azurefirewallrulesv1.ParseNetworkProtocol)
+}
+
+// GetNatProtocols converts the IP protocols of a Nat rule, skipping the ones other than TCP and UDP.
+func GetNatProtocols(protocol []string) *[]n.FirewallPolicyRuleNetworkProtocol {
+	return getIpProtocols(protocol, azurefirewallrulesv1.ParseNatProtocol)
+}
+
+func getIpProtocols(protocol []string, parse func(string) (n.FirewallPolicyRuleNetworkProtocol, error)) *[]n.FirewallPolicyRuleNetworkProtocol {
 	var protocols []n.FirewallPolicyRuleNetworkProtocol
 
 	for i := 0; i < len(protocol); i++ {
-		if protocol[i] == "TCP" {
-			protocols = append(protocols, n.FirewallPolicyRuleNetworkProtocolTCP)
-		} else if protocol[i] == "UDP" {
-			protocols = append(protocols, n.FirewallPolicyRuleNetworkProtocolUDP)
-		} else if protocol[i] == "ICMP" {
-			protocols = append(protocols, n.FirewallPolicyRuleNetworkProtocolICMP)
-		} else {
-			protocols = append(protocols, n.FirewallPolicyRuleNetworkProtocolAny)
+		ipProtocol, err := parse(protocol[i])
+		if err != nil {
+			klog.Errorf("Skipping IP protocol %q: %v", protocol[i], err)
+			continue
 		}
+		protocols = append(protocols, ipProtocol)
 	}
 	return &protocols
 }
 
-func GetRuleType(ruleType string) n.RuleType {
+// ruleProtocolsError returns an error when none of the protocols of the rule can be converted. Azure rejects a rule
+// without protocol, and with it the whole rule collection group.
+func ruleProtocolsError(rule azurefirewallrulesv1.AzureFirewallEgressrulesRulesSpec) error {
+	for _, protocol := range rule.Protocol {
+		var err error
+		switch rule.RuleType {
+		case azurefirewallrulesv1.RuleTypeApplication:
+			_, _, err = azurefirewallrulesv1.ParseApplicationProtocol(protocol)
+		case azurefirewallrulesv1.RuleTypeNat:
+			_, err = azurefirewallrulesv1.ParseNatProtocol(protocol)
+		default:
+			_, err = azurefirewallrulesv1.ParseNetworkProtocol(protocol)
+		}
+		if err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("rule %s of rule collection %s has no valid protocol in %v", rule.RuleName, rule.RuleCollectionName, rule.Protocol)
+}
+
+func GetRuleType(ruleType azurefirewallrulesv1.RuleType) n.RuleType {
 	var ruletype n.RuleType
-	if ruleType == "Network" {
+	if ruleType == azurefirewallrulesv1.RuleTypeNetwork {
 		ruletype = "NetworkRule"
-	} else if ruleType == "Application" {
+	} else if ruleType == azurefirewallrulesv1.RuleTypeApplication {
 		ruletype = "ApplicationRule"
+	} else if ruleType == azurefirewallrulesv1.RuleTypeNat {
+		ruletype = "NatRule"
 	}
 	return ruletype
 }
 
-func GetRuleCollectionType(ruleType string) n.RuleCollectionType {
+func GetRuleCollectionType(ruleType azurefirewallrulesv1.RuleType) n.RuleCollectionType {
 	var ruleCollectionType n.RuleCollectionType
-	if ruleType == "Network" || ruleType == "Application" {
+	if ruleType == azurefirewallrulesv1.RuleTypeNetwork || ruleType == azurefirewallrulesv1.RuleTypeApplication {
 		ruleCollectionType = "FirewallPolicyFilterRuleCollection"
 	} else {
 		ruleCollectionType = "FirewallPolicyNatRuleCollection"
@@ -3,6 +3,7 @@ package azure
 import (
 	"testing"
 	"encoding/json"
+	"reflect"
 	"strings"
 
 	azurefirewallrulesv1 "github.com/Azure/azure-firewall-egress-controller/pkg/api/v1"
@@ -178,6 +179,7 @@ func TestBuildFirewallConfig(t *testing.T) {
 --                        "destinationFqdns": [
 --                            "*"
 --                        ],
+--                        "destinationIpGroups": [],
 --                        "destinationPorts": [
 --                            "*"
 --                        ],
@@ -198,6 +200,7 @@ func TestBuildFirewallConfig(t *testing.T) {
 --                            "*"
 --                        ],
 --                        "destinationFqdns": [],
+--                        "destinationIpGroups": [],
 --                        "destinationPorts": [
 --                            "*"
 --                        ],
@@ -262,3 +265,218 @@ func TestBuildFirewallConfig(t *testing.T) {
 		}
 	}
 }
+
+func TestBuildFirewallConfigNat(t *testing.T) {
+	erulesList := azurefirewallrulesv1.AzureFirewallRulesList{
+		Items: []azurefirewallrulesv1.AzureFirewallRules{
+			{
+				Spec: azurefirewallrulesv1.AzureFirewallRulesSpec{
+					EgressRules: []azurefirewallrulesv1.AzureFirewallEgressRulesSpec{
+						{
+							Name:         "test1",
+							NodeSelector: []map[string]string{{"app": "service"}},
+							Rules: []azurefirewallrulesv1.AzureFirewallEgressrulesRulesSpec{
+								{
+									RuleCollectionName:   "aks-fw-ng-dnat",
+									Priority:             100,
+									RuleName:             "ingress-https",
+									DestinationAddresses: []string{"20.1.2.3"},
+									DestinationPorts:     []string{"443"},
+									TranslatedAddress:    "10.240.0.100",
+									TranslatedPort:       "8443",
+									Protocol:             []string{"TCP"},
+									Action:               "DNAT",
+									RuleType:             "Nat",
+								},
+								{
+									RuleCollectionName:   "aks-fw-ng-dnat",
+									Priority:             100,
+									RuleName:             "ingress-dns",
+									SourceAddresses:      []string{"192.168.0.0/16"},
+									DestinationAddresses: []string{"20.1.2.3"},
+									DestinationPorts:     []string{"53"},
+									TranslatedFqdn:       "dns.internal.contoso.com",
+									TranslatedPort:       "53",
+									Protocol:             []string{"UDP"},
+									Action:               "DNAT",
+									RuleType:             "Nat",
+								},
+								{
+									RuleCollectionName: "aks-fw-ng-allow",
+									Priority:           210,
+									RuleName:           "rule1",
+									TargetFqdns:        []string{"*.google.com"},
+									Protocol:           []string{"HTTP:80"},
+									Action:             "Allow",
+									RuleType:           "Application",
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	erulesSourceAddresses := map[string][]string{
+		"test1": {"/subscriptions/7a06e974-7329-4485-87e7-3211b06c15aa/resourceGroups/afc-controller-setup-rg/providers/Microsoft.Network/ipGroups/IPGroup-node-appservice"},
+	}
+
+	ruleCollections := *BuildFirewallConfig(erulesList, erulesSourceAddresses)
+	if len(ruleCollections) != 2 {
+		t.Fatalf("Expected %d rule collections, but got: %d", 2, len(ruleCollections))
+	}
+
+	natRuleCollection, ok := ruleCollections[0].(*n.FirewallPolicyNatRuleCollection)
+	if !ok {
+		t.Fatalf("Expected a FirewallPolicyNatRuleCollection, but got: %T", ruleCollections[0])
+	}
+	if natRuleCollection.Action.Type != n.FirewallPolicyNatRuleCollectionActionTypeDNAT {
+		t.Errorf("Expected action %s, but got: %s", n.FirewallPolicyNatRuleCollectionActionTypeDNAT, natRuleCollection.Action.Type)
+	}
+	if natRuleCollection.RuleCollectionType != n.RuleCollectionTypeFirewallPolicyNatRuleCollection {
+		t.Errorf("Expected rule collection type %s, but got: %s", n.RuleCollectionTypeFirewallPolicyNatRuleCollection, natRuleCollection.RuleCollectionType)
+	}
+	if len(*natRuleCollection.Rules) != 2 {
+		t.Fatalf("Expected %d rules, but got: %d", 2, len(*natRuleCollection.Rules))
+	}
+
+	httpsRule := (*natRuleCollection.Rules)[0].(*n.NatRule)
+	if *httpsRule.TranslatedAddress != "10.240.0.100" || *httpsRule.TranslatedPort != "8443" || httpsRule.TranslatedFqdn != nil {
+		t.Errorf("Expected translation to %s:%s, but got: %v:%v", "10.240.0.100", "8443", httpsRule.TranslatedAddress, httpsRule.TranslatedPort)
+	}
+	if (*httpsRule.SourceAddresses)[0] != "*" {
+		t.Errorf("Expected source addresses %v, but got: %v", []string{"*"}, *httpsRule.SourceAddresses)
+	}
+	if httpsRule.RuleType != n.RuleTypeNatRule {
+		t.Errorf("Expected rule type %s, but got: %s", n.RuleTypeNatRule, httpsRule.RuleType)
+	}
+
+	dnsRule := (*natRuleCollection.Rules)[1].(*n.NatRule)
+	if *dnsRule.TranslatedFqdn != "dns.internal.contoso.com" || dnsRule.TranslatedAddress != nil {
+		t.Errorf("Expected translation to %s, but got: %v", "dns.internal.contoso.com", dnsRule.TranslatedFqdn)
+	}
+	if (*dnsRule.SourceAddresses)[0] != "192.168.0.0/16" {
+		t.Errorf("Expected source addresses %v, but got: %v", []string{"192.168.0.0/16"}, *dnsRule.SourceAddresses)
+	}
+	if (*dnsRule.IPProtocols)[0] != n.FirewallPolicyRuleNetworkProtocolUDP {
+		t.Errorf("Expected protocol %s, but got: %s", n.FirewallPolicyRuleNetworkProtocolUDP, (*dnsRule.IPProtocols)[0])
+	}
+
+	if _, ok := ruleCollections[1].(*n.FirewallPolicyFilterRuleCollection); !ok {
+		t.Errorf("Expected a FirewallPolicyFilterRuleCollection, but got: %T", ruleCollections[1])
+	}
+}
+
+func TestBuildFirewallConfigNatWithoutMatchingNodes(t *testing.T) {
+	erulesList := azurefirewallrulesv1.AzureFirewallRulesList{
+		Items: []azurefirewallrulesv1.AzureFirewallRules{
+			{
+				Spec: azurefirewallrulesv1.AzureFirewallRulesSpec{
+					EgressRules: []azurefirewallrulesv1.AzureFirewallEgressRulesSpec{
+						{
+							Name:         "test1",
+							NodeSelector: []map[string]string{{"app": "missing"}},
+							Rules: []azurefirewallrulesv1.AzureFirewallEgressrulesRulesSpec{
+								{
+									RuleCollectionName:   "aks-fw-ng-dnat",
+									Priority:             100,
+									RuleName:             "ingress-https",
+									DestinationAddresses: []string{"20.1.2.3"},
+									DestinationPorts:     []string{"443"},
+									TranslatedAddress:    "10.240.0.100",
+									TranslatedPort:       "8443",
+									Protocol:             []string{"TCP"},
+									Action:               "DNAT",
+									RuleType:             "Nat",
+								},
+								{
+									RuleCollectionName: "aks-fw-ng-allow",
+									Priority:           210,
+									RuleName:           "rule1",
+									TargetFqdns:        []string{"*.google.com"},
+									Protocol:           []string{"HTTP:80"},
+									Action:             "Allow",
+									RuleType:           "Application",
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	// No node matches the selector, or its IP Group could not be resolved: the DNAT rule doesn't use it.
+	ruleCollections := *BuildFirewallConfig(erulesList, map[string][]string{})
+	if len(ruleCollections) != 1 {
+		t.Fatalf("Expected %d rule collection, but got: %d", 1, len(ruleCollections))
+	}
+	natRuleCollection, ok := ruleCollections[0].(*n.FirewallPolicyNatRuleCollection)
+	if !ok {
+		t.Fatalf("Expected a FirewallPolicyNatRuleCollection, but got: %T", ruleCollections[0])
+	}
+	if len(*natRuleCollection.Rules) != 1 {
+		t.Errorf("Expected %d rule, but got: %d", 1, len(*natRuleCollection.Rules))
+	}
+}
+
+func TestGetProtocolsSkipsMalformedProtocols(t *testing.T) {
+	applicationProtocols := *GetApplicationProtocols([]string{"HTTP", "HTTPS:8443", "HTTPS:", "FTP:21", "HTTP:80:80"})
+	expectedApplicationProtocols := []n.FirewallPolicyRuleApplicationProtocol{
+		{ProtocolType: n.FirewallPolicyRuleApplicationProtocolTypeHTTP, Port: to.Int32Ptr(80)},
+		{ProtocolType: n.FirewallPolicyRuleApplicationProtocolTypeHTTPS, Port: to.Int32Ptr(8443)},
+	}
+	if !reflect.DeepEqual(applicationProtocols, expectedApplicationProtocols) {
+		t.Errorf("Expected application protocols %v, but got: %v", expectedApplicationProtocols, applicationProtocols)
+	}
+
+	ipProtocols := *GetIpProtocols([]string{"tcp", "TPC", "Any", "HTTPS"})
+	expectedIpProtocols := []n.FirewallPolicyRuleNetworkProtocol{n.FirewallPolicyRuleNetworkProtocolTCP, n.FirewallPolicyRuleNetworkProtocolAny}
+	if !reflect.DeepEqual(ipProtocols, expectedIpProtocols) {
+		t.Errorf("Expected IP protocols %v, but got: %v", expectedIpProtocols, ipProtocols)
+	}
+}
+
+func TestGetRuleNetworkDestinations(t *testing.T) {
+	egressRule := azurefirewallrulesv1.AzureFirewallEgressRulesSpec{Name: "test1"}
+	erulesSourceAddresses := map[string][]string{"test1": {"/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Network/ipGroups/IPGroup-node-appservice"}}
+	ipGroupID := "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Network/ipGroups/shared-services"
+
+	type testCase struct {
+		Name              string
+		rule              azurefirewallrulesv1.AzureFirewallEgressrulesRulesSpec
+		ExpectedAddresses []string
+		ExpectedIpGroups  []string
+	}
+	testCases := []testCase{
+		{
+			Name:              "service-tags",
+			rule:              azurefirewallrulesv1.AzureFirewallEgressrulesRulesSpec{RuleName: "key-vault", DestinationServiceTags: []string{"AzureKeyVault.WestEurope", "Storage"}, DestinationPorts: []string{"443"}, Protocol: []string{"TCP"}, RuleType: "Network"},
+			ExpectedAddresses: []string{"AzureKeyVault.WestEurope", "Storage"},
+			ExpectedIpGroups:  []string{},
+		},
+		{
+			Name:              "ip-groups",
+			rule:              azurefirewallrulesv1.AzureFirewallEgressrulesRulesSpec{RuleName: "shared", DestinationIPGroups: []string{ipGroupID}, DestinationPorts: []string{"*"}, Protocol: []string{"Any"}, RuleType: "Network"},
+			ExpectedAddresses: []string{},
+			ExpectedIpGroups:  []string{ipGroupID},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			rule, ok := GetRule(egressRule, tc.rule, erulesSourceAddresses).(*n.Rule)
+			if !ok {
+				t.Fatalf("Expected a network rule, but got: %T", rule)
+			}
+			if !reflect.DeepEqual(*rule.DestinationAddresses, tc.ExpectedAddresses) {
+				t.Errorf("Expected destination addresses %v, but got: %v", tc.ExpectedAddresses, *rule.DestinationAddresses)
+			}
+			if !reflect.DeepEqual(*rule.DestinationIPGroups, tc.ExpectedIpGroups) {
+				t.Errorf("Expected destination IP Groups %v, but got: %v", tc.ExpectedIpGroups, *rule.DestinationIPGroups)
+			}
+		})
+	}
+}
@@ -0,0 +1,413 @@
+// -------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package azure
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	azurefirewallrulesv1 "github.com/Azure/azure-firewall-egress-controller/pkg/api/v1"
+	n "github.com/Azure/azure-sdk-for-go/services/network/mgmt/2021-03-01/network"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/klog/v2"
+)
+
+// Policies for the rule collections and rules found in the live rule collection group that the controller
+// does not generate, e.g. because they were added in the portal.
+const (
+	// UnmanagedRulesOverwrite replaces them with the generated config.
+	UnmanagedRulesOverwrite = "overwrite"
+	// UnmanagedRulesAdopt keeps them in the rule collection group from then on.
+	UnmanagedRulesAdopt = "adopt"
+	// UnmanagedRulesRefuse doesn't update the rule collection group as long as they exist.
+	UnmanagedRulesRefuse = "refuse"
+)
+
+// Policies for the changes made to the rule collection group and the IP Groups outside of the controller, which
+// are detected by the periodic drift checks.
+const (
+	// DriftPolicyCorrect restores the generated config.
+	DriftPolicyCorrect = "correct"
+	// DriftPolicyAlert only reports the drift. It is corrected by the next change of the generated config.
+	DriftPolicyAlert = "alert"
+)
+
+// Reasons of the Drifted condition.
+const (
+	reasonInSync         = "InSync"
+	reasonDrifted        = "Drifted"
+	reasonDriftCorrected = "DriftCorrected"
+	reasonAdopted        = "Adopted"
+	reasonUnmanagedRules = "UnmanagedRules"
+	reasonOtherCluster   = "OwnedByAnotherCluster"
+)
+
+// ruleCollectionGroupDrift describes how the live rule collection group differs from the generated one.
+type ruleCollectionGroupDrift struct {
+	// Drifted is true when the live rule collection group differs from the generated one.
+	Drifted bool
+	// Changes are the changes needed to turn the live rule collection group into the generated one.
+	Changes []string
+	// UnmanagedRuleCollections are the names of the live rule collections the controller does not generate, and
+	// that hold rules the controller did not generate earlier either.
+	UnmanagedRuleCollections []string
+	// UnmanagedRules are the "<rule collection>/<rule>" names of the live rules the controller neither generates
+	// nor generated earlier, in the rule collections it manages.
+	UnmanagedRules []string
+}
+
+func (d ruleCollectionGroupDrift) hasUnmanagedRules() bool {
+	return len(d.UnmanagedRuleCollections) != 0 || len(d.UnmanagedRules) != 0
+}
+
+func (d ruleCollectionGroupDrift) String() string {
+	var parts []string
+	if len(d.UnmanagedRuleCollections) != 0 {
+		parts = append(parts, fmt.Sprintf("rule collections not managed by the controller: %s", strings.Join(d.UnmanagedRuleCollections, ", ")))
+	}
+	if len(d.UnmanagedRules) != 0 {
+		parts = append(parts, fmt.Sprintf("rules not managed by the controller: %s", strings.Join(d.UnmanagedRules, ", ")))
+	}
+	if len(parts) == 0 {
+		return "the rules differ from the generated config"
+	}
+	return strings.Join(parts, "; ")
+}
+
+// SetDriftPolicy sets how the changes made outside of the controller are handled and how often the live rule
+// collection group is compared with the generated one. A zero period disables the periodic comparison.
+func (az *azClient) SetDriftPolicy(policy string, checkPeriod time.Duration) {
+	az.driftPolicy = policy
+	az.driftCheckPeriod = checkPeriod
+}
+
+// driftCheckDue returns true when the live rule collection group should be compared with the generated one,
+// even if the generated one didn't change.
+func (az *azClient) driftCheckDue() bool {
+	return az.driftCheckPeriod > 0 && time.Since(az.lastDriftCheck) >= az.driftCheckPeriod
+}
+
+func sortedAddresses(addresses []*string) []string {
+	sorted := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		sorted = append(sorted, *address)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// recordAppliedIpGroup records the addresses of an IP Group that matches the generated config.
+func (az *azClient) recordAppliedIpGroup(name string, addresses []*string) {
+	az.appliedIpGroups[name] = sortedAddresses(addresses)
+	ipGroupDrifted.WithLabelValues(az.resourceGroupName, name).Set(0)
+}
+
+// ipGroupDrifted returns true if the live IP Group differs from the given addresses because it was changed outside
+// of the controller, i.e. the addresses didn't change since the controller last applied them.
+func (az *azClient) ipGroupDrifted(name string, addresses []*string) bool {
+	applied, ok := az.appliedIpGroups[name]
+	if !ok {
+		return false
+	}
+	return strings.Join(applied, ",") == strings.Join(sortedAddresses(addresses), ",")
+}
+
+// SetUnmanagedRulesPolicy sets how the rules added to the rule collection group outside of the controller are handled.
+func (az *azClient) SetUnmanagedRulesPolicy(policy string) {
+	az.unmanagedRulesPolicy = policy
+}
+
+func ruleCollectionRules(ruleCollection n.BasicFirewallPolicyRuleCollection) []n.BasicFirewallPolicyRule {
+	var rules *[]n.BasicFirewallPolicyRule
+	if natRuleCollection, ok := ruleCollection.AsFirewallPolicyNatRuleCollection(); ok {
+		rules = natRuleCollection.Rules
+	} else if filterRuleCollection, ok := ruleCollection.AsFirewallPolicyFilterRuleCollection(); ok {
+		rules = filterRuleCollection.Rules
+	}
+	if rules == nil {
+		return nil
+	}
+	return *rules
+}
+
+func ruleName(rule n.BasicFirewallPolicyRule) string {
+	var name *string
+	if applicationRule, ok := rule.AsApplicationRule(); ok {
+		name = applicationRule.Name
+	} else if natRule, ok := rule.AsNatRule(); ok {
+		name = natRule.Name
+	} else if networkRule, ok := rule.AsRule(); ok {
+		name = networkRule.Name
+	}
+	if name == nil {
+		return ""
+	}
+	return *name
+}
+
+func ruleCollectionsOf(fwRuleCollectionGrp *n.FirewallPolicyRuleCollectionGroup) []n.BasicFirewallPolicyRuleCollection {
+	if fwRuleCollectionGrp.FirewallPolicyRuleCollectionGroupProperties == nil || fwRuleCollectionGrp.RuleCollections == nil {
+		return nil
+	}
+	return *fwRuleCollectionGrp.RuleCollections
+}
+
+// compareRuleCollectionGroups compares the generated rule collection group with the live one. The live rules owned
+// by the controller are not unmanaged, even when the generated config doesn't have them anymore, e.g. because their
+// object was deleted: they are removed by the next deployment.
+func compareRuleCollectionGroups(desired *n.FirewallPolicyRuleCollectionGroup, live *n.FirewallPolicyRuleCollectionGroup, owned func(n.BasicFirewallPolicyRule) bool) ruleCollectionGroupDrift {
+	drift := ruleCollectionGroupDrift{}
+
+	desiredRules := make(map[string]map[string]bool)
+	for _, ruleCollection := range ruleCollectionsOf(desired) {
+		rules := make(map[string]bool)
+		for _, rule := range ruleCollectionRules(ruleCollection) {
+			rules[ruleName(rule)] = true
+		}
+		desiredRules[GetRuleCollectionName(ruleCollection)] = rules
+	}
+	for _, ruleCollection := range ruleCollectionsOf(live) {
+		name := GetRuleCollectionName(ruleCollection)
+		rules, ok := desiredRules[name]
+		if !ok {
+			if len(unownedRules(ruleCollection, owned)) != 0 || len(ruleCollectionRules(ruleCollection)) == 0 {
+				drift.UnmanagedRuleCollections = append(drift.UnmanagedRuleCollections, name)
+			}
+			continue
+		}
+		for _, rule := range unownedRules(ruleCollection, owned) {
+			if !rules[ruleName(rule)] {
+				drift.UnmanagedRules = append(drift.UnmanagedRules, name+"/"+ruleName(rule))
+			}
+		}
+	}
+	sort.Strings(drift.UnmanagedRuleCollections)
+	sort.Strings(drift.UnmanagedRules)
+
+	drift.Changes = diffRuleCollectionGroups(canonicalRuleCollectionGroupOf(live), canonicalRuleCollectionGroupOf(desired))
+	drift.Drifted = len(drift.Changes) != 0
+	return drift
+}
+
+// unownedRules returns the rules of the rule collection that are not owned by the controller.
+func unownedRules(ruleCollection n.BasicFirewallPolicyRuleCollection, owned func(n.BasicFirewallPolicyRule) bool) []n.BasicFirewallPolicyRule {
+	var rules []n.BasicFirewallPolicyRule
+	for _, rule := range ruleCollectionRules(ruleCollection) {
+		if !owned(rule) {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// ruleCollectionWithRules returns a copy of the rule collection holding the given rules.
+func ruleCollectionWithRules(ruleCollection n.BasicFirewallPolicyRuleCollection, rules []n.BasicFirewallPolicyRule) n.BasicFirewallPolicyRuleCollection {
+	if natRuleCollection, ok := ruleCollection.AsFirewallPolicyNatRuleCollection(); ok {
+		copied := *natRuleCollection
+		copied.Rules = &rules
+		return &copied
+	}
+	filterRuleCollection, _ := ruleCollection.AsFirewallPolicyFilterRuleCollection()
+	copied := *filterRuleCollection
+	copied.Rules = &rules
+	return &copied
+}
+
+// adoptRules records the unmanaged rule collections and rules of the live rule collection group, so that they are
+// kept in every generated rule collection group. The rules the controller generated earlier are not adopted.
+func (az *azClient) adoptRules(live *n.FirewallPolicyRuleCollectionGroup, drift ruleCollectionGroupDrift) {
+	unmanagedRuleCollections := make(map[string]bool)
+	for _, name := range drift.UnmanagedRuleCollections {
+		unmanagedRuleCollections[name] = true
+	}
+	unmanagedRules := make(map[string]bool)
+	for _, name := range drift.UnmanagedRules {
+		unmanagedRules[name] = true
+	}
+	for _, ruleCollection := range ruleCollectionsOf(live) {
+		name := GetRuleCollectionName(ruleCollection)
+		if unmanagedRuleCollections[name] {
+			az.adoptedRuleCollections = append(az.adoptedRuleCollections, ruleCollectionWithRules(ruleCollection, unownedRules(ruleCollection, az.ownsRule)))
+			continue
+		}
+		for _, rule := range ruleCollectionRules(ruleCollection) {
+			if unmanagedRules[name+"/"+ruleName(rule)] {
+				az.adoptedRules[name] = append(az.adoptedRules[name], rule)
+			}
+		}
+	}
+}
+
+// withAdoptedRules adds the adopted rule collections and rules to the generated ones. The generated rules win
+// over adopted rules with the same rule collection name.
+func (az *azClient) withAdoptedRules(ruleCollections *[]n.BasicFirewallPolicyRuleCollection) *[]n.BasicFirewallPolicyRuleCollection {
+	generated := make(map[string]bool)
+	for _, ruleCollection := range *ruleCollections {
+		name := GetRuleCollectionName(ruleCollection)
+		generated[name] = true
+		existing := make(map[string]bool)
+		for _, rule := range ruleCollectionRules(ruleCollection) {
+			existing[ruleName(rule)] = true
+		}
+		for _, rule := range az.adoptedRules[name] {
+			if !existing[ruleName(rule)] {
+				AppendRule(ruleCollection, rule)
+			}
+		}
+	}
+	for _, ruleCollection := range az.adoptedRuleCollections {
+		if !generated[GetRuleCollectionName(ruleCollection)] {
+			*ruleCollections = append(*ruleCollections, ruleCollection)
+		}
+	}
+	return ruleCollections
+}
+
+// checkLiveRuleCollectionGroup compares the generated rule collection group with the live one, applies the
+// unmanaged rules policy and returns whether the live rule collection group is already up to date.
+// It runs before the first deployment of every rule collection group of the client, so that a restart doesn't
+// redeploy an unchanged rule collection group, and before every deployment when the policy refuses to overwrite
+// unmanaged rules. A rule collection group holding rules of another cluster or client is never overwritten, and
+// is checked again by every run.
+func (az *azClient) checkLiveRuleCollectionGroup(name string, fwRuleCollectionGrp *n.FirewallPolicyRuleCollectionGroup, objects []k8sruntime.Object) (bool, error) {
+	live, err := az.fwPolicyRuleCollectionGroupClient.Get(az.ctx, az.resourceGroupName, az.fwPolicyName, name)
+	observeARMRequest(opRuleCollectionGroupGet, err)
+	if err != nil {
+		if live.Response.Response != nil && live.StatusCode == http.StatusNotFound {
+			klog.Infof("Rule collection group %s does not exist yet", name)
+			az.setLiveChecked(name)
+			az.setLiveCondition(name, metav1.ConditionFalse, reasonInSync, "The rule collection group does not exist yet")
+			return false, nil
+		}
+		return false, err
+	}
+
+	if owners := az.foreignOwners(&live); len(owners) != 0 {
+		message := fmt.Sprintf("Refusing to overwrite rule collection group %s, which contains rules of %s", name, strings.Join(owners, ", "))
+		az.setLiveCondition(name, metav1.ConditionTrue, reasonOtherCluster, message)
+		az.recordDeploymentEvent(objects, corev1.EventTypeWarning, EventReasonClusterConflict, message)
+		return false, fmt.Errorf("rule collection group %s contains rules of %s", name, strings.Join(owners, ", "))
+	}
+
+	drift := compareRuleCollectionGroups(fwRuleCollectionGrp, &live, az.ownsRule)
+
+	if drift.hasUnmanagedRules() {
+		switch az.unmanagedRulesPolicy {
+		case UnmanagedRulesRefuse:
+			az.setLiveCondition(name, metav1.ConditionTrue, reasonUnmanagedRules, "Refusing to overwrite the rule collection group, which contains "+drift.String())
+			az.recordDeploymentEvent(objects, corev1.EventTypeWarning, EventReasonUnmanagedRefused, "Refusing to overwrite rule collection group %s, which contains %s", name, drift.String())
+			return false, fmt.Errorf("rule collection group %s contains %s", name, drift.String())
+		case UnmanagedRulesAdopt:
+			if !az.liveChecked(name) {
+				klog.Infof("Adopting the %s of rule collection group %s", drift.String(), name)
+				// Only the rule collections adopted from this rule collection group are added to it, the ones
+				// adopted from the other rule collection groups of the client are already deployed there.
+				adopted := az.adoptedRuleCollections
+				az.adoptedRuleCollections = nil
+				az.adoptRules(&live, drift)
+				fwRuleCollectionGrp.RuleCollections = az.withAdoptedRules(fwRuleCollectionGrp.RuleCollections)
+				az.adoptedRuleCollections = append(adopted, az.adoptedRuleCollections...)
+				az.recordDeploymentEvent(objects, corev1.EventTypeNormal, EventReasonUnmanagedAdopted, "Adopted the %s of rule collection group %s", drift.String(), name)
+				drift = compareRuleCollectionGroups(fwRuleCollectionGrp, &live, az.ownsRule)
+			}
+		}
+	}
+	az.setLiveChecked(name)
+
+	if !drift.Drifted {
+		klog.Infof("Rule collection group %s is up to date", name)
+		if name == az.fwPolicyRuleCollectionGroupName && live.Etag != nil {
+			az.ruleCollectionGroupETag = *live.Etag
+		}
+		if len(az.adoptedRuleCollections) != 0 || len(az.adoptedRules) != 0 {
+			az.setLiveCondition(name, metav1.ConditionFalse, reasonAdopted, "The rules added outside of the controller were adopted")
+		} else {
+			az.setLiveCondition(name, metav1.ConditionFalse, reasonInSync, "The live rule collection group matches the generated config")
+		}
+		return true, nil
+	}
+
+	klog.Infof("Rule collection group %s differs from the generated config: %s\n%s", name, drift.String(), strings.Join(drift.Changes, "\n"))
+	az.setLiveCondition(name, metav1.ConditionTrue, reasonDrifted, fmt.Sprintf("The live rule collection group %s differs from the generated config: %s", name, drift.String()))
+	az.recordDeploymentEvent(objects, corev1.EventTypeWarning, EventReasonDriftDetected, "Rule collection group %s was changed outside of the controller: %s", name, drift.String())
+	return false, nil
+}
+
+// liveChecked returns whether the rule collection group was compared with the live one since the client started.
+func (az *azClient) liveChecked(name string) bool {
+	if name == az.fwPolicyRuleCollectionGroupName {
+		return az.liveRuleCollectionGroupChecked
+	}
+	return az.liveShardsChecked[name]
+}
+
+// setLiveChecked records the comparison of the rule collection group with the live one. The drift check period
+// starts with the comparison of the first rule collection group, which runs before the other ones.
+func (az *azClient) setLiveChecked(name string) {
+	if name == az.fwPolicyRuleCollectionGroupName {
+		az.liveRuleCollectionGroupChecked = true
+		az.lastDriftCheck = time.Now()
+		return
+	}
+	az.liveShardsChecked[name] = true
+}
+
+// setLiveCondition records the outcome of the comparison of a rule collection group with the live one. The first
+// rule collection group is compared first and sets the condition, the other ones only report their drift.
+func (az *azClient) setLiveCondition(name string, status metav1.ConditionStatus, reason string, message string) {
+	if name != az.fwPolicyRuleCollectionGroupName && status != metav1.ConditionTrue {
+		return
+	}
+	az.setDriftCondition(status, reason, message)
+}
+
+// setDriftCondition records the outcome of the last comparison with the live rule collection group, which is
+// written to the status of the objects.
+func (az *azClient) setDriftCondition(status metav1.ConditionStatus, reason string, message string) {
+	az.driftCondition = &metav1.Condition{
+		Type:    azurefirewallrulesv1.ConditionTypeDrifted,
+		Status:  status,
+		Reason:  reason,
+		Message: message,
+	}
+	if status == metav1.ConditionTrue {
+		ruleCollectionGroupDrifted.WithLabelValues(az.fwPolicyRuleCollectionGroupName).Set(1)
+	} else {
+		ruleCollectionGroupDrifted.WithLabelValues(az.fwPolicyRuleCollectionGroupName).Set(0)
+	}
+}
+
+// correctDrift records that the deployment overwrote the changes made outside of the controller.
+func (az *azClient) correctDrift() {
+	if az.driftCondition != nil && az.driftCondition.Status == metav1.ConditionTrue {
+		az.setDriftCondition(metav1.ConditionFalse, reasonDriftCorrected, "The changes made outside of the controller were overwritten")
+	}
+}
+
+func (az *azClient) applyDriftCondition(conditions *[]metav1.Condition, generation int64) {
+	if len(az.driftedIpGroups) != 0 {
+		meta.SetStatusCondition(conditions, metav1.Condition{
+			Type:               azurefirewallrulesv1.ConditionTypeDrifted,
+			Status:             metav1.ConditionTrue,
+			Reason:             reasonDrifted,
+			Message:            "IP Groups changed outside of the controller: " + strings.Join(az.driftedIpGroups, ", "),
+			ObservedGeneration: generation,
+		})
+		return
+	}
+	if az.driftCondition == nil {
+		return
+	}
+	condition := *az.driftCondition
+	condition.ObservedGeneration = generation
+	meta.SetStatusCondition(conditions, condition)
+}
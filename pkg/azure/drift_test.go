@@ -0,0 +1,393 @@
+package azure
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	azurefirewallrulesv1 "github.com/Azure/azure-firewall-egress-controller/pkg/api/v1"
+	azfake "github.com/Azure/azure-firewall-egress-controller/pkg/azure/fake"
+	n "github.com/Azure/azure-sdk-for-go/services/network/mgmt/2021-03-01/network"
+	"github.com/Azure/go-autorest/autorest/to"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func newDriftTestRules() azurefirewallrulesv1.AzureFirewallRules {
+	rules := newTestFirewallRules()
+	rules.Spec.EgressRules = rules.Spec.EgressRules[:1]
+	rules.Spec.EgressRules[0].Rules = []azurefirewallrulesv1.AzureFirewallEgressrulesRulesSpec{
+		{
+			RuleCollectionName: "allow-service",
+			Priority:           200,
+			RuleName:           "github",
+			TargetFqdns:        []string{"github.com"},
+			Protocol:           []string{"HTTPS:443"},
+			Action:             "Allow",
+			RuleType:           "Application",
+		},
+	}
+	return rules
+}
+
+func newPortalRuleCollection(name string) *n.FirewallPolicyFilterRuleCollection {
+	return &n.FirewallPolicyFilterRuleCollection{
+		Name:               to.StringPtr(name),
+		Priority:           to.Int32Ptr(900),
+		RuleCollectionType: n.RuleCollectionTypeFirewallPolicyFilterRuleCollection,
+		Action:             &n.FirewallPolicyFilterRuleCollectionAction{Type: n.FirewallPolicyFilterRuleCollectionActionTypeDeny},
+		Rules: &[]n.BasicFirewallPolicyRule{
+			&n.Rule{
+				Name:                 to.StringPtr("deny-dns"),
+				RuleType:             n.RuleTypeNetworkRule,
+				SourceAddresses:      &[]string{"*"},
+				DestinationAddresses: &[]string{"8.8.8.8"},
+				DestinationPorts:     &[]string{"53"},
+				IPProtocols:          &[]n.FirewallPolicyRuleNetworkProtocol{n.FirewallPolicyRuleNetworkProtocolUDP},
+			},
+		},
+	}
+}
+
+// deployAndAddPortalRuleCollection deploys the rules and then adds a rule collection to the live rule collection
+// group, as if it was added in the portal.
+func deployAndAddPortalRuleCollection(t *testing.T, arm *azfake.ARM, objs ...client.Object) {
+	az, _ := newTestAzClientWithFakeARM(t, arm, objs...)
+	if err := az.processRequest(context.Background(), ctrl.Request{}, nil); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	rcgID := azfake.RuleCollectionGroupID(testSubscriptionID, testResourceGroup, testFwPolicy, testRuleCollGroup)
+	live, _ := arm.RuleCollectionGroup(rcgID)
+	ruleCollections := append(*live.RuleCollections, newPortalRuleCollection("portal-added"))
+	live.RuleCollections = &ruleCollections
+	if err := arm.SetRuleCollectionGroup(rcgID, live); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+}
+
+func countRuleCollectionGroupPuts(arm *azfake.ARM) int {
+	puts := 0
+	for _, req := range arm.Requests() {
+		if req == http.MethodPut+" "+azfake.RuleCollectionGroupID(testSubscriptionID, testResourceGroup, testFwPolicy, testRuleCollGroup) {
+			puts++
+		}
+	}
+	return puts
+}
+
+func liveRuleCollectionNames(t *testing.T, arm *azfake.ARM) []string {
+	live, ok := arm.RuleCollectionGroup(azfake.RuleCollectionGroupID(testSubscriptionID, testResourceGroup, testFwPolicy, testRuleCollGroup))
+	if !ok {
+		t.Fatalf("Expected rule collection group %s to exist", testRuleCollGroup)
+	}
+	var names []string
+	for _, ruleCollection := range *live.RuleCollections {
+		names = append(names, GetRuleCollectionName(ruleCollection))
+	}
+	return names
+}
+
+func driftCondition(t *testing.T, k8sClient client.Client, name string) *metav1.Condition {
+	rules := &azurefirewallrulesv1.AzureFirewallRules{}
+	if err := k8sClient.Get(context.Background(), types.NamespacedName{Name: name}, rules); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	return meta.FindStatusCondition(rules.Status.Conditions, azurefirewallrulesv1.ConditionTypeDrifted)
+}
+
+func TestCompareRuleCollectionGroups(t *testing.T) {
+	rules := newDriftTestRules()
+	desired := &n.FirewallPolicyRuleCollectionGroup{
+		FirewallPolicyRuleCollectionGroupProperties: &n.FirewallPolicyRuleCollectionGroupProperties{
+			Priority:        to.Int32Ptr(400),
+			RuleCollections: BuildFirewallConfig(azurefirewallrulesv1.AzureFirewallRulesList{Items: []azurefirewallrulesv1.AzureFirewallRules{rules}}, map[string][]string{"test1": {"ipgroup-id"}}),
+		},
+	}
+	live := &n.FirewallPolicyRuleCollectionGroup{
+		FirewallPolicyRuleCollectionGroupProperties: &n.FirewallPolicyRuleCollectionGroupProperties{
+			Priority:        to.Int32Ptr(400),
+			RuleCollections: BuildFirewallConfig(azurefirewallrulesv1.AzureFirewallRulesList{Items: []azurefirewallrulesv1.AzureFirewallRules{rules}}, map[string][]string{"test1": {"ipgroup-id"}}),
+		},
+	}
+
+	az := &azClient{clusterName: "aks-prod"}
+	drift := compareRuleCollectionGroups(desired, live, az.ownsRule)
+	if drift.Drifted || drift.hasUnmanagedRules() {
+		t.Errorf("Expected no drift, but got: %+v", drift)
+	}
+
+	// The rules generated earlier by the controller, e.g. for a deleted object, are not unmanaged.
+	staleRuleCollection := newPortalRuleCollection("stale")
+	(*staleRuleCollection.Rules)[0].(*n.Rule).Description = to.StringPtr(clusterRuleDescriptionPrefix + "aks-prod")
+	staleRule := *(*newPortalRuleCollection("unused").Rules)[0].(*n.Rule)
+	staleRule.Name = to.StringPtr("stale-dns")
+	staleRule.Description = to.StringPtr(managedRuleDescription)
+	AppendRule((*live.RuleCollections)[0], &staleRule)
+	AppendRule((*live.RuleCollections)[0], (*newPortalRuleCollection("unused").Rules)[0])
+	ruleCollections := append(*live.RuleCollections, newPortalRuleCollection("portal-added"), staleRuleCollection)
+	live.RuleCollections = &ruleCollections
+	drift = compareRuleCollectionGroups(desired, live, az.ownsRule)
+	expected := ruleCollectionGroupDrift{
+		Drifted: true,
+		Changes: []string{
+			"- rule allow-service/deny-dns",
+			"- rule allow-service/stale-dns",
+			"- rule collection portal-added",
+			"- rule collection stale",
+		},
+		UnmanagedRuleCollections: []string{"portal-added"},
+		UnmanagedRules:           []string{"allow-service/deny-dns"},
+	}
+	if !reflect.DeepEqual(drift, expected) {
+		t.Errorf("Expected %+v, but got: %+v", expected, drift)
+	}
+}
+
+func TestRestartDoesNotRedeployUnchangedRuleCollectionGroup(t *testing.T) {
+	rules := newDriftTestRules()
+	node := newTestNode("node-1", map[string]string{"app": "service"}, "10.240.0.4")
+	arm := azfake.NewARM()
+	az, _ := newTestAzClientWithFakeARM(t, arm, rules.DeepCopy(), node.DeepCopy())
+	if err := az.processRequest(context.Background(), ctrl.Request{}, nil); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	// A new client behaves like a restarted controller.
+	az, k8sClient := newTestAzClientWithFakeARM(t, arm, rules.DeepCopy(), node.DeepCopy())
+	if err := az.processRequest(context.Background(), ctrl.Request{}, nil); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if puts := countRuleCollectionGroupPuts(arm); puts != 1 {
+		t.Errorf("Expected %d rule collection group updates, but got: %d", 1, puts)
+	}
+	if condition := driftCondition(t, k8sClient, rules.Name); condition == nil || condition.Status != metav1.ConditionFalse || condition.Reason != reasonInSync {
+		t.Errorf("Expected condition %s to be False with reason %s, but got: %v", azurefirewallrulesv1.ConditionTypeDrifted, reasonInSync, condition)
+	}
+}
+
+func TestUnmanagedRulesPolicy(t *testing.T) {
+	type testCase struct {
+		Name                    string
+		policy                  string
+		ExpectedErr             bool
+		ExpectedPuts            int
+		ExpectedRuleCollections []string
+		ExpectedStatus          metav1.ConditionStatus
+		ExpectedReason          string
+	}
+
+	testCases := []testCase{
+		{
+			Name:                    "overwrite",
+			policy:                  UnmanagedRulesOverwrite,
+			ExpectedPuts:            2,
+			ExpectedRuleCollections: []string{"allow-service"},
+			ExpectedStatus:          metav1.ConditionFalse,
+			ExpectedReason:          reasonDriftCorrected,
+		},
+		{
+			Name:                    "adopt",
+			policy:                  UnmanagedRulesAdopt,
+			ExpectedPuts:            1,
+			ExpectedRuleCollections: []string{"allow-service", "portal-added"},
+			ExpectedStatus:          metav1.ConditionFalse,
+			ExpectedReason:          reasonAdopted,
+		},
+		{
+			Name:                    "refuse",
+			policy:                  UnmanagedRulesRefuse,
+			ExpectedErr:             true,
+			ExpectedPuts:            1,
+			ExpectedRuleCollections: []string{"allow-service", "portal-added"},
+			ExpectedStatus:          metav1.ConditionTrue,
+			ExpectedReason:          reasonUnmanagedRules,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			rules := newDriftTestRules()
+			node := newTestNode("node-1", map[string]string{"app": "service"}, "10.240.0.4")
+			arm := azfake.NewARM()
+			deployAndAddPortalRuleCollection(t, arm, rules.DeepCopy(), node.DeepCopy())
+
+			az, k8sClient := newTestAzClientWithFakeARM(t, arm, rules.DeepCopy(), node.DeepCopy())
+			az.SetUnmanagedRulesPolicy(tc.policy)
+			if err := az.processRequest(context.Background(), ctrl.Request{}, nil); (err != nil) != tc.ExpectedErr {
+				t.Errorf("Expected error %t, but got: %v", tc.ExpectedErr, err)
+			}
+			if puts := countRuleCollectionGroupPuts(arm); puts != tc.ExpectedPuts {
+				t.Errorf("Expected %d rule collection group updates, but got: %d", tc.ExpectedPuts, puts)
+			}
+			if names := liveRuleCollectionNames(t, arm); !reflect.DeepEqual(names, tc.ExpectedRuleCollections) {
+				t.Errorf("Expected rule collections %v, but got: %v", tc.ExpectedRuleCollections, names)
+			}
+			if condition := driftCondition(t, k8sClient, rules.Name); condition == nil || condition.Status != tc.ExpectedStatus || condition.Reason != tc.ExpectedReason {
+				t.Errorf("Expected condition %s to be %s with reason %s, but got: %v", azurefirewallrulesv1.ConditionTypeDrifted, tc.ExpectedStatus, tc.ExpectedReason, condition)
+			}
+		})
+	}
+}
+
+func TestAdoptedRulesAreKept(t *testing.T) {
+	rules := newDriftTestRules()
+	arm := azfake.NewARM()
+	deployAndAddPortalRuleCollection(t, arm, rules.DeepCopy(), newTestNode("node-1", map[string]string{"app": "service"}, "10.240.0.4"))
+
+	az, k8sClient := newTestAzClientWithFakeARM(t, arm, rules.DeepCopy(), newTestNode("node-1", map[string]string{"app": "service"}, "10.240.0.4"))
+	az.SetUnmanagedRulesPolicy(UnmanagedRulesAdopt)
+	if err := az.processRequest(context.Background(), ctrl.Request{}, nil); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	// A change of the generated rules redeploys the rule collection group with the adopted rule collection.
+	updated := &azurefirewallrulesv1.AzureFirewallRules{}
+	if err := k8sClient.Get(context.Background(), types.NamespacedName{Name: rules.Name}, updated); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	updated.Spec.EgressRules[0].Rules[0].TargetFqdns = []string{"github.com", "*.github.com"}
+	if err := k8sClient.Update(context.Background(), updated); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if err := az.processRequest(context.Background(), ctrl.Request{}, nil); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if puts := countRuleCollectionGroupPuts(arm); puts != 2 {
+		t.Errorf("Expected %d rule collection group updates, but got: %d", 2, puts)
+	}
+	if names := liveRuleCollectionNames(t, arm); !reflect.DeepEqual(names, []string{"allow-service", "portal-added"}) {
+		t.Errorf("Expected rule collections %v, but got: %v", []string{"allow-service", "portal-added"}, names)
+	}
+}
+
+func TestDriftPolicy(t *testing.T) {
+	type testCase struct {
+		Name                    string
+		policy                  string
+		ExpectedPuts            int
+		ExpectedRuleCollections []string
+		ExpectedStatus          metav1.ConditionStatus
+		ExpectedReason          string
+	}
+
+	testCases := []testCase{
+		{
+			Name:                    "correct",
+			policy:                  DriftPolicyCorrect,
+			ExpectedPuts:            2,
+			ExpectedRuleCollections: []string{"allow-service"},
+			ExpectedStatus:          metav1.ConditionFalse,
+			ExpectedReason:          reasonDriftCorrected,
+		},
+		{
+			Name:                    "alert",
+			policy:                  DriftPolicyAlert,
+			ExpectedPuts:            1,
+			ExpectedRuleCollections: []string{"allow-service", "portal-added"},
+			ExpectedStatus:          metav1.ConditionTrue,
+			ExpectedReason:          reasonDrifted,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			rules := newDriftTestRules()
+			node := newTestNode("node-1", map[string]string{"app": "service"}, "10.240.0.4")
+			arm := azfake.NewARM()
+			az, k8sClient := newTestAzClientWithFakeARM(t, arm, rules.DeepCopy(), node.DeepCopy())
+			az.SetDriftPolicy(tc.policy, time.Hour)
+			if err := az.processRequest(context.Background(), ctrl.Request{}, nil); err != nil {
+				t.Fatalf("Expected no error, but got: %v", err)
+			}
+
+			rcgID := azfake.RuleCollectionGroupID(testSubscriptionID, testResourceGroup, testFwPolicy, testRuleCollGroup)
+			live, _ := arm.RuleCollectionGroup(rcgID)
+			ruleCollections := append(*live.RuleCollections, newPortalRuleCollection("portal-added"))
+			live.RuleCollections = &ruleCollections
+			if err := arm.SetRuleCollectionGroup(rcgID, live); err != nil {
+				t.Fatalf("Expected no error, but got: %v", err)
+			}
+
+			// The live rule collection group isn't read again before the check period elapsed.
+			if err := az.processRequest(context.Background(), ctrl.Request{}, nil); err != nil {
+				t.Fatalf("Expected no error, but got: %v", err)
+			}
+			if names := liveRuleCollectionNames(t, arm); !reflect.DeepEqual(names, []string{"allow-service", "portal-added"}) {
+				t.Errorf("Expected rule collections %v, but got: %v", []string{"allow-service", "portal-added"}, names)
+			}
+
+			az.lastDriftCheck = time.Now().Add(-time.Hour)
+			if err := az.processRequest(context.Background(), ctrl.Request{}, nil); err != nil {
+				t.Fatalf("Expected no error, but got: %v", err)
+			}
+			if puts := countRuleCollectionGroupPuts(arm); puts != tc.ExpectedPuts {
+				t.Errorf("Expected %d rule collection group updates, but got: %d", tc.ExpectedPuts, puts)
+			}
+			if names := liveRuleCollectionNames(t, arm); !reflect.DeepEqual(names, tc.ExpectedRuleCollections) {
+				t.Errorf("Expected rule collections %v, but got: %v", tc.ExpectedRuleCollections, names)
+			}
+			if condition := driftCondition(t, k8sClient, rules.Name); condition == nil || condition.Status != tc.ExpectedStatus || condition.Reason != tc.ExpectedReason {
+				t.Errorf("Expected condition %s to be %s with reason %s, but got: %v", azurefirewallrulesv1.ConditionTypeDrifted, tc.ExpectedStatus, tc.ExpectedReason, condition)
+			}
+		})
+	}
+}
+
+func TestIPGroupDriftPolicy(t *testing.T) {
+	type testCase struct {
+		Name              string
+		policy            string
+		ExpectedAddresses []string
+		ExpectedStatus    metav1.ConditionStatus
+	}
+
+	testCases := []testCase{
+		{
+			Name:              "correct",
+			policy:            DriftPolicyCorrect,
+			ExpectedAddresses: []string{"10.240.0.4"},
+			ExpectedStatus:    metav1.ConditionFalse,
+		},
+		{
+			Name:              "alert",
+			policy:            DriftPolicyAlert,
+			ExpectedAddresses: []string{"10.240.0.4", "10.240.0.99"},
+			ExpectedStatus:    metav1.ConditionTrue,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			rules := newDriftTestRules()
+			node := newTestNode("node-1", map[string]string{"app": "service"}, "10.240.0.4")
+			arm := azfake.NewARM()
+			az, k8sClient := newTestAzClientWithFakeARM(t, arm, rules.DeepCopy(), node.DeepCopy())
+			az.SetDriftPolicy(tc.policy, 0)
+			if err := az.processRequest(context.Background(), ctrl.Request{}, nil); err != nil {
+				t.Fatalf("Expected no error, but got: %v", err)
+			}
+			arm.CompleteOperations()
+
+			// An address added to the IP Group in the portal.
+			arm.AddIPGroup(testSubscriptionID, testResourceGroup, nodeIpGroupNameOf("app", "service"), "westeurope", []string{"10.240.0.4", "10.240.0.99"})
+			if err := az.processRequest(context.Background(), ctrl.Request{}, nil); err != nil {
+				t.Fatalf("Expected no error, but got: %v", err)
+			}
+			arm.CompleteOperations()
+			if addresses := ipGroupAddresses(t, arm, nodeIpGroupNameOf("app", "service")); !reflect.DeepEqual(addresses, tc.ExpectedAddresses) {
+				t.Errorf("Expected addresses %v, but got: %v", tc.ExpectedAddresses, addresses)
+			}
+			if condition := driftCondition(t, k8sClient, rules.Name); condition == nil || condition.Status != tc.ExpectedStatus {
+				t.Errorf("Expected condition %s to be %s, but got: %v", azurefirewallrulesv1.ConditionTypeDrifted, tc.ExpectedStatus, condition)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+// -------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package azure
+
+import (
+	"context"
+
+	azurefirewallrulesv1 "github.com/Azure/azure-firewall-egress-controller/pkg/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// egressPolicyKey is the key under which the IP Group of an EgressPolicy is tracked in erulesSourceAddresses.
+func egressPolicyKey(policy azurefirewallrulesv1.EgressPolicy) string {
+	return "egresspolicy/" + policy.Namespace + "/" + policy.Name
+}
+
+// egressPolicyToFirewallRules converts an EgressPolicy into an AzureFirewallRules object with a single
+// egress rule so that it can be fed to BuildFirewallConfig.
+func egressPolicyToFirewallRules(policy azurefirewallrulesv1.EgressPolicy) azurefirewallrulesv1.AzureFirewallRules {
+	return azurefirewallrulesv1.AzureFirewallRules{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       policy.Name,
+			Generation: policy.Generation,
+		},
+		Spec: azurefirewallrulesv1.AzureFirewallRulesSpec{
+			EgressRules: []azurefirewallrulesv1.AzureFirewallEgressRulesSpec{
+				{
+					Name:  egressPolicyKey(policy),
+					Rules: policy.Spec.Rules,
+				},
+			},
+		},
+	}
+}
+
+// hasNatRules tells whether the EgressPolicy has any Nat rule.
+func hasNatRules(policy azurefirewallrulesv1.EgressPolicy) bool {
+	for _, rule := range policy.Spec.Rules {
+		if rule.RuleType == azurefirewallrulesv1.RuleTypeNat {
+			return true
+		}
+	}
+	return false
+}
+
+// getSourceAddressesByPodSelector returns the IPs of the pods selected by the EgressPolicy.
+func (az *azClient) getSourceAddressesByPodSelector(ctx context.Context, policy azurefirewallrulesv1.EgressPolicy) ([]*string, error) {
+	podSelector, err := metav1.LabelSelectorAsSelector(&policy.Spec.PodSelector)
+	if err != nil {
+		return nil, err
+	}
+
+	namespaces := []string{policy.Namespace}
+	if policy.Spec.NamespaceSelector != nil {
+		namespaceSelector, err := metav1.LabelSelectorAsSelector(policy.Spec.NamespaceSelector)
+		if err != nil {
+			return nil, err
+		}
+		namespaceList := &corev1.NamespaceList{}
+		if err := az.client.List(ctx, namespaceList, client.MatchingLabelsSelector{Selector: namespaceSelector}); err != nil {
+			return nil, err
+		}
+		namespaces = []string{}
+		for _, ns := range namespaceList.Items {
+			namespaces = append(namespaces, ns.Name)
+		}
+	}
+
+	var pods []corev1.Pod
+	for _, ns := range namespaces {
+		podList := &corev1.PodList{}
+		if err := az.client.List(ctx, podList, client.InNamespace(ns), client.MatchingLabelsSelector{Selector: podSelector}); err != nil {
+			return nil, err
+		}
+		pods = append(pods, podList.Items...)
+	}
+	return getSourceAddressesByPods(pods), nil
+}
+
+// EgressPolicySelectsPod tells whether the EgressPolicy selects the pod, given the namespace of the pod. The namespace
+// is only read when the policy has a namespaceSelector and may be nil otherwise.
+func EgressPolicySelectsPod(policy azurefirewallrulesv1.EgressPolicy, pod *corev1.Pod, namespace *corev1.Namespace) bool {
+	if policy.Spec.NamespaceSelector == nil {
+		if pod.Namespace != policy.Namespace {
+			return false
+		}
+	} else {
+		namespaceSelector, err := metav1.LabelSelectorAsSelector(policy.Spec.NamespaceSelector)
+		if err != nil || namespace == nil || !namespaceSelector.Matches(labels.Set(namespace.Labels)) {
+			return false
+		}
+	}
+	podSelector, err := metav1.LabelSelectorAsSelector(&policy.Spec.PodSelector)
+	return err == nil && podSelector.Matches(labels.Set(pod.Labels))
+}
+
+// updateEgressPolicyStatus writes the outcome of the last policy build back to every EgressPolicy object.
+func (az *azClient) updateEgressPolicyStatus(ctx context.Context, policyList azurefirewallrulesv1.EgressPolicyList, erulesSourceAddresses map[string][]string, erulesErrors map[string]string, buildErr error) {
+	for i := range policyList.Items {
+		policy := &policyList.Items[i]
+		patch := client.MergeFrom(policy.DeepCopy())
+		item := egressPolicyToFirewallRules(*policy)
+		item.Status = policy.Status
+		policy.Status = buildStatus(item, erulesSourceAddresses, erulesErrors, az.ruleCollectionGroupETag, buildErr)
+		az.applyDriftCondition(&policy.Status.Conditions, policy.Generation)
+		if err := az.client.Status().Patch(ctx, policy, patch); err != nil {
+			klog.Error("Error updating the status of ", policy.Namespace, "/", policy.Name, ": ", err)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package azure
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	azurefirewallrulesv1 "github.com/Azure/azure-firewall-egress-controller/pkg/api/v1"
+	n "github.com/Azure/azure-sdk-for-go/services/network/mgmt/2021-03-01/network"
+	"github.com/Azure/go-autorest/autorest/to"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	fake "sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newTestPod(name string, namespace string, labels map[string]string, ip string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels:    labels,
+		},
+		Status: corev1.PodStatus{
+			Phase: corev1.PodRunning,
+			PodIP: ip,
+		},
+	}
+}
+
+func TestEgressPolicyToFirewallRules(t *testing.T) {
+	policy := azurefirewallrulesv1.EgressPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "allow-github",
+			Namespace: "team-a",
+		},
+		Spec: azurefirewallrulesv1.EgressPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+			Rules: []azurefirewallrulesv1.AzureFirewallEgressrulesRulesSpec{
+				{
+					RuleCollectionName: "team-a-allow",
+					Priority:           300,
+					RuleName:           "github",
+					TargetFqdns:        []string{"github.com"},
+					Protocol:           []string{"HTTPS:443"},
+					Action:             "Allow",
+					RuleType:           "Application",
+				},
+			},
+		},
+	}
+
+	erulesList := azurefirewallrulesv1.AzureFirewallRulesList{
+		Items: []azurefirewallrulesv1.AzureFirewallRules{egressPolicyToFirewallRules(policy)},
+	}
+	erulesSourceAddresses := map[string][]string{
+		"egresspolicy/team-a/allow-github": {"/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Network/ipGroups/IPGroup-pod-team-a-allow-github"},
+	}
+
+	ruleCollections := *BuildFirewallConfig(erulesList, erulesSourceAddresses)
+	if len(ruleCollections) != 1 {
+		t.Fatalf("Expected %d rule collections, but got: %d", 1, len(ruleCollections))
+	}
+
+	ruleCollection := ruleCollections[0].(*n.FirewallPolicyFilterRuleCollection)
+	if *ruleCollection.Name != "team-a-allow" {
+		t.Errorf("Expected rule collection %s, but got: %s", "team-a-allow", *ruleCollection.Name)
+	}
+
+	rule := (*ruleCollection.Rules)[0].(*n.ApplicationRule)
+	if !reflect.DeepEqual(*rule.SourceIPGroups, erulesSourceAddresses["egresspolicy/team-a/allow-github"]) {
+		t.Errorf("Expected source IP Groups %v, but got: %v", erulesSourceAddresses["egresspolicy/team-a/allow-github"], *rule.SourceIPGroups)
+	}
+}
+
+func TestGetSourceAddressesByPodSelector(t *testing.T) {
+	obj := []client.Object{
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a", Labels: map[string]string{"team": "a"}}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a-staging", Labels: map[string]string{"team": "a"}}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-b", Labels: map[string]string{"team": "b"}}},
+		newTestPod("web-1", "team-a", map[string]string{"app": "web"}, "10.240.0.10"),
+		newTestPod("web-2", "team-a-staging", map[string]string{"app": "web"}, "10.240.0.11"),
+		newTestPod("web-3", "team-b", map[string]string{"app": "web"}, "10.240.0.12"),
+		newTestPod("db-1", "team-a", map[string]string{"app": "db"}, "10.240.0.13"),
+		newTestPod("web-pending", "team-a", map[string]string{"app": "web"}, ""),
+	}
+
+	az := &azClient{
+		client: fake.NewClientBuilder().WithObjects(obj...).Build(),
+	}
+
+	type testCase struct {
+		Name           string
+		policy         azurefirewallrulesv1.EgressPolicy
+		ExpectedOutput []*string
+	}
+
+	testCases := []testCase{
+		{
+			Name: "own-namespace",
+			policy: azurefirewallrulesv1.EgressPolicy{
+				ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "team-a"},
+				Spec: azurefirewallrulesv1.EgressPolicySpec{
+					PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+				},
+			},
+			ExpectedOutput: []*string{to.StringPtr("10.240.0.10")},
+		},
+		{
+			Name: "namespace-selector",
+			policy: azurefirewallrulesv1.EgressPolicy{
+				ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "team-a"},
+				Spec: azurefirewallrulesv1.EgressPolicySpec{
+					PodSelector:       metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+					NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "a"}},
+				},
+			},
+			ExpectedOutput: []*string{to.StringPtr("10.240.0.10"), to.StringPtr("10.240.0.11")},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			output, err := az.getSourceAddressesByPodSelector(context.Background(), tc.policy)
+			if err != nil {
+				t.Errorf("Expected no error, but got: %v", err)
+			}
+			if !reflect.DeepEqual(output, tc.ExpectedOutput) {
+				t.Errorf("Expected %v, but got: %v", tc.ExpectedOutput, output)
+			}
+		})
+	}
+}
+
+func TestEgressPolicySelectsPod(t *testing.T) {
+	teamA := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a-staging", Labels: map[string]string{"team": "a"}}}
+	teamB := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-b", Labels: map[string]string{"team": "b"}}}
+
+	type testCase struct {
+		Name              string
+		namespaceSelector *metav1.LabelSelector
+		pod               *corev1.Pod
+		namespace         *corev1.Namespace
+		Expected          bool
+	}
+
+	testCases := []testCase{
+		{
+			Name:     "own-namespace",
+			pod:      newTestPod("web-1", "team-a", map[string]string{"app": "web"}, "10.240.0.10"),
+			Expected: true,
+		},
+		{
+			Name:     "other-labels",
+			pod:      newTestPod("db-1", "team-a", map[string]string{"app": "db"}, "10.240.0.13"),
+			Expected: false,
+		},
+		{
+			Name:     "other-namespace",
+			pod:      newTestPod("web-3", "team-b", map[string]string{"app": "web"}, "10.240.0.12"),
+			Expected: false,
+		},
+		{
+			Name:              "selected-namespace",
+			namespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "a"}},
+			pod:               newTestPod("web-2", "team-a-staging", map[string]string{"app": "web"}, "10.240.0.11"),
+			namespace:         teamA,
+			Expected:          true,
+		},
+		{
+			Name:              "unselected-namespace",
+			namespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "a"}},
+			pod:               newTestPod("web-3", "team-b", map[string]string{"app": "web"}, "10.240.0.12"),
+			namespace:         teamB,
+			Expected:          false,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			policy := azurefirewallrulesv1.EgressPolicy{
+				ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "team-a"},
+				Spec: azurefirewallrulesv1.EgressPolicySpec{
+					PodSelector:       metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+					NamespaceSelector: tc.namespaceSelector,
+				},
+			}
+			if selected := EgressPolicySelectsPod(policy, tc.pod, tc.namespace); selected != tc.Expected {
+				t.Errorf("Expected %v, but got: %v", tc.Expected, selected)
+			}
+		})
+	}
+}
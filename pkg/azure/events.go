@@ -0,0 +1,59 @@
+// -------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package azure
+
+import (
+	azurefirewallrulesv1 "github.com/Azure/azure-firewall-egress-controller/pkg/api/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+)
+
+// Reasons of the events recorded on the AzureFirewallRules, EgressPolicy and Node objects.
+const (
+	EventReasonDeploymentStarted   = "PolicyDeploymentStarted"
+	EventReasonDeploymentSucceeded = "PolicyDeploymentSucceeded"
+	EventReasonDeploymentFailed    = "PolicyDeploymentFailed"
+	EventReasonTaintAdded          = "TaintAdded"
+	EventReasonTaintRemoved        = "TaintRemoved"
+	EventReasonIpGroupUpdated      = "IPGroupUpdated"
+	EventReasonDriftDetected       = "DriftDetected"
+	EventReasonUnmanagedAdopted    = "UnmanagedRulesAdopted"
+	EventReasonUnmanagedRefused    = "UnmanagedRulesRefused"
+	EventReasonClusterConflict     = "OwnedByAnotherCluster"
+	EventReasonLimitsExceeded      = "LimitsExceeded"
+)
+
+// SetEventRecorder makes the client record Kubernetes events for every firewall action. No events are recorded
+// until a recorder is set.
+func (az *azClient) SetEventRecorder(recorder record.EventRecorder) {
+	az.recorder = recorder
+}
+
+func (az *azClient) recordEvent(object runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+	if az.recorder == nil {
+		return
+	}
+	az.recorder.Eventf(object, eventtype, reason, messageFmt, args...)
+}
+
+// recordDeploymentEvent records the event on every object whose rules are part of the rule collection group.
+func (az *azClient) recordDeploymentEvent(objects []runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+	for _, object := range objects {
+		az.recordEvent(object, eventtype, reason, messageFmt, args...)
+	}
+}
+
+// deployedObjects returns the objects whose rules are deployed to the rule collection group.
+func deployedObjects(erulesList []azurefirewallrulesv1.AzureFirewallRules, policyList []azurefirewallrulesv1.EgressPolicy) []runtime.Object {
+	var objects []runtime.Object
+	for i := range erulesList {
+		objects = append(objects, &erulesList[i])
+	}
+	for i := range policyList {
+		objects = append(objects, &policyList[i])
+	}
+	return objects
+}
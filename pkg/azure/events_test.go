@@ -0,0 +1,97 @@
+package azure
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	azfake "github.com/Azure/azure-firewall-egress-controller/pkg/azure/fake"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// receiveEventReasons returns the reasons of the next count events, or of the events received before the timeout.
+func receiveEventReasons(recorder *record.FakeRecorder, count int) []string {
+	var reasons []string
+	for len(reasons) < count {
+		select {
+		case event := <-recorder.Events:
+			reasons = append(reasons, strings.Fields(event)[1])
+		case <-time.After(5 * time.Second):
+			return reasons
+		}
+	}
+	return reasons
+}
+
+func TestProcessRequestRecordsDeploymentEvents(t *testing.T) {
+	rules := newTestFirewallRules()
+	arm := azfake.NewARM()
+	az, _ := newTestAzClientWithFakeARM(t, arm, &rules)
+	recorder := record.NewFakeRecorder(10)
+	az.SetEventRecorder(recorder)
+	ctx := context.Background()
+
+	arm.FailNext(http.MethodPut, azfake.RuleCollectionGroupID(testSubscriptionID, testResourceGroup, testFwPolicy, testRuleCollGroup), http.StatusBadRequest)
+	if err := az.processRequest(ctx, ctrl.Request{}, nil); err == nil {
+		t.Errorf("Expected an error, but got: nil")
+	}
+	expected := []string{EventReasonDeploymentStarted, EventReasonDeploymentFailed}
+	if output := receiveEventReasons(recorder, 2); !reflect.DeepEqual(output, expected) {
+		t.Errorf("Expected events %v, but got: %v", expected, output)
+	}
+	arm.CompleteOperations()
+
+	if err := az.processRequest(ctx, ctrl.Request{}, nil); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	expected = []string{EventReasonDeploymentStarted, EventReasonDeploymentSucceeded}
+	if output := receiveEventReasons(recorder, 2); !reflect.DeepEqual(output, expected) {
+		t.Errorf("Expected events %v, but got: %v", expected, output)
+	}
+
+	// Nothing is deployed when the config has not changed.
+	if err := az.processRequest(ctx, ctrl.Request{}, nil); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if len(recorder.Events) != 0 {
+		t.Errorf("Expected no events, but got: %d", len(recorder.Events))
+	}
+}
+
+func TestNodeEvents(t *testing.T) {
+	rules := newTestFirewallRules()
+	arm := azfake.NewARM()
+	az, k8sClient := newTestAzClientWithFakeARM(t, arm, &rules,
+		newTestNode("node-1", map[string]string{"app": "service"}, "10.240.0.4"),
+	)
+	recorder := record.NewFakeRecorder(10)
+	az.SetEventRecorder(recorder)
+	ctx := context.Background()
+
+	az.AddTaints(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: "node-1"}})
+	if output := receiveEventReasons(recorder, 1); !reflect.DeepEqual(output, []string{EventReasonTaintAdded}) {
+		t.Errorf("Expected events %v, but got: %v", []string{EventReasonTaintAdded}, output)
+	}
+
+	node := &corev1.Node{}
+	if err := k8sClient.Get(ctx, types.NamespacedName{Name: "node-1"}, node); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if err := az.processRequest(ctx, ctrl.Request{}, []*corev1.Node{node}); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	output := receiveEventReasons(recorder, 4)
+	sort.Strings(output)
+	expected := []string{EventReasonIpGroupUpdated, EventReasonDeploymentStarted, EventReasonDeploymentSucceeded, EventReasonTaintRemoved}
+	sort.Strings(expected)
+	if !reflect.DeepEqual(output, expected) {
+		t.Errorf("Expected events %v, but got: %v", expected, output)
+	}
+}
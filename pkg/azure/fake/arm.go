@@ -0,0 +1,464 @@
+// -------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+// Package fake provides an in-memory Azure Resource Manager backend that serves the IP Group, firewall policy
+// and rule collection group APIs used by the controller, so the whole reconcile-to-firewall path can be
+// exercised in tests without an Azure subscription.
+package fake
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	a "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/network/armnetwork/v2"
+	n "github.com/Azure/azure-sdk-for-go/services/network/mgmt/2021-03-01/network"
+)
+
+const (
+	ProvisioningStateSucceeded = "Succeeded"
+	ProvisioningStateUpdating  = "Updating"
+	ProvisioningStateDeleting  = "Deleting"
+
+	ipGroupsType             = "ipgroups"
+	firewallPoliciesType     = "firewallpolicies"
+	ruleCollectionGroupsType = "rulecollectiongroups"
+	operationsPath           = "/providers/Microsoft.Network/operations/"
+)
+
+var resourceTypes = map[string]string{
+	ipGroupsType:             "Microsoft.Network/ipGroups",
+	firewallPoliciesType:     "Microsoft.Network/firewallPolicies",
+	ruleCollectionGroupsType: "Microsoft.Network/firewallPolicies/ruleCollectionGroups",
+}
+
+// ARM is an in-memory Azure Resource Manager. It implements both the azcore policy.Transporter and the
+// autorest Sender interfaces, so it can be plugged into the track 1 and the track 2 SDK clients.
+//
+// Every PUT and DELETE starts a long-running operation that keeps the resource in the Updating or Deleting
+// provisioning state until it has been observed PendingPolls times, either through its Azure-AsyncOperation
+// URL or through a GET of the resource. Updating a rule collection group puts its firewall policy in the
+// Updating state as well.
+type ARM struct {
+	// PendingPolls is the number of times a long-running operation reports InProgress before it completes.
+	PendingPolls int
+
+	mu         sync.Mutex
+	resources  map[string]map[string]interface{}
+	operations map[string]*operation
+	faults     map[string]int
+	requests   []string
+	etag       int
+	opID       int
+}
+
+type operation struct {
+	id        string
+	remaining int
+	resources []string
+	complete  func()
+	done      bool
+}
+
+// NewARM returns an empty in-memory Azure Resource Manager.
+func NewARM() *ARM {
+	return &ARM{
+		resources:  map[string]map[string]interface{}{},
+		operations: map[string]*operation{},
+		faults:     map[string]int{},
+	}
+}
+
+// Credential returns a token credential that the track 2 SDK clients can use against the fake.
+func (arm *ARM) Credential() azcore.TokenCredential {
+	return credential{}
+}
+
+type credential struct{}
+
+func (credential) GetToken(ctx context.Context, options policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	return azcore.AccessToken{Token: "fake", ExpiresOn: time.Now().Add(time.Hour)}, nil
+}
+
+// IPGroupID returns the resource ID of an IP Group.
+func IPGroupID(subscriptionID string, resourceGroup string, name string) string {
+	return fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Network/ipGroups/%s", subscriptionID, resourceGroup, name)
+}
+
+// FirewallPolicyID returns the resource ID of a firewall policy.
+func FirewallPolicyID(subscriptionID string, resourceGroup string, name string) string {
+	return fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Network/firewallPolicies/%s", subscriptionID, resourceGroup, name)
+}
+
+// RuleCollectionGroupID returns the resource ID of a rule collection group.
+func RuleCollectionGroupID(subscriptionID string, resourceGroup string, policyName string, name string) string {
+	return FirewallPolicyID(subscriptionID, resourceGroup, policyName) + "/ruleCollectionGroups/" + name
+}
+
+// AddFirewallPolicy creates a firewall policy in the Succeeded provisioning state.
+func (arm *ARM) AddFirewallPolicy(subscriptionID string, resourceGroup string, name string, location string) {
+	arm.mu.Lock()
+	defer arm.mu.Unlock()
+	arm.store(FirewallPolicyID(subscriptionID, resourceGroup, name), map[string]interface{}{
+		"location":   location,
+		"properties": map[string]interface{}{},
+	}, ProvisioningStateSucceeded)
+}
+
+// AddIPGroup creates an IP Group in the Succeeded provisioning state.
+func (arm *ARM) AddIPGroup(subscriptionID string, resourceGroup string, name string, location string, addresses []string) {
+	arm.mu.Lock()
+	defer arm.mu.Unlock()
+	arm.store(IPGroupID(subscriptionID, resourceGroup, name), map[string]interface{}{
+		"location":   location,
+		"properties": map[string]interface{}{"ipAddresses": addresses},
+	}, ProvisioningStateSucceeded)
+}
+
+// IPGroup returns the IP Group with the given resource ID.
+func (arm *ARM) IPGroup(id string) (a.IPGroup, bool) {
+	ipGroup := a.IPGroup{}
+	return ipGroup, arm.decode(id, &ipGroup)
+}
+
+// IPGroups returns the IP Groups of a resource group sorted by name.
+func (arm *ARM) IPGroups(subscriptionID string, resourceGroup string) []a.IPGroup {
+	var ipGroups []a.IPGroup
+	for _, id := range arm.list(IPGroupID(subscriptionID, resourceGroup, "")) {
+		if ipGroup, ok := arm.IPGroup(id); ok {
+			ipGroups = append(ipGroups, ipGroup)
+		}
+	}
+	return ipGroups
+}
+
+// FirewallPolicy returns the firewall policy with the given resource ID.
+func (arm *ARM) FirewallPolicy(id string) (a.FirewallPolicy, bool) {
+	fwPolicy := a.FirewallPolicy{}
+	return fwPolicy, arm.decode(id, &fwPolicy)
+}
+
+// RuleCollectionGroup returns the rule collection group with the given resource ID.
+func (arm *ARM) RuleCollectionGroup(id string) (n.FirewallPolicyRuleCollectionGroup, bool) {
+	ruleCollectionGroup := n.FirewallPolicyRuleCollectionGroup{}
+	return ruleCollectionGroup, arm.decode(id, &ruleCollectionGroup)
+}
+
+// SetRuleCollectionGroup replaces the rule collection group with the given resource ID, e.g. to simulate a change
+// made in the portal.
+func (arm *ARM) SetRuleCollectionGroup(id string, ruleCollectionGroup n.FirewallPolicyRuleCollectionGroup) error {
+	raw, err := ruleCollectionGroup.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	resource := map[string]interface{}{}
+	if err := json.Unmarshal(raw, &resource); err != nil {
+		return err
+	}
+	arm.mu.Lock()
+	defer arm.mu.Unlock()
+	arm.store(id, resource, ProvisioningStateSucceeded)
+	return nil
+}
+
+// SetProvisioningState overrides the provisioning state of a resource, e.g. to simulate a firewall policy
+// that is being updated by another client.
+func (arm *ARM) SetProvisioningState(id string, state string) {
+	arm.mu.Lock()
+	defer arm.mu.Unlock()
+	if resource, ok := arm.resources[strings.ToLower(id)]; ok {
+		resource["properties"].(map[string]interface{})["provisioningState"] = state
+	}
+}
+
+// CompleteOperations completes every pending long-running operation.
+func (arm *ARM) CompleteOperations() {
+	arm.mu.Lock()
+	defer arm.mu.Unlock()
+	for _, op := range arm.operations {
+		if !op.done {
+			op.remaining = 0
+			arm.advance(op)
+		}
+	}
+}
+
+// FailNext makes the next request with the given method against the resource ID fail with the status code.
+func (arm *ARM) FailNext(method string, id string, statusCode int) {
+	arm.mu.Lock()
+	defer arm.mu.Unlock()
+	arm.faults[method+" "+strings.ToLower(id)] = statusCode
+}
+
+// Requests returns the "METHOD path" of every request served so far.
+func (arm *ARM) Requests() []string {
+	arm.mu.Lock()
+	defer arm.mu.Unlock()
+	return append([]string{}, arm.requests...)
+}
+
+// Do serves an ARM request.
+func (arm *ARM) Do(req *http.Request) (*http.Response, error) {
+	arm.mu.Lock()
+	defer arm.mu.Unlock()
+
+	path := strings.TrimSuffix(req.URL.Path, "/")
+	key := strings.ToLower(path)
+	arm.requests = append(arm.requests, req.Method+" "+path)
+
+	if statusCode, ok := arm.faults[req.Method+" "+key]; ok {
+		delete(arm.faults, req.Method+" "+key)
+		return errorResponse(req, statusCode, "InjectedFault", "injected fault for "+path), nil
+	}
+
+	if strings.HasPrefix(key, strings.ToLower(operationsPath)) {
+		return arm.getOperation(req, strings.TrimPrefix(key, strings.ToLower(operationsPath)))
+	}
+
+	segments := strings.Split(strings.TrimPrefix(key, "/"), "/")
+	if len(segments) < 7 || segments[0] != "subscriptions" || segments[2] != "resourcegroups" || segments[4] != "providers" || segments[5] != "microsoft.network" {
+		return errorResponse(req, http.StatusBadRequest, "InvalidResourceId", "unsupported path "+path), nil
+	}
+	resourceType := segments[6]
+	if len(segments) == 10 {
+		resourceType = segments[8]
+	}
+	if _, ok := resourceTypes[resourceType]; !ok {
+		return errorResponse(req, http.StatusBadRequest, "InvalidResourceType", "unsupported resource type "+resourceType), nil
+	}
+
+	switch {
+	case (len(segments) == 7 || len(segments) == 9) && req.Method == http.MethodGet:
+		return arm.listResources(req, path)
+	case (len(segments) == 8 || len(segments) == 10) && req.Method == http.MethodGet:
+		return arm.getResource(req, path)
+	case (len(segments) == 8 || len(segments) == 10) && req.Method == http.MethodPut:
+		return arm.putResource(req, path, resourceType)
+	case (len(segments) == 8 || len(segments) == 10) && req.Method == http.MethodDelete:
+		return arm.deleteResource(req, path)
+	}
+	return errorResponse(req, http.StatusMethodNotAllowed, "MethodNotAllowed", req.Method+" is not supported on "+path), nil
+}
+
+func (arm *ARM) listResources(req *http.Request, path string) (*http.Response, error) {
+	var value []interface{}
+	for _, id := range arm.listLocked(path + "/") {
+		arm.observe(id)
+		if resource, ok := arm.resources[id]; ok {
+			value = append(value, resource)
+		}
+	}
+	return jsonResponse(req, http.StatusOK, map[string]interface{}{"value": value}), nil
+}
+
+func (arm *ARM) getResource(req *http.Request, path string) (*http.Response, error) {
+	key := strings.ToLower(path)
+	arm.observe(key)
+	resource, ok := arm.resources[key]
+	if !ok {
+		return errorResponse(req, http.StatusNotFound, "ResourceNotFound", "resource "+path+" was not found"), nil
+	}
+	return jsonResponse(req, http.StatusOK, resource), nil
+}
+
+func (arm *ARM) putResource(req *http.Request, path string, resourceType string) (*http.Response, error) {
+	key := strings.ToLower(path)
+	body := map[string]interface{}{}
+	if req.Body != nil {
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			return errorResponse(req, http.StatusBadRequest, "InvalidRequestContent", err.Error()), nil
+		}
+	}
+	if _, ok := body["properties"].(map[string]interface{}); !ok {
+		body["properties"] = map[string]interface{}{}
+	}
+
+	affected := []string{key}
+	if resourceType == ruleCollectionGroupsType {
+		parent := key[:strings.Index(key, "/rulecollectiongroups/")]
+		fwPolicy, ok := arm.resources[parent]
+		if !ok {
+			return errorResponse(req, http.StatusNotFound, "ParentResourceNotFound", "firewall policy of "+path+" was not found"), nil
+		}
+		if fwPolicy["properties"].(map[string]interface{})["provisioningState"] == ProvisioningStateUpdating {
+			return errorResponse(req, http.StatusConflict, "AnotherOperationInProgress", "firewall policy of "+path+" is being updated"), nil
+		}
+		fwPolicy["properties"].(map[string]interface{})["provisioningState"] = ProvisioningStateUpdating
+		affected = append(affected, parent)
+	}
+
+	statusCode := http.StatusOK
+	if _, ok := arm.resources[key]; !ok {
+		statusCode = http.StatusCreated
+	}
+	arm.store(path, body, ProvisioningStateUpdating)
+
+	op := arm.startOperation(affected, func() {
+		for _, id := range affected {
+			if resource, ok := arm.resources[id]; ok {
+				resource["properties"].(map[string]interface{})["provisioningState"] = ProvisioningStateSucceeded
+			}
+		}
+	})
+	resp := jsonResponse(req, statusCode, arm.resources[key])
+	resp.Header.Set("Azure-AsyncOperation", operationURL(req, op))
+	return resp, nil
+}
+
+func (arm *ARM) deleteResource(req *http.Request, path string) (*http.Response, error) {
+	key := strings.ToLower(path)
+	resource, ok := arm.resources[key]
+	if !ok {
+		return &http.Response{StatusCode: http.StatusNoContent, Header: http.Header{}, Body: io.NopCloser(bytes.NewReader(nil)), Request: req}, nil
+	}
+	resource["properties"].(map[string]interface{})["provisioningState"] = ProvisioningStateDeleting
+
+	op := arm.startOperation([]string{key}, func() {
+		for id := range arm.resources {
+			if id == key || strings.HasPrefix(id, key+"/") {
+				delete(arm.resources, id)
+			}
+		}
+	})
+	resp := &http.Response{StatusCode: http.StatusAccepted, Header: http.Header{}, Body: io.NopCloser(bytes.NewReader(nil)), Request: req}
+	resp.Header.Set("Azure-AsyncOperation", operationURL(req, op))
+	resp.Header.Set("Location", operationURL(req, op))
+	return resp, nil
+}
+
+func (arm *ARM) getOperation(req *http.Request, id string) (*http.Response, error) {
+	op, ok := arm.operations[id]
+	if !ok {
+		return errorResponse(req, http.StatusNotFound, "OperationNotFound", "operation "+id+" was not found"), nil
+	}
+	arm.advance(op)
+	if !op.done {
+		resp := jsonResponse(req, http.StatusOK, map[string]interface{}{"status": "InProgress"})
+		resp.Header.Set("Retry-After", "1")
+		return resp, nil
+	}
+	return jsonResponse(req, http.StatusOK, map[string]interface{}{"status": ProvisioningStateSucceeded}), nil
+}
+
+func (arm *ARM) startOperation(resources []string, complete func()) *operation {
+	arm.opID++
+	op := &operation{
+		id:        fmt.Sprintf("op-%d", arm.opID),
+		remaining: arm.PendingPolls,
+		resources: resources,
+		complete:  complete,
+	}
+	arm.operations[op.id] = op
+	return op
+}
+
+// observe advances the pending operations of a resource, as if time had passed since it was last looked at.
+func (arm *ARM) observe(key string) {
+	for _, op := range arm.operations {
+		if op.done {
+			continue
+		}
+		for _, id := range op.resources {
+			if id == key {
+				arm.advance(op)
+				break
+			}
+		}
+	}
+}
+
+func (arm *ARM) advance(op *operation) {
+	if op.done {
+		return
+	}
+	if op.remaining > 0 {
+		op.remaining--
+		return
+	}
+	op.done = true
+	op.complete()
+}
+
+func (arm *ARM) store(id string, resource map[string]interface{}, provisioningState string) {
+	segments := strings.Split(strings.TrimPrefix(id, "/"), "/")
+	resourceType := strings.ToLower(segments[len(segments)-2])
+
+	arm.etag++
+	resource["id"] = id
+	resource["name"] = segments[len(segments)-1]
+	resource["type"] = resourceTypes[resourceType]
+	resource["etag"] = fmt.Sprintf("W/\"%d\"", arm.etag)
+	if _, ok := resource["properties"].(map[string]interface{}); !ok {
+		resource["properties"] = map[string]interface{}{}
+	}
+	resource["properties"].(map[string]interface{})["provisioningState"] = provisioningState
+	arm.resources[strings.ToLower(id)] = resource
+}
+
+func (arm *ARM) decode(id string, v interface{}) bool {
+	arm.mu.Lock()
+	defer arm.mu.Unlock()
+	resource, ok := arm.resources[strings.ToLower(id)]
+	if !ok {
+		return false
+	}
+	raw, err := json.Marshal(resource)
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(raw, v) == nil
+}
+
+func (arm *ARM) list(prefix string) []string {
+	arm.mu.Lock()
+	defer arm.mu.Unlock()
+	return arm.listLocked(prefix)
+}
+
+// listLocked returns the direct children of prefix, sorted so that pages are stable.
+func (arm *ARM) listLocked(prefix string) []string {
+	prefix = strings.ToLower(prefix)
+	var ids []string
+	for id := range arm.resources {
+		if strings.HasPrefix(id, prefix) && !strings.Contains(strings.TrimPrefix(id, prefix), "/") {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func operationURL(req *http.Request, op *operation) string {
+	return req.URL.Scheme + "://" + req.URL.Host + operationsPath + op.id + "?api-version=" + req.URL.Query().Get("api-version")
+}
+
+func jsonResponse(req *http.Request, statusCode int, body interface{}) *http.Response {
+	raw, _ := json.Marshal(body)
+	return &http.Response{
+		StatusCode:    statusCode,
+		Status:        fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode)),
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          io.NopCloser(bytes.NewReader(raw)),
+		ContentLength: int64(len(raw)),
+		Request:       req,
+	}
+}
+
+func errorResponse(req *http.Request, statusCode int, code string, message string) *http.Response {
+	resp := jsonResponse(req, statusCode, map[string]interface{}{
+		"error": map[string]interface{}{"code": code, "message": message},
+	})
+	resp.Header.Set("x-ms-error-code", code)
+	return resp
+}
@@ -0,0 +1,85 @@
+// -------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package azure
+
+import (
+	"context"
+
+	azurefirewallrulesv1 "github.com/Azure/azure-firewall-egress-controller/pkg/api/v1"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// splitDeletedFirewallRules separates the AzureFirewallRules being deleted from the other ones. The rules of the
+// deleted objects are no longer part of the generated config, and their finalizer is removed once it is applied.
+func splitDeletedFirewallRules(items []azurefirewallrulesv1.AzureFirewallRules) (live []azurefirewallrulesv1.AzureFirewallRules, deleted []azurefirewallrulesv1.AzureFirewallRules) {
+	for _, item := range items {
+		if item.DeletionTimestamp.IsZero() {
+			live = append(live, item)
+		} else if controllerutil.ContainsFinalizer(&item, azurefirewallrulesv1.CleanupFinalizer) {
+			deleted = append(deleted, item)
+		}
+	}
+	return live, deleted
+}
+
+// splitDeletedEgressPolicies separates the EgressPolicies being deleted from the other ones.
+func splitDeletedEgressPolicies(items []azurefirewallrulesv1.EgressPolicy) (live []azurefirewallrulesv1.EgressPolicy, deleted []azurefirewallrulesv1.EgressPolicy) {
+	for _, item := range items {
+		if item.DeletionTimestamp.IsZero() {
+			live = append(live, item)
+		} else if controllerutil.ContainsFinalizer(&item, azurefirewallrulesv1.CleanupFinalizer) {
+			deleted = append(deleted, item)
+		}
+	}
+	return live, deleted
+}
+
+// finalizedObjects returns the objects holding the cleanup finalizer.
+func finalizedObjects(erulesList []azurefirewallrulesv1.AzureFirewallRules, policyList []azurefirewallrulesv1.EgressPolicy) []client.Object {
+	var objects []client.Object
+	for i := range erulesList {
+		objects = append(objects, &erulesList[i])
+	}
+	for i := range policyList {
+		objects = append(objects, &policyList[i])
+	}
+	return objects
+}
+
+// addFinalizers adds the cleanup finalizer to the objects that don't have it yet, so that their rules are removed
+// from the firewall policy before they disappear.
+func (az *azClient) addFinalizers(ctx context.Context, objects []client.Object) {
+	for _, obj := range objects {
+		if controllerutil.ContainsFinalizer(obj, azurefirewallrulesv1.CleanupFinalizer) {
+			continue
+		}
+		patch := client.MergeFromWithOptions(obj.DeepCopyObject().(client.Object), client.MergeFromWithOptimisticLock{})
+		controllerutil.AddFinalizer(obj, azurefirewallrulesv1.CleanupFinalizer)
+		if err := az.client.Patch(ctx, obj, patch); err != nil {
+			klog.Error("Error adding the finalizer to ", client.ObjectKeyFromObject(obj), ": ", err)
+		}
+	}
+}
+
+// removeFinalizers releases the deleted objects. It must only run after the rule collection group without their
+// rules has been applied.
+func (az *azClient) removeFinalizers(ctx context.Context, objects []client.Object) {
+	for _, obj := range objects {
+		if err := removeFinalizer(ctx, az.client, obj); err != nil {
+			klog.Error("Error removing the finalizer of ", client.ObjectKeyFromObject(obj), ": ", err)
+			continue
+		}
+		klog.Infof("Removed the rules of the deleted object %s", client.ObjectKeyFromObject(obj))
+	}
+}
+
+func removeFinalizer(ctx context.Context, c client.Client, obj client.Object) error {
+	patch := client.MergeFromWithOptions(obj.DeepCopyObject().(client.Object), client.MergeFromWithOptimisticLock{})
+	controllerutil.RemoveFinalizer(obj, azurefirewallrulesv1.CleanupFinalizer)
+	return client.IgnoreNotFound(c.Patch(ctx, obj, patch))
+}
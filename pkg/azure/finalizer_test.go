@@ -0,0 +1,141 @@
+package azure
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+
+	azurefirewallrulesv1 "github.com/Azure/azure-firewall-egress-controller/pkg/api/v1"
+	azfake "github.com/Azure/azure-firewall-egress-controller/pkg/azure/fake"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// newDeletionTestRules returns the rules of the drift tests and another object with its own rule collection.
+func newDeletionTestRules() (azurefirewallrulesv1.AzureFirewallRules, azurefirewallrulesv1.AzureFirewallRules) {
+	db := newTestFirewallRules()
+	db.Name = "egressrules-db"
+	db.Spec.EgressRules = db.Spec.EgressRules[1:]
+	db.Spec.EgressRules[0].Rules = []azurefirewallrulesv1.AzureFirewallEgressrulesRulesSpec{
+		{RuleCollectionName: "allow-db", Priority: 300, RuleName: "sql", DestinationAddresses: []string{"10.0.0.4"}, DestinationPorts: []string{"1433"}, Protocol: []string{"TCP"}, Action: "Allow", RuleType: "Network"},
+	}
+	return newDriftTestRules(), db
+}
+
+func TestProcessRequestRemovesRulesOfDeletedObjects(t *testing.T) {
+	service, db := newDeletionTestRules()
+	arm := azfake.NewARM()
+	az, k8sClient := newTestAzClientWithFakeARM(t, arm,
+		&service,
+		&db,
+		newTestNode("node-1", map[string]string{"app": "service"}, "10.240.0.4"),
+		newTestNode("node-2", map[string]string{"app": "db"}, "10.240.0.5"),
+	)
+	ctx := context.Background()
+
+	if err := az.processRequest(ctx, ctrl.Request{}, nil); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	arm.CompleteOperations()
+	for _, name := range []string{service.Name, db.Name} {
+		updated := &azurefirewallrulesv1.AzureFirewallRules{}
+		if err := k8sClient.Get(ctx, types.NamespacedName{Name: name}, updated); err != nil {
+			t.Fatalf("Expected no error, but got: %v", err)
+		}
+		if !controllerutil.ContainsFinalizer(updated, azurefirewallrulesv1.CleanupFinalizer) {
+			t.Errorf("Expected finalizer %s on %s, but got: %v", azurefirewallrulesv1.CleanupFinalizer, name, updated.Finalizers)
+		}
+	}
+	if names := liveRuleCollectionNames(t, arm); len(names) != 2 {
+		t.Errorf("Expected %d rule collections, but got: %v", 2, names)
+	}
+
+	if err := k8sClient.Delete(ctx, &db); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	// The object is kept as long as its rules can't be removed from the rule collection group.
+	arm.FailNext(http.MethodPut, azfake.RuleCollectionGroupID(testSubscriptionID, testResourceGroup, testFwPolicy, testRuleCollGroup), http.StatusBadRequest)
+	if err := az.processRequest(ctx, ctrl.Request{}, nil); err == nil {
+		t.Errorf("Expected an error, but got: nil")
+	}
+	deleted := &azurefirewallrulesv1.AzureFirewallRules{}
+	if err := k8sClient.Get(ctx, types.NamespacedName{Name: db.Name}, deleted); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if deleted.DeletionTimestamp.IsZero() {
+		t.Errorf("Expected %s to be deleted", db.Name)
+	}
+
+	if err := az.processRequest(ctx, ctrl.Request{}, nil); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	arm.CompleteOperations()
+	if names := liveRuleCollectionNames(t, arm); len(names) != 1 || names[0] != "allow-service" {
+		t.Errorf("Expected rule collections %v, but got: %v", []string{"allow-service"}, names)
+	}
+	if _, ok := arm.IPGroup(azfake.IPGroupID(testSubscriptionID, testResourceGroup, nodeIpGroupNameOf("app", "db"))); ok {
+		t.Errorf("Expected IP Group %s to be deleted", nodeIpGroupNameOf("app", "db"))
+	}
+	if _, ok := arm.IPGroup(azfake.IPGroupID(testSubscriptionID, testResourceGroup, nodeIpGroupNameOf("app", "service"))); !ok {
+		t.Errorf("Expected IP Group %s to exist", nodeIpGroupNameOf("app", "service"))
+	}
+	if err := k8sClient.Get(ctx, types.NamespacedName{Name: db.Name}, deleted); !apierrors.IsNotFound(err) {
+		t.Errorf("Expected %s to be removed, but got: %v", db.Name, err)
+	}
+}
+
+func TestProcessRequestKeepsFinalizersInDryRun(t *testing.T) {
+	service := newDriftTestRules()
+	arm := azfake.NewARM()
+	az, k8sClient := newTestAzClientWithFakeARM(t, arm, &service, newTestNode("node-1", map[string]string{"app": "service"}, "10.240.0.4"))
+	az.SetDryRun(true)
+	az.planOutput = io.Discard
+
+	if err := az.processRequest(context.Background(), ctrl.Request{}, nil); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	updated := &azurefirewallrulesv1.AzureFirewallRules{}
+	if err := k8sClient.Get(context.Background(), types.NamespacedName{Name: service.Name}, updated); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if len(updated.Finalizers) != 0 {
+		t.Errorf("Expected no finalizer in dry run, but got: %v", updated.Finalizers)
+	}
+}
+
+func TestRefuseUnmanagedRulesAllowsDeletion(t *testing.T) {
+	service, db := newDeletionTestRules()
+	arm := azfake.NewARM()
+	az, k8sClient := newTestAzClientWithFakeARM(t, arm,
+		&service,
+		&db,
+		newTestNode("node-1", map[string]string{"app": "service"}, "10.240.0.4"),
+		newTestNode("node-2", map[string]string{"app": "db"}, "10.240.0.5"),
+	)
+	az.SetUnmanagedRulesPolicy(UnmanagedRulesRefuse)
+	ctx := context.Background()
+
+	if err := az.processRequest(ctx, ctrl.Request{}, nil); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	arm.CompleteOperations()
+	if err := k8sClient.Delete(ctx, &db); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	// The rules of the deleted object were generated by the controller, so they are not unmanaged.
+	if err := az.processRequest(ctx, ctrl.Request{}, nil); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	arm.CompleteOperations()
+	if names := liveRuleCollectionNames(t, arm); len(names) != 1 || names[0] != "allow-service" {
+		t.Errorf("Expected rule collections %v, but got: %v", []string{"allow-service"}, names)
+	}
+	if err := k8sClient.Get(ctx, types.NamespacedName{Name: db.Name}, &azurefirewallrulesv1.AzureFirewallRules{}); !apierrors.IsNotFound(err) {
+		t.Errorf("Expected %s to be gone, but got: %v", db.Name, err)
+	}
+}
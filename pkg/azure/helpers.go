@@ -6,7 +6,7 @@
 package azure
 
 import (
-	"bytes"
+	"strings"
 
 	n "github.com/Azure/azure-sdk-for-go/services/network/mgmt/2021-03-01/network"
 	"k8s.io/klog/v2"
@@ -26,28 +26,22 @@ func dumpSanitizedJSON(fwRuleCollectionGrp *n.FirewallPolicyRuleCollectionGroup)
 	return prettyJSON, err
 }
 
+// configIsSame compares the canonical models of the generated and the last applied configs, so that reordered
+// rules, addresses or objects don't redeploy the rule collection group, and logs what changed.
 func (az *azClient) configIsSame(fwRuleCollectionGrp *n.FirewallPolicyRuleCollectionGroup) bool {
 	if az.configCache == nil {
 		return false
 	}
 
-	jsonConfig, err := fwRuleCollectionGrp.MarshalJSON()
-	if err != nil {
-		klog.Error("Could not marshal fw config.")
+	config := canonicalRuleCollectionGroupOf(fwRuleCollectionGrp)
+	if config.equal(*az.configCache) {
+		return true
 	}
-	klog.Info("input state = ", string(jsonConfig))
-	klog.Info("cached state = ", string(*az.configCache))
-
-	// The result will be 0 if a==b, -1 if a < b, and +1 if a > b.
-	return az.configCache != nil && bytes.Compare(*az.configCache, jsonConfig) == 0
+	klog.Infof("Config changed:\n%s", strings.Join(diffRuleCollectionGroups(*az.configCache, config), "\n"))
+	return false
 }
 
 func (az *azClient) updateCache(fwRuleCollectionGrp *n.FirewallPolicyRuleCollectionGroup) {
-	jsonConfig, err := fwRuleCollectionGrp.MarshalJSON()
-	if err != nil {
-		klog.Error("Could not marshal fw config to update cache; Wiping cache.", err)
-		az.configCache = nil
-		return
-	}
-	*az.configCache = jsonConfig
+	config := canonicalRuleCollectionGroupOf(fwRuleCollectionGrp)
+	az.configCache = &config
 }
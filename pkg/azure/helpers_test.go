@@ -47,9 +47,7 @@ func TestDumpSanitizedJSON(t *testing.T) {
 }
 
 func TestConfigIsSame(t *testing.T) {
-	az := &azClient{
-		configCache: to.ByteSlicePtr([]byte{}),
-	}
+	az := &azClient{}
 	config := &n.FirewallPolicyRuleCollectionGroup{
 		FirewallPolicyRuleCollectionGroupProperties: &(n.FirewallPolicyRuleCollectionGroupProperties{
 			Priority:        to.Int32Ptr(300),
@@ -0,0 +1,91 @@
+// -------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package azure
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	azurefirewallrulesv1 "github.com/Azure/azure-firewall-egress-controller/pkg/api/v1"
+	a "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/network/armnetwork/v2"
+	"k8s.io/klog/v2"
+)
+
+// isManagedIpGroup returns true if the IP Group was created by the controller.
+func isManagedIpGroup(ipGroup *a.IPGroup) bool {
+	if ipGroup.Tags[ManagedByTagKey] != nil {
+		return *ipGroup.Tags[ManagedByTagKey] == ManagedByTagValue
+	}
+	// IP Groups created before the controller started tagging them are recognized by their name.
+	return ipGroup.Name != nil && (strings.HasPrefix(*ipGroup.Name, IpGroupNamePrefix) || strings.HasPrefix(*ipGroup.Name, PodIpGroupNamePrefix))
+}
+
+// orphanedIpGroups returns the names of the IP Groups managed for the cluster that are not desired anymore.
+// IP Groups of other clusters are never orphans. The IP Groups tagged by the controller without a cluster tag could
+// have been created by the controller of any cluster before it had a name, so a named cluster only adopts the ones
+// it can prove it created, i.e. named after one of its own selectors, see unnamedClusterIpGroups. The IP Groups only
+// recognized by their name are kept once the cluster has a name.
+func orphanedIpGroups(ipGroupsInRG map[string]*a.IPGroup, desiredIpGroups map[string]bool, clusterName string, adoptedIpGroups map[string]bool) []string {
+	var orphans []string
+	for name, ipGroup := range ipGroupsInRG {
+		if desiredIpGroups[name] || !isManagedIpGroup(ipGroup) {
+			continue
+		}
+		if cluster := ipGroupCluster(ipGroup); cluster != clusterName && (cluster != "" || ipGroup.Tags[ManagedByTagKey] == nil || !adoptedIpGroups[name]) {
+			continue
+		}
+		if ipGroup.Properties != nil && ipGroup.Properties.ProvisioningState != nil && *ipGroup.Properties.ProvisioningState == a.ProvisioningStateDeleting {
+			continue
+		}
+		orphans = append(orphans, name)
+	}
+	sort.Strings(orphans)
+	return orphans
+}
+
+// unnamedClusterIpGroups returns the names of the IP Groups of the selectors of the objects when the cluster had no
+// name.
+func unnamedClusterIpGroups(erules []azurefirewallrulesv1.AzureFirewallRules, policies []azurefirewallrulesv1.EgressPolicy) map[string]bool {
+	names := make(map[string]bool)
+	for _, item := range erules {
+		for _, egressrule := range item.Spec.EgressRules {
+			nodeIpGroups, _ := nodeIpGroupsOf("", egressrule)
+			for _, nodeIpGroup := range nodeIpGroups {
+				names[nodeIpGroup.name] = true
+			}
+		}
+	}
+	for _, policy := range policies {
+		names[PodIpGroupName("", policy.Namespace, policy.Name)] = true
+	}
+	return names
+}
+
+// deleteOrphanedIpGroups deletes the managed IP Groups that are no longer referenced by any egress rule.
+// It must only run after the rule collection group has been applied, as Azure refuses to delete IP Groups
+// that are still referenced by a firewall policy.
+func (az *azClient) deleteOrphanedIpGroups(ctx context.Context, ipGroupsInRG map[string]*a.IPGroup, desiredIpGroups map[string]bool, adoptedIpGroups map[string]bool) {
+	defer az.lockIpGroups()()
+	for _, name := range orphanedIpGroups(ipGroupsInRG, desiredIpGroups, az.clusterName, adoptedIpGroups) {
+		if az.dryRun {
+			fmt.Fprintf(az.planOutput, "IP Group %s is no longer referenced and would be deleted.\n", name)
+			continue
+		}
+		klog.Info("Deleting orphaned IP Group: ", name)
+		_, err := az.ipGroupClient.BeginDelete(ctx, az.resourceGroupName, name, nil)
+		observeARMRequest(opIPGroupDelete, err)
+		if err != nil {
+			klog.Error("Error deleting the orphaned IP Group ", name, ": ", err)
+			continue
+		}
+		delete(az.pollers, name)
+		ipGroupAddressCount.DeleteLabelValues(az.resourceGroupName, name)
+		ipGroupDrifted.DeleteLabelValues(az.resourceGroupName, name)
+		delete(az.appliedIpGroups, name)
+	}
+}
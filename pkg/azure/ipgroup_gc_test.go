@@ -0,0 +1,90 @@
+package azure
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+
+	azurefirewallrulesv1 "github.com/Azure/azure-firewall-egress-controller/pkg/api/v1"
+	azfake "github.com/Azure/azure-firewall-egress-controller/pkg/azure/fake"
+	a "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/network/armnetwork/v2"
+	"github.com/Azure/go-autorest/autorest/to"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+func TestOrphanedIpGroups(t *testing.T) {
+	newIpGroup := func(name string, tags map[string]*string, state a.ProvisioningState) *a.IPGroup {
+		return &a.IPGroup{
+			Name:       to.StringPtr(name),
+			Tags:       tags,
+			Properties: &a.IPGroupPropertiesFormat{ProvisioningState: &state},
+		}
+	}
+	managed := map[string]*string{ManagedByTagKey: to.StringPtr(ManagedByTagValue)}
+
+	ipGroupsInRG := map[string]*a.IPGroup{
+		nodeIpGroupNameOf("app", "service"): newIpGroup(nodeIpGroupNameOf("app", "service"), managed, a.ProvisioningStateSucceeded),
+		"IPGroup-node-appold":               newIpGroup("IPGroup-node-appold", nil, a.ProvisioningStateSucceeded),
+		"IPGroup-pod-team-a-web":            newIpGroup("IPGroup-pod-team-a-web", managed, a.ProvisioningStateSucceeded),
+		"IPGroup-node-deleting":             newIpGroup("IPGroup-node-deleting", managed, a.ProvisioningStateDeleting),
+		"IPGroup-node-foreign":              newIpGroup("IPGroup-node-foreign", map[string]*string{ManagedByTagKey: to.StringPtr("someone-else")}, a.ProvisioningStateSucceeded),
+		"onprem-ranges":                     newIpGroup("onprem-ranges", nil, a.ProvisioningStateSucceeded),
+		"tagged-custom-name":                newIpGroup("tagged-custom-name", managed, a.ProvisioningStateSucceeded),
+	}
+	desiredIpGroups := map[string]bool{nodeIpGroupNameOf("app", "service"): true}
+
+	expected := []string{"IPGroup-node-appold", "IPGroup-pod-team-a-web", "tagged-custom-name"}
+	if output := orphanedIpGroups(ipGroupsInRG, desiredIpGroups, "", nil); !reflect.DeepEqual(output, expected) {
+		t.Errorf("Expected %v, but got: %v", expected, output)
+	}
+}
+
+func TestProcessRequestDeletesOrphanedIpGroups(t *testing.T) {
+	rules := newTestFirewallRules()
+	arm := azfake.NewARM()
+	arm.AddIPGroup(testSubscriptionID, testResourceGroup, "IPGroup-node-appold", "westeurope", []string{"10.240.0.9"})
+	arm.AddIPGroup(testSubscriptionID, testResourceGroup, "onprem-ranges", "westeurope", []string{"192.168.0.0/16"})
+	az, _ := newTestAzClientWithFakeARM(t, arm, &rules, newTestNode("node-1", map[string]string{"app": "service"}, "10.240.0.4"))
+	ctx := context.Background()
+
+	// The rule collection group can't be applied, so no IP Group may be deleted.
+	arm.FailNext(http.MethodPut, azfake.RuleCollectionGroupID(testSubscriptionID, testResourceGroup, testFwPolicy, testRuleCollGroup), http.StatusBadRequest)
+	if err := az.processRequest(ctx, ctrl.Request{}, nil); err == nil {
+		t.Errorf("Expected an error, but got: nil")
+	}
+	arm.CompleteOperations()
+	if _, ok := arm.IPGroup(azfake.IPGroupID(testSubscriptionID, testResourceGroup, "IPGroup-node-appold")); !ok {
+		t.Errorf("Expected IP Group %s to exist", "IPGroup-node-appold")
+	}
+
+	if err := az.processRequest(ctx, ctrl.Request{}, nil); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	arm.CompleteOperations()
+
+	var names []string
+	for _, ipGroup := range arm.IPGroups(testSubscriptionID, testResourceGroup) {
+		names = append(names, *ipGroup.Name)
+	}
+	expected := []string{nodeIpGroupNameOf("app", "db"), nodeIpGroupNameOf("app", "service"), "onprem-ranges"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected IP Groups %v, but got: %v", expected, names)
+	}
+
+	ipGroup, _ := arm.IPGroup(azfake.IPGroupID(testSubscriptionID, testResourceGroup, nodeIpGroupNameOf("app", "service")))
+	if ipGroup.Tags[ManagedByTagKey] == nil || *ipGroup.Tags[ManagedByTagKey] != ManagedByTagValue {
+		t.Errorf("Expected tag %s=%s, but got: %v", ManagedByTagKey, ManagedByTagValue, ipGroup.Tags)
+	}
+}
+
+func TestUnnamedClusterIpGroups(t *testing.T) {
+	rules := newTestFirewallRules()
+	policy := azurefirewallrulesv1.EgressPolicy{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "team-a"}}
+
+	expected := map[string]bool{nodeIpGroupNameOf("app", "service"): true, nodeIpGroupNameOf("app", "db"): true, PodIpGroupName("", "team-a", "web"): true}
+	if output := unnamedClusterIpGroups([]azurefirewallrulesv1.AzureFirewallRules{rules}, []azurefirewallrulesv1.EgressPolicy{policy}); !reflect.DeepEqual(output, expected) {
+		t.Errorf("Expected %v, but got: %v", expected, output)
+	}
+}
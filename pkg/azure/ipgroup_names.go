@@ -0,0 +1,76 @@
+// -------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package azure
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	// Azure resource names of IP Groups are limited to 80 characters.
+	maxIpGroupNameLength  = 80
+	ipGroupNameHashLength = 10
+
+	// Azure tag values are limited to 256 characters.
+	maxTagValueLength = 256
+)
+
+// invalidIpGroupNameChars matches the characters that are not allowed in IP Group names.
+var invalidIpGroupNameChars = regexp.MustCompile(`[^A-Za-z0-9_.]+`)
+
+// ipGroupName returns a valid IP Group name made of the prefix, the sanitized readable part truncated to fit the
+// length limit, and a hash of the identity, so that distinct identities never share a name.
+func ipGroupName(prefix string, readable string, identity string) string {
+	hash := sha256.Sum256([]byte(identity))
+	suffix := "-" + hex.EncodeToString(hash[:])[:ipGroupNameHashLength]
+
+	readable = strings.Trim(invalidIpGroupNameChars.ReplaceAllString(readable, "-"), "-.")
+	if maxLength := maxIpGroupNameLength - len(prefix) - len(suffix); len(readable) > maxLength {
+		readable = strings.TrimRight(readable[:maxLength], "-.")
+	}
+	if readable == "" {
+		return prefix + suffix[1:]
+	}
+	return prefix + readable + suffix
+}
+
+// NodeIpGroupName returns the name of the IP Group holding the IPs of the nodes of the cluster matching the
+// selector, e.g. "IPGroup-node-kubernetes.azure.com-agentpool-egress-0123456789" for
+// kubernetes.azure.com/agentpool=egress. Equivalent selectors share the IP Group. The name of the cluster, if any,
+// follows the prefix, so that clusters sharing a resource group don't share IP Groups.
+func NodeIpGroupName(clusterName string, selector labels.Selector) string {
+	requirements, _ := selector.Requirements()
+	var readable []string
+	for _, requirement := range requirements {
+		readable = append(readable, requirement.Key())
+		readable = append(readable, requirement.Values().List()...)
+	}
+	return clusterIpGroupName(IpGroupNamePrefix, clusterName, strings.Join(readable, "-"), canonicalSelector(selector))
+}
+
+// PodIpGroupName returns the name of the IP Group holding the IPs of the pods selected by an EgressPolicy.
+func PodIpGroupName(clusterName string, namespace string, name string) string {
+	return clusterIpGroupName(PodIpGroupNamePrefix, clusterName, namespace+"-"+name, namespace+"/"+name)
+}
+
+func clusterIpGroupName(prefix string, clusterName string, readable string, identity string) string {
+	if clusterName == "" {
+		return ipGroupName(prefix, readable, identity)
+	}
+	return ipGroupName(prefix, clusterName+"-"+readable, clusterName+"/"+identity)
+}
+
+func truncateTagValue(value string) string {
+	if len(value) > maxTagValueLength {
+		return value[:maxTagValueLength]
+	}
+	return value
+}
@@ -0,0 +1,90 @@
+package azure
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+
+	azfake "github.com/Azure/azure-firewall-egress-controller/pkg/azure/fake"
+	"github.com/Azure/azure-firewall-egress-controller/pkg/version"
+	"k8s.io/apimachinery/pkg/labels"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// validIpGroupName matches the names accepted by Azure for IP Groups.
+var validIpGroupName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,78}[A-Za-z0-9_]$`)
+
+func TestNodeIpGroupName(t *testing.T) {
+	type testCase struct {
+		Name     string
+		selector labels.Set
+		Expected string
+	}
+
+	testCases := []testCase{
+		{
+			Name:     "simple",
+			selector: labels.Set{"app": "service"},
+			Expected: "IPGroup-node-app-service-1d80579166",
+		},
+		{
+			Name:     "prefixed-key",
+			selector: labels.Set{"kubernetes.azure.com/agentpool": "egress"},
+			Expected: "IPGroup-node-kubernetes.azure.com-agentpool-egress-",
+		},
+		{
+			Name:     "long",
+			selector: labels.Set{"example.com/" + strings.Repeat("k", 60): strings.Repeat("v", 60)},
+			Expected: "IPGroup-node-example.com-kkkk",
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			name := NodeIpGroupName("", labels.SelectorFromSet(tc.selector))
+			if !strings.HasPrefix(name, tc.Expected) {
+				t.Errorf("Expected IP Group name to start with %s, but got: %s", tc.Expected, name)
+			}
+			if !validIpGroupName.MatchString(name) {
+				t.Errorf("Expected a valid IP Group name, but got: %s", name)
+			}
+		})
+	}
+
+	// Concatenating the key and the value would make these selectors collide.
+	if NodeIpGroupName("", labels.SelectorFromSet(labels.Set{"ab": "c"})) == NodeIpGroupName("", labels.SelectorFromSet(labels.Set{"a": "bc"})) {
+		t.Errorf("Expected distinct IP Group names for %s and %s", "ab=c", "a=bc")
+	}
+	if name := PodIpGroupName("", strings.Repeat("n", 63), strings.Repeat("p", 253)); !validIpGroupName.MatchString(name) {
+		t.Errorf("Expected a valid IP Group name, but got: %s", name)
+	}
+}
+
+func TestIpGroupTags(t *testing.T) {
+	rules := newDriftTestRules()
+	arm := azfake.NewARM()
+	az, _ := newTestAzClientWithFakeARM(t, arm, rules.DeepCopy(), newTestNode("node-1", map[string]string{"app": "service"}, "10.240.0.4"))
+	az.SetClusterName("aks-prod")
+	if err := az.processRequest(context.Background(), ctrl.Request{}, nil); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	name := NodeIpGroupName("aks-prod", labels.SelectorFromSet(labels.Set{"app": "service"}))
+	ipGroup, ok := arm.IPGroup(azfake.IPGroupID(testSubscriptionID, testResourceGroup, name))
+	if !ok {
+		t.Fatalf("Expected IP Group %s to exist", name)
+	}
+	expected := map[string]string{
+		ManagedByTagKey:         ManagedByTagValue,
+		ClusterTagKey:           "aks-prod",
+		SelectorTagKey:          "app in (service)",
+		ControllerVersionTagKey: version.Version,
+	}
+	for key, value := range expected {
+		if ipGroup.Tags[key] == nil || *ipGroup.Tags[key] != value {
+			t.Errorf("Expected tag %s=%s, but got: %v", key, value, ipGroup.Tags[key])
+		}
+	}
+}
@@ -0,0 +1,348 @@
+// -------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package azure
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	n "github.com/Azure/azure-sdk-for-go/services/network/mgmt/2021-03-01/network"
+	"github.com/Azure/go-autorest/autorest/to"
+	corev1 "k8s.io/api/core/v1"
+	k8sruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/klog/v2"
+)
+
+// firewallPolicyLimits are the Azure Firewall Policy limits the generated config must fit in.
+type firewallPolicyLimits struct {
+	// RuleCollectionGroupSize is the maximum size of a rule collection group, in bytes.
+	RuleCollectionGroupSize int
+	// RuleCollectionGroups is the maximum number of rule collection groups of a firewall policy.
+	RuleCollectionGroups int
+	// Rules is the maximum number of rules of a firewall policy.
+	Rules int
+	// IpGroups is the maximum number of IP Groups referenced by a firewall.
+	IpGroups int
+}
+
+// defaultFirewallPolicyLimits are the limits documented in
+// https://learn.microsoft.com/azure/azure-resource-manager/management/azure-subscription-service-limits#azure-firewall-limits
+var defaultFirewallPolicyLimits = firewallPolicyLimits{
+	RuleCollectionGroupSize: 2 * 1024 * 1024,
+	RuleCollectionGroups:    100,
+	Rules:                   10000,
+	IpGroups:                200,
+}
+
+// maxRuleCollectionGroupPriority is the highest priority of a rule collection group.
+const maxRuleCollectionGroupPriority = 65000
+
+// limitsExceededError is returned when the generated config doesn't fit in the firewall policy limits.
+type limitsExceededError struct {
+	violations []string
+}
+
+func (e *limitsExceededError) Error() string {
+	return "the generated config exceeds the Azure Firewall Policy limits: " + strings.Join(e.violations, "; ")
+}
+
+// ruleCollectionGroupShard is one of the rule collection groups the generated config is split into.
+type ruleCollectionGroupShard struct {
+	name            string
+	priority        int32
+	ruleCollections []n.BasicFirewallPolicyRuleCollection
+}
+
+func (s ruleCollectionGroupShard) ruleCollectionGroup() *n.FirewallPolicyRuleCollectionGroup {
+	ruleCollections := s.ruleCollections
+	return &n.FirewallPolicyRuleCollectionGroup{
+		FirewallPolicyRuleCollectionGroupProperties: &n.FirewallPolicyRuleCollectionGroupProperties{
+			Priority:        to.Int32Ptr(s.priority),
+			RuleCollections: &ruleCollections,
+		},
+	}
+}
+
+// shardName returns the name of the shard with the given index: the first shard is the configured rule collection
+// group, the next ones are suffixed with their number, e.g. "aks-egress-2".
+func shardName(name string, index int) string {
+	if index == 0 {
+		return name
+	}
+	return name + "-" + strconv.Itoa(index+1)
+}
+
+// jsonSize returns the size of the ARM representation of v.
+func jsonSize(v interface{}) int {
+	raw, _ := json.Marshal(v)
+	return len(raw)
+}
+
+// shardRuleCollections checks the rule collections against the limits and splits them into as many rule collection
+// groups as their size requires. A rule collection is never split. The rule collections are sorted by priority and
+// the shards get consecutive priorities, so that the firewall processes them in the same order as a single rule
+// collection group.
+func shardRuleCollections(ruleCollections []n.BasicFirewallPolicyRuleCollection, name string, priority int32, limits firewallPolicyLimits) ([]ruleCollectionGroupShard, error) {
+	var violations []string
+
+	rules := 0
+	ipGroups := make(map[string]bool)
+	for _, ruleCollection := range ruleCollections {
+		for _, rule := range ruleCollectionRules(ruleCollection) {
+			rules++
+			canonical := canonicalRuleOf(rule)
+			for _, id := range append(canonical.SourceIPGroups, canonical.DestinationIPGroups...) {
+				ipGroups[strings.ToLower(id)] = true
+			}
+		}
+	}
+	if rules > limits.Rules {
+		violations = append(violations, fmt.Sprintf("%d rules (limit %d)", rules, limits.Rules))
+	}
+	if len(ipGroups) > limits.IpGroups {
+		violations = append(violations, fmt.Sprintf("%d IP Groups (limit %d)", len(ipGroups), limits.IpGroups))
+	}
+
+	sorted := make([]n.BasicFirewallPolicyRuleCollection, len(ruleCollections))
+	copy(sorted, ruleCollections)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return canonicalRuleCollectionOf(sorted[i]).Priority < canonicalRuleCollectionOf(sorted[j]).Priority
+	})
+
+	envelope := jsonSize(ruleCollectionGroupShard{name: name, priority: priority}.ruleCollectionGroup())
+	shards := []ruleCollectionGroupShard{{name: name, priority: priority}}
+	size := envelope
+	for _, ruleCollection := range sorted {
+		collectionSize := jsonSize(ruleCollection) + 1
+		if envelope+collectionSize > limits.RuleCollectionGroupSize {
+			violations = append(violations, fmt.Sprintf("rule collection %s is %d bytes (limit %d)", GetRuleCollectionName(ruleCollection), collectionSize, limits.RuleCollectionGroupSize-envelope))
+			continue
+		}
+		current := &shards[len(shards)-1]
+		if len(current.ruleCollections) != 0 && size+collectionSize > limits.RuleCollectionGroupSize {
+			index := len(shards)
+			shards = append(shards, ruleCollectionGroupShard{name: shardName(name, index), priority: priority + int32(index)})
+			current = &shards[index]
+			size = envelope
+		}
+		current.ruleCollections = append(current.ruleCollections, ruleCollection)
+		size += collectionSize
+	}
+
+	if len(shards) > limits.RuleCollectionGroups {
+		violations = append(violations, fmt.Sprintf("%d rule collection groups (limit %d)", len(shards), limits.RuleCollectionGroups))
+	}
+	if last := int(priority) + len(shards) - 1; len(shards) > 1 && last > maxRuleCollectionGroupPriority {
+		violations = append(violations, fmt.Sprintf("rule collection group priority %d (limit %d)", last, maxRuleCollectionGroupPriority))
+	}
+
+	if len(violations) != 0 {
+		return nil, &limitsExceededError{violations: violations}
+	}
+	return shards, nil
+}
+
+// checkShardPriorities refuses to overflow into rule collection groups whose priority is already taken by another
+// rule collection group of the firewall policy: a live one, e.g. of another cluster or added in the portal, or one
+// managed by another client of the set. The live rule collection groups are listed when the number of rule
+// collection groups changes and when they are compared with the live ones.
+func (az *azClient) checkShardPriorities(shards []ruleCollectionGroupShard, checkLive bool) error {
+	if len(shards) < 2 {
+		az.shardPrioritiesChecked = len(shards)
+		return nil
+	}
+	own := make(map[string]bool)
+	for _, shard := range shards {
+		own[strings.ToLower(shard.name)] = true
+	}
+	used := az.otherTargetPriorities()
+	if checkLive || az.shardPrioritiesChecked != len(shards) {
+		live, err := az.fwPolicyRuleCollectionGroupClient.ListComplete(az.ctx, az.resourceGroupName, az.fwPolicyName)
+		observeARMRequest(opRuleCollectionGroupList, err)
+		for ; err == nil && live.NotDone(); err = live.NextWithContext(az.ctx) {
+			ruleCollectionGroup := live.Value()
+			if ruleCollectionGroup.Name == nil || own[strings.ToLower(*ruleCollectionGroup.Name)] || ruleCollectionGroup.FirewallPolicyRuleCollectionGroupProperties == nil || ruleCollectionGroup.Priority == nil {
+				continue
+			}
+			used[*ruleCollectionGroup.Priority] = *ruleCollectionGroup.Name
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	var violations []string
+	for _, shard := range shards[1:] {
+		if name, ok := used[shard.priority]; ok {
+			violations = append(violations, fmt.Sprintf("priority %d of rule collection group %s is taken by rule collection group %s", shard.priority, shard.name, name))
+		}
+	}
+	if len(violations) != 0 {
+		return &limitsExceededError{violations: violations}
+	}
+	az.shardPrioritiesChecked = len(shards)
+	return nil
+}
+
+// deployShards applies the rule collection groups beyond the first one that changed since they were last applied,
+// and releases the ones the generated config doesn't overflow into anymore. Like the first one, every rule
+// collection group is compared with the live one before its first deployment and when the drift check is due.
+func (az *azClient) deployShards(shards []ruleCollectionGroupShard, checkLive bool, objects []k8sruntime.Object) error {
+	desired := make(map[string]bool)
+	for _, shard := range shards {
+		desired[shard.name] = true
+		fwRuleCollectionGrpObj := shard.ruleCollectionGroup()
+		if checkLive || !az.liveShardsChecked[shard.name] {
+			upToDate, err := az.checkLiveRuleCollectionGroup(shard.name, fwRuleCollectionGrpObj, objects)
+			if err != nil {
+				klog.Error("Error checking the live rule collection group: ", err)
+				return err
+			}
+			config := canonicalRuleCollectionGroupOf(fwRuleCollectionGrpObj)
+			if upToDate {
+				az.shardCache[shard.name] = &config
+				continue
+			}
+			if cached, ok := az.shardCache[shard.name]; ok && cached.equal(config) {
+				if az.driftPolicy == DriftPolicyAlert {
+					continue
+				}
+				delete(az.shardCache, shard.name)
+			}
+		}
+		config := canonicalRuleCollectionGroupOf(fwRuleCollectionGrpObj)
+		if cached, ok := az.shardCache[shard.name]; ok && cached.equal(config) {
+			configCacheHits.WithLabelValues(shard.name).Inc()
+			continue
+		}
+
+		unlockFirewallPolicy := az.lockFirewallPolicy()
+		err := az.waitForPolicyUpdate()
+		if err == nil {
+			klog.Infof("Deploying rule collection group %s with priority %d", shard.name, shard.priority)
+			var future n.FirewallPolicyRuleCollectionGroupsCreateOrUpdateFuture
+			future, err = az.fwPolicyRuleCollectionGroupClient.CreateOrUpdate(az.ctx, az.resourceGroupName, az.fwPolicyName, shard.name, *fwRuleCollectionGrpObj)
+			if err == nil {
+				err = future.WaitForCompletionRef(az.ctx, az.fwPolicyRuleCollectionGroupClient.BaseClient.Client)
+			}
+			observeARMRequest(opRuleCollectionGroupCreateOrUpdate, err)
+		}
+		unlockFirewallPolicy()
+		if err != nil {
+			delete(az.shardCache, shard.name)
+			klog.Error("Error updating the Firewall Policy: ", err)
+			az.recordDeploymentEvent(objects, corev1.EventTypeWarning, EventReasonDeploymentFailed, "Failed to deploy rule collection group %s to firewall policy %s: %v", shard.name, az.fwPolicyName, err)
+			return err
+		}
+		az.shardCache[shard.name] = &config
+		az.recordDeploymentEvent(objects, corev1.EventTypeNormal, EventReasonDeploymentSucceeded, "Deployed rule collection group %s to firewall policy %s", shard.name, az.fwPolicyName)
+	}
+
+	var stale []string
+	for name := range az.shardCache {
+		if !desired[name] {
+			stale = append(stale, name)
+		}
+	}
+	if !az.shardsChecked {
+		// The shards applied before a restart are not cached, so look for them past the last desired one. Only
+		// the rules the client generated are removed from them.
+		for index := len(shards) + 1; index < az.limits.RuleCollectionGroups; index++ {
+			name := shardName(az.fwPolicyRuleCollectionGroupName, index)
+			live, err := az.fwPolicyRuleCollectionGroupClient.Get(az.ctx, az.resourceGroupName, az.fwPolicyName, name)
+			observeARMRequest(opRuleCollectionGroupGet, err)
+			if err != nil {
+				if live.Response.Response != nil && live.StatusCode == http.StatusNotFound {
+					break
+				}
+				return err
+			}
+			if _, ok := az.shardCache[name]; !ok {
+				stale = append(stale, name)
+			}
+		}
+		az.shardsChecked = true
+	}
+	sort.Strings(stale)
+
+	for _, name := range stale {
+		if err := az.releaseRuleCollectionGroup(az.ctx, name); err != nil {
+			return err
+		}
+		delete(az.shardCache, name)
+		delete(az.liveShardsChecked, name)
+	}
+	return nil
+}
+
+// releaseRuleCollectionGroup removes the rules generated by the client from the live rule collection group. The
+// rule collection group is deleted when nothing else is left in it, and left alone when it holds none of them.
+func (az *azClient) releaseRuleCollectionGroup(ctx context.Context, name string) error {
+	live, err := az.fwPolicyRuleCollectionGroupClient.Get(ctx, az.resourceGroupName, az.fwPolicyName, name)
+	observeARMRequest(opRuleCollectionGroupGet, err)
+	if err != nil {
+		if live.Response.Response != nil && live.StatusCode == http.StatusNotFound {
+			return nil
+		}
+		return err
+	}
+
+	var remaining []n.BasicFirewallPolicyRuleCollection
+	released := false
+	for _, ruleCollection := range ruleCollectionsOf(&live) {
+		rules := unownedRules(ruleCollection, az.ownsRule)
+		if len(rules) == len(ruleCollectionRules(ruleCollection)) {
+			remaining = append(remaining, ruleCollection)
+			continue
+		}
+		released = true
+		if len(rules) != 0 {
+			remaining = append(remaining, ruleCollectionWithRules(ruleCollection, rules))
+		}
+	}
+	if !released {
+		klog.Infof("Rule collection group %s holds no rules generated by the controller, leaving it alone", name)
+		return nil
+	}
+
+	defer az.lockFirewallPolicy()()
+	err = az.waitForPolicyUpdate()
+	if err == nil {
+		if len(remaining) == 0 {
+			klog.Infof("Deleting rule collection group %s of firewall policy %s", name, az.fwPolicyName)
+			var future n.FirewallPolicyRuleCollectionGroupsDeleteFuture
+			future, err = az.fwPolicyRuleCollectionGroupClient.Delete(ctx, az.resourceGroupName, az.fwPolicyName, name)
+			if err == nil {
+				err = future.WaitForCompletionRef(ctx, az.fwPolicyRuleCollectionGroupClient.BaseClient.Client)
+			}
+			observeARMRequest(opRuleCollectionGroupDelete, err)
+		} else {
+			klog.Infof("Removing the rules generated by the controller from rule collection group %s of firewall policy %s", name, az.fwPolicyName)
+			fwRuleCollectionGrp := n.FirewallPolicyRuleCollectionGroup{
+				FirewallPolicyRuleCollectionGroupProperties: &n.FirewallPolicyRuleCollectionGroupProperties{
+					Priority:        live.Priority,
+					RuleCollections: &remaining,
+				},
+			}
+			var future n.FirewallPolicyRuleCollectionGroupsCreateOrUpdateFuture
+			future, err = az.fwPolicyRuleCollectionGroupClient.CreateOrUpdate(ctx, az.resourceGroupName, az.fwPolicyName, name, fwRuleCollectionGrp)
+			if err == nil {
+				err = future.WaitForCompletionRef(ctx, az.fwPolicyRuleCollectionGroupClient.BaseClient.Client)
+			}
+			observeARMRequest(opRuleCollectionGroupCreateOrUpdate, err)
+		}
+	}
+	if err != nil {
+		klog.Error("Error releasing rule collection group ", name, ": ", err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,316 @@
+package azure
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	azurefirewallrulesv1 "github.com/Azure/azure-firewall-egress-controller/pkg/api/v1"
+	azfake "github.com/Azure/azure-firewall-egress-controller/pkg/azure/fake"
+	n "github.com/Azure/azure-sdk-for-go/services/network/mgmt/2021-03-01/network"
+	"github.com/Azure/go-autorest/autorest/to"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// newShardTestRules returns rules in three rule collections of the same size, declared out of priority order.
+func newShardTestRules() azurefirewallrulesv1.AzureFirewallRules {
+	rules := newDriftTestRules()
+	var specs []azurefirewallrulesv1.AzureFirewallEgressrulesRulesSpec
+	for _, collection := range []struct {
+		name     string
+		priority int32
+	}{{"allow-c", 300}, {"allow-a", 100}, {"allow-b", 200}} {
+		specs = append(specs, azurefirewallrulesv1.AzureFirewallEgressrulesRulesSpec{
+			RuleCollectionName: collection.name,
+			Priority:           collection.priority,
+			RuleName:           "github",
+			TargetFqdns:        []string{"github.com"},
+			Protocol:           []string{"HTTPS:443"},
+			Action:             "Allow",
+			RuleType:           "Application",
+		})
+	}
+	rules.Spec.EgressRules[0].Rules = specs
+	return rules
+}
+
+// shardTestLimits returns limits that fit two of the rule collections of newShardTestRules in a rule collection group.
+func shardTestLimits(ruleCollections []n.BasicFirewallPolicyRuleCollection) firewallPolicyLimits {
+	limits := defaultFirewallPolicyLimits
+	limits.RuleCollectionGroupSize = jsonSize(ruleCollectionGroupShard{name: testRuleCollGroup, priority: 400}.ruleCollectionGroup()) + 2*(jsonSize(ruleCollections[0])+1) + 16
+	return limits
+}
+
+func shardRuleCollectionNames(shards []ruleCollectionGroupShard) map[string][]string {
+	names := make(map[string][]string)
+	for _, shard := range shards {
+		for _, ruleCollection := range shard.ruleCollections {
+			names[shard.name] = append(names[shard.name], GetRuleCollectionName(ruleCollection))
+		}
+	}
+	return names
+}
+
+func TestShardRuleCollections(t *testing.T) {
+	rules := newShardTestRules()
+	ruleCollections := *BuildFirewallConfig(azurefirewallrulesv1.AzureFirewallRulesList{Items: []azurefirewallrulesv1.AzureFirewallRules{rules}}, map[string][]string{"test1": {"ipgroup-1"}})
+	limits := shardTestLimits(ruleCollections)
+
+	shards, err := shardRuleCollections(ruleCollections, testRuleCollGroup, 400, defaultFirewallPolicyLimits)
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if expected := map[string][]string{testRuleCollGroup: {"allow-a", "allow-b", "allow-c"}}; !reflect.DeepEqual(shardRuleCollectionNames(shards), expected) {
+		t.Errorf("Expected %v, but got: %v", expected, shardRuleCollectionNames(shards))
+	}
+
+	shards, err = shardRuleCollections(ruleCollections, testRuleCollGroup, 400, limits)
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	expected := map[string][]string{testRuleCollGroup: {"allow-a", "allow-b"}, testRuleCollGroup + "-2": {"allow-c"}}
+	if !reflect.DeepEqual(shardRuleCollectionNames(shards), expected) {
+		t.Errorf("Expected %v, but got: %v", expected, shardRuleCollectionNames(shards))
+	}
+	if shards[1].priority != 401 {
+		t.Errorf("Expected priority %d, but got: %d", 401, shards[1].priority)
+	}
+
+	type testCase struct {
+		Name     string
+		limits   func() firewallPolicyLimits
+		priority int32
+		Expected string
+	}
+
+	testCases := []testCase{
+		{
+			Name:     "rules",
+			limits:   func() firewallPolicyLimits { l := defaultFirewallPolicyLimits; l.Rules = 2; return l },
+			priority: 400,
+			Expected: "3 rules (limit 2)",
+		},
+		{
+			Name:     "ip-groups",
+			limits:   func() firewallPolicyLimits { l := defaultFirewallPolicyLimits; l.IpGroups = 0; return l },
+			priority: 400,
+			Expected: "1 IP Groups (limit 0)",
+		},
+		{
+			Name:     "rule-collection-groups",
+			limits:   func() firewallPolicyLimits { l := limits; l.RuleCollectionGroups = 1; return l },
+			priority: 400,
+			Expected: "2 rule collection groups (limit 1)",
+		},
+		{
+			Name:     "priority",
+			limits:   func() firewallPolicyLimits { return limits },
+			priority: maxRuleCollectionGroupPriority,
+			Expected: "rule collection group priority 65001 (limit 65000)",
+		},
+		{
+			Name: "rule-collection-size",
+			limits: func() firewallPolicyLimits {
+				l := defaultFirewallPolicyLimits
+				l.RuleCollectionGroupSize = 100
+				return l
+			},
+			priority: 400,
+			Expected: "rule collection allow-a is",
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			_, err := shardRuleCollections(ruleCollections, testRuleCollGroup, tc.priority, tc.limits())
+			var limitsErr *limitsExceededError
+			if !errors.As(err, &limitsErr) || !strings.Contains(err.Error(), tc.Expected) {
+				t.Errorf("Expected an error containing %q, but got: %v", tc.Expected, err)
+			}
+		})
+	}
+}
+
+func TestProcessRequestShardsRuleCollectionGroup(t *testing.T) {
+	rules := newShardTestRules()
+	arm := azfake.NewARM()
+	az, k8sClient := newTestAzClientWithFakeARM(t, arm, rules.DeepCopy(), newTestNode("node-1", map[string]string{"app": "service"}, "10.240.0.4"))
+	ipGroupID := azfake.IPGroupID(testSubscriptionID, testResourceGroup, nodeIpGroupNameOf("app", "service"))
+	az.limits = shardTestLimits(*az.withManagedDescription(BuildFirewallConfig(azurefirewallrulesv1.AzureFirewallRulesList{Items: []azurefirewallrulesv1.AzureFirewallRules{rules}}, map[string][]string{"test1": {ipGroupID}})))
+	ctx := context.Background()
+
+	if err := az.processRequest(ctx, ctrl.Request{}, nil); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if names := liveRuleCollectionNames(t, arm); !reflect.DeepEqual(names, []string{"allow-a", "allow-b"}) {
+		t.Errorf("Expected rule collections %v, but got: %v", []string{"allow-a", "allow-b"}, names)
+	}
+	shardID := azfake.RuleCollectionGroupID(testSubscriptionID, testResourceGroup, testFwPolicy, testRuleCollGroup+"-2")
+	shard, ok := arm.RuleCollectionGroup(shardID)
+	if !ok {
+		t.Fatalf("Expected rule collection group %s to exist", testRuleCollGroup+"-2")
+	}
+	if *shard.Priority != 401 || len(*shard.RuleCollections) != 1 || GetRuleCollectionName((*shard.RuleCollections)[0]) != "allow-c" {
+		t.Errorf("Expected rule collection %s with priority %d, but got: %v", "allow-c", 401, shard.FirewallPolicyRuleCollectionGroupProperties)
+	}
+
+	// The config fits in a single rule collection group again.
+	current := &azurefirewallrulesv1.AzureFirewallRules{}
+	if err := k8sClient.Get(ctx, types.NamespacedName{Name: rules.Name}, current); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	current.Spec.EgressRules[0].Rules = current.Spec.EgressRules[0].Rules[:2]
+	if err := k8sClient.Update(ctx, current); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if err := az.processRequest(ctx, ctrl.Request{}, nil); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	arm.CompleteOperations()
+	if _, ok := arm.RuleCollectionGroup(shardID); ok {
+		t.Errorf("Expected rule collection group %s to be deleted", testRuleCollGroup+"-2")
+	}
+}
+
+func TestProcessRequestExceedingLimits(t *testing.T) {
+	rules := newShardTestRules()
+	arm := azfake.NewARM()
+	az, k8sClient := newTestAzClientWithFakeARM(t, arm, rules.DeepCopy(), newTestNode("node-1", map[string]string{"app": "service"}, "10.240.0.4"))
+	az.limits.Rules = 2
+
+	if err := az.processRequest(context.Background(), ctrl.Request{}, nil); err == nil {
+		t.Errorf("Expected an error, but got: nil")
+	}
+	if puts := countRuleCollectionGroupPuts(arm); puts != 0 {
+		t.Errorf("Expected %d rule collection group updates, but got: %d", 0, puts)
+	}
+
+	current := &azurefirewallrulesv1.AzureFirewallRules{}
+	if err := k8sClient.Get(context.Background(), types.NamespacedName{Name: rules.Name}, current); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	ready := meta.FindStatusCondition(current.Status.Conditions, azurefirewallrulesv1.ConditionTypeReady)
+	if ready == nil || ready.Status != metav1.ConditionFalse || ready.Reason != reasonLimitsExceeded || !strings.Contains(ready.Message, "3 rules (limit 2)") {
+		t.Errorf("Expected condition %s with reason %s, but got: %v", azurefirewallrulesv1.ConditionTypeReady, reasonLimitsExceeded, ready)
+	}
+}
+
+func TestProcessRequestDoesNotShardIntoTakenPriority(t *testing.T) {
+	rules := newShardTestRules()
+	arm := azfake.NewARM()
+	az, k8sClient := newTestAzClientWithFakeARM(t, arm, rules.DeepCopy(), newTestNode("node-1", map[string]string{"app": "service"}, "10.240.0.4"))
+	ipGroupID := azfake.IPGroupID(testSubscriptionID, testResourceGroup, nodeIpGroupNameOf("app", "service"))
+	az.limits = shardTestLimits(*az.withManagedDescription(BuildFirewallConfig(azurefirewallrulesv1.AzureFirewallRulesList{Items: []azurefirewallrulesv1.AzureFirewallRules{rules}}, map[string][]string{"test1": {ipGroupID}})))
+	ctx := context.Background()
+
+	// The priority of the first shard is taken by a rule collection group added in the portal.
+	if err := arm.SetRuleCollectionGroup(azfake.RuleCollectionGroupID(testSubscriptionID, testResourceGroup, testFwPolicy, "portal"), n.FirewallPolicyRuleCollectionGroup{
+		FirewallPolicyRuleCollectionGroupProperties: &n.FirewallPolicyRuleCollectionGroupProperties{
+			Priority:        to.Int32Ptr(401),
+			RuleCollections: &[]n.BasicFirewallPolicyRuleCollection{newPortalRuleCollection("customer")},
+		},
+	}); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	if err := az.processRequest(ctx, ctrl.Request{}, nil); err == nil {
+		t.Errorf("Expected an error, but got: nil")
+	}
+	if puts := countRuleCollectionGroupPuts(arm); puts != 0 {
+		t.Errorf("Expected %d rule collection group updates, but got: %d", 0, puts)
+	}
+	current := &azurefirewallrulesv1.AzureFirewallRules{}
+	if err := k8sClient.Get(ctx, types.NamespacedName{Name: rules.Name}, current); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	ready := meta.FindStatusCondition(current.Status.Conditions, azurefirewallrulesv1.ConditionTypeReady)
+	if ready == nil || ready.Reason != reasonLimitsExceeded || !strings.Contains(ready.Message, "priority 401 of rule collection group "+testRuleCollGroup+"-2 is taken by rule collection group portal") {
+		t.Errorf("Expected condition %s with reason %s, but got: %v", azurefirewallrulesv1.ConditionTypeReady, reasonLimitsExceeded, ready)
+	}
+}
+
+func TestProcessRequestReleasesOnlyOwnedShards(t *testing.T) {
+	rules := newShardTestRules()
+	rules.Spec.EgressRules[0].Rules = rules.Spec.EgressRules[0].Rules[:2]
+	arm := azfake.NewARM()
+	az, _ := newTestAzClientWithFakeARM(t, arm, rules.DeepCopy(), newTestNode("node-1", map[string]string{"app": "service"}, "10.240.0.4"))
+
+	// A rule collection group named like a shard holds a rule collection of the customer and one the controller
+	// generated before a restart.
+	owned := newPortalRuleCollection("allow-d")
+	az.withManagedDescription(&[]n.BasicFirewallPolicyRuleCollection{owned})
+	shardID := azfake.RuleCollectionGroupID(testSubscriptionID, testResourceGroup, testFwPolicy, testRuleCollGroup+"-2")
+	if err := arm.SetRuleCollectionGroup(shardID, n.FirewallPolicyRuleCollectionGroup{
+		FirewallPolicyRuleCollectionGroupProperties: &n.FirewallPolicyRuleCollectionGroupProperties{
+			Priority:        to.Int32Ptr(401),
+			RuleCollections: &[]n.BasicFirewallPolicyRuleCollection{newPortalRuleCollection("customer"), owned},
+		},
+	}); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	if err := az.processRequest(context.Background(), ctrl.Request{}, nil); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	arm.CompleteOperations()
+	shard, ok := arm.RuleCollectionGroup(shardID)
+	if !ok {
+		t.Fatalf("Expected rule collection group %s to exist", testRuleCollGroup+"-2")
+	}
+	if len(*shard.RuleCollections) != 1 || GetRuleCollectionName((*shard.RuleCollections)[0]) != "customer" {
+		t.Errorf("Expected rule collections %v, but got: %v", []string{"customer"}, shard.FirewallPolicyRuleCollectionGroupProperties)
+	}
+}
+
+func TestProcessRequestDoesNotShardIntoAnotherTarget(t *testing.T) {
+	rules := newShardTestRules()
+	arm := azfake.NewARM()
+	node := newTestNode("node-1", map[string]string{"app": "service"}, "10.240.0.4")
+
+	// Another target of the same cluster is named like the first shard of the client.
+	otherRules := newShardTestRules()
+	otherRules.Spec.EgressRules[0].Rules = otherRules.Spec.EgressRules[0].Rules[:1]
+	other, _ := newTestAzClientWithFakeARM(t, arm, otherRules.DeepCopy(), node.DeepCopy())
+	other.fwPolicyRuleCollectionGroupName = testRuleCollGroup + "-2"
+	if err := other.processRequest(context.Background(), ctrl.Request{}, nil); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	arm.CompleteOperations()
+	otherID := azfake.RuleCollectionGroupID(testSubscriptionID, testResourceGroup, testFwPolicy, testRuleCollGroup+"-2")
+	expected, _ := arm.RuleCollectionGroup(otherID)
+
+	az, k8sClient := newTestAzClientWithFakeARM(t, arm, rules.DeepCopy(), node.DeepCopy())
+	ipGroupID := azfake.IPGroupID(testSubscriptionID, testResourceGroup, nodeIpGroupNameOf("app", "service"))
+	az.limits = shardTestLimits(*az.withManagedDescription(BuildFirewallConfig(azurefirewallrulesv1.AzureFirewallRulesList{Items: []azurefirewallrulesv1.AzureFirewallRules{rules}}, map[string][]string{"test1": {ipGroupID}})))
+	ctx := context.Background()
+	if err := az.processRequest(ctx, ctrl.Request{}, nil); err == nil || !strings.Contains(err.Error(), "rule collection group "+testRuleCollGroup+"-2") {
+		t.Errorf("Expected an error about rule collection group %s, but got: %v", testRuleCollGroup+"-2", err)
+	}
+	arm.CompleteOperations()
+	if live, _ := arm.RuleCollectionGroup(otherID); !canonicalRuleCollectionGroupOf(&live).equal(canonicalRuleCollectionGroupOf(&expected)) {
+		t.Errorf("Expected rule collection group %s to be unchanged, but got: %v", testRuleCollGroup+"-2", live.FirewallPolicyRuleCollectionGroupProperties)
+	}
+
+	// The rule collection group of the other target is not released when the config fits in one again.
+	current := &azurefirewallrulesv1.AzureFirewallRules{}
+	if err := k8sClient.Get(ctx, types.NamespacedName{Name: rules.Name}, current); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	current.Spec.EgressRules[0].Rules = current.Spec.EgressRules[0].Rules[:2]
+	if err := k8sClient.Update(ctx, current); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if err := az.processRequest(ctx, ctrl.Request{}, nil); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	arm.CompleteOperations()
+	if live, ok := arm.RuleCollectionGroup(otherID); !ok || !canonicalRuleCollectionGroupOf(&live).equal(canonicalRuleCollectionGroupOf(&expected)) {
+		t.Errorf("Expected rule collection group %s to be unchanged, but got: %v", testRuleCollGroup+"-2", live.FirewallPolicyRuleCollectionGroupProperties)
+	}
+}
@@ -0,0 +1,112 @@
+// -------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package azure
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const metricsNamespace = "azure_firewall_egress_controller"
+
+// ARM operations reported by the arm_requests_total and arm_request_errors_total metrics.
+const (
+	opIPGroupList                       = "IPGroupList"
+	opIPGroupGet                        = "IPGroupGet"
+	opIPGroupCreateOrUpdate             = "IPGroupCreateOrUpdate"
+	opIPGroupDelete                     = "IPGroupDelete"
+	opFirewallPolicyGet                 = "FirewallPolicyGet"
+	opRuleCollectionGroupGet            = "RuleCollectionGroupGet"
+	opRuleCollectionGroupList           = "RuleCollectionGroupList"
+	opRuleCollectionGroupCreateOrUpdate = "RuleCollectionGroupCreateOrUpdate"
+	opRuleCollectionGroupDelete         = "RuleCollectionGroupDelete"
+)
+
+var (
+	processRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "process_request_duration_seconds",
+		Help:      "Duration of the event loop runs that generate and apply a rule collection group.",
+		Buckets:   []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600},
+	}, []string{"rule_collection_group"})
+
+	armRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "arm_requests_total",
+		Help:      "Number of Azure Resource Manager calls by operation.",
+	}, []string{"operation"})
+
+	armRequestErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "arm_request_errors_total",
+		Help:      "Number of failed Azure Resource Manager calls by operation.",
+	}, []string{"operation"})
+
+	configCacheHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "config_cache_hits_total",
+		Help:      "Number of generated rule collection groups that were not applied because they matched the last applied one.",
+	}, []string{"rule_collection_group"})
+
+	ruleCollectionGroupShards = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "rule_collection_group_shards",
+		Help:      "Number of rule collection groups the generated config is split into to fit in the size limit.",
+	}, []string{"rule_collection_group"})
+
+	jobsDrained = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "jobs_drained_total",
+		Help:      "Number of queued events coalesced into another event loop run.",
+	})
+
+	taintedNodes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "tainted_nodes",
+		Help:      "Number of nodes tainted until their IP is added to the IP Groups.",
+	})
+
+	ruleCollectionGroupDrifted = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "rule_collection_group_drifted",
+		Help:      "Whether the live rule collection group was found to differ from the generated one (1) or not (0).",
+	}, []string{"rule_collection_group"})
+
+	ipGroupDrifted = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "ip_group_drifted",
+		Help:      "Whether the IP Group was changed outside of the controller and the change was not corrected (1) or not (0).",
+	}, []string{"resource_group", "ip_group"})
+
+	ipGroupAddressCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "ip_group_addresses",
+		Help:      "Number of addresses in the IP Groups managed by the controller.",
+	}, []string{"resource_group", "ip_group"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(
+		processRequestDuration,
+		armRequests,
+		armRequestErrors,
+		configCacheHits,
+		ruleCollectionGroupShards,
+		jobsDrained,
+		taintedNodes,
+		ruleCollectionGroupDrifted,
+		ipGroupDrifted,
+		ipGroupAddressCount,
+	)
+}
+
+// observeARMRequest records the outcome of an Azure Resource Manager call.
+func observeARMRequest(operation string, err error) {
+	armRequests.WithLabelValues(operation).Inc()
+	if err != nil {
+		armRequestErrors.WithLabelValues(operation).Inc()
+	}
+}
@@ -0,0 +1,55 @@
+package azure
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	azfake "github.com/Azure/azure-firewall-egress-controller/pkg/azure/fake"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+func TestObserveARMRequest(t *testing.T) {
+	requests := testutil.ToFloat64(armRequests.WithLabelValues("TestOperation"))
+	errs := testutil.ToFloat64(armRequestErrors.WithLabelValues("TestOperation"))
+
+	observeARMRequest("TestOperation", nil)
+	observeARMRequest("TestOperation", errors.New("throttled"))
+
+	if output := testutil.ToFloat64(armRequests.WithLabelValues("TestOperation")) - requests; output != 2 {
+		t.Errorf("Expected %d requests, but got: %v", 2, output)
+	}
+	if output := testutil.ToFloat64(armRequestErrors.WithLabelValues("TestOperation")) - errs; output != 1 {
+		t.Errorf("Expected %d errors, but got: %v", 1, output)
+	}
+}
+
+func TestProcessRequestMetrics(t *testing.T) {
+	rules := newTestFirewallRules()
+	arm := azfake.NewARM()
+	az, _ := newTestAzClientWithFakeARM(t, arm, &rules,
+		newTestNode("node-1", map[string]string{"app": "service"}, "10.240.0.4"),
+		newTestNode("node-2", map[string]string{"app": "service"}, "10.240.0.5"),
+	)
+	ctx := context.Background()
+
+	rcgUpdates := testutil.ToFloat64(armRequests.WithLabelValues(opRuleCollectionGroupCreateOrUpdate))
+	cacheHits := testutil.ToFloat64(configCacheHits.WithLabelValues(testRuleCollGroup))
+
+	for i := 0; i < 2; i++ {
+		if err := az.processRequest(ctx, ctrl.Request{}, nil); err != nil {
+			t.Fatalf("Expected no error, but got: %v", err)
+		}
+	}
+
+	if output := testutil.ToFloat64(armRequests.WithLabelValues(opRuleCollectionGroupCreateOrUpdate)) - rcgUpdates; output != 1 {
+		t.Errorf("Expected %d rule collection group updates, but got: %v", 1, output)
+	}
+	if output := testutil.ToFloat64(configCacheHits.WithLabelValues(testRuleCollGroup)) - cacheHits; output != 1 {
+		t.Errorf("Expected %d config cache hits, but got: %v", 1, output)
+	}
+	if output := testutil.ToFloat64(ipGroupAddressCount.WithLabelValues(testResourceGroup, nodeIpGroupNameOf("app", "service"))); output != 2 {
+		t.Errorf("Expected %d addresses, but got: %v", 2, output)
+	}
+}
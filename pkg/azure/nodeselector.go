@@ -0,0 +1,82 @@
+// -------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package azure
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+
+	azurefirewallrulesv1 "github.com/Azure/azure-firewall-egress-controller/pkg/api/v1"
+)
+
+// nodeIpGroup is an IP Group holding the IPs of the nodes matching a selector.
+type nodeIpGroup struct {
+	name     string
+	selector labels.Selector
+}
+
+// description returns the value of the selector tag of the IP Group.
+func (g nodeIpGroup) description() string {
+	return canonicalSelector(g.selector)
+}
+
+// nodeIpGroupsOf returns the IP Groups that are the sources of the rules of the egress rule. The legacy nodeSelector
+// has an IP Group per label, while a nodeLabelSelector has a single IP Group. Egress rules with equivalent selectors
+// share the IP Group.
+func nodeIpGroupsOf(clusterName string, egressrule azurefirewallrulesv1.AzureFirewallEgressRulesSpec) ([]nodeIpGroup, error) {
+	if egressrule.NodeLabelSelector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(egressrule.NodeLabelSelector)
+		if err != nil {
+			return nil, err
+		}
+		return []nodeIpGroup{{name: NodeIpGroupName(clusterName, selector), selector: selector}}, nil
+	}
+
+	var ipGroups []nodeIpGroup
+	for _, m := range egressrule.NodeSelector {
+		for k, v := range m {
+			selector := labels.SelectorFromSet(labels.Set{k: v})
+			ipGroups = append(ipGroups, nodeIpGroup{name: NodeIpGroupName(clusterName, selector), selector: selector})
+		}
+	}
+	return ipGroups, nil
+}
+
+// canonicalSelector returns the selector with its requirements sorted by key, their values sorted and the
+// equality operators replaced by the equivalent set operators, e.g. "pool in (egress),zone in (1,2)".
+func canonicalSelector(selector labels.Selector) string {
+	requirements, _ := selector.Requirements()
+	var canonical []string
+	for _, requirement := range requirements {
+		operator := requirement.Operator()
+		switch operator {
+		case selection.Equals, selection.DoubleEquals:
+			operator = selection.In
+		case selection.NotEquals:
+			operator = selection.NotIn
+		}
+		canonical = append(canonical, fmt.Sprintf("%s %s (%s)", requirement.Key(), operator, strings.Join(requirement.Values().List(), ",")))
+	}
+	sort.Strings(canonical)
+	return strings.Join(canonical, ",")
+}
+
+// nodesBySelector returns the nodes that are members of the IP Group of the given selector.
+func nodesBySelector(selector labels.Selector, nodeList corev1.NodeList) []*corev1.Node {
+	var nodes []*corev1.Node
+	for i := range nodeList.Items {
+		if selector.Matches(labels.Set(nodeList.Items[i].ObjectMeta.Labels)) {
+			nodes = append(nodes, &nodeList.Items[i])
+		}
+	}
+	return nodes
+}
@@ -0,0 +1,94 @@
+package azure
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	azurefirewallrulesv1 "github.com/Azure/azure-firewall-egress-controller/pkg/api/v1"
+	azfake "github.com/Azure/azure-firewall-egress-controller/pkg/azure/fake"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+func TestNodeIpGroupsOf(t *testing.T) {
+	poolAndZone := &metav1.LabelSelector{
+		MatchLabels: map[string]string{"pool": "egress"},
+		MatchExpressions: []metav1.LabelSelectorRequirement{
+			{Key: "zone", Operator: metav1.LabelSelectorOpIn, Values: []string{"1", "2"}},
+		},
+	}
+	sameSelector := &metav1.LabelSelector{
+		MatchExpressions: []metav1.LabelSelectorRequirement{
+			{Key: "zone", Operator: metav1.LabelSelectorOpIn, Values: []string{"2", "1"}},
+			{Key: "pool", Operator: metav1.LabelSelectorOpIn, Values: []string{"egress"}},
+		},
+	}
+
+	legacy, err := nodeIpGroupsOf("", azurefirewallrulesv1.AzureFirewallEgressRulesSpec{
+		NodeSelector: []map[string]string{{"app": "service"}, {"app": "db"}},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	var names []string
+	for _, ipGroup := range legacy {
+		names = append(names, ipGroup.name)
+	}
+	if expected := []string{"IPGroup-node-app-service-1d80579166", "IPGroup-node-app-db-62779c13e6"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected IP Groups %v, but got: %v", expected, names)
+	}
+
+	selected, err := nodeIpGroupsOf("", azurefirewallrulesv1.AzureFirewallEgressRulesSpec{NodeLabelSelector: poolAndZone})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	same, err := nodeIpGroupsOf("", azurefirewallrulesv1.AzureFirewallEgressRulesSpec{NodeLabelSelector: sameSelector})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if len(selected) != 1 || len(same) != 1 || selected[0].name != same[0].name {
+		t.Errorf("Expected equivalent selectors to share the IP Group, but got: %v and %v", selected, same)
+	}
+
+	_, err = nodeIpGroupsOf("", azurefirewallrulesv1.AzureFirewallEgressRulesSpec{NodeLabelSelector: &metav1.LabelSelector{
+		MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "zone", Operator: "Between"}},
+	}})
+	if err == nil {
+		t.Errorf("Expected an error for an invalid operator, but got none")
+	}
+}
+
+func TestProcessRequestWithNodeLabelSelector(t *testing.T) {
+	rules := newDriftTestRules()
+	rules.Spec.EgressRules[0].NodeSelector = nil
+	rules.Spec.EgressRules[0].NodeLabelSelector = &metav1.LabelSelector{
+		MatchLabels: map[string]string{"pool": "egress"},
+		MatchExpressions: []metav1.LabelSelectorRequirement{
+			{Key: "zone", Operator: metav1.LabelSelectorOpIn, Values: []string{"1", "2"}},
+		},
+	}
+
+	arm := azfake.NewARM()
+	az, _ := newTestAzClientWithFakeARM(t, arm,
+		rules.DeepCopy(),
+		newTestNode("node-1", map[string]string{"pool": "egress", "zone": "1"}, "10.240.0.4"),
+		newTestNode("node-2", map[string]string{"pool": "egress", "zone": "2"}, "10.240.0.5"),
+		newTestNode("node-3", map[string]string{"pool": "egress", "zone": "3"}, "10.240.0.6"),
+		newTestNode("node-4", map[string]string{"pool": "system", "zone": "1"}, "10.240.0.7"),
+	)
+	if err := az.processRequest(context.Background(), ctrl.Request{}, nil); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	ipGroups, _ := nodeIpGroupsOf("", rules.Spec.EgressRules[0])
+	addresses := ipGroupAddresses(t, arm, ipGroups[0].name)
+	sort.Strings(addresses)
+	if !reflect.DeepEqual(addresses, []string{"10.240.0.4", "10.240.0.5"}) {
+		t.Errorf("Expected addresses %v, but got: %v", []string{"10.240.0.4", "10.240.0.5"}, addresses)
+	}
+	if ipGroups := arm.IPGroups(testSubscriptionID, testResourceGroup); len(ipGroups) != 1 {
+		t.Errorf("Expected %d IP Group, but got: %d", 1, len(ipGroups))
+	}
+}
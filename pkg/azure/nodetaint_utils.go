@@ -24,6 +24,10 @@ var taint = corev1.Taint{
 }
 
 func (az *azClient) AddTaints(ctx context.Context, req ctrl.Request) {
+	if az.dryRun {
+		// The firewall policy is never updated in dry-run mode, so there is nothing to wait for.
+		return
+	}
 	node := &corev1.Node{}
 	if err := az.client.Get(ctx, req.NamespacedName, node); err != nil {
 		klog.Error(err, "unable to fetch Node")
@@ -33,7 +37,9 @@ func (az *azClient) AddTaints(ctx context.Context, req ctrl.Request) {
 		node.Spec.Taints = append(node.Spec.Taints, taint)
 		err := az.client.Patch(ctx, node, patch)
 		if err == nil {
+			taintedNodes.Inc()
 			klog.Info("Taints added on node: ", node.Name)
+			az.recordEvent(node, corev1.EventTypeNormal, EventReasonTaintAdded, "Added taint %s until the node IP is added to the IP Groups of the firewall policy", taint.ToString())
 		} else {
 			klog.Info("Error adding the taints", err)
 		}
@@ -53,31 +59,123 @@ func (az *azClient) RemoveTaints(ctx context.Context, node *corev1.Node) {
 		node.Spec.Taints = updatedTaints
 		err := az.client.Patch(ctx, node, patch)
 		if err == nil {
+			taintedNodes.Dec()
 			klog.Info("Taints removed on node: ", node.Name)
+			az.recordEvent(node, corev1.EventTypeNormal, EventReasonTaintRemoved, "Removed taint %s, the node IP is part of the firewall policy", taint.ToString())
 		} else {
 			klog.Info("Error removing the taints", err)
 		}
 	}
 }
 
-func (az *azClient) WaitForNodeIpGroupUpdate(ctx context.Context, nodesWithFwTaint []*corev1.Node, pollers map[string]*runtime.Poller[a.IPGroupsClientCreateOrUpdateResponse]) {
+// taintRemovalBarrier holds the taint of a node until every client of a set has applied the IP Groups of its event
+// loop run, as each client waits for its own IP Group updates only.
+type taintRemovalBarrier struct {
+	mu sync.Mutex
+	// targets returns the rule collection groups of the client set.
+	targets func() []string
+	// pending holds the rule collection groups not done yet with every tainted node.
+	pending map[string]map[string]bool
+}
+
+func newTaintRemovalBarrier(targets func() []string) *taintRemovalBarrier {
+	return &taintRemovalBarrier{targets: targets, pending: make(map[string]map[string]bool)}
+}
+
+// done records that the client of the rule collection group is done with the node, and returns true once every
+// rule collection group managed when the first of them was done, and still managed, is done with it.
+func (b *taintRemovalBarrier) done(node string, target string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	current := make(map[string]bool)
+	for _, key := range b.targets() {
+		current[key] = true
+	}
+	pending, ok := b.pending[node]
+	if !ok {
+		pending = make(map[string]bool, len(current))
+		for key := range current {
+			pending[key] = true
+		}
+		b.pending[node] = pending
+	}
+	delete(pending, target)
+	for key := range pending {
+		if !current[key] {
+			delete(pending, key)
+		}
+	}
+	if len(pending) != 0 {
+		return false
+	}
+	delete(b.pending, node)
+	return true
+}
+
+// ipGroupUpdate is a pending IP Group update. The poller of the update is not safe for concurrent use, while the
+// runs of every client of the set wait for it.
+type ipGroupUpdate struct {
+	mu     sync.Mutex
+	poller *runtime.Poller[a.IPGroupsClientCreateOrUpdateResponse]
+}
+
+// wait polls the update until it completes.
+func (u *ipGroupUpdate) wait(ctx context.Context) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	_, err := u.poller.PollUntilDone(ctx, nil)
+	return err
+}
+
+// pendingIpGroupUpdates returns a copy of the pending IP Group updates, which the next event loop run may modify. It must be
+// called with the lock of the IP Groups held.
+func (az *azClient) pendingIpGroupUpdates() map[string]*ipGroupUpdate {
+	updates := make(map[string]*ipGroupUpdate, len(az.pollers))
+	for name, update := range az.pollers {
+		updates[name] = update
+	}
+	return updates
+}
+
+// WaitForNodeIpGroupUpdate waits for the IP Group updates to complete, records an event on the nodes of every IP Group
+// updated by the last event loop run and removes the taints of the given nodes once no other client of the set is
+// still updating them.
+func (az *azClient) WaitForNodeIpGroupUpdate(ctx context.Context, nodesWithFwTaint []*corev1.Node, updates map[string]*ipGroupUpdate, ipGroupNodes map[string][]*corev1.Node) {
 	var wg sync.WaitGroup
-	for _, poller := range pollers {
+	for name, update := range updates {
 		wg.Add(1)
-		go func(poller *runtime.Poller[a.IPGroupsClientCreateOrUpdateResponse]) {
-			_, err := poller.PollUntilDone(ctx, nil)
+		go func(name string, update *ipGroupUpdate) {
+			defer wg.Done()
+			err := update.wait(ctx)
 			if err != nil {
 				klog.Error("failed to pull the result: %v", err)
+				return
 			}
-			defer wg.Done()
-		}(poller)
+			for _, node := range ipGroupNodes[name] {
+				az.recordEvent(node, corev1.EventTypeNormal, EventReasonIpGroupUpdated, "IP Group %s containing the node IP was updated", name)
+			}
+		}(name, update)
 	}
 	wg.Wait()
 	for _, node := range nodesWithFwTaint {
+		if az.taintBarrier != nil && !az.taintBarrier.done(node.Name, az.targetKey()) {
+			klog.Info("Keeping the taints of node ", node.Name, " until every rule collection group is updated")
+			continue
+		}
 		az.RemoveTaints(ctx, node)
 	}
 }
 
+func countTaintedNodes(nodeList corev1.NodeList) int {
+	count := 0
+	for i := range nodeList.Items {
+		if CheckIfTaintExists(&nodeList.Items[i]) {
+			count++
+		}
+	}
+	return count
+}
+
 func CheckIfTaintExists(node *corev1.Node) bool {
 	for _, t := range node.Spec.Taints {
 		if t.Key == taint.Key && t.Effect == taint.Effect {
@@ -179,4 +179,24 @@ func TestAddTaints(t *testing.T) {
 	if CheckIfTaintExists(updatedNode) != true {
 		t.Errorf("Expected %t, but got: %t", true, false);
 	}
-}
\ No newline at end of file
+}
+func TestTaintRemovalBarrier(t *testing.T) {
+	targets := []string{"first", "second"}
+	barrier := newTaintRemovalBarrier(func() []string { return targets })
+
+	if barrier.done("node1", "first") {
+		t.Errorf("Expected the taint to be kept until every target is done")
+	}
+	if !barrier.done("node1", "second") {
+		t.Errorf("Expected the taint to be removed once every target is done")
+	}
+
+	// A target removed meanwhile is not waited for.
+	if barrier.done("node2", "second") {
+		t.Errorf("Expected the taint to be kept until every target is done")
+	}
+	targets = []string{"second"}
+	if !barrier.done("node2", "second") {
+		t.Errorf("Expected the taint to be removed once every remaining target is done")
+	}
+}
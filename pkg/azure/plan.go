@@ -0,0 +1,100 @@
+// -------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package azure
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	n "github.com/Azure/azure-sdk-for-go/services/network/mgmt/2021-03-01/network"
+	"k8s.io/klog/v2"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// Plan renders the rule collection group generated from the AzureFirewallRules and Nodes in the cluster and
+// prints it together with a diff against the live rule collection group, without modifying any Azure resource.
+func (az *azClient) Plan(ctx context.Context) error {
+	az.SetDryRun(true)
+	return az.processRequest(ctx, ctrl.Request{}, nil)
+}
+
+// printPlan prints the generated rule collection group as sent to ARM, and the changes to the live one computed on
+// the canonical model.
+func (az *azClient) printPlan(name string, fwRuleCollectionGrp *n.FirewallPolicyRuleCollectionGroup) error {
+	desiredJSON, err := normalizedConfigJSON(fwRuleCollectionGrp)
+	if err != nil {
+		return err
+	}
+
+	live, err := az.fwPolicyRuleCollectionGroupClient.Get(az.ctx, az.resourceGroupName, az.fwPolicyName, name)
+	observeARMRequest(opRuleCollectionGroupGet, err)
+	liveRuleCollectionGrp := &n.FirewallPolicyRuleCollectionGroup{}
+	if err != nil {
+		if live.Response.Response == nil || live.StatusCode != http.StatusNotFound {
+			return err
+		}
+		klog.Infof("Rule collection group %s does not exist yet", name)
+	} else {
+		liveRuleCollectionGrp.FirewallPolicyRuleCollectionGroupProperties = live.FirewallPolicyRuleCollectionGroupProperties
+	}
+
+	fmt.Fprintf(az.planOutput, "Generated config for rule collection group %s:\n%s\n\n", name, desiredJSON)
+	changes := diffRuleCollectionGroups(canonicalRuleCollectionGroupOf(liveRuleCollectionGrp), canonicalRuleCollectionGroupOf(fwRuleCollectionGrp))
+	if len(changes) == 0 {
+		fmt.Fprintln(az.planOutput, "No changes. The live rule collection group matches the generated config.")
+		return nil
+	}
+	fmt.Fprintf(az.planOutput, "Changes to the live rule collection group:\n%s\n", strings.Join(changes, "\n"))
+	return nil
+}
+
+// normalizedConfigJSON marshals the rule collection group into indented JSON without read-only fields,
+// nulls and empty lists.
+func normalizedConfigJSON(fwRuleCollectionGrp *n.FirewallPolicyRuleCollectionGroup) (string, error) {
+	jsonConfig, err := fwRuleCollectionGrp.MarshalJSON()
+	if err != nil {
+		return "", err
+	}
+
+	var config interface{}
+	if err := json.Unmarshal(jsonConfig, &config); err != nil {
+		return "", err
+	}
+
+	prettyJSON, err := json.MarshalIndent(pruneEmpty(config), "", "    ")
+	return string(prettyJSON), err
+}
+
+func pruneEmpty(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		pruned := map[string]interface{}{}
+		for key, val := range v {
+			if val = pruneEmpty(val); val != nil {
+				pruned[key] = val
+			}
+		}
+		if len(pruned) == 0 {
+			return nil
+		}
+		return pruned
+	case []interface{}:
+		var pruned []interface{}
+		for _, val := range v {
+			if val = pruneEmpty(val); val != nil {
+				pruned = append(pruned, val)
+			}
+		}
+		if len(pruned) == 0 {
+			return nil
+		}
+		return pruned
+	}
+	return value
+}
@@ -0,0 +1,124 @@
+package azure
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	azfake "github.com/Azure/azure-firewall-egress-controller/pkg/azure/fake"
+	n "github.com/Azure/azure-sdk-for-go/services/network/mgmt/2021-03-01/network"
+	"github.com/Azure/go-autorest/autorest/to"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+func TestNormalizedConfigJSON(t *testing.T) {
+	generated := &n.FirewallPolicyRuleCollectionGroup{
+		FirewallPolicyRuleCollectionGroupProperties: &(n.FirewallPolicyRuleCollectionGroupProperties{
+			Priority: to.Int32Ptr(300),
+			RuleCollections: &[]n.BasicFirewallPolicyRuleCollection{
+				&n.FirewallPolicyFilterRuleCollection{
+					Name:               to.StringPtr("aks-fw-ng-network"),
+					Priority:           to.Int32Ptr(110),
+					RuleCollectionType: n.RuleCollectionTypeFirewallPolicyFilterRuleCollection,
+					Rules: &[]n.BasicFirewallPolicyRule{
+						&n.Rule{
+							Name:                 to.StringPtr("rule1"),
+							RuleType:             n.RuleTypeNetworkRule,
+							DestinationAddresses: &[]string{"*"},
+							DestinationFqdns:     &[]string{},
+						},
+					},
+				},
+			},
+		}),
+	}
+	live := &n.FirewallPolicyRuleCollectionGroup{
+		Name: to.StringPtr("live"),
+		Etag: to.StringPtr("etag"),
+		FirewallPolicyRuleCollectionGroupProperties: &(n.FirewallPolicyRuleCollectionGroupProperties{
+			Priority: to.Int32Ptr(300),
+			RuleCollections: &[]n.BasicFirewallPolicyRuleCollection{
+				&n.FirewallPolicyFilterRuleCollection{
+					Name:               to.StringPtr("aks-fw-ng-network"),
+					Priority:           to.Int32Ptr(110),
+					RuleCollectionType: n.RuleCollectionTypeFirewallPolicyFilterRuleCollection,
+					Rules: &[]n.BasicFirewallPolicyRule{
+						&n.Rule{
+							Name:                 to.StringPtr("rule1"),
+							RuleType:             n.RuleTypeNetworkRule,
+							DestinationAddresses: &[]string{"*"},
+							SourceAddresses:      &[]string{},
+						},
+					},
+				},
+			},
+		}),
+	}
+	live.FirewallPolicyRuleCollectionGroupProperties.ProvisioningState = n.ProvisioningStateSucceeded
+
+	generatedJSON, err := normalizedConfigJSON(generated)
+	if err != nil {
+		t.Errorf("Expected no error, but got: %v", err)
+	}
+	liveJSON, err := normalizedConfigJSON(&n.FirewallPolicyRuleCollectionGroup{FirewallPolicyRuleCollectionGroupProperties: live.FirewallPolicyRuleCollectionGroupProperties})
+	if err != nil {
+		t.Errorf("Expected no error, but got: %v", err)
+	}
+
+	if generatedJSON != liveJSON {
+		t.Errorf("Expected the configs to be equal:\n%s\nvs live:\n%s", generatedJSON, liveJSON)
+	}
+}
+
+func TestPrintPlan(t *testing.T) {
+	service := newDriftTestRules()
+	arm := azfake.NewARM()
+	az, k8sClient := newTestAzClientWithFakeARM(t, arm, &service, newTestNode("node-1", map[string]string{"app": "service"}, "10.240.0.4"))
+	ctx := context.Background()
+
+	az.SetDryRun(true)
+	output := &bytes.Buffer{}
+	az.planOutput = output
+	if err := az.processRequest(ctx, ctrl.Request{}, nil); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	for _, expected := range []string{
+		"Generated config for rule collection group " + testRuleCollGroup + ":",
+		`"ruleCollectionType": "FirewallPolicyFilterRuleCollection"`,
+		`"ruleType": "ApplicationRule"`,
+		`"protocolType": "Https"`,
+		"+ rule collection allow-service",
+		"+ rule allow-service/github",
+	} {
+		if !strings.Contains(output.String(), expected) {
+			t.Errorf("Expected the plan to contain %q, but got:\n%s", expected, output.String())
+		}
+	}
+
+	az.SetDryRun(false)
+	if err := az.processRequest(ctx, ctrl.Request{}, nil); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	arm.CompleteOperations()
+	if err := k8sClient.Get(ctx, types.NamespacedName{Name: service.Name}, &service); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	service.Spec.EgressRules[0].Rules[0].TargetFqdns = []string{"*.github.com"}
+	if err := k8sClient.Update(ctx, &service); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	az.SetDryRun(true)
+	output.Reset()
+	if err := az.processRequest(ctx, ctrl.Request{}, nil); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if expected := "~ rule allow-service/github: targetFqdns [github.com] -> [*.github.com]"; !strings.Contains(output.String(), expected) {
+		t.Errorf("Expected the plan to contain %q, but got:\n%s", expected, output.String())
+	}
+	if strings.Contains(output.String(), "+ rule collection allow-service") {
+		t.Errorf("Expected no added rule collection, but got:\n%s", output.String())
+	}
+}
@@ -0,0 +1,123 @@
+// -------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package azure
+
+import (
+	"context"
+	"errors"
+
+	azurefirewallrulesv1 "github.com/Azure/azure-firewall-egress-controller/pkg/api/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	reasonApplied          = "Applied"
+	reasonApplyFailed      = "ApplyFailed"
+	reasonLimitsExceeded   = "LimitsExceeded"
+	reasonEgressRuleErrors = "EgressRuleErrors"
+	reasonAsExpected       = "AsExpected"
+)
+
+// updateStatus writes the outcome of the last policy build back to every AzureFirewallRules object.
+func (az *azClient) updateStatus(ctx context.Context, erulesList azurefirewallrulesv1.AzureFirewallRulesList, erulesSourceAddresses map[string][]string, erulesErrors map[string]string, buildErr error) {
+	for i := range erulesList.Items {
+		item := &erulesList.Items[i]
+		patch := client.MergeFrom(item.DeepCopy())
+		item.Status = buildStatus(*item, erulesSourceAddresses, erulesErrors, az.ruleCollectionGroupETag, buildErr)
+		az.applyDriftCondition(&item.Status.Conditions, item.Generation)
+		if err := az.client.Status().Patch(ctx, item, patch); err != nil {
+			klog.Error("Error updating the status of ", item.Name, ": ", err)
+		}
+	}
+}
+
+func buildStatus(item azurefirewallrulesv1.AzureFirewallRules, erulesSourceAddresses map[string][]string, erulesErrors map[string]string, etag string, buildErr error) azurefirewallrulesv1.AzureFirewallRulesStatus {
+	status := *item.Status.DeepCopy()
+	status.ObservedGeneration = item.Generation
+	status.EgressRules = nil
+
+	degraded := false
+	for _, egressrule := range item.Spec.EgressRules {
+		erStatus := azurefirewallrulesv1.AzureFirewallEgressRuleStatus{
+			Name:       egressrule.Name,
+			IPGroupIDs: erulesSourceAddresses[egressrule.Name],
+		}
+		if msg, ok := erulesErrors[egressrule.Name]; ok {
+			erStatus.Error = msg
+			degraded = true
+		} else if buildErr != nil {
+			erStatus.Error = buildErr.Error()
+		}
+		status.EgressRules = append(status.EgressRules, erStatus)
+	}
+
+	// The generated config that doesn't fit in the firewall policy limits is not applied at all.
+	failedReason := reasonApplyFailed
+	var limitsErr *limitsExceededError
+	if errors.As(buildErr, &limitsErr) {
+		failedReason = reasonLimitsExceeded
+	}
+
+	if buildErr != nil {
+		meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+			Type:               azurefirewallrulesv1.ConditionTypeSynced,
+			Status:             metav1.ConditionFalse,
+			Reason:             failedReason,
+			Message:            buildErr.Error(),
+			ObservedGeneration: item.Generation,
+		})
+	} else {
+		status.RuleCollectionGroupETag = etag
+		meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+			Type:               azurefirewallrulesv1.ConditionTypeSynced,
+			Status:             metav1.ConditionTrue,
+			Reason:             reasonApplied,
+			Message:            "Rule collection group applied to the firewall policy",
+			ObservedGeneration: item.Generation,
+		})
+	}
+
+	if degraded {
+		meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+			Type:               azurefirewallrulesv1.ConditionTypeDegraded,
+			Status:             metav1.ConditionTrue,
+			Reason:             reasonEgressRuleErrors,
+			Message:            "One or more egress rules could not be processed",
+			ObservedGeneration: item.Generation,
+		})
+	} else {
+		meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+			Type:               azurefirewallrulesv1.ConditionTypeDegraded,
+			Status:             metav1.ConditionFalse,
+			Reason:             reasonAsExpected,
+			Message:            "All egress rules processed",
+			ObservedGeneration: item.Generation,
+		})
+	}
+
+	ready := metav1.Condition{
+		Type:               azurefirewallrulesv1.ConditionTypeReady,
+		Status:             metav1.ConditionTrue,
+		Reason:             reasonApplied,
+		Message:            "Egress rules are enforced by the firewall policy",
+		ObservedGeneration: item.Generation,
+	}
+	if buildErr != nil {
+		ready.Status = metav1.ConditionFalse
+		ready.Reason = failedReason
+		ready.Message = buildErr.Error()
+	} else if degraded {
+		ready.Status = metav1.ConditionFalse
+		ready.Reason = reasonEgressRuleErrors
+		ready.Message = "One or more egress rules could not be processed"
+	}
+	meta.SetStatusCondition(&status.Conditions, ready)
+
+	return status
+}
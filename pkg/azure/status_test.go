@@ -0,0 +1,147 @@
+package azure
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	azurefirewallrulesv1 "github.com/Azure/azure-firewall-egress-controller/pkg/api/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	fake "sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newTestFirewallRules() azurefirewallrulesv1.AzureFirewallRules {
+	return azurefirewallrulesv1.AzureFirewallRules{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       "egressrules-sample",
+			Generation: 2,
+		},
+		Spec: azurefirewallrulesv1.AzureFirewallRulesSpec{
+			EgressRules: []azurefirewallrulesv1.AzureFirewallEgressRulesSpec{
+				{
+					Name:         "test1",
+					NodeSelector: []map[string]string{{"app": "service"}},
+				},
+				{
+					Name:         "test2",
+					NodeSelector: []map[string]string{{"app": "db"}},
+				},
+			},
+		},
+	}
+}
+
+func TestBuildStatus(t *testing.T) {
+	type testCase struct {
+		Name            string
+		erulesErrors    map[string]string
+		buildErr        error
+		ExpectedReady   metav1.ConditionStatus
+		ExpectedSynced  metav1.ConditionStatus
+		ExpectedDegrade metav1.ConditionStatus
+		ExpectedETag    string
+	}
+
+	testCases := []testCase{
+		{
+			Name:            "applied",
+			erulesErrors:    map[string]string{},
+			ExpectedReady:   metav1.ConditionTrue,
+			ExpectedSynced:  metav1.ConditionTrue,
+			ExpectedDegrade: metav1.ConditionFalse,
+			ExpectedETag:    "etag-1",
+		},
+		{
+			Name:            "egress-rule-error",
+			erulesErrors:    map[string]string{"test2": "Failed to get the IP Group"},
+			ExpectedReady:   metav1.ConditionFalse,
+			ExpectedSynced:  metav1.ConditionTrue,
+			ExpectedDegrade: metav1.ConditionTrue,
+			ExpectedETag:    "etag-1",
+		},
+		{
+			Name:            "apply-failed",
+			erulesErrors:    map[string]string{},
+			buildErr:        errors.New("conflict"),
+			ExpectedReady:   metav1.ConditionFalse,
+			ExpectedSynced:  metav1.ConditionFalse,
+			ExpectedDegrade: metav1.ConditionFalse,
+			ExpectedETag:    "",
+		},
+	}
+
+	erulesSourceAddresses := map[string][]string{
+		"test1": {"/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Network/ipGroups/IPGroup-node-appservice"},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			status := buildStatus(newTestFirewallRules(), erulesSourceAddresses, tc.erulesErrors, "etag-1", tc.buildErr)
+
+			if status.ObservedGeneration != 2 {
+				t.Errorf("Expected observed generation %d, but got: %d", 2, status.ObservedGeneration)
+			}
+			if status.RuleCollectionGroupETag != tc.ExpectedETag {
+				t.Errorf("Expected etag %q, but got: %q", tc.ExpectedETag, status.RuleCollectionGroupETag)
+			}
+			if len(status.EgressRules) != 2 {
+				t.Fatalf("Expected %d egress rule statuses, but got: %d", 2, len(status.EgressRules))
+			}
+			if len(status.EgressRules[0].IPGroupIDs) != 1 {
+				t.Errorf("Expected %d IP Group IDs, but got: %d", 1, len(status.EgressRules[0].IPGroupIDs))
+			}
+			if tc.erulesErrors["test2"] != "" && status.EgressRules[1].Error != tc.erulesErrors["test2"] {
+				t.Errorf("Expected error %q, but got: %q", tc.erulesErrors["test2"], status.EgressRules[1].Error)
+			}
+
+			expected := map[string]metav1.ConditionStatus{
+				azurefirewallrulesv1.ConditionTypeReady:    tc.ExpectedReady,
+				azurefirewallrulesv1.ConditionTypeSynced:   tc.ExpectedSynced,
+				azurefirewallrulesv1.ConditionTypeDegraded: tc.ExpectedDegrade,
+			}
+			for conditionType, expectedStatus := range expected {
+				if !meta.IsStatusConditionPresentAndEqual(status.Conditions, conditionType, expectedStatus) {
+					t.Errorf("Expected condition %s to be %s, but got: %v", conditionType, expectedStatus, meta.FindStatusCondition(status.Conditions, conditionType))
+				}
+			}
+		})
+	}
+}
+
+func TestUpdateStatus(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := azurefirewallrulesv1.AddToScheme(scheme); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	item := newTestFirewallRules()
+	client := fake.NewClientBuilder().WithScheme(scheme).WithObjects(&item).Build()
+
+	az := &azClient{
+		client:                  client,
+		ruleCollectionGroupETag: "etag-1",
+	}
+
+	erulesList := azurefirewallrulesv1.AzureFirewallRulesList{}
+	if err := client.List(context.Background(), &erulesList); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	az.updateStatus(context.Background(), erulesList, map[string][]string{}, map[string]string{}, nil)
+
+	updated := &azurefirewallrulesv1.AzureFirewallRules{}
+	if err := client.Get(context.Background(), types.NamespacedName{Name: item.Name}, updated); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	if updated.Status.RuleCollectionGroupETag != "etag-1" {
+		t.Errorf("Expected etag %q, but got: %q", "etag-1", updated.Status.RuleCollectionGroupETag)
+	}
+	if !meta.IsStatusConditionTrue(updated.Status.Conditions, azurefirewallrulesv1.ConditionTypeReady) {
+		t.Errorf("Expected condition %s to be %s", azurefirewallrulesv1.ConditionTypeReady, metav1.ConditionTrue)
+	}
+}
@@ -0,0 +1,205 @@
+// -------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package azure
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	azurefirewallrulesv1 "github.com/Azure/azure-firewall-egress-controller/pkg/api/v1"
+	a "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/network/armnetwork/v2"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// uninstallPollInterval is the interval at which the deleted objects are listed until they are gone.
+const uninstallPollInterval = 1 * time.Second
+
+// Uninstall deletes the AzureFirewallRules and EgressPolicy objects, waits up to timeout for the running controller
+// to remove their rules and release them, then removes the remaining rules and the IP Groups managed by the client.
+// It is meant to run once before the controller is removed from the cluster.
+func (az *azClient) Uninstall(ctx context.Context, timeout time.Duration) error {
+	adoptedIpGroups, err := listUnnamedClusterIpGroups(ctx, az.client)
+	if err != nil {
+		return err
+	}
+	if err := deleteObjects(ctx, az.client, timeout); err != nil {
+		return err
+	}
+	if err := az.releaseManagedRuleCollectionGroups(ctx); err != nil {
+		return err
+	}
+	return az.deleteManagedIpGroups(ctx, adoptedIpGroups)
+}
+
+func (s *azClientSet) Uninstall(ctx context.Context, timeout time.Duration) (err error) {
+	// The rule collection groups and the IP Groups of the cluster are found while the objects still exist.
+	clients := s.discoverTargets(ctx)
+	adoptedIpGroups, err := listUnnamedClusterIpGroups(ctx, s.client)
+	if err != nil {
+		return err
+	}
+	if err := deleteObjects(ctx, s.client, timeout); err != nil {
+		return err
+	}
+	// The IP Groups of a resource group may be referenced by the rule collection groups of every client, so they are
+	// deleted once all of them are released, and left alone in the resource groups where one couldn't be.
+	released := make(map[string]bool)
+	for _, az := range clients {
+		if err1 := az.releaseManagedRuleCollectionGroups(ctx); err1 != nil {
+			released[az.resourceGroupKey()] = false
+			if err == nil {
+				err = err1
+			}
+		} else if _, ok := released[az.resourceGroupKey()]; !ok {
+			released[az.resourceGroupKey()] = true
+		}
+	}
+	for _, az := range clients {
+		if !released[az.resourceGroupKey()] {
+			continue
+		}
+		delete(released, az.resourceGroupKey())
+		if err1 := az.deleteManagedIpGroups(ctx, adoptedIpGroups); err1 != nil && err == nil {
+			err = err1
+		}
+	}
+	return
+}
+
+// deleteObjects deletes all the AzureFirewallRules and EgressPolicy objects, including the protected ones, and
+// waits for the controller to remove their finalizers. The finalizers left after the timeout, e.g. when the
+// controller isn't running, are removed so that the objects and their CRDs can be deleted.
+func deleteObjects(ctx context.Context, c client.Client, timeout time.Duration) error {
+	objects, err := listObjects(ctx, c)
+	if err != nil {
+		return err
+	}
+	for _, obj := range objects {
+		if _, ok := obj.GetAnnotations()[azurefirewallrulesv1.ProtectedAnnotation]; ok {
+			patch := client.MergeFrom(obj.DeepCopyObject().(client.Object))
+			annotations := obj.GetAnnotations()
+			delete(annotations, azurefirewallrulesv1.ProtectedAnnotation)
+			obj.SetAnnotations(annotations)
+			if err := c.Patch(ctx, obj, patch); client.IgnoreNotFound(err) != nil {
+				return err
+			}
+		}
+		klog.Infof("Deleting %T %s", obj, client.ObjectKeyFromObject(obj))
+		if err := c.Delete(ctx, obj); client.IgnoreNotFound(err) != nil {
+			return err
+		}
+	}
+
+	err = wait.PollImmediate(uninstallPollInterval, timeout, func() (bool, error) {
+		objects, err = listObjects(ctx, c)
+		return len(objects) == 0, err
+	})
+	if !errors.Is(err, wait.ErrWaitTimeout) {
+		return err
+	}
+	klog.Infof("The controller didn't remove the rules of %d objects within %s, removing their finalizers", len(objects), timeout)
+	for _, obj := range objects {
+		if err := removeFinalizer(ctx, c, obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listUnnamedClusterIpGroups returns the names of the IP Groups the selectors of the objects had when the cluster had
+// no name, see unnamedClusterIpGroups.
+func listUnnamedClusterIpGroups(ctx context.Context, c client.Client) (map[string]bool, error) {
+	erulesList := &azurefirewallrulesv1.AzureFirewallRulesList{}
+	if err := c.List(ctx, erulesList); err != nil {
+		return nil, err
+	}
+	policyList := &azurefirewallrulesv1.EgressPolicyList{}
+	if err := c.List(ctx, policyList); err != nil {
+		return nil, err
+	}
+	return unnamedClusterIpGroups(erulesList.Items, policyList.Items), nil
+}
+
+func listObjects(ctx context.Context, c client.Client) ([]client.Object, error) {
+	erulesList := &azurefirewallrulesv1.AzureFirewallRulesList{}
+	if err := c.List(ctx, erulesList); err != nil {
+		return nil, err
+	}
+	policyList := &azurefirewallrulesv1.EgressPolicyList{}
+	if err := c.List(ctx, policyList); err != nil {
+		return nil, err
+	}
+	return finalizedObjects(erulesList.Items, policyList.Items), nil
+}
+
+// releaseManagedRuleCollectionGroups removes the rules generated by the client from its rule collection group and
+// the rule collection groups its config overflowed into. The rule collection groups are only deleted when they hold
+// no other rules, e.g. of another cluster or added in the portal.
+func (az *azClient) releaseManagedRuleCollectionGroups(ctx context.Context) error {
+	names := []string{az.fwPolicyRuleCollectionGroupName}
+	for index := 1; index < az.limits.RuleCollectionGroups; index++ {
+		name := shardName(az.fwPolicyRuleCollectionGroupName, index)
+		live, err := az.fwPolicyRuleCollectionGroupClient.Get(ctx, az.resourceGroupName, az.fwPolicyName, name)
+		observeARMRequest(opRuleCollectionGroupGet, err)
+		if err != nil {
+			if live.Response.Response != nil && live.StatusCode == http.StatusNotFound {
+				break
+			}
+			return err
+		}
+		names = append(names, name)
+	}
+	for _, name := range names {
+		if err := az.releaseRuleCollectionGroup(ctx, name); err != nil {
+			return err
+		}
+	}
+	az.configCache = nil
+	az.shardCache = make(map[string]*canonicalRuleCollectionGroup)
+	az.liveRuleCollectionGroupChecked = false
+	az.liveShardsChecked = make(map[string]bool)
+	return nil
+}
+
+// deleteManagedIpGroups deletes the IP Groups managed for the cluster in the resource group of the firewall policy.
+// It must only run once no rule collection group references them.
+func (az *azClient) deleteManagedIpGroups(ctx context.Context, adoptedIpGroups map[string]bool) error {
+	defer az.lockIpGroups()()
+	var ipGroupsInRG = make(map[string]*a.IPGroup)
+	pager := az.ipGroupClient.NewListByResourceGroupPager(az.resourceGroupName, nil)
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		observeARMRequest(opIPGroupList, err)
+		if err != nil {
+			return err
+		}
+		for _, ipGroup := range page.Value {
+			ipGroupsInRG[*ipGroup.Name] = ipGroup
+		}
+	}
+	var err error
+	for _, name := range orphanedIpGroups(ipGroupsInRG, map[string]bool{}, az.clusterName, adoptedIpGroups) {
+		klog.Info("Deleting IP Group: ", name)
+		poller, err1 := az.ipGroupClient.BeginDelete(ctx, az.resourceGroupName, name, nil)
+		if err1 == nil {
+			_, err1 = poller.PollUntilDone(ctx, nil)
+		}
+		observeARMRequest(opIPGroupDelete, err1)
+		if err1 != nil {
+			klog.Error("Error deleting the IP Group ", name, ": ", err1)
+			if err == nil {
+				err = err1
+			}
+			continue
+		}
+		delete(az.appliedIpGroups, name)
+	}
+	return err
+}
@@ -0,0 +1,170 @@
+package azure
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	azurefirewallrulesv1 "github.com/Azure/azure-firewall-egress-controller/pkg/api/v1"
+	azfake "github.com/Azure/azure-firewall-egress-controller/pkg/azure/fake"
+	n "github.com/Azure/azure-sdk-for-go/services/network/mgmt/2021-03-01/network"
+	"github.com/Azure/go-autorest/autorest/to"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestUninstall(t *testing.T) {
+	rules := newShardTestRules()
+	rules.Annotations = map[string]string{azurefirewallrulesv1.ProtectedAnnotation: "true"}
+	policy := &azurefirewallrulesv1.EgressPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "allow-github", Namespace: "team-a"},
+		Spec: azurefirewallrulesv1.EgressPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+			Rules: []azurefirewallrulesv1.AzureFirewallEgressrulesRulesSpec{
+				{RuleCollectionName: "team-a-allow", Priority: 300, RuleName: "github", TargetFqdns: []string{"github.com"}, Protocol: []string{"Https:443"}, Action: "Allow", RuleType: "Application"},
+			},
+		},
+	}
+	arm := azfake.NewARM()
+	arm.AddIPGroup(testSubscriptionID, testResourceGroup, "onprem-ranges", "westeurope", []string{"192.168.0.0/16"})
+	az, k8sClient := newTestAzClientWithFakeARM(t, arm,
+		rules.DeepCopy(),
+		policy,
+		newTestNode("node-1", map[string]string{"app": "service"}, "10.240.0.4"),
+		newTestPod("web-1", "team-a", map[string]string{"app": "web"}, "10.244.0.4"),
+	)
+	ipGroupID := azfake.IPGroupID(testSubscriptionID, testResourceGroup, nodeIpGroupNameOf("app", "service"))
+	az.limits = shardTestLimits(*az.withManagedDescription(BuildFirewallConfig(azurefirewallrulesv1.AzureFirewallRulesList{Items: []azurefirewallrulesv1.AzureFirewallRules{rules}}, map[string][]string{"test1": {ipGroupID}})))
+	ctx := context.Background()
+
+	if err := az.processRequest(ctx, ctrl.Request{}, nil); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	arm.CompleteOperations()
+	// A managed IP Group left behind, e.g. after a failed deletion.
+	arm.AddIPGroup(testSubscriptionID, testResourceGroup, "IPGroup-node-appold", "westeurope", []string{"10.240.0.9"})
+	shardID := azfake.RuleCollectionGroupID(testSubscriptionID, testResourceGroup, testFwPolicy, testRuleCollGroup+"-2")
+	if _, ok := arm.RuleCollectionGroup(shardID); !ok {
+		t.Fatalf("Expected rule collection group %s to exist", testRuleCollGroup+"-2")
+	}
+
+	// No controller removes the finalizers, so the uninstall removes them after the timeout.
+	if err := az.Uninstall(ctx, 10*time.Millisecond); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	for _, id := range []string{azfake.RuleCollectionGroupID(testSubscriptionID, testResourceGroup, testFwPolicy, testRuleCollGroup), shardID} {
+		if _, ok := arm.RuleCollectionGroup(id); ok {
+			t.Errorf("Expected rule collection group %s to be deleted", id)
+		}
+	}
+	var names []string
+	for _, ipGroup := range arm.IPGroups(testSubscriptionID, testResourceGroup) {
+		names = append(names, *ipGroup.Name)
+	}
+	if len(names) != 1 || names[0] != "onprem-ranges" {
+		t.Errorf("Expected IP Groups %v, but got: %v", []string{"onprem-ranges"}, names)
+	}
+	for _, obj := range []client.Object{&azurefirewallrulesv1.AzureFirewallRules{}, &azurefirewallrulesv1.EgressPolicy{}} {
+		key := types.NamespacedName{Name: rules.Name}
+		if _, ok := obj.(*azurefirewallrulesv1.EgressPolicy); ok {
+			key = types.NamespacedName{Name: policy.Name, Namespace: policy.Namespace}
+		}
+		if err := k8sClient.Get(ctx, key, obj); !apierrors.IsNotFound(err) {
+			t.Errorf("Expected %s to be deleted, but got: %v", key, err)
+		}
+	}
+}
+
+func TestUninstallKeepsRulesOfOtherClusters(t *testing.T) {
+	rules := newDriftTestRules()
+	arm := azfake.NewARM()
+	az, _ := newTestAzClientWithFakeARM(t, arm, rules.DeepCopy(), newTestNode("node-1", map[string]string{"app": "service"}, "10.240.0.4"))
+	az.SetClusterName("aks-prod")
+	ctx := context.Background()
+
+	if err := az.processRequest(ctx, ctrl.Request{}, nil); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	arm.CompleteOperations()
+
+	// Another cluster and the portal add rule collections to the same rule collection group.
+	foreign := newPortalRuleCollection("aks-test-allow")
+	(*foreign.Rules)[0].(*n.Rule).Description = to.StringPtr(clusterRuleDescriptionPrefix + "aks-test" + ruleCollectionGroupDescriptionInfix + testRuleCollGroup)
+	rcgID := azfake.RuleCollectionGroupID(testSubscriptionID, testResourceGroup, testFwPolicy, testRuleCollGroup)
+	live, _ := arm.RuleCollectionGroup(rcgID)
+	ruleCollections := append(*live.RuleCollections, foreign, newPortalRuleCollection("portal-added"))
+	live.RuleCollections = &ruleCollections
+	if err := arm.SetRuleCollectionGroup(rcgID, live); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	if err := az.Uninstall(ctx, 10*time.Millisecond); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	arm.CompleteOperations()
+	if names := liveRuleCollectionNames(t, arm); !reflect.DeepEqual(names, []string{"aks-test-allow", "portal-added"}) {
+		t.Errorf("Expected rule collections %v, but got: %v", []string{"aks-test-allow", "portal-added"}, names)
+	}
+}
+
+func TestAzClientSetUninstallReleasesEveryTargetFirst(t *testing.T) {
+	defaultRules := newTestFirewallRules()
+	secondRules := newTestFirewallRules()
+	secondRules.Name = "second-rules"
+	secondRules.Spec.FirewallPolicy = &azurefirewallrulesv1.FirewallPolicyReference{
+		ResourceID:                  azfake.FirewallPolicyID(testSubscriptionID, testResourceGroup, testFwPolicy),
+		RuleCollectionGroup:         "aks-egress-2",
+		RuleCollectionGroupPriority: 500,
+	}
+
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if err := azurefirewallrulesv1.AddToScheme(scheme); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(&defaultRules, &secondRules, newTestNode("node-1", map[string]string{"app": "service"}, "10.240.0.4")).Build()
+
+	arm := azfake.NewARM()
+	arm.AddFirewallPolicy(testSubscriptionID, testResourceGroup, testFwPolicy, "westeurope")
+	s := NewAzClientSetWithTransport(testSubscriptionID, testResourceGroup, testFwPolicy, testRuleCollGroup, 400, k8sClient, arm, arm.Credential()).(*azClientSet)
+	ctx := context.Background()
+	if err := s.processRequest(ctx, ctrl.Request{}, nil); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	arm.CompleteOperations()
+	start := len(arm.Requests())
+
+	// Both rule collection groups reference the same IP Group, which can only be deleted once both are released.
+	if err := s.Uninstall(ctx, 10*time.Millisecond); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	arm.CompleteOperations()
+	ipGroupDeleted := false
+	for _, request := range arm.Requests()[start:] {
+		if strings.HasPrefix(request, http.MethodGet+" ") {
+			continue
+		}
+		if strings.Contains(request, "/ipGroups/") {
+			ipGroupDeleted = true
+		} else if strings.Contains(request, "/ruleCollectionGroups/") && ipGroupDeleted {
+			t.Errorf("Expected the rule collection groups to be released before the IP Groups are deleted, but got: %s", request)
+		}
+	}
+	if !ipGroupDeleted {
+		t.Errorf("Expected the IP Groups to be deleted")
+	}
+	if _, ok := arm.IPGroup(azfake.IPGroupID(testSubscriptionID, testResourceGroup, nodeIpGroupNameOf("app", "service"))); ok {
+		t.Errorf("Expected IP Group %s to be deleted", nodeIpGroupNameOf("app", "service"))
+	}
+}
@@ -58,3 +58,22 @@ func getSourceAddressesByNodeLabels(k string, v string, nodeList corev1.NodeList
 	}
 	return sourceAddresses
 }
+
+func getSourceAddressesByNodes(nodes []*corev1.Node) []*string {
+	var sourceAddresses []*string
+	for _, node := range nodes {
+		sourceAddresses = append(sourceAddresses, to.StringPtr(node.Status.Addresses[0].Address))
+	}
+	return sourceAddresses
+}
+
+func getSourceAddressesByPods(pods []corev1.Pod) []*string {
+	var sourceAddresses []*string
+	for _, pod := range pods {
+		if pod.Spec.HostNetwork || pod.Status.PodIP == "" || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		sourceAddresses = append(sourceAddresses, to.StringPtr(pod.Status.PodIP))
+	}
+	return sourceAddresses
+}
@@ -10,131 +10,145 @@ import (
 	"sync"
 	"time"
 
-	//egressv1 "github.com/Azure/azure-firewall-egress-controller/api/v1"
-	"github.com/orcaman/concurrent-map/v2"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
 	"k8s.io/klog/v2"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
-const minTimeBetweenUpdates = 1 * time.Second
+const (
+	minTimeBetweenUpdates = 1 * time.Second
 
-var jobsInQueue = cmap.New[bool]()
-var mutex sync.Mutex
+	// A failed event loop run is retried with an exponential backoff.
+	minRetryDelay = 1 * time.Second
+	maxRetryDelay = 5 * time.Minute
+)
 
+// Queue coalesces the events of a rule collection group. Every event loop run processes all the objects, so the
+// queue holds a single item, and keeps the requests received since the last run to remove the taints of their nodes.
 type Queue struct {
-	name   string
-	jobs   chan Job
-	ctx    context.Context
-	cancel context.CancelFunc
-}
+	name  string
+	queue workqueue.RateLimitingInterface
 
-// Job - holds logic to perform some operations during queue execution.
-type Job struct {
-	Request  ctrl.Request
-	ctx      context.Context
-	AzClient AzClient
+	mu       sync.Mutex
+	requests map[types.NamespacedName]bool
 }
 
+// Worker runs the event loop of a rule collection group. Runs of the same queue are serialized, while the
+// workers of different rule collection groups run concurrently.
 type Worker struct {
-	Queue  *Queue
-	client client.Client
+	Queue    *Queue
+	client   client.Client
+	AzClient AzClient
 }
 
 // NewQueue instantiates new queue.
 func NewQueue(name string) *Queue {
-	ctx, cancel := context.WithCancel(context.Background())
+	return newQueue(name, workqueue.NewItemExponentialFailureRateLimiter(minRetryDelay, maxRetryDelay))
+}
 
+func newQueue(name string, rateLimiter workqueue.RateLimiter) *Queue {
 	return &Queue{
-		jobs:   make(chan Job),
-		name:   name,
-		ctx:    ctx,
-		cancel: cancel,
+		name:     name,
+		queue:    workqueue.NewNamedRateLimitingQueue(rateLimiter, name),
+		requests: make(map[types.NamespacedName]bool),
 	}
 }
 
-func (q *Queue) AddJob(job Job) {
-	resourceName := job.Request.NamespacedName.Name
+// AddJob queues an event loop run for the request. It never blocks: requests received while a run is pending are
+// coalesced into it.
+func (q *Queue) AddJob(req ctrl.Request) {
+	q.mu.Lock()
+	q.requests[req.NamespacedName] = true
+	q.mu.Unlock()
+	q.queue.Add(q.name)
+}
+
+// Len returns the number of pending event loop runs.
+func (q *Queue) Len() int {
+	return q.queue.Len()
+}
 
-	alreadyExists, ok := jobsInQueue.Get(resourceName)
-	if ok && alreadyExists {
-		return
+// takeRequests returns the requests received since the last run.
+func (q *Queue) takeRequests() []types.NamespacedName {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var requests []types.NamespacedName
+	for name := range q.requests {
+		requests = append(requests, name)
 	}
-	jobsInQueue.Set(resourceName, true)
-	q.jobs <- job
+	q.requests = make(map[types.NamespacedName]bool)
+	return requests
 }
 
-func (j Job) Run(nodesWithFwTaint []*corev1.Node) error {
-	klog.Info("Processing request: ", j.Request)
-	j.AzClient.processRequest(j.ctx, j.Request, nodesWithFwTaint)
-	return nil
+// restoreRequests gives back the requests of a failed run, so that the retry removes the taints of their nodes.
+func (q *Queue) restoreRequests(requests []types.NamespacedName) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, name := range requests {
+		q.requests[name] = true
+	}
 }
 
-func NewWorker(queue *Queue, client client.Client) *Worker {
+func NewWorker(queue *Queue, client client.Client, azClient AzClient) *Worker {
 	return &Worker{
-		Queue:  queue,
-		client: client,
+		Queue:    queue,
+		client:   client,
+		AzClient: azClient,
 	}
 }
 
-func (w *Worker) drainChan(defaultEvent Job) []*corev1.Node {
+// nodesWithFwTaint returns the nodes of the requests that wait for the firewall policy update.
+func (w *Worker) nodesWithFwTaint(ctx context.Context, requests []types.NamespacedName) []*corev1.Node {
 	var nodesWithFwTaint []*corev1.Node
-	c := 0
-	for {
-		select {
-		case event := <-w.Queue.jobs:
-			resourceName := event.Request.NamespacedName.Name
-			jobsInQueue.Set(resourceName, false)
-			c = c + 1
-			node := &corev1.Node{}
-			if err := w.client.Get(event.ctx, event.Request.NamespacedName, node); err == nil {
-				if CheckIfTaintExists(node) {
-					nodesWithFwTaint = append(nodesWithFwTaint, node)
-				}
-			}
-		default:
-			klog.Infof("Draining %d events from work channel", c)
-			return nodesWithFwTaint
+	for _, name := range requests {
+		node := &corev1.Node{}
+		if err := w.client.Get(ctx, name, node); err == nil && CheckIfTaintExists(node) {
+			nodesWithFwTaint = append(nodesWithFwTaint, node)
 		}
 	}
+	return nodesWithFwTaint
 }
 
-// DoWork processes jobs from the queue (jobs channel).
-func (w *Worker) DoWork() bool {
-	lastUpdate := time.Now().Add(-1 * time.Second)
-	klog.Info("Worker started")
-	for {
-		select {
-		case <-w.Queue.ctx.Done():
-			klog.Error("Context cancelled ... :", w.Queue.ctx.Err())
-			return true
-		// if job received.
-		case job := <-w.Queue.jobs:
-
-			resourceName := job.Request.NamespacedName.Name
-			jobsInQueue.Set(resourceName, false)
-
-			since := time.Since(lastUpdate)
-			if since < minTimeBetweenUpdates {
-				sleep := minTimeBetweenUpdates - since
-				klog.Infof("[worker] It has been %+v since last update; Sleeping for %+v before next update", since, sleep)
-				time.Sleep(sleep)
-			}
-
-			nodesWithFwTaint := w.drainChan(job)
-			node := &corev1.Node{}
-			if err := w.client.Get(job.ctx, job.Request.NamespacedName, node); err == nil {
-				nodesWithFwTaint = append(nodesWithFwTaint, node)
-			}
-
-			err := job.Run(nodesWithFwTaint)
-			if err != nil {
-				klog.Error("Err in DoWork ... :", err)
-				continue
-			}
-
-			lastUpdate = time.Now()
-		}
+// DoWork processes the queue until the context is cancelled.
+func (w *Worker) DoWork(ctx context.Context) {
+	klog.Info("Worker started: ", w.Queue.name)
+	go func() {
+		<-ctx.Done()
+		w.Queue.queue.ShutDown()
+	}()
+	for w.processNextItem(ctx) {
+	}
+	klog.Info("Worker stopped: ", w.Queue.name)
+}
+
+func (w *Worker) processNextItem(ctx context.Context) bool {
+	item, shutdown := w.Queue.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer w.Queue.queue.Done(item)
+
+	requests := w.Queue.takeRequests()
+	if len(requests) > 1 {
+		jobsDrained.Add(float64(len(requests) - 1))
+	}
+	klog.Infof("Processing %d requests for %s", len(requests), w.Queue.name)
+
+	if err := w.AzClient.processRequest(ctx, ctrl.Request{}, w.nodesWithFwTaint(ctx, requests)); err != nil {
+		w.Queue.restoreRequests(requests)
+		klog.Errorf("Error processing the requests for %s (retry %d): %v", w.Queue.name, w.Queue.queue.NumRequeues(item)+1, err)
+		w.Queue.queue.AddRateLimited(item)
+	} else {
+		w.Queue.queue.Forget(item)
+	}
+
+	// Events received until the next run are coalesced into it.
+	select {
+	case <-ctx.Done():
+	case <-time.After(minTimeBetweenUpdates):
 	}
+	return true
 }
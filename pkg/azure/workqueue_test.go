@@ -1,105 +1,91 @@
 package azure
 
 import (
-	"testing"
 	"context"
+	"net/http"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
 
-	fake "sigs.k8s.io/controller-runtime/pkg/client/fake"
+	azfake "github.com/Azure/azure-firewall-egress-controller/pkg/azure/fake"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	fake "sigs.k8s.io/controller-runtime/pkg/client/fake"
 )
 
 func TestAddJob(t *testing.T) {
-	mockRequest := ctrl.Request {
-		NamespacedName: client.ObjectKey {
-			Name:      "example-pod",
-			Namespace: "default",
-		},
-	}
+	queue := NewQueue("testqueue")
+	defer queue.queue.ShutDown()
 
-	obj := []client.Object{}
-	ctx, cancel := context.WithCancel(context.Background());
-
-	buffSize := 10
-	queue := &Queue {
-		jobs: make(chan Job, buffSize),
-		name: "testqueue",
-		ctx: ctx,
-		cancel: cancel,
+	for _, name := range []string{"node-1", "node-2", "node-1"} {
+		queue.AddJob(ctrl.Request{NamespacedName: client.ObjectKey{Name: name}})
 	}
 
-	az:= &azClient {
-		client: fake.NewClientBuilder().WithObjects(obj...).Build(),
-		queue: queue,
-		ctx: context.TODO(),
+	if queue.Len() != 1 {
+		t.Errorf("Expected length %d, but got: %d", 1, queue.Len())
 	}
-
-	job := Job {
-		Request: mockRequest,
-		ctx: az.ctx,
-		AzClient: az,
+	requests := queue.takeRequests()
+	sort.Slice(requests, func(i, j int) bool { return requests[i].Name < requests[j].Name })
+	expected := []types.NamespacedName{{Name: "node-1"}, {Name: "node-2"}}
+	if !reflect.DeepEqual(requests, expected) {
+		t.Errorf("Expected requests %v, but got: %v", expected, requests)
 	}
-
-	az.queue.AddJob(job);
-	if len(az.queue.jobs) == 0 {
-		t.Errorf("Expected length %d, but got: %d", 1, 0);
+	if requests := queue.takeRequests(); len(requests) != 0 {
+		t.Errorf("Expected length %d, but got: %d", 0, len(requests))
 	}
 }
 
-func TestDrainChan(t *testing.T) {
-	mockRequest := ctrl.Request {
-		NamespacedName: client.ObjectKey {
-			Name:      "example-pod",
-			Namespace: "default",
-		},
-	}
-
-	obj := []client.Object{}
-	ctx, cancel := context.WithCancel(context.Background());
+func TestNodesWithFwTaint(t *testing.T) {
+	tainted := newTestNode("node-1", nil, "10.240.0.4")
+	tainted.Spec.Taints = []corev1.Taint{taint}
+	worker := NewWorker(NewQueue("testqueue-taints"), fake.NewClientBuilder().WithObjects(tainted, newTestNode("node-2", nil, "10.240.0.5")).Build(), nil)
 
-	buffSize := 10
-	counter := int64(0)
-	queue := &Queue {
-		jobs: make(chan Job, buffSize),
-		name: "testqueue",
-		ctx: ctx,
-		cancel: cancel,
-	}
-
-	az:= &azClient {
-		client: fake.NewClientBuilder().WithObjects(obj...).Build(),
-		queue: queue,
-		ctx: context.TODO(),
+	nodes := worker.nodesWithFwTaint(context.Background(), []types.NamespacedName{{Name: "node-1"}, {Name: "node-2"}, {Name: "example-pod", Namespace: "default"}})
+	if len(nodes) != 1 || nodes[0].Name != "node-1" {
+		t.Errorf("Expected nodes %v, but got: %v", []string{"node-1"}, nodes)
 	}
+}
 
-	worker := &Worker {
-		Queue: queue,
-		client: az.client,
+func TestWorkerRequeuesFailedJob(t *testing.T) {
+	rules := newTestFirewallRules()
+	arm := azfake.NewARM()
+	az, k8sClient := newTestAzClientWithFakeARM(t, arm, &rules, newTestNode("node-1", map[string]string{"app": "service"}, "10.240.0.4"))
+	rcgID := azfake.RuleCollectionGroupID(testSubscriptionID, testResourceGroup, testFwPolicy, testRuleCollGroup)
+
+	queue := newQueue("testqueue-requeue", workqueue.NewItemExponentialFailureRateLimiter(10*time.Millisecond, 100*time.Millisecond))
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		NewWorker(queue, k8sClient, az).DoWork(ctx)
+		close(stopped)
+	}()
+
+	arm.FailNext(http.MethodPut, rcgID, http.StatusBadRequest)
+	queue.AddJob(ctrl.Request{})
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, ok := arm.RuleCollectionGroup(rcgID); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected rule collection group %s to be applied after a retry", testRuleCollGroup)
+		}
+		time.Sleep(50 * time.Millisecond)
 	}
 
-	job := Job {
-		Request: mockRequest,
-		ctx: az.ctx,
-		AzClient: az,
+	// The worker stops when the context is cancelled.
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the worker to stop")
 	}
-
-	Fill:
-			for {
-				select {
-				case az.queue.jobs <- job:
-					counter++
-				default:
-					break Fill
-				}
-			}
-
-	if int64(len(az.queue.jobs)) != counter {
-		t.Errorf("Expected length %d, but got: %d", counter, int64(len(az.queue.jobs)));
+	if retries := queue.queue.NumRequeues(queue.name); retries != 0 {
+		t.Errorf("Expected %d requeues after a success, but got: %d", 0, retries)
 	}
-
-	worker.drainChan(job);
-
-	if len(az.queue.jobs) != 0 {
-		t.Errorf("Expected length %d, but got: %d", 0, len(az.queue.jobs));
-	}
-}
\ No newline at end of file
+}
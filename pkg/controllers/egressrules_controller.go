@@ -19,17 +19,23 @@ package controllers
 import (
 	"context"
 	"reflect"
+	"time"
 
 	azurefirewallrulesv1 "github.com/Azure/azure-firewall-egress-controller/pkg/api/v1"
 	a "github.com/Azure/azure-firewall-egress-controller/pkg/azure"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 	"sigs.k8s.io/controller-runtime/pkg/source"
 )
 
@@ -38,14 +44,25 @@ type AzureFirewallRulesReconciler struct {
 	client.Client
 	Scheme   *runtime.Scheme
 	AzClient a.AzClient
+
+	// ResyncPeriod is the interval at which the rule collection groups are rebuilt without any event, so that the
+	// controller converges even if a failed update is not followed by another event. Zero disables the resync.
+	ResyncPeriod time.Duration
 }
 
 //+kubebuilder:rbac:groups=egress.azure-firewall-egress-controller.io,resources=azurefirewallrules,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=egress.azure-firewall-egress-controller.io,resources=azurefirewallrules/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=egress.azure-firewall-egress-controller.io,resources=azurefirewallrules/finalizers,verbs=update
+//+kubebuilder:rbac:groups=egress.azure-firewall-egress-controller.io,resources=egresspolicies,verbs=get;list;watch;update;patch;delete
+//+kubebuilder:rbac:groups=egress.azure-firewall-egress-controller.io,resources=egresspolicies/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=egress.azure-firewall-egress-controller.io,resources=egresspolicies/finalizers,verbs=update
+//+kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch
+//+kubebuilder:rbac:groups=core,resources=namespaces,verbs=get;list;watch
 //+kubebuilder:rbac:groups=core,resources=nodes,verbs=get;watch;list
 //+kubebuilder:rbac:groups=core,resources=nodes,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=core,resources=nodes/status,verbs=get;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
+//+kubebuilder:rbac:groups=authorization.k8s.io,resources=subjectaccessreviews,verbs=create
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -59,25 +76,107 @@ type AzureFirewallRulesReconciler struct {
 func (r *AzureFirewallRulesReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	_ = log.FromContext(ctx)
 
+	// Namespaced requests are for EgressPolicies, including the ones mapped from the pods they select.
+	if req.Namespace != "" {
+		r.AzClient.UpdateFirewallPolicy(ctx, req)
+		return ctrl.Result{}, nil
+	}
+
 	node := &corev1.Node{}
 	err := r.Get(ctx, req.NamespacedName, node)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return ctrl.Result{}, err
+	}
 
-	if (err != nil && req.NamespacedName.Namespace != "kube-system") || (err == nil && !a.CheckIfNodeNotReady(node)) {
-		go r.AzClient.UpdateFirewallPolicy(ctx, req)
-	} else if a.CheckIfNodeNotReady(node) {
+	// The other cluster scoped requests are for AzureFirewallRules.
+	if apierrors.IsNotFound(err) || !a.CheckIfNodeNotReady(node) {
+		r.AzClient.UpdateFirewallPolicy(ctx, req)
+	} else {
 		go r.AzClient.AddTaints(ctx, req)
 	}
 
 	return ctrl.Result{}, nil
 }
 
+// egressPoliciesSelectingPod maps a pod to the EgressPolicies selecting it, so that the pods no policy selects don't
+// trigger a rebuild of the rule collection groups.
+func (r *AzureFirewallRulesReconciler) egressPoliciesSelectingPod(obj client.Object) []reconcile.Request {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		return nil
+	}
+	ctx := context.Background()
+	policyList := &azurefirewallrulesv1.EgressPolicyList{}
+	if err := r.List(ctx, policyList); err != nil {
+		log.FromContext(ctx).Error(err, "unable to list EgressPolicies")
+		return nil
+	}
+
+	// The namespace of the pod is only fetched for the first policy with a namespaceSelector.
+	var namespace *corev1.Namespace
+	namespaceFetched := false
+	var requests []reconcile.Request
+	for _, policy := range policyList.Items {
+		if policy.Spec.NamespaceSelector != nil && !namespaceFetched {
+			namespaceFetched = true
+			namespace = &corev1.Namespace{}
+			if err := r.Get(ctx, types.NamespacedName{Name: pod.Namespace}, namespace); err != nil {
+				log.FromContext(ctx).Error(err, "unable to fetch Namespace", "namespace", pod.Namespace)
+				namespace = nil
+			}
+		}
+		if a.EgressPolicySelectsPod(policy, pod, namespace) {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: policy.Namespace, Name: policy.Name}})
+		}
+	}
+	return requests
+}
+
+// resync queues an event loop run every ResyncPeriod until the manager stops.
+func (r *AzureFirewallRulesReconciler) resync(ctx context.Context) error {
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		r.AzClient.UpdateFirewallPolicy(ctx, ctrl.Request{})
+	}, r.ResyncPeriod)
+	return nil
+}
+
 // SetupWithManager sets up the controller with the Manager.
 func (r *AzureFirewallRulesReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if r.ResyncPeriod > 0 {
+		if err := mgr.Add(manager.RunnableFunc(r.resync)); err != nil {
+			return err
+		}
+	}
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&azurefirewallrulesv1.AzureFirewallRules{}).
 		Watches(&source.Kind{Type: &corev1.Node{}}, &handler.EnqueueRequestForObject{}).
+		Watches(&source.Kind{Type: &azurefirewallrulesv1.EgressPolicy{}}, &handler.EnqueueRequestForObject{}).
+		Watches(&source.Kind{Type: &corev1.Pod{}}, handler.EnqueueRequestsFromMapFunc(r.egressPoliciesSelectingPod)).
 		WithEventFilter(predicate.Funcs{
+			CreateFunc: func(e event.CreateEvent) bool {
+				if pod, ok := e.Object.(*corev1.Pod); ok {
+					// Pods are usually created without an IP, the update assigning it triggers the reconciler.
+					return pod.Status.PodIP != ""
+				}
+				return true
+			},
 			UpdateFunc: func(e event.UpdateEvent) bool {
+				switch e.ObjectNew.(type) {
+				case *azurefirewallrulesv1.AzureFirewallRules, *azurefirewallrulesv1.EgressPolicy:
+					// Status updates written by the controller don't change the generation. The deletion of an object
+					// is processed whether it changed the generation or not.
+					deleted := e.ObjectOld.GetDeletionTimestamp().IsZero() != e.ObjectNew.GetDeletionTimestamp().IsZero()
+					return deleted || e.ObjectOld.GetGeneration() != e.ObjectNew.GetGeneration()
+				}
+				if _, ok := e.ObjectNew.(*corev1.Pod); ok {
+					oldObj := e.ObjectOld.(*corev1.Pod)
+					newObj := e.ObjectNew.(*corev1.Pod)
+
+					labelChanged := !reflect.DeepEqual(oldObj.GetLabels(), newObj.GetLabels())
+					ipChanged := oldObj.Status.PodIP != newObj.Status.PodIP
+					phaseChanged := oldObj.Status.Phase != newObj.Status.Phase
+					return labelChanged || ipChanged || phaseChanged
+				}
 				if _, ok := e.ObjectNew.(*corev1.Node); ok {
 					oldObj := e.ObjectOld.(*corev1.Node)
 					newObj := e.ObjectNew.(*corev1.Node)
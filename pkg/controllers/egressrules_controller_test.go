@@ -0,0 +1,115 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	egressv1 "github.com/Azure/azure-firewall-egress-controller/pkg/api/v1"
+	"github.com/Azure/azure-firewall-egress-controller/pkg/azure"
+	azfake "github.com/Azure/azure-firewall-egress-controller/pkg/azure/fake"
+	n "github.com/Azure/azure-sdk-for-go/services/network/mgmt/2021-03-01/network"
+)
+
+const (
+	timeout  = 30 * time.Second
+	interval = 250 * time.Millisecond
+)
+
+func createNode(ctx context.Context, name string, labels map[string]string, ip string) *corev1.Node {
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels}}
+	Expect(k8sClient.Create(ctx, node)).To(Succeed())
+	node.Status.Addresses = []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: ip}}
+	Expect(k8sClient.Status().Update(ctx, node)).To(Succeed())
+	return node
+}
+
+func ipGroupAddresses(name string) func() []string {
+	return func() []string {
+		ipGroup, ok := fakeARM.IPGroup(azfake.IPGroupID(testSubscriptionID, testResourceGroup, name))
+		if !ok {
+			return nil
+		}
+		var addresses []string
+		for _, address := range ipGroup.Properties.IPAddresses {
+			addresses = append(addresses, *address)
+		}
+		sort.Strings(addresses)
+		return addresses
+	}
+}
+
+func ruleCollectionNames() []string {
+	rcg, ok := fakeARM.RuleCollectionGroup(azfake.RuleCollectionGroupID(testSubscriptionID, testResourceGroup, testFwPolicy, testRuleCollGroup))
+	if !ok || rcg.RuleCollections == nil {
+		return nil
+	}
+	var names []string
+	for _, rc := range *rcg.RuleCollections {
+		names = append(names, *rc.(n.FirewallPolicyFilterRuleCollection).Name)
+	}
+	return names
+}
+
+var _ = Describe("AzureFirewallRules controller", func() {
+	It("programs the firewall from AzureFirewallRules and node events", func() {
+		ctx := context.Background()
+
+		node1 := createNode(ctx, "node-1", map[string]string{"pool": "egress"}, "10.240.0.4")
+		createNode(ctx, "node-2", map[string]string{"pool": "egress"}, "10.240.0.5")
+
+		rules := &egressv1.AzureFirewallRules{
+			ObjectMeta: metav1.ObjectMeta{Name: "egressrules-sample"},
+			Spec: egressv1.AzureFirewallRulesSpec{
+				EgressRules: []egressv1.AzureFirewallEgressRulesSpec{
+					{
+						Name:         "egress-pool",
+						NodeSelector: []map[string]string{{"pool": "egress"}},
+						Rules: []egressv1.AzureFirewallEgressrulesRulesSpec{
+							{
+								RuleCollectionName: "allow-github",
+								Priority:           200,
+								RuleName:           "github",
+								TargetFqdns:        []string{"github.com"},
+								Protocol:           []string{"HTTPS:443"},
+								Action:             "Allow",
+								RuleType:           "Application",
+							},
+						},
+					},
+				},
+			},
+		}
+		Expect(k8sClient.Create(ctx, rules)).To(Succeed())
+
+		By("creating the IP Group of the selected nodes and the rule collection group")
+		Eventually(ipGroupAddresses(azure.NodeIpGroupName("", labels.SelectorFromSet(labels.Set{"pool": "egress"}))), timeout, interval).Should(Equal([]string{"10.240.0.4", "10.240.0.5"}))
+		Eventually(ruleCollectionNames, timeout, interval).Should(Equal([]string{"allow-github"}))
+
+		By("removing a deleted node from the IP Group")
+		Expect(k8sClient.Delete(ctx, node1)).To(Succeed())
+		Eventually(ipGroupAddresses(azure.NodeIpGroupName("", labels.SelectorFromSet(labels.Set{"pool": "egress"}))), timeout, interval).Should(Equal([]string{"10.240.0.5"}))
+	})
+})
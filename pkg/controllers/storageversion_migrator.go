@@ -0,0 +1,105 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+
+	azurefirewallrulesv2 "github.com/Azure/azure-firewall-egress-controller/pkg/api/v2"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// AzureFirewallRulesCRDName is the name of the CustomResourceDefinition of AzureFirewallRules.
+const AzureFirewallRulesCRDName = "azurefirewallrules.egress.azure-firewall-egress-controller.io"
+
+//+kubebuilder:rbac:groups=apiextensions.k8s.io,resources=customresourcedefinitions,verbs=get
+//+kubebuilder:rbac:groups=apiextensions.k8s.io,resources=customresourcedefinitions/status,verbs=get;update;patch
+
+// StorageVersionMigrator rewrites the AzureFirewallRules objects stored in an older version in the storage version,
+// then removes the older versions from the stored versions of the CRD, so that they can be removed from the CRD.
+type StorageVersionMigrator struct {
+	// Client writes the objects and the CRD status.
+	Client client.Client
+	// Reader reads the objects and the CRD from the API server, bypassing the cache.
+	Reader client.Reader
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable, so that a single replica migrates the objects.
+func (m *StorageVersionMigrator) NeedLeaderElection() bool {
+	return true
+}
+
+// Start implements manager.Runnable. A failed migration is logged and retried on the next start, as the objects
+// stored in an older version keep working through the conversion webhook.
+func (m *StorageVersionMigrator) Start(ctx context.Context) error {
+	if err := m.migrate(ctx); err != nil {
+		klog.Error("Error migrating the AzureFirewallRules to the storage version ", azurefirewallrulesv2.GroupVersion.Version, ": ", err)
+	}
+	return nil
+}
+
+func (m *StorageVersionMigrator) migrate(ctx context.Context) error {
+	crd := &unstructured.Unstructured{}
+	crd.SetGroupVersionKind(schema.GroupVersionKind{Group: "apiextensions.k8s.io", Version: "v1", Kind: "CustomResourceDefinition"})
+	if err := m.Reader.Get(ctx, types.NamespacedName{Name: AzureFirewallRulesCRDName}, crd); err != nil {
+		return err
+	}
+	storedVersions, _, err := unstructured.NestedStringSlice(crd.Object, "status", "storedVersions")
+	if err != nil {
+		return err
+	}
+	storageVersions := []string{azurefirewallrulesv2.GroupVersion.Version}
+	if reflect.DeepEqual(storedVersions, storageVersions) {
+		return nil
+	}
+
+	klog.Infof("Migrating the AzureFirewallRules stored in versions %v to version %s", storedVersions, azurefirewallrulesv2.GroupVersion.Version)
+	rulesList := &azurefirewallrulesv2.AzureFirewallRulesList{}
+	if err := m.Reader.List(ctx, rulesList); err != nil {
+		return err
+	}
+	for i := range rulesList.Items {
+		name := types.NamespacedName{Name: rulesList.Items[i].Name}
+		// An update without changes makes the API server write the object in the storage version.
+		err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			rules := &azurefirewallrulesv2.AzureFirewallRules{}
+			if err := m.Reader.Get(ctx, name, rules); err != nil {
+				return err
+			}
+			return m.Client.Update(ctx, rules)
+		})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	if err := unstructured.SetNestedStringSlice(crd.Object, storageVersions, "status", "storedVersions"); err != nil {
+		return err
+	}
+	if err := m.Client.Status().Update(ctx, crd); err != nil {
+		return err
+	}
+	klog.Infof("Migrated %d AzureFirewallRules to version %s", len(rulesList.Items), azurefirewallrulesv2.GroupVersion.Version)
+	return nil
+}
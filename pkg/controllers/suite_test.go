@@ -17,6 +17,7 @@ limitations under the License.
 package controllers
 
 import (
+	"context"
 	"path/filepath"
 	"testing"
 
@@ -24,6 +25,7 @@ import (
 	. "github.com/onsi/gomega"
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
+	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/envtest"
 	"sigs.k8s.io/controller-runtime/pkg/envtest/printer"
@@ -33,6 +35,8 @@ import (
 	corev1 "k8s.io/api/core/v1"
 
 	egressv1 "github.com/Azure/azure-firewall-egress-controller/pkg/api/v1"
+	"github.com/Azure/azure-firewall-egress-controller/pkg/azure"
+	azfake "github.com/Azure/azure-firewall-egress-controller/pkg/azure/fake"
 	//+kubebuilder:scaffold:imports
 )
 
@@ -42,6 +46,15 @@ import (
 var cfg *rest.Config
 var k8sClient client.Client
 var testEnv *envtest.Environment
+var fakeARM *azfake.ARM
+var cancel context.CancelFunc
+
+const (
+	testSubscriptionID = "00000000-0000-0000-0000-000000000000"
+	testResourceGroup  = "rg"
+	testFwPolicy       = "fw-policy"
+	testRuleCollGroup  = "aks-egress"
+)
 
 func TestAPIs(t *testing.T) {
 	RegisterFailHandler(Fail)
@@ -56,7 +69,7 @@ var _ = BeforeSuite(func() {
 
 	By("bootstrapping test environment")
 	testEnv = &envtest.Environment{
-		CRDDirectoryPaths:     []string{filepath.Join("..", "config", "crd", "bases")},
+		CRDDirectoryPaths:     []string{filepath.Join("..", "..", "config", "crd", "bases")},
 		ErrorIfCRDPathMissing: true,
 	}
 
@@ -78,10 +91,39 @@ var _ = BeforeSuite(func() {
 	Expect(err).NotTo(HaveOccurred())
 	Expect(k8sClient).NotTo(BeNil())
 
+	By("starting the controller against the in-memory Azure backend")
+	fakeARM = azfake.NewARM()
+	fakeARM.AddFirewallPolicy(testSubscriptionID, testResourceGroup, testFwPolicy, "westeurope")
+
+	mgr, err := ctrl.NewManager(cfg, ctrl.Options{
+		Scheme:             scheme.Scheme,
+		MetricsBindAddress: "0",
+	})
+	Expect(err).NotTo(HaveOccurred())
+
+	azClient := azure.NewAzClientSetWithTransport(testSubscriptionID, testResourceGroup, testFwPolicy, testRuleCollGroup, 400, mgr.GetClient(), fakeARM, fakeARM.Credential())
+	Expect(azClient.FetchFirewallPolicyLocation()).To(Equal("westeurope"))
+	Expect(mgr.Add(azClient)).To(Succeed())
+
+	err = (&AzureFirewallRulesReconciler{
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		AzClient: azClient,
+	}).SetupWithManager(mgr)
+	Expect(err).NotTo(HaveOccurred())
+
+	var ctx context.Context
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		defer GinkgoRecover()
+		Expect(mgr.Start(ctx)).To(Succeed())
+	}()
+
 }, 60)
 
 var _ = AfterSuite(func() {
 	By("tearing down the test environment")
+	cancel()
 	err := testEnv.Stop()
 	Expect(err).NotTo(HaveOccurred())
 })
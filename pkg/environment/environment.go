@@ -33,6 +33,12 @@ const (
 
 	// fwPolicyResourceID is the name of the FW_POLICY_RESOURCE_ID
 	fwPolicyResourceID = "FW_POLICY_RESOURCE_ID"
+
+	// clusterNameVarName is the name of the cluster the controller runs in, used to tag the Azure resources
+	clusterNameVarName = "CLUSTER_NAME"
+
+	// perClusterRuleCollectionGroupVarName suffixes the rule collection group with the cluster name when "true"
+	perClusterRuleCollectionGroupVarName = "PER_CLUSTER_RULE_COLLECTION_GROUP"
 )
 
 // EnvVariables is a struct storing values for environment variables.
@@ -44,6 +50,7 @@ type EnvVariables struct {
 	FwPolicyRuleCollectionGroupName     string
 	FwPolicyRuleCollectionGroupPriority int32
 	FwPolicyResourceID                  string
+	ClusterName                         string
 }
 
 // GetEnv returns values for defined environment variables for Egress Controller.
@@ -58,6 +65,7 @@ func GetEnv() EnvVariables {
 		FwPolicyRuleCollectionGroupName:     os.Getenv(fwPolicyRuleCollectionGroupvarName),
 		FwPolicyRuleCollectionGroupPriority: int32(rcgPriority),
 		FwPolicyResourceID:                  os.Getenv(fwPolicyResourceID),
+		ClusterName:                         os.Getenv(clusterNameVarName),
 	}
 
 	if env.FwPolicyResourceID != "" {
@@ -67,5 +75,9 @@ func GetEnv() EnvVariables {
 		env.FwPolicyName = string(firewallPolicyName)
 	}
 
+	if perCluster, _ := strconv.ParseBool(os.Getenv(perClusterRuleCollectionGroupVarName)); perCluster && env.ClusterName != "" {
+		env.FwPolicyRuleCollectionGroupName = env.FwPolicyRuleCollectionGroupName + "-" + env.ClusterName
+	}
+
 	return env
 }
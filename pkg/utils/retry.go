@@ -17,6 +17,12 @@ type RetriableFunction func() (Retriable, error)
 // if retriableFunction returns boolean as true, then Retry will retry if fn returned an error
 // if totalRetryCount is -1, then retry happen forever until one of the two above conditions are satisfied.
 func Retry(totalRetryCount int, retryPause time.Duration, retriableFunction RetriableFunction) (err error) {
+	return RetryWithBackoff(totalRetryCount, retryPause, retryPause, retriableFunction)
+}
+
+// RetryWithBackoff retries retriableFunction like Retry, but doubles the gap after every retry, starting with
+// retryPause and capped at maxRetryPause.
+func RetryWithBackoff(totalRetryCount int, retryPause time.Duration, maxRetryPause time.Duration, retriableFunction RetriableFunction) (err error) {
 	retryCounter := 0
 	retry := Retriable(true)
 	for {
@@ -32,6 +38,9 @@ func Retry(totalRetryCount int, retryPause time.Duration, retriableFunction Retr
 
 		klog.Infof("Retrying in %s", retryPause)
 		time.Sleep(retryPause)
+		if retryPause = 2 * retryPause; retryPause > maxRetryPause {
+			retryPause = maxRetryPause
+		}
 	}
 	return
 }
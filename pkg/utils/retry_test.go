@@ -104,5 +104,25 @@ var _ = Describe("Retry", func() {
 				Expect(retryError).To(BeNil())
 			})
 		})
+
+		Context("Test retry backoff", func() {
+			It("should double the pause between every retry up to the max pause.", func() {
+				retry := 4
+				err := errors.New("fake")
+				pause := 100 * time.Millisecond
+				execTimeList := make([]time.Time, 0)
+				retryError := RetryWithBackoff(retry, pause, 2*pause,
+					func() (Retriable, error) {
+						execTimeList = append(execTimeList, time.Now())
+						return Retriable(true), err
+					})
+				Expect(execTimeList).To(HaveLen(retry))
+				Expect(retryError).To(Equal(err))
+				Expect(execTimeList[1].Sub(execTimeList[0])).To(BeNumerically(">=", pause))
+				Expect(execTimeList[2].Sub(execTimeList[1])).To(BeNumerically(">=", 2*pause))
+				Expect(execTimeList[3].Sub(execTimeList[2])).To(BeNumerically(">=", 2*pause))
+				Expect(execTimeList[3].Sub(execTimeList[2])).To(BeNumerically("<", 4*pause))
+			})
+		})
 	})
 })
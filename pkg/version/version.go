@@ -0,0 +1,10 @@
+// -------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See License.txt in the project root for license information.
+// --------------------------------------------------------------------------------------------
+
+package version
+
+// Version is the version of the controller, set at build time with
+// -ldflags "-X github.com/Azure/azure-firewall-egress-controller/pkg/version.Version=<version>".
+var Version = "dev"
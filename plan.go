@@ -0,0 +1,73 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+
+	"github.com/Azure/go-autorest/autorest/azure/auth"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	azure "github.com/Azure/azure-firewall-egress-controller/pkg/azure"
+	environment "github.com/Azure/azure-firewall-egress-controller/pkg/environment"
+)
+
+// runPlan implements the "plan" subcommand. It prints the rule collection group the controller would apply
+// for the current cluster state together with a diff against the live rule collection group.
+func runPlan(args []string) int {
+	opts := zap.Options{
+		Development: true,
+	}
+	opts.BindFlags(flag.CommandLine)
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return 1
+	}
+
+	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
+
+	k8sClient, err := client.New(ctrl.GetConfigOrDie(), client.Options{Scheme: scheme})
+	if err != nil {
+		setupLog.Error(err, "unable to create client")
+		return 1
+	}
+
+	env := environment.GetEnv()
+
+	azClient := azure.NewAzClientSet(env.SubscriptionID, env.ResourceGroupName, env.FwPolicyName, env.FwPolicyRuleCollectionGroupName, env.FwPolicyRuleCollectionGroupPriority, env.ClientID, k8sClient)
+	if azClient == nil {
+		setupLog.Info("unable to create Azure client")
+		return 1
+	}
+
+	authorizer, err := auth.NewAuthorizerFromEnvironment()
+	if err != nil {
+		setupLog.Error(err, "unable to create authorizer")
+		return 1
+	}
+	azClient.SetAuthorizer(authorizer)
+	azClient.SetClusterName(env.ClusterName)
+	azClient.FetchFirewallPolicyLocation()
+
+	if err := azClient.Plan(context.Background()); err != nil {
+		setupLog.Error(err, "unable to plan the firewall policy")
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/azure/auth"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	azure "github.com/Azure/azure-firewall-egress-controller/pkg/azure"
+	environment "github.com/Azure/azure-firewall-egress-controller/pkg/environment"
+)
+
+// runUninstall implements the "uninstall" subcommand, run by the pre-delete hook of the chart. It deletes the
+// AzureFirewallRules and EgressPolicy objects, then the rule collection groups and the IP Groups managed by the
+// controller.
+func runUninstall(args []string) int {
+	var timeout time.Duration
+	flag.DurationVar(&timeout, "timeout", 2*time.Minute,
+		"How long to wait for the running controller to remove the rules of the deleted objects before removing their finalizers.")
+	opts := zap.Options{
+		Development: true,
+	}
+	opts.BindFlags(flag.CommandLine)
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return 1
+	}
+
+	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
+
+	k8sClient, err := client.New(ctrl.GetConfigOrDie(), client.Options{Scheme: scheme})
+	if err != nil {
+		setupLog.Error(err, "unable to create client")
+		return 1
+	}
+
+	env := environment.GetEnv()
+
+	azClient := azure.NewAzClientSet(env.SubscriptionID, env.ResourceGroupName, env.FwPolicyName, env.FwPolicyRuleCollectionGroupName, env.FwPolicyRuleCollectionGroupPriority, env.ClientID, k8sClient)
+	if azClient == nil {
+		setupLog.Info("unable to create Azure client")
+		return 1
+	}
+
+	authorizer, err := auth.NewAuthorizerFromEnvironment()
+	if err != nil {
+		setupLog.Error(err, "unable to create authorizer")
+		return 1
+	}
+	azClient.SetAuthorizer(authorizer)
+	azClient.SetClusterName(env.ClusterName)
+	azClient.FetchFirewallPolicyLocation()
+
+	if err := azClient.Uninstall(context.Background(), timeout); err != nil {
+		setupLog.Error(err, "unable to uninstall the controller")
+		return 1
+	}
+	setupLog.Info("removed the rule collection groups and the IP Groups managed by the controller")
+	return 0
+}